@@ -17,11 +17,11 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/api"
@@ -37,17 +37,49 @@ const (
 	tmpBucketEnvVar            = "TMP_EXPORT_BUCKET"
 	maxRecordsEnvVar           = "EXPORT_FILE_MAX_RECORDS"
 	defaultMaxRecords          = 30000
+	filenameTemplateEnvVar     = "EXPORT_FILENAME_TEMPLATE"
+	formatVersionEnvVar        = "EXPORT_FORMAT_VERSION"
+	reportTypeMappingEnvVar    = "EXPORT_REPORT_TYPE_MAPPING"
+	maxAttemptsEnvVar          = "EXPORT_BATCH_MAX_ATTEMPTS"
+	defaultMaxAttempts         = 5
+	batchAlignmentEnvVar       = "EXPORT_BATCH_ALIGNMENT"
+	zipExportsEnvVar           = "EXPORT_ZIP"
+	signingKeyEnvVar           = "EXPORT_SIGNING_KEY"
+	signingKeyIDEnvVar         = "EXPORT_SIGNING_KEY_ID"
+	signingKeyVersionEnvVar    = "EXPORT_SIGNING_KEY_VERSION"
+	signingKeyNotBeforeEnvVar  = "EXPORT_SIGNING_KEY_NOT_BEFORE"
+	signingKeyNotAfterEnvVar   = "EXPORT_SIGNING_KEY_NOT_AFTER"
+	splitRegionsEnvVar         = "EXPORT_SPLIT_REGIONS"
+	partialRegionsEnvVar       = "EXPORT_PARTIAL_REGIONS"
+	splitReportTypesEnvVar     = "EXPORT_SPLIT_REPORT_TYPES"
+	lookbackWindowEnvVar       = "EXPORT_LOOKBACK_WINDOW"
+	verifyExportsEnvVar        = "EXPORT_VERIFY"
+	debugNDJSONEnvVar          = "EXPORT_DEBUG_NDJSON"
+	debugBucketEnvVar          = "EXPORT_DEBUG_BUCKET"
+	checkDeterminismEnvVar     = "EXPORT_CHECK_DETERMINISM"
+	formatVersionPolicyEnvVar  = "EXPORT_UNKNOWN_FORMAT_VERSION_POLICY"
+	latestPointerEnvVar        = "EXPORT_LATEST_POINTER"
+	revocationsEnvVar          = "EXPORT_REVOCATIONS"
+	minKeysEnvVar              = "EXPORT_MIN_KEYS"
+	storageRetriesEnvVar       = "EXPORT_STORAGE_RETRIES"
+	defaultStorageRetries      = 3
+	quotaRetryDelayEnvVar      = "EXPORT_QUOTA_RETRY_DELAY"
 )
 
 func main() {
 	ctx := context.Background()
 	logger := logging.FromContext(ctx)
 
+	env := serverenv.New(ctx)
+
 	db, err := database.NewFromEnv(ctx)
 	if err != nil {
 		logger.Fatalf("unable to connect to database: %v", err)
 	}
-	defer db.Close(ctx)
+	env.RegisterCloser("database", func(ctx context.Context) error {
+		db.Close(ctx)
+		return nil
+	})
 
 	bsc := api.BatchServerConfig{}
 	createBatchesTimeout := defaultTimeout
@@ -70,14 +102,242 @@ func main() {
 	bsc.TmpBucket = os.Getenv(tmpBucketEnvVar)
 	bsc.Bucket = os.Getenv(bucketEnvVar)
 
+	bsc.FilenameTemplate = api.DefaultFilenameTemplate
+	if tmpl := os.Getenv(filenameTemplateEnvVar); tmpl != "" {
+		bsc.FilenameTemplate = tmpl
+	}
+	if err := api.ValidateFilenameTemplate(bsc.FilenameTemplate); err != nil {
+		logger.Fatalf("invalid $%s: %v", filenameTemplateEnvVar, err)
+	}
+	logger.Infof("Using export filename template %q (override with $%s)", bsc.FilenameTemplate, filenameTemplateEnvVar)
+
+	bsc.FormatVersion = api.DefaultExportFormatVersion
+	if versionStr := os.Getenv(formatVersionEnvVar); versionStr != "" {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", formatVersionEnvVar, versionStr, err)
+		}
+		bsc.FormatVersion = version
+	}
+	if err := api.ValidateExportFormatVersion(bsc.FormatVersion); err != nil {
+		logger.Fatalf("invalid $%s: %v", formatVersionEnvVar, err)
+	}
+	logger.Infof("Using export format version %d (override with $%s)", bsc.FormatVersion, formatVersionEnvVar)
+
+	bsc.ReportTypeMapping, err = api.ParseReportTypeMapping(os.Getenv(reportTypeMappingEnvVar))
+	if err != nil {
+		logger.Fatalf("invalid $%s: %v", reportTypeMappingEnvVar, err)
+	}
+	logger.Infof("Using report type mapping %v (override with $%s)", bsc.ReportTypeMapping, reportTypeMappingEnvVar)
+
+	bsc.MaxAttempts = defaultMaxAttempts
+	if attemptsStr := os.Getenv(maxAttemptsEnvVar); attemptsStr != "" {
+		attempts, err := strconv.Atoi(attemptsStr)
+		if err != nil {
+			logger.Warnf("Failed to parse $%s value %q, using default.", maxAttemptsEnvVar, attemptsStr)
+		} else {
+			bsc.MaxAttempts = attempts
+		}
+	}
+	logger.Infof("Using export batch max attempts %d (override with $%s)", bsc.MaxAttempts, maxAttemptsEnvVar)
+
+	bsc.StorageRetries = defaultStorageRetries
+	if retriesStr := os.Getenv(storageRetriesEnvVar); retriesStr != "" {
+		bsc.StorageRetries, err = strconv.Atoi(retriesStr)
+		if err != nil || bsc.StorageRetries < 0 {
+			logger.Fatalf("invalid $%s value %q: must be a non-negative integer", storageRetriesEnvVar, retriesStr)
+		}
+	}
+	logger.Infof("Using export storage retries %d (override with $%s)", bsc.StorageRetries, storageRetriesEnvVar)
+
+	bsc.QuotaRetryDelay = api.DefaultQuotaRetryDelay
+	if delayStr := os.Getenv(quotaRetryDelayEnvVar); delayStr != "" {
+		bsc.QuotaRetryDelay, err = time.ParseDuration(delayStr)
+		if err != nil || bsc.QuotaRetryDelay <= 0 {
+			logger.Fatalf("invalid $%s value %q: must be a positive duration", quotaRetryDelayEnvVar, delayStr)
+		}
+	}
+	logger.Infof("Using export storage quota retry delay %v (override with $%s)", bsc.QuotaRetryDelay, quotaRetryDelayEnvVar)
+
+	if alignmentStr := os.Getenv(batchAlignmentEnvVar); alignmentStr != "" {
+		bsc.BatchAlignment, err = time.ParseDuration(alignmentStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", batchAlignmentEnvVar, alignmentStr, err)
+		}
+	}
+	if err := api.ValidateBatchAlignment(bsc.BatchAlignment); err != nil {
+		logger.Fatalf("invalid $%s: %v", batchAlignmentEnvVar, err)
+	}
+	logger.Infof("Using export batch alignment %v (override with $%s)", bsc.BatchAlignment, batchAlignmentEnvVar)
+
+	if lookbackStr := os.Getenv(lookbackWindowEnvVar); lookbackStr != "" {
+		bsc.LookbackWindow, err = time.ParseDuration(lookbackStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", lookbackWindowEnvVar, lookbackStr, err)
+		}
+	}
+	if err := api.ValidateLookbackWindow(bsc.LookbackWindow); err != nil {
+		logger.Fatalf("invalid $%s: %v", lookbackWindowEnvVar, err)
+	}
+	logger.Infof("Using export lookback window %v (override with $%s)", bsc.LookbackWindow, lookbackWindowEnvVar)
+
+	if zipStr := os.Getenv(zipExportsEnvVar); zipStr != "" {
+		bsc.ZipExports, err = strconv.ParseBool(zipStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", zipExportsEnvVar, zipStr, err)
+		}
+	}
+	if bsc.ZipExports {
+		keyPath := os.Getenv(signingKeyEnvVar)
+		if keyPath == "" {
+			logger.Fatalf("$%s is required when $%s is set", signingKeyEnvVar, zipExportsEnvVar)
+		}
+		// Each variable holds a comma-separated list, to sign with several keys while rotating.
+		bsc.Signers, err = api.LoadExportSigners(keyPath, os.Getenv(signingKeyIDEnvVar), os.Getenv(signingKeyVersionEnvVar),
+			os.Getenv(signingKeyNotBeforeEnvVar), os.Getenv(signingKeyNotAfterEnvVar))
+		if err != nil {
+			logger.Fatalf("invalid $%s: %v", signingKeyEnvVar, err)
+		}
+		for _, s := range bsc.Signers {
+			logger.Infof("Using signing key %s version %s, valid from %v to %v", s.KeyID, s.KeyVersion, s.NotBefore, s.NotAfter)
+		}
+	}
+	logger.Infof("Using zipped exports %v (override with $%s)", bsc.ZipExports, zipExportsEnvVar)
+
+	if splitStr := os.Getenv(splitRegionsEnvVar); splitStr != "" {
+		bsc.SplitRegions, err = strconv.ParseBool(splitStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", splitRegionsEnvVar, splitStr, err)
+		}
+	}
+	logger.Infof("Using per-region exports %v (override with $%s)", bsc.SplitRegions, splitRegionsEnvVar)
+
+	if partialStr := os.Getenv(partialRegionsEnvVar); partialStr != "" {
+		bsc.PartialRegionExports, err = strconv.ParseBool(partialStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", partialRegionsEnvVar, partialStr, err)
+		}
+		if bsc.PartialRegionExports && !bsc.SplitRegions {
+			logger.Fatalf("$%s requires $%s", partialRegionsEnvVar, splitRegionsEnvVar)
+		}
+	}
+	logger.Infof("Using partial region exports %v (override with $%s)", bsc.PartialRegionExports, partialRegionsEnvVar)
+
+	if splitStr := os.Getenv(splitReportTypesEnvVar); splitStr != "" {
+		bsc.SplitReportTypes, err = strconv.ParseBool(splitStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", splitReportTypesEnvVar, splitStr, err)
+		}
+		if bsc.SplitReportTypes {
+			if err := api.ValidateSplitReportTypes(bsc.FormatVersion); err != nil {
+				logger.Fatalf("invalid $%s: %v", splitReportTypesEnvVar, err)
+			}
+		}
+	}
+	logger.Infof("Using per-report type exports %v (override with $%s)", bsc.SplitReportTypes, splitReportTypesEnvVar)
+
+	if revocationsStr := os.Getenv(revocationsEnvVar); revocationsStr != "" {
+		bsc.ExportRevocations, err = strconv.ParseBool(revocationsStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", revocationsEnvVar, revocationsStr, err)
+		}
+		if bsc.ExportRevocations {
+			if err := api.ValidateExportRevocations(bsc.FormatVersion); err != nil {
+				logger.Fatalf("invalid $%s: %v", revocationsEnvVar, err)
+			}
+		}
+	}
+	logger.Infof("Using revocation list exports %v (override with $%s)", bsc.ExportRevocations, revocationsEnvVar)
+
+	if minKeysStr := os.Getenv(minKeysEnvVar); minKeysStr != "" {
+		bsc.MinExportKeys, err = strconv.Atoi(minKeysStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", minKeysEnvVar, minKeysStr, err)
+		}
+		if bsc.MinExportKeys < 0 {
+			logger.Fatalf("invalid $%s value %q: must not be negative", minKeysEnvVar, minKeysStr)
+		}
+	}
+	logger.Infof("Using minimum export keys %d (override with $%s)", bsc.MinExportKeys, minKeysEnvVar)
+
+	if verifyStr := os.Getenv(verifyExportsEnvVar); verifyStr != "" {
+		bsc.VerifyExports, err = strconv.ParseBool(verifyStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", verifyExportsEnvVar, verifyStr, err)
+		}
+	}
+	logger.Infof("Using export read-back verification %v (override with $%s)", bsc.VerifyExports, verifyExportsEnvVar)
+
+	if latestStr := os.Getenv(latestPointerEnvVar); latestStr != "" {
+		bsc.LatestPointer, err = strconv.ParseBool(latestStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", latestPointerEnvVar, latestStr, err)
+		}
+	}
+	logger.Infof("Using latest batch pointer %v (override with $%s)", bsc.LatestPointer, latestPointerEnvVar)
+
+	if ndjsonStr := os.Getenv(debugNDJSONEnvVar); ndjsonStr != "" {
+		bsc.DebugNDJSON, err = strconv.ParseBool(ndjsonStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", debugNDJSONEnvVar, ndjsonStr, err)
+		}
+	}
+
+	bsc.DebugBucket = os.Getenv(debugBucketEnvVar)
+	if bsc.DebugBucket != "" {
+		if bsc.DebugBucket == bsc.Bucket {
+			logger.Fatalf("$%s must not be the production bucket %s", debugBucketEnvVar, bsc.Bucket)
+		}
+		logger.Warnf("Copying export files to debug bucket %s. To disable unset $%s", bsc.DebugBucket, debugBucketEnvVar)
+	}
+	if bsc.DebugNDJSON {
+		if bsc.DebugBucket == "" {
+			logger.Fatalf("$%s requires $%s to be set", debugNDJSONEnvVar, debugBucketEnvVar)
+		}
+		logger.Warnf("Writing NDJSON copies of export files to debug bucket %s. To disable unset $%s", bsc.DebugBucket, debugNDJSONEnvVar)
+	}
+
+	if determinismStr := os.Getenv(checkDeterminismEnvVar); determinismStr != "" {
+		bsc.CheckDeterminism, err = strconv.ParseBool(determinismStr)
+		if err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", checkDeterminismEnvVar, determinismStr, err)
+		}
+	}
+	logger.Infof("Using export determinism check %v (override with $%s)", bsc.CheckDeterminism, checkDeterminismEnvVar)
+
+	formatPolicy, err := api.ParseFormatVersionPolicy(os.Getenv(formatVersionPolicyEnvVar))
+	if err != nil {
+		logger.Fatalf("invalid $%s: %v", formatVersionPolicyEnvVar, err)
+	}
+	logger.Infof("Using unknown format version policy %q (override with $%s)", formatPolicy, formatVersionPolicyEnvVar)
+
 	// TODO(guray): remove or gate the /test handler
-	http.Handle("/test", api.NewTestExportHandler(db))
+	http.Handle("/test", api.NewTestExportHandler(db, formatPolicy))
 
 	batchServer := api.NewBatchServer(db, bsc)
 	http.HandleFunc("/create-batches", batchServer.CreateBatchesHandler) // controller that creates work items
 	http.HandleFunc("/create-files", batchServer.CreateFilesHandler)     // worker that executes work
+	http.HandleFunc("/compact-batches", batchServer.CompactBatchesHandler)
+
+	srv := env.HTTPServer(nil)
+	env.RegisterCloser("http server", srv.Shutdown)
+
+	// On SIGTERM (sent by Cloud Run before stopping an instance), stop accepting requests, let
+	// in-flight requests finish, and then release the database.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		logger.Infof("Received %v, shutting down.", <-sig)
+		if err := env.Shutdown(ctx); err != nil {
+			logger.Errorf("Shutdown: %v", err)
+		}
+	}()
 
-	env := serverenv.New(ctx)
 	logger.Info("starting infection export server")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", env.Port()), nil))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+	<-shutdownDone
 }
@@ -21,6 +21,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/api"
@@ -32,6 +33,16 @@ import (
 var (
 	timeoutEnvVar  = "PULL_TIMEOUT"
 	defaultTimeout = 5 * time.Minute
+
+	// insertRateEnvVar limits the keys per second a sync inserts. Unset or 0 is unlimited.
+	insertRateEnvVar = "PULL_INSERT_RATE"
+
+	// maxConcurrentSyncsEnvVar limits the syncs running at once. Unset or 0 is unlimited.
+	maxConcurrentSyncsEnvVar = "PULL_MAX_CONCURRENT_SYNCS"
+
+	// retryTokenEnvVar is the bearer token operators retry syncs at /retry-sync with. Unset
+	// disables /retry-sync.
+	retryTokenEnvVar = "PULL_RETRY_TOKEN"
 )
 
 func main() {
@@ -49,13 +60,42 @@ func main() {
 	}
 	logger.Infof("Using fetch timeout %v (override with $%s)", timeout, timeoutEnvVar)
 
+	insertRate := 0
+	if rateStr := os.Getenv(insertRateEnvVar); rateStr != "" {
+		var err error
+		insertRate, err = strconv.Atoi(rateStr)
+		if err != nil || insertRate < 0 {
+			logger.Fatalf("invalid $%s value %q, must be a non-negative number of keys per second", insertRateEnvVar, rateStr)
+		}
+	}
+	if insertRate > 0 {
+		logger.Infof("Limiting federation inserts to %d keys per second (override with $%s)", insertRate, insertRateEnvVar)
+	}
+
+	maxConcurrentSyncs := 0
+	if maxStr := os.Getenv(maxConcurrentSyncsEnvVar); maxStr != "" {
+		var err error
+		maxConcurrentSyncs, err = strconv.Atoi(maxStr)
+		if err != nil || maxConcurrentSyncs < 0 {
+			logger.Fatalf("invalid $%s value %q, must be a non-negative number of syncs", maxConcurrentSyncsEnvVar, maxStr)
+		}
+	}
+	if maxConcurrentSyncs > 0 {
+		logger.Infof("Limiting federation to %d concurrent syncs (override with $%s)", maxConcurrentSyncs, maxConcurrentSyncsEnvVar)
+	}
+
 	db, err := database.NewFromEnv(ctx)
 	if err != nil {
 		logger.Fatalf("unable to connect to database: %v", err)
 	}
 	defer db.Close(ctx)
 
-	http.Handle("/", api.NewFederationPullHandler(db, timeout))
+	pull := api.NewFederationPullHandler(db, timeout, insertRate, maxConcurrentSyncs)
+	http.Handle("/", pull)
+	if token := os.Getenv(retryTokenEnvVar); token != "" {
+		http.Handle("/retry-sync", pull.RetryHandler(token))
+		logger.Infof("Serving /retry-sync (disable by unsetting $%s)", retryTokenEnvVar)
+	}
 	logger.Info("starting federation puller")
 	env := serverenv.New(ctx)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", env.Port()), nil))
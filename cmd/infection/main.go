@@ -20,12 +20,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/api"
 	"github.com/googlepartners/exposure-notifications/internal/api/config"
 	"github.com/googlepartners/exposure-notifications/internal/database"
 	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
 	"github.com/googlepartners/exposure-notifications/internal/serverenv"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
@@ -34,6 +37,24 @@ import (
 	"go.opencensus.io/stats/view"
 )
 
+// regionPolicyEnvVar selects how keys published for several regions are stored, "global"
+// (the default) or "per-region".
+const regionPolicyEnvVar = "PUBLISH_REGION_POLICY"
+
+const (
+	// publishBatchDelayEnvVar enables buffering the keys of concurrent publishes for up to this
+	// duration to store them together. Unset or 0 stores each publish on its own.
+	publishBatchDelayEnvVar = "PUBLISH_BATCH_MAX_DELAY"
+	// publishBatchKeysEnvVar stores the buffered keys as soon as this many are buffered.
+	publishBatchKeysEnvVar = "PUBLISH_BATCH_MAX_KEYS"
+)
+
+// defaultRiskEnvVar is the transmission risk stored for keys published without one, 0 by default.
+const defaultRiskEnvVar = "PUBLISH_DEFAULT_TRANSMISSION_RISK"
+
+// configRetryPeriod is how often loading the APIConfigs is retried if it fails at startup.
+const configRetryPeriod = 5 * time.Second
+
 var (
 	// TODO(beggers) delete this example metric once we have useful ones.
 	dbOpenTimeMs      = stats.Int64("db/open", "Latency in ms to open a db connection", "ms")
@@ -55,6 +76,9 @@ func main() {
 	if err := view.Register(dbOpenLatencyView); err != nil {
 		log.Fatalf("Failed to register db open latency ms view: %v", err)
 	}
+	if err := view.Register(api.PublishRejectionsView); err != nil {
+		log.Fatalf("Failed to register publish rejections view: %v", err)
+	}
 	//TODO(beggers): We need to export to Stackdriver too. And have a flag
 	// to choose which one to export to.
 	pe, err := prometheus.NewExporter(prometheus.Options{
@@ -72,11 +96,47 @@ func main() {
 	stats.Record(ctx, dbOpenTimeMs.M(time.Now().Sub(dbOpenStart).Milliseconds()))
 	defer db.Close(ctx)
 
+	regionPolicy, err := model.ParseRegionPolicy(os.Getenv(regionPolicyEnvVar))
+	if err != nil {
+		logger.Fatalf("invalid $%s: %v", regionPolicyEnvVar, err)
+	}
+	logger.Infof("Storing multi-region keys with the %q region policy", regionPolicy)
+
+	var batching api.PublishBatching
+	if v := os.Getenv(publishBatchDelayEnvVar); v != "" {
+		if batching.MaxDelay, err = time.ParseDuration(v); err != nil || batching.MaxDelay < 0 {
+			logger.Fatalf("invalid $%s value %q, must be a non-negative duration", publishBatchDelayEnvVar, v)
+		}
+	}
+	if v := os.Getenv(publishBatchKeysEnvVar); v != "" {
+		if batching.MaxKeys, err = strconv.Atoi(v); err != nil || batching.MaxKeys < 0 {
+			logger.Fatalf("invalid $%s value %q, must be a non-negative number of keys", publishBatchKeysEnvVar, v)
+		}
+	}
+	if batching.MaxDelay > 0 {
+		logger.Infof("Buffering published keys for up to %v (override with $%s and $%s)", batching.MaxDelay, publishBatchDelayEnvVar, publishBatchKeysEnvVar)
+	}
+
+	var defaultRisk int
+	if v := os.Getenv(defaultRiskEnvVar); v != "" {
+		if defaultRisk, err = strconv.Atoi(v); err != nil {
+			logger.Fatalf("invalid $%s value %q: %v", defaultRiskEnvVar, v, err)
+		}
+		if err := model.ValidateTransmissionRisk(defaultRisk); err != nil {
+			logger.Fatalf("invalid $%s: %v", defaultRiskEnvVar, err)
+		}
+	}
+	logger.Infof("Using default transmission risk %d (override with $%s)", defaultRisk, defaultRiskEnvVar)
+
 	cfg := config.New(db)
+	// Load the configs before accepting requests. If they can't be loaded, the server starts but
+	// reports it isn't ready until a retry succeeds.
+	cfg.Prewarm(ctx, configRetryPeriod)
 	env := serverenv.New(ctx)
 
 	http.Handle("/metrics", pe)
-	http.Handle("/v1", &ochttp.Handler{Handler: api.NewPublishHandler(db, cfg)})
+	http.Handle("/ready", cfg.ReadyHandler())
+	http.Handle("/v1", &ochttp.Handler{Handler: api.NewPublishHandler(db, cfg, regionPolicy, batching, defaultRisk)})
 	logger.Info("starting infection server")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", env.Port()), nil))
 }
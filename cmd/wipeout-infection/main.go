@@ -56,6 +56,7 @@ func main() {
 	defer db.Close(ctx)
 
 	http.Handle("/", api.NewInfectionWipeoutHandler(db, timeout))
+	http.Handle("/purge", api.NewExposurePurgeHandler(db, timeout))
 	logger.Info("starting wipeout server")
 	env := serverenv.New(ctx)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", env.Port()), nil))
@@ -20,6 +20,7 @@ require (
 	go.uber.org/zap v1.14.1
 	golang.org/x/sys v0.0.0-20200413165638-669c56c373c4 // indirect
 	golang.org/x/tools v0.0.0-20200331202046-9d5940d49312 // indirect
+	google.golang.org/api v0.20.0
 	google.golang.org/genproto v0.0.0-20200413115906-b5235f65be36 // indirect
 	google.golang.org/grpc v1.28.1
 	google.golang.org/protobuf v1.21.0
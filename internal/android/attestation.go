@@ -0,0 +1,211 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package android
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// attestationHostname is the hostname the leaf certificate of a valid attestation is issued to.
+	attestationHostname = "attest.android.com"
+	attestationAlg      = "RS256"
+
+	// DefaultMaxAttestationSize is the longest attestation, in bytes, accepted when
+	// ParseOpts.MaxSize is zero. Real attestations are a few kilobytes; this leaves half of the
+	// 64000 byte publish request body for the rest of the request.
+	DefaultMaxAttestationSize = 32000
+)
+
+var (
+	// ErrMalformedAttestation is returned when the attestation is not a well formed JWS.
+	ErrMalformedAttestation = errors.New("malformed attestation")
+	// ErrInvalidCertificateChain is returned when the attestation certificates do not chain to a trusted root.
+	ErrInvalidCertificateChain = errors.New("invalid attestation certificate chain")
+	// ErrCertificateExpired is returned when an attestation certificate is not valid at the verification time.
+	ErrCertificateExpired = errors.New("attestation certificate expired or not yet valid")
+	// ErrInvalidSignature is returned when the JWS signature does not match the leaf certificate.
+	ErrInvalidSignature = errors.New("invalid attestation signature")
+	// ErrAttestationTooLarge is returned, before any parsing, when the attestation is longer than
+	// ParseOpts.MaxSize.
+	ErrAttestationTooLarge = errors.New("attestation too large")
+)
+
+// Attestation holds the claims of a verified SafetyNet attestation.
+// https://developer.android.com/training/safetynet/attestation#use-response-server
+type Attestation struct {
+	Nonce                      string   `json:"nonce"`
+	TimestampMs                int64    `json:"timestampMs"`
+	APKPackageName             string   `json:"apkPackageName"`
+	APKDigestSha256            string   `json:"apkDigestSha256"`
+	APKCertificateDigestSha256 []string `json:"apkCertificateDigestSha256"`
+	CTSProfileMatch            bool     `json:"ctsProfileMatch"`
+	BasicIntegrity             bool     `json:"basicIntegrity"`
+	Advice                     string   `json:"advice"`
+	EvaluationType             string   `json:"evaluationType"`
+	// Region is the region the device declares it operates in. It is not part of SafetyNet, and
+	// present only in deployments whose attestations carry it.
+	Region string `json:"region,omitempty"`
+}
+
+// IssueTime returns the time at which the attestation was generated.
+func (a *Attestation) IssueTime() time.Time {
+	return time.Unix(a.TimestampMs/1000, 0)
+}
+
+// ParseOpts control how the attestation certificates are verified.
+type ParseOpts struct {
+	// Roots are the trusted root certificates. The system roots are used if nil.
+	Roots *x509.CertPool
+	// CurrentTime is the time at which the certificates must be valid. The current time is used if zero.
+	CurrentTime time.Time
+	// MaxSize is the longest attestation accepted, in bytes. DefaultMaxAttestationSize is used if zero.
+	MaxSize int
+}
+
+func (o ParseOpts) maxSize() int {
+	if o.MaxSize == 0 {
+		return DefaultMaxAttestationSize
+	}
+	return o.MaxSize
+}
+
+type attestationHeader struct {
+	Alg string   `json:"alg"`
+	X5c []string `json:"x5c"`
+}
+
+// ParseAndVerifyAttestation parses a SafetyNet JWS attestation, verifies its certificate chain
+// and signature, and returns its claims. The returned error wraps ErrAttestationTooLarge,
+// ErrMalformedAttestation, ErrInvalidCertificateChain, ErrCertificateExpired or
+// ErrInvalidSignature, depending on which check failed. The claims themselves are not validated.
+func ParseAndVerifyAttestation(token string, opts ParseOpts) (*Attestation, error) {
+	payload, err := verifyAttestationJWS(token, opts)
+	if err != nil {
+		return nil, err
+	}
+	var att Attestation
+	if err := json.Unmarshal(payload, &att); err != nil {
+		return nil, fmt.Errorf("%w: decoding claims: %v", ErrMalformedAttestation, err)
+	}
+	return &att, nil
+}
+
+// verifyAttestationJWS verifies token and returns its decoded payload.
+func verifyAttestationJWS(token string, opts ParseOpts) ([]byte, error) {
+	// Checked first, so that an oversized token costs nothing to reject.
+	if max := opts.maxSize(); len(token) > max {
+		return nil, fmt.Errorf("%w: %d bytes, must not exceed %d", ErrAttestationTooLarge, len(token), max)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformedAttestation, len(parts))
+	}
+
+	headerBytes, err := jwt.DecodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding header: %v", ErrMalformedAttestation, err)
+	}
+	var header attestationHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("%w: decoding header: %v", ErrMalformedAttestation, err)
+	}
+	if header.Alg != attestationAlg {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrMalformedAttestation, header.Alg)
+	}
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %v", ErrMalformedAttestation, err)
+	}
+
+	certs, err := parseCertificates(header.X5c)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCertificates(certs, opts); err != nil {
+		return nil, err
+	}
+
+	key, ok := certs[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: leaf certificate does not have an RSA key", ErrInvalidCertificateChain)
+	}
+	signingString := parts[0] + "." + parts[1]
+	if err := jwt.SigningMethodRS256.Verify(signingString, parts[2], key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return payload, nil
+}
+
+func parseCertificates(x5c []string) ([]*x509.Certificate, error) {
+	if len(x5c) == 0 {
+		return nil, fmt.Errorf("%w: attestation is missing certificate", ErrMalformedAttestation)
+	}
+	certs := make([]*x509.Certificate, len(x5c))
+	for i, certStr := range x5c {
+		if certStr == "" {
+			return nil, fmt.Errorf("%w: certificate is empty", ErrMalformedAttestation)
+		}
+		certData, err := base64.StdEncoding.DecodeString(certStr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid certificate encoding: %v", ErrMalformedAttestation, err)
+		}
+		certs[i], err = x509.ParseCertificate(certData)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid certificate: %v", ErrMalformedAttestation, err)
+		}
+	}
+	return certs, nil
+}
+
+// verifyCertificates checks the validity dates of certs and that the first certificate chains
+// to a trusted root using the rest as intermediates. The validity dates are checked first so
+// that an expired certificate is reported as such rather than as a broken chain.
+func verifyCertificates(certs []*x509.Certificate, opts ParseOpts) error {
+	now := opts.CurrentTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for _, cert := range certs {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return fmt.Errorf("%w: %q is valid from %v to %v", ErrCertificateExpired,
+				cert.Subject.CommonName, cert.NotBefore.UTC(), cert.NotAfter.UTC())
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	verifyOpts := x509.VerifyOptions{
+		DNSName:       attestationHostname, // required hostname for valid attestation.
+		Intermediates: intermediates,
+		Roots:         opts.Roots,
+		CurrentTime:   now,
+	}
+	if _, err := certs[0].Verify(verifyOpts); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificateChain, err)
+	}
+	return nil
+}
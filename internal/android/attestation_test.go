@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package android
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/go-cmp/cmp"
+)
+
+var testNow = time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             testNow.Add(-365 * 24 * time.Hour),
+		NotAfter:              testNow.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating root certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing root certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issueLeaf issues an attest.android.com certificate valid between notBefore and notAfter.
+func (ca *testCA) issueLeaf(t *testing.T, notBefore, notAfter time.Time) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: attestationHostname},
+		DNSNames:     []string{attestationHostname},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating leaf certificate: %v", err)
+	}
+	return key, der
+}
+
+func signTestAttestation(t *testing.T, key *rsa.PrivateKey, certDER []byte, att *Attestation) string {
+	t.Helper()
+	header, err := json.Marshal(attestationHeader{
+		Alg: attestationAlg,
+		X5c: []string{base64.StdEncoding.EncodeToString(certDER)},
+	})
+	if err != nil {
+		t.Fatalf("marshalling header: %v", err)
+	}
+	payload, err := json.Marshal(att)
+	if err != nil {
+		t.Fatalf("marshalling payload: %v", err)
+	}
+	signingString := jwt.EncodeSegment(header) + "." + jwt.EncodeSegment(payload)
+	sig, err := jwt.SigningMethodRS256.Sign(signingString, key)
+	if err != nil {
+		t.Fatalf("signing attestation: %v", err)
+	}
+	return signingString + "." + sig
+}
+
+func TestParseAndVerifyAttestation(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	att := &Attestation{
+		Nonce:           "bm9uY2U=",
+		TimestampMs:     testNow.Unix() * 1000,
+		APKPackageName:  appPackage,
+		CTSProfileMatch: true,
+		BasicIntegrity:  true,
+		EvaluationType:  "BASIC",
+	}
+
+	key, leaf := ca.issueLeaf(t, testNow.Add(-time.Hour), testNow.Add(time.Hour))
+	valid := signTestAttestation(t, key, leaf, att)
+
+	expiredKey, expiredLeaf := ca.issueLeaf(t, testNow.Add(-2*time.Hour), testNow.Add(-time.Hour))
+	expired := signTestAttestation(t, expiredKey, expiredLeaf, att)
+
+	// Replace the payload, keeping the original signature.
+	parts := strings.Split(valid, ".")
+	tamperedPayload, err := json.Marshal(&Attestation{Nonce: att.Nonce, TimestampMs: att.TimestampMs, CTSProfileMatch: false})
+	if err != nil {
+		t.Fatalf("marshalling payload: %v", err)
+	}
+	tampered := parts[0] + "." + jwt.EncodeSegment(tamperedPayload) + "." + parts[2]
+
+	testCases := []struct {
+		name    string
+		token   string
+		roots   *x509.CertPool
+		maxSize int
+		wantErr error
+	}{
+		{name: "valid", token: valid, roots: ca.pool()},
+		{name: "not a jws", token: "abc", roots: ca.pool(), wantErr: ErrMalformedAttestation},
+		{name: "bad header", token: "e30." + parts[1] + "." + parts[2], roots: ca.pool(), wantErr: ErrMalformedAttestation},
+		{name: "tampered payload", token: tampered, roots: ca.pool(), wantErr: ErrInvalidSignature},
+		{name: "expired certificate", token: expired, roots: ca.pool(), wantErr: ErrCertificateExpired},
+		{name: "untrusted root", token: valid, roots: otherCA.pool(), wantErr: ErrInvalidCertificateChain},
+		{name: "at size limit", token: valid, roots: ca.pool(), maxSize: len(valid)},
+		{name: "over size limit", token: valid, roots: ca.pool(), maxSize: len(valid) - 1, wantErr: ErrAttestationTooLarge},
+		{name: "over default size limit", token: strings.Repeat("a", DefaultMaxAttestationSize+1), roots: ca.pool(), wantErr: ErrAttestationTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseAndVerifyAttestation(tc.token, ParseOpts{Roots: tc.roots, CurrentTime: testNow, MaxSize: tc.maxSize})
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("ParseAndVerifyAttestation returned error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAndVerifyAttestation returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(att, got); diff != "" {
+				t.Errorf("ParseAndVerifyAttestation mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
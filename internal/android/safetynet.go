@@ -18,9 +18,9 @@ package android
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime/trace"
 	"time"
@@ -30,6 +30,29 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
+var (
+	// ErrNonceMismatch is returned when the attestation nonce does not match the request.
+	ErrNonceMismatch = errors.New("attestation nonce mismatch")
+	// ErrAttestationTime is returned when the attestation is too old or issued in the future.
+	ErrAttestationTime = errors.New("attestation issued outside the valid time window")
+	// ErrIntegrity is returned when the device fails a required integrity check.
+	ErrIntegrity = errors.New("device integrity check failed")
+)
+
+// claimError is a failed claim check, with a message describing it, that classifies as reason.
+type claimError struct {
+	reason error
+	msg    string
+}
+
+func (e *claimError) Error() string { return e.msg }
+
+func (e *claimError) Unwrap() error { return e.reason }
+
+func newClaimError(reason error, format string, args ...interface{}) error {
+	return &claimError{reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
 // The VerifyOpts determine the fields that are required for verification
 type VerifyOpts struct {
 	AppPkgName      string
@@ -39,50 +62,54 @@ type VerifyOpts struct {
 	BasicIntegrity  bool
 	MinValidTime    *time.Time
 	MaxValidTime    *time.Time
+	// MaxAttestationSize is the longest attestation accepted; see ParseOpts.MaxSize.
+	MaxAttestationSize int
 }
 
 //, appPackageName string, base64keys []string, regions []string
 
+// ValidateAttestation verifies attestation and checks its claims against opts. Failed claim
+// checks wrap ErrNonceMismatch, ErrAttestationTime or ErrIntegrity; see
+// ParseAndVerifyAttestation for the errors of an attestation that cannot be verified.
 func ValidateAttestation(ctx context.Context, attestation string, opts VerifyOpts) error {
+	_, err := VerifyAttestation(ctx, attestation, opts)
+	return err
+}
+
+// VerifyAttestation is ValidateAttestation, also returning the claims of a valid attestation
+// for checks beyond opts.
+func VerifyAttestation(ctx context.Context, attestation string, opts VerifyOpts) (*Attestation, error) {
 	defer trace.StartRegion(ctx, "ValidateAttestation").End()
 	logger := logging.FromContext(ctx)
 
-	claims, err := parseAttestation(ctx, attestation)
+	att, err := ParseAndVerifyAttestation(attestation, ParseOpts{MaxSize: opts.MaxAttestationSize})
 	if err != nil {
-		return fmt.Errorf("parseAttestation: %v", err)
+		return nil, fmt.Errorf("ParseAndVerifyAttestation: %w", err)
 	}
 
 	// Validate claims based on the options passed in.
 	if opts.Nonce != nil {
-		nonceClaimB64, ok := claims["nonce"].(string)
-		if !ok {
-			return fmt.Errorf("invalid nonce claim, not a string")
-		}
-		nonceClaimBytes, err := base64.StdEncoding.DecodeString(nonceClaimB64)
+		nonceClaimBytes, err := base64.StdEncoding.DecodeString(att.Nonce)
 		if err != nil {
-			return fmt.Errorf("unable to decode nonce claim data: %v", err)
+			return nil, fmt.Errorf("unable to decode nonce claim data: %v", err)
 		}
 		nonceClaim := string(nonceClaimBytes)
 		nonceCalculated := opts.Nonce.Nonce()
 		if nonceCalculated != nonceClaim {
-			return fmt.Errorf("nonce mismatch: expected %v got %v", nonceCalculated, nonceClaim)
+			return nil, newClaimError(ErrNonceMismatch, "nonce mismatch: expected %v got %v", nonceCalculated, nonceClaim)
 		}
 	} else {
 		logger.Warnf("ValidateAttestation called without nonce data")
 	}
 
 	if opts.MinValidTime != nil || opts.MaxValidTime != nil {
-		issMsF, ok := claims["timestampMs"].(float64)
-		if !ok {
-			return fmt.Errorf("timestampMs is not a readable value: %v", claims["timestampMs"])
-		}
-		issueTime := time.Unix(int64(issMsF/1000), 0)
+		issueTime := att.IssueTime()
 
 		if opts.MinValidTime != nil && opts.MinValidTime.Unix() > issueTime.Unix() {
-			return fmt.Errorf("attestation is too old, must be newer than %v, was %v", opts.MinValidTime.Unix(), issueTime.Unix())
+			return nil, newClaimError(ErrAttestationTime, "attestation is too old, must be newer than %v, was %v", opts.MinValidTime.Unix(), issueTime.Unix())
 		}
 		if opts.MaxValidTime != nil && opts.MaxValidTime.Unix() < issueTime.Unix() {
-			return fmt.Errorf("attestation is in the future, must be older than %v, was %v", opts.MaxValidTime.Unix(), issueTime.Unix())
+			return nil, newClaimError(ErrAttestationTime, "attestation is in the future, must be older than %v, was %v", opts.MaxValidTime.Unix(), issueTime.Unix())
 		}
 
 	} else {
@@ -94,95 +121,33 @@ func ValidateAttestation(ctx context.Context, attestation string, opts VerifyOpt
 
 	// Integrity checks.
 	if opts.CTSProfileMatch {
-		ctsProfileMatch, ok := claims["ctsProfileMatch"].(bool)
-		if !ok {
-			return fmt.Errorf("attestation value of ctsProfileMatch is not a valid bool, %v", claims["ctsProfileMatch"])
-		}
-		if !ctsProfileMatch {
-			return fmt.Errorf("ctsProfileMatch is false when true is required")
+		if !att.CTSProfileMatch {
+			return nil, newClaimError(ErrIntegrity, "ctsProfileMatch is false when true is required")
 		}
 	} else {
 		logger.Warnf("Verify attestation is not checking ctsProfileMatch")
 	}
 
 	if opts.BasicIntegrity {
-		basicIntegrity, ok := claims["basicIntegrity"].(bool)
-		if !ok {
-			return fmt.Errorf("attestation value of basicIntegrity is not a valid bool, %v", claims["basicIntegrity"])
-		}
-		if !basicIntegrity {
-			return fmt.Errorf("basicIntegrity is false when true is required")
-		}
-	}
-
-	return nil
-}
-
-// The keyFunc is based on the Android sample code
-// https://github.com/googlesamples/android-play-safetynet/blob/d7513a54e2f28c0dcd7f8d8d0fa03adb5d87b91a/server/java/src/main/java/OfflineVerify.java
-func keyFunc(ctx context.Context, tok *jwt.Token) (interface{}, error) {
-	x5c, ok := tok.Header["x5c"].([]interface{})
-	if !ok || len(x5c) == 0 {
-		return nil, fmt.Errorf("attestation is missing certificate")
-	}
-
-	// Verify the sigature of the JWS and retrieve the signature and certificates.
-	x509certs := make([]*x509.Certificate, len(x5c))
-	for i, certStr := range x5c {
-		if certStr == "" {
-			return nil, fmt.Errorf("certificate is empty")
-		}
-		certData, err := base64.StdEncoding.DecodeString(certStr.(string))
-		if err != nil {
-			return nil, fmt.Errorf("invalid certificate encoding: %v", err)
-		}
-		x509certs[i], err = x509.ParseCertificate(certData)
-		if err != nil {
-			return nil, fmt.Errorf("invalid certificate: %v", err)
+		if !att.BasicIntegrity {
+			return nil, newClaimError(ErrIntegrity, "basicIntegrity is false when true is required")
 		}
 	}
 
-	pool := x509.NewCertPool()
-	for _, cert := range x509certs {
-		pool.AddCert(cert)
-	}
-	opts := x509.VerifyOptions{
-		DNSName:       "attest.android.com", // required hostname for valid attestation.
-		Intermediates: pool,
-	}
-
-	// Verify the first certificate, with all added as allowed intermediates.
-	_, err := x509certs[0].Verify(opts)
-	if err != nil {
-		return nil, fmt.Errorf("invalid certificate chain: %v", err)
-	}
-
-	// extract the public key for verification.
-	if rsaKey, ok := x509certs[0].PublicKey.(*rsa.PublicKey); ok {
-		return rsaKey, nil
-	}
-	return nil, fmt.Errorf("invalid certificate, unable to extract public key")
+	return att, nil
 }
 
+// parseAttestation verifies signedAttestation and returns its untyped claims.
 func parseAttestation(ctx context.Context, signedAttestation string) (jwt.MapClaims, error) {
 	defer trace.StartRegion(ctx, "parseAttestation").End()
-	logger := logging.FromContext(ctx)
-	// jwt.Parse also validates the signature after extracting
-	// the key via the keyFunc, which validates the certificate chain.
-	token, err := jwt.Parse(signedAttestation,
-		func(tok *jwt.Token) (interface{}, error) {
-			return keyFunc(ctx, tok)
-		})
 
+	payload, err := verifyAttestationJWS(signedAttestation, ParseOpts{})
 	if err != nil {
-		return nil, fmt.Errorf("jwt.Parse: %v", err)
-	}
-	if !token.Valid {
-		logger.Errorf("invalid JWS attestation passed.")
+		return nil, err
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("claims are of wrong type")
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: decoding claims: %v", ErrMalformedAttestation, err)
 	}
 	return claims, nil
 }
@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// allRegionsPolicyEnvVar selects the AllRegionsPolicy the configs are loaded with.
+const allRegionsPolicyEnvVar = "CONFIG_ALL_REGIONS_POLICY"
+
+// AllRegionsPolicy controls what happens to APIConfigs with AllowAllRegions set when they are
+// loaded, so that a deployment can insist on every app listing its regions.
+type AllRegionsPolicy string
+
+const (
+	// AllRegionsAllow loads the configs as they are. This is the default.
+	AllRegionsAllow AllRegionsPolicy = "allow"
+	// AllRegionsDowngrade clears AllowAllRegions, leaving the app only its AllowedRegions.
+	AllRegionsDowngrade AllRegionsPolicy = "downgrade"
+	// AllRegionsReject drops the config, so that its app is treated as unconfigured.
+	AllRegionsReject AllRegionsPolicy = "reject"
+)
+
+// ParseAllRegionsPolicy parses an all regions policy name. An empty name selects
+// AllRegionsAllow.
+func ParseAllRegionsPolicy(name string) (AllRegionsPolicy, error) {
+	switch p := AllRegionsPolicy(name); p {
+	case "":
+		return AllRegionsAllow, nil
+	case AllRegionsAllow, AllRegionsDowngrade, AllRegionsReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown all regions policy %q, must be %q, %q or %q", name, AllRegionsAllow, AllRegionsDowngrade, AllRegionsReject)
+	}
+}
+
+// apply returns the configs to serve under the policy, logging each config it changes or drops.
+// The configs are not modified; a downgraded config is a copy.
+func (p AllRegionsPolicy) apply(ctx context.Context, configs []*model.APIConfig) []*model.APIConfig {
+	if p != AllRegionsDowngrade && p != AllRegionsReject {
+		return configs
+	}
+	logger := logging.FromContext(ctx)
+
+	kept := make([]*model.APIConfig, 0, len(configs))
+	for _, cfg := range configs {
+		if !cfg.AllowAllRegions {
+			kept = append(kept, cfg)
+			continue
+		}
+		if p == AllRegionsReject {
+			logger.Errorf("rejecting APIConfig for %v: AllowAllRegions is forbidden by $%s=%s", cfg.AppPackageName, allRegionsPolicyEnvVar, p)
+			continue
+		}
+		logger.Warnf("downgrading APIConfig for %v to its %d allowed regions: AllowAllRegions is forbidden by $%s=%s", cfg.AppPackageName, len(cfg.AllowedRegions), allRegionsPolicyEnvVar, p)
+		downgraded := *cfg
+		downgraded.AllowAllRegions = false
+		kept = append(kept, &downgraded)
+	}
+	return kept
+}
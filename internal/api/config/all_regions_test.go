@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAllRegionsPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    AllRegionsPolicy
+		wantErr bool
+	}{
+		{name: "", want: AllRegionsAllow},
+		{name: "allow", want: AllRegionsAllow},
+		{name: "downgrade", want: AllRegionsDowngrade},
+		{name: "reject", want: AllRegionsReject},
+		{name: "forbid", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseAllRegionsPolicy(tc.name)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("ParseAllRegionsPolicy(%q) returned error %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ParseAllRegionsPolicy(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestAllRegionsPolicy tests that the policy is applied to the configs as they are loaded.
+func TestAllRegionsPolicy(t *testing.T) {
+	allRegions := &model.APIConfig{AppPackageName: "com.example.all", AllowAllRegions: true, AllowedRegions: map[string]bool{"US": true}}
+	listed := &model.APIConfig{AppPackageName: "com.example.listed", AllowedRegions: map[string]bool{"CA": true}}
+	load := func(context.Context) ([]*model.APIConfig, error) {
+		return []*model.APIConfig{allRegions, listed}, nil
+	}
+
+	testCases := []struct {
+		policy AllRegionsPolicy
+		want   map[string]*model.APIConfig
+	}{
+		{
+			policy: AllRegionsAllow,
+			want:   map[string]*model.APIConfig{allRegions.AppPackageName: allRegions, listed.AppPackageName: listed},
+		},
+		{
+			policy: AllRegionsDowngrade,
+			want: map[string]*model.APIConfig{
+				allRegions.AppPackageName: {AppPackageName: "com.example.all", AllowedRegions: map[string]bool{"US": true}},
+				listed.AppPackageName:     listed,
+			},
+		},
+		{
+			policy: AllRegionsReject,
+			want:   map[string]*model.APIConfig{listed.AppPackageName: listed},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			c := newConfig(load, time.Hour)
+			c.allRegions = tc.policy
+			if err := c.loadConfig(context.Background()); err != nil {
+				t.Fatalf("loadConfig returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, c.cache); diff != "" {
+				t.Errorf("cached configs mismatch (-want +got):\n%s", diff)
+			}
+			if !allRegions.AllowAllRegions {
+				t.Errorf("policy %q modified the loaded config", tc.policy)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ package config
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -29,9 +30,13 @@ const (
 	defaultRefreshPeriod = time.Minute
 )
 
+// loadFn reads every APIConfig.
+type loadFn func(ctx context.Context) ([]*model.APIConfig, error)
+
 type Config struct {
-	db            *database.DB
+	load          loadFn
 	refreshPeriod time.Duration
+	allRegions    AllRegionsPolicy
 
 	mu           sync.RWMutex
 	lastLoadTime time.Time
@@ -42,11 +47,7 @@ func New(db *database.DB) *Config {
 	ctx := context.Background()
 	logger := logging.FromContext(ctx)
 
-	cfg := &Config{
-		db:            db,
-		refreshPeriod: defaultRefreshPeriod,
-		cache:         make(map[string]*model.APIConfig),
-	}
+	cfg := newConfig(db.ReadAPIConfigs, defaultRefreshPeriod)
 
 	if ds := os.Getenv("CONFIG_REFRESH_DURATION"); ds != "" {
 		if d, err := time.ParseDuration(ds); err != nil {
@@ -60,9 +61,25 @@ func New(db *database.DB) *Config {
 		logger.Warn("config refresh duration is > 5 minutes: %v", cfg.refreshPeriod)
 	}
 
+	policy, err := ParseAllRegionsPolicy(os.Getenv(allRegionsPolicyEnvVar))
+	if err != nil {
+		logger.Fatalf("invalid $%s: %v", allRegionsPolicyEnvVar, err)
+	}
+	cfg.allRegions = policy
+	logger.Infof("Loading APIConfigs with the %q all regions policy (override with $%s)", policy, allRegionsPolicyEnvVar)
+
 	return cfg
 }
 
+func newConfig(load loadFn, refreshPeriod time.Duration) *Config {
+	return &Config{
+		load:          load,
+		refreshPeriod: refreshPeriod,
+		allRegions:    AllRegionsAllow,
+		cache:         make(map[string]*model.APIConfig),
+	}
+}
+
 func (c *Config) loadConfig(ctx context.Context) error {
 	// In case multiple requests notice expiration simultaneously, only do it once.
 	c.mu.Lock()
@@ -75,8 +92,13 @@ func (c *Config) loadConfig(ctx context.Context) error {
 
 	logger := logging.FromContext(ctx)
 
-	configs, err := c.db.ReadAPIConfigs(ctx)
+	configs, err := c.load(ctx)
 	if err != nil {
+		if c.lastLoadTime.IsZero() {
+			// Never loaded, so the server isn't ready yet and Prewarm keeps retrying.
+			logger.Errorf("error loading APIConfig: %v", err)
+			return err
+		}
 		// This will exit the server. Without a valid config, we cannot process
 		// requests.
 		// TODO(mikehelmick) stable fallbacks
@@ -85,7 +107,7 @@ func (c *Config) loadConfig(ctx context.Context) error {
 	}
 
 	c.cache = make(map[string]*model.APIConfig)
-	for _, apiConfig := range configs {
+	for _, apiConfig := range c.allRegions.apply(ctx, configs) {
 		c.cache[apiConfig.AppPackageName] = apiConfig
 	}
 	logger.Info("loaded new APIConfig values")
@@ -94,6 +116,52 @@ func (c *Config) loadConfig(ctx context.Context) error {
 	return nil
 }
 
+// Prewarm loads the configs into the cache, so that the first requests don't wait for them. If
+// the load fails, it is retried every retryPeriod in the background until it succeeds or ctx is
+// done. Call it before serving requests, and use Ready to tell whether the configs are loaded.
+func (c *Config) Prewarm(ctx context.Context, retryPeriod time.Duration) {
+	logger := logging.FromContext(ctx)
+	if err := c.loadConfig(ctx); err == nil {
+		return
+	}
+	logger.Warnf("APIConfig prewarm failed, not ready; retrying every %v", retryPeriod)
+
+	go func() {
+		ticker := time.NewTicker(retryPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := c.loadConfig(ctx); err == nil {
+				logger.Infof("APIConfig prewarm succeeded, ready")
+				return
+			}
+		}
+	}()
+}
+
+// Ready reports whether the configs have been loaded at least once.
+func (c *Config) Ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.lastLoadTime.IsZero()
+}
+
+// ReadyHandler returns a readiness check handler that responds with 503 Service Unavailable
+// until the configs have been loaded.
+func (c *Config) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.Ready() {
+			http.Error(w, "APIConfig not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
 func (c *Config) AppPkgConfig(ctx context.Context, appPkg string) *model.APIConfig {
 	c.loadConfig(ctx)
 
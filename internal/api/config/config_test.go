@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+const testAppPkg = "com.example.android.app"
+
+func testConfigs(context.Context) ([]*model.APIConfig, error) {
+	return []*model.APIConfig{{AppPackageName: testAppPkg}}, nil
+}
+
+func readyStatus(t *testing.T, c *Config) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.ReadyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	return w.Code
+}
+
+// cached returns the cached config for testAppPkg without loading.
+func cached(c *Config) *model.APIConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cache[testAppPkg]
+}
+
+func TestPrewarm(t *testing.T) {
+	c := newConfig(testConfigs, time.Hour)
+	if c.Ready() {
+		t.Fatalf("Ready before Prewarm")
+	}
+	if got := readyStatus(t, c); got != http.StatusServiceUnavailable {
+		t.Errorf("ready status before Prewarm = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	c.Prewarm(context.Background(), time.Millisecond)
+	if !c.Ready() {
+		t.Fatalf("not Ready after Prewarm")
+	}
+	if cached(c) == nil {
+		t.Errorf("config for %s not cached when ready", testAppPkg)
+	}
+	if got := readyStatus(t, c); got != http.StatusOK {
+		t.Errorf("ready status after Prewarm = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestPrewarmRetry(t *testing.T) {
+	failures := make(chan error, 2)
+	failures <- errors.New("database unavailable")
+	failures <- errors.New("database unavailable")
+	close(failures)
+	load := func(ctx context.Context) ([]*model.APIConfig, error) {
+		if err, ok := <-failures; ok {
+			return nil, err
+		}
+		return testConfigs(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newConfig(load, time.Hour)
+	c.Prewarm(ctx, time.Millisecond)
+	if c.Ready() {
+		t.Fatalf("Ready after failed load")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not Ready after retries")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The cache is filled before readiness flips.
+	if cached(c) == nil {
+		t.Errorf("config for %s not cached when ready", testAppPkg)
+	}
+}
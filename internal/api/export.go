@@ -17,6 +17,7 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -30,6 +31,14 @@ import (
 
 const (
 	batchIDParam = "batch-id"
+	oneDay       = 24 * time.Hour
+
+	// MaxLookbackWindow bounds BatchServerConfig.LookbackWindow; keys older than this are no
+	// longer useful to devices.
+	MaxLookbackWindow = 14 * oneDay
+
+	// createBatchesLock guards the creation and replacement of export batches.
+	createBatchesLock = "create_batches"
 )
 
 func NewBatchServer(db *database.DB, bsc BatchServerConfig) *BatchServer {
@@ -50,6 +59,147 @@ type BatchServerConfig struct {
 	TmpBucket     string
 	Bucket        string
 	MaxRecords    int
+
+	// FilenameTemplate names the export files of a batch; see ValidateFilenameTemplate for the
+	// supported tokens. DefaultFilenameTemplate is used if empty.
+	FilenameTemplate string
+
+	// FormatVersion selects the export file format. DefaultExportFormatVersion is used if zero.
+	FormatVersion int
+
+	// ReportTypeMapping translates stored report types to the report type written to export
+	// files. A key whose report type maps to ReportTypeExclude is left out of the export.
+	// Report types not present in the map are exported unchanged.
+	ReportTypeMapping map[int]int
+
+	// MaxAttempts is the number of times a batch is attempted before it is marked failed and
+	// left for an operator to re-queue. Zero retries indefinitely.
+	MaxAttempts int
+
+	// BatchAlignment, if set, snaps the end of newly created batches to a multiple of this
+	// duration since UTC midnight (e.g. 1h for the top of the hour, 24h for UTC midnight) rather
+	// than to a multiple of the export config's period. See ValidateBatchAlignment.
+	BatchAlignment time.Duration
+
+	// ZipExports writes each export file as a zip holding export.bin and export.sig, signed with
+	// every one of Signers valid at the time, instead of the bare serialized keys.
+	ZipExports bool
+	Signers    []*ExportSigner
+
+	// SplitRegions exports each of a batch's included regions to its own files, rather than the
+	// keys of all regions together. Batches that include all regions are not split.
+	SplitRegions bool
+
+	// PartialRegionExports, with SplitRegions, lets the other regions of a batch complete when one
+	// fails. The batch is then marked partially complete with its failed regions, for an operator
+	// to re-queue. By default the first failure fails the whole batch.
+	PartialRegionExports bool
+
+	// SplitReportTypes exports the keys of each report type to their own files, so that clients
+	// can weigh them differently. Each report type's files are a sequence of their own, limited
+	// to MaxRecords keys each. Requires a format version carrying report types; see
+	// ValidateSplitReportTypes.
+	SplitReportTypes bool
+
+	// LookbackWindow, if longer than a batch's window, exports the keys created in the
+	// LookbackWindow before the end of the batch rather than only those created within it, so that
+	// keys which arrive late, such as federated keys, are still exported. See
+	// ValidateLookbackWindow.
+	LookbackWindow time.Duration
+
+	// VerifyExports reads every export file back from storage after it is written and checks its
+	// checksum, key count and, for zips, signature, failing the batch on a mismatch. It doubles
+	// the storage IO of an export.
+	VerifyExports bool
+
+	// DebugNDJSON also writes the keys of each export file as NDJSON, one key per line, to an
+	// object in DebugBucket named after the file with an added .ndjson extension, for operators
+	// to inspect. It has no effect unless DebugBucket is set, and like the other debug copies a
+	// failure to write it is logged but does not fail the export.
+	DebugNDJSON bool
+
+	// DebugBucket, if set, receives a copy of every export file, under the same name, with a
+	// sidecar describing the batch and timings of the file. Failing to write to it is logged but
+	// does not fail the export, and the copies are not recorded in the database.
+	DebugBucket string
+
+	// LatestPointer writes, after each batch completes, an object named latest.json under the
+	// config's filename root that names the batch, its window and its files, so that clients can
+	// discover the newest files without listing the bucket. It is not updated for partially
+	// complete batches, nor for a batch ending before the one it already names.
+	LatestPointer bool
+
+	// ExportRevocations also writes, for each batch, revocation lists of the keys revoked during
+	// the batch, with the revoked report type, so that clients delete them. They are named like
+	// the batch's files, with "revocations" as the report type, listed in the latest pointer and
+	// recorded as revocation files of the batch; none are written if no key was revoked. Revoked
+	// keys are left out of every export, with or without this. Requires a format version
+	// carrying report types; see ValidateExportRevocations.
+	ExportRevocations bool
+
+	// MinExportKeys, if set, defers creating batches for an export config until at least this
+	// many keys, across all of its regions, have been created since its latest batch, so that no
+	// export narrows down the few people who published keys. The windows deferred are carried
+	// forward into a single batch covering them all once the minimum is reached. Before a
+	// config's first batch, its windows are carried forward from the first one deferred. Zero
+	// creates batches regardless.
+	MinExportKeys int
+
+	// StorageRetries is the number of times the write of an export file that fails with a
+	// transient storage error, such as a timeout or throttling, is retried, with exponential
+	// backoff, before the attempt of the batch fails. Writes failing with any other error are not
+	// retried. A batch whose writes fail for lack of permission is marked failed on its first
+	// attempt, whatever MaxAttempts.
+	StorageRetries int
+
+	// QuotaRetryDelay is how long a batch whose attempt failed because a storage quota is
+	// exhausted waits before it is leased again. Such attempts do not count towards MaxAttempts.
+	// DefaultQuotaRetryDelay is used if zero.
+	QuotaRetryDelay time.Duration
+
+	// CheckDeterminism marshals every export file a second time, from the keys in reverse order,
+	// and fails the batch unless both are identical, apart from the randomized signatures. An
+	// export whose bytes change while its keys do not makes clients download it again.
+	CheckDeterminism bool
+}
+
+// ValidateLookbackWindow returns an error if lookback is not a valid LookbackWindow.
+func ValidateLookbackWindow(lookback time.Duration) error {
+	if lookback < 0 {
+		return fmt.Errorf("lookback window must not be negative, got %v", lookback)
+	}
+	if lookback > MaxLookbackWindow {
+		return fmt.Errorf("lookback window must not exceed %v, got %v", MaxLookbackWindow, lookback)
+	}
+	return nil
+}
+
+// ValidateBatchAlignment returns an error if alignment is not a valid BatchAlignment.
+func ValidateBatchAlignment(alignment time.Duration) error {
+	if alignment < 0 {
+		return fmt.Errorf("batch alignment must not be negative, got %v", alignment)
+	}
+	if alignment == 0 {
+		return nil
+	}
+	if alignment > oneDay || oneDay%alignment != 0 {
+		return fmt.Errorf("batch alignment must divide equally into 24 hours (e.g., 1h, 4h, 24h), got %v", alignment)
+	}
+	return nil
+}
+
+func (c BatchServerConfig) quotaRetryDelay() time.Duration {
+	if c.QuotaRetryDelay == 0 {
+		return DefaultQuotaRetryDelay
+	}
+	return c.QuotaRetryDelay
+}
+
+func (c BatchServerConfig) formatVersion() int {
+	if c.FormatVersion == 0 {
+		return DefaultExportFormatVersion
+	}
+	return c.FormatVersion
 }
 
 // CreateBatchesHandler is a handler to iterate the rows of ExportConfig and
@@ -60,7 +210,7 @@ func (s *BatchServer) CreateBatchesHandler(w http.ResponseWriter, r *http.Reques
 	logger := logging.FromContext(ctx)
 
 	// Obtain lock to make sure there are no other processes working to create batches.
-	lock := "create_batches"
+	lock := createBatchesLock
 	unlockFn, err := s.db.Lock(ctx, lock, s.bsc.CreateTimeout) // TODO(jasonco): double this?
 	if err != nil {
 		if err == database.ErrAlreadyLocked {
@@ -129,12 +279,44 @@ func (s *BatchServer) maybeCreateBatches(ctx context.Context, ec *model.ExportCo
 		return fmt.Errorf("fetching most recent batch for config %d: %v", ec.ConfigID, err)
 	}
 
-	ranges := makeBatchRanges(ec.Period, latestEnd, now)
+	// Until a config has a batch, only the deferral record says where its deferred windows start.
+	var deferredFrom time.Time
+	if s.bsc.MinExportKeys > 0 && latestEnd.Before(sanityDate) {
+		if deferredFrom, err = s.db.GetExportDeferredFrom(ctx, ec.ConfigID); err != nil {
+			return fmt.Errorf("fetching deferred windows of config %d: %v", ec.ConfigID, err)
+		}
+	}
+
+	ranges := carriedBatchRanges(ec.Period, s.bsc.BatchAlignment, latestEnd, deferredFrom, now)
 	if len(ranges) == 0 {
 		logger.Debugf("Batch creation for config %d is not required. Skipping.", ec.ConfigID)
 		return nil
 	}
 
+	if s.bsc.MinExportKeys > 0 {
+		window := model.ExportBatch{
+			StartTimestamp: ranges[0].start,
+			EndTimestamp:   ranges[len(ranges)-1].end,
+			IncludeRegions: ec.IncludeRegions,
+			ExcludeRegions: ec.ExcludeRegions,
+		}
+		keys, err := s.db.CountInfections(ctx, infectionsCriteria(window, "", 0, time.Time{}))
+		if err != nil {
+			return fmt.Errorf("counting keys for config %d: %v", ec.ConfigID, err)
+		}
+		ranges = applyMinExportKeys(ranges, keys, s.bsc.MinExportKeys)
+		if len(ranges) == 0 {
+			logger.Infof("Deferring batch creation for config %d: %d key(s) created from %v to %v, fewer than the minimum of %d.",
+				ec.ConfigID, keys, window.StartTimestamp, window.EndTimestamp, s.bsc.MinExportKeys)
+			if latestEnd.Before(sanityDate) {
+				if err := s.db.DeferExportConfig(ctx, ec.ConfigID, window.StartTimestamp); err != nil {
+					return fmt.Errorf("deferring config %d: %v", ec.ConfigID, err)
+				}
+			}
+			return nil
+		}
+	}
+
 	var batches []*model.ExportBatch
 	for _, br := range ranges {
 		batches = append(batches, &model.ExportBatch{
@@ -160,12 +342,48 @@ type batchRange struct {
 	start, end time.Time
 }
 
+// applyMinExportKeys returns the ranges to create batches for, given that keys were created
+// within them: none if keys is below minKeys, so that they are carried forward to a later run,
+// or else a single range spanning them all. A minKeys of zero returns ranges unchanged.
+func applyMinExportKeys(ranges []batchRange, keys, minKeys int) []batchRange {
+	if minKeys <= 0 || len(ranges) == 0 {
+		return ranges
+	}
+	if keys < minKeys {
+		return nil
+	}
+	return []batchRange{{start: ranges[0].start, end: ranges[len(ranges)-1].end}}
+}
+
 var sanityDate = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
 
+// carriedBatchRanges is makeAlignedBatchRanges for a config whose windows may have been deferred
+// by BatchServerConfig.MinExportKeys before it had any batch, starting at deferredFrom. Such a
+// config's ranges reach back to deferredFrom, so that the keys of every deferred window are
+// carried forward, rather than covering only the most recent period.
+func carriedBatchRanges(period, alignment time.Duration, latestEnd, deferredFrom, now time.Time) []batchRange {
+	if latestEnd.Before(sanityDate) && !deferredFrom.Before(sanityDate) {
+		latestEnd = deferredFrom
+	}
+	return makeAlignedBatchRanges(period, alignment, latestEnd, now)
+}
+
 func makeBatchRanges(period time.Duration, latestEnd, now time.Time) []batchRange {
+	return makeAlignedBatchRanges(period, 0, latestEnd, now)
+}
 
-	// Truncate now to align with period; use this as the end date.
-	end := now.Truncate(period)
+// makeAlignedBatchRanges is makeBatchRanges with the end of the most recent batch truncated to
+// alignment instead of period. An alignment of zero aligns with period. When alignment differs
+// from period, the ends of successive runs are not a period apart, so no batch is created until
+// a full period has passed since latestEnd, and the earliest new batch starts at latestEnd
+// rather than overlapping the latest batch.
+func makeAlignedBatchRanges(period, alignment time.Duration, latestEnd, now time.Time) []batchRange {
+	if alignment == 0 {
+		alignment = period
+	}
+
+	// Truncate now to the alignment boundary; use this as the end date.
+	end := now.Truncate(alignment)
 
 	// If the end date < latest end date, we already have a batch that covers this period, so return no batches.
 	if end.Before(latestEnd) {
@@ -182,11 +400,19 @@ func makeBatchRanges(period time.Duration, latestEnd, now time.Time) []batchRang
 		return []batchRange{{start: start, end: end}}
 	}
 
+	aligned := alignment != period
+	if aligned && end.Before(latestEnd.Add(period)) {
+		return nil
+	}
+
 	// Build up a list of batches until we reach that latestEnd.
 	// Allow for overlap so we don't miss keys; this might happen in the event that
 	// an ExportConfig was edited and the new settings don't quite align.
 	ranges := []batchRange{}
 	for end.After(latestEnd) {
+		if aligned && start.Before(latestEnd) {
+			start = latestEnd
+		}
 		ranges = append([]batchRange{{start: start, end: end}}, ranges...)
 		start = start.Add(-period)
 		end = end.Add(-period)
@@ -217,7 +443,23 @@ func (s *BatchServer) CreateFilesHandler(w http.ResponseWriter, r *http.Request)
 
 	// Create file(s)
 	if err = s.createExportFilesForBatch(ctx, *batch); err != nil {
-		logger.Errorf("Failed to create files for batch: %v", err)
+		f := newBatchFailure(err, s.bsc.MaxAttempts, s.bsc.quotaRetryDelay(), time.Now().UTC())
+		logger.Errorf("Failed to create files for batch %d (%s): %v", batch.BatchID, f.class, err)
+		// The lease context may be what expired, so record the failure against the request context.
+		if !f.deferUntil.IsZero() {
+			logger.Errorf("Export storage quota exceeded: batch %d deferred until %v, without counting the attempt", batch.BatchID, f.deferUntil)
+			if derr := s.db.DeferBatch(r.Context(), batch.BatchID, f.reason, f.deferUntil); derr != nil {
+				logger.Errorf("Failed to defer batch %d: %v", batch.BatchID, derr)
+			}
+			http.Error(w, "Export storage quota exceeded, check logs.", http.StatusInternalServerError)
+			return
+		}
+		failed, ferr := s.db.FailBatch(r.Context(), batch.BatchID, f.reason, f.maxAttempts)
+		if ferr != nil {
+			logger.Errorf("Failed to record failure of batch %d: %v", batch.BatchID, ferr)
+		} else if failed {
+			logger.Errorf("Batch %d failed after %d attempts, marked %s", batch.BatchID, batch.Attempts, model.ExportBatchFailed)
+		}
 		http.Error(w, "Failed to create files for batch, check logs.", http.StatusInternalServerError)
 		return
 	}
@@ -233,120 +475,296 @@ func (s *BatchServer) createExportFilesForBatch(ctx context.Context, eb model.Ex
 	logger.Infof("Included regions %v, ExcludedRegions %v ", eb.IncludeRegions, eb.ExcludeRegions)
 	logger.Infof("FilenameRoot %v ", eb.FilenameRoot)
 
-	var (
-		done         = false
-		batchCount   = 0
-		recordCount  = 1
-		exposureKeys []*model.Infection
-		files        []string
-		criteria     = database.IterateInfectionsCriteria{
-			SinceTimestamp:      eb.StartTimestamp,
-			UntilTimestamp:      eb.EndTimestamp,
-			IncludeRegions:      eb.IncludeRegions,
-			ExcludeRegions:      eb.ExcludeRegions,
-			OnlyLocalProvenance: false, // include federated ids
+	// An empty region exports the keys of all included regions together.
+	regions := []string{""}
+	if s.bsc.SplitRegions && len(eb.IncludeRegions) > 0 {
+		regions = eb.IncludeRegions
+		if len(eb.FailedRegions) > 0 {
+			// A re-queued partial batch only exports the regions that failed.
+			regions = eb.FailedRegions
 		}
-	)
+	}
 
-	it, err := s.db.IterateInfections(ctx, criteria)
+	watermark, err := s.db.GetExportWatermark(ctx, eb.ConfigID)
 	if err != nil {
-		return fmt.Errorf("iterating infections: %v", err)
+		return fmt.Errorf("reading export watermark: %v", err)
 	}
-	defer it.Close()
 
-	exp, done, err := it.Next()
-	// TODO(lmohanan): Watch for context deadline
-	for !done && err == nil {
-		if exp != nil {
-			exposureKeys = append(exposureKeys, exp)
-			recordCount++
+	// latest is the creation time of the newest key read by any region of the batch.
+	var latest time.Time
+	failed, err := exportRegions(ctx, regions, s.bsc.PartialRegionExports, func(ctx context.Context, region string) error {
+		return s.createExportFilesForRegion(ctx, eb, region, watermark, &latest)
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		reason := fmt.Sprintf("failed to create files for regions %v", failed)
+		if err := s.db.PartiallyCompleteBatch(ctx, eb.BatchID, failed, reason); err != nil {
+			return fmt.Errorf("marking batch %v partially complete: %v", eb.BatchID, err)
+		}
+		logger.Errorf("Batch %d marked %s, %s", eb.BatchID, model.ExportBatchPartial, reason)
+		return nil
+	}
+
+	// Update ExportFile for the batch to mark it complete.
+	if err := s.db.CompleteBatch(ctx, eb.BatchID); err != nil {
+		return fmt.Errorf("marking batch %v complete: %v", eb.BatchID, err)
+	}
+	// The batch is already complete, so a failure here only means the next batch reads from its
+	// own start rather than from where this one left off.
+	if !latest.IsZero() {
+		if err := s.db.AdvanceExportWatermark(ctx, eb.ConfigID, latest); err != nil {
+			logger.Errorf("Failed to advance export watermark of config %d: %v", eb.ConfigID, err)
 		}
+	}
+	// Only once every file is written and the batch is complete, never for a partial batch.
+	if s.bsc.LatestPointer {
+		s.updateLatestPointer(ctx, eb)
+	}
 
-		if recordCount == s.bsc.MaxRecords {
-			objectName := fmt.Sprintf(eb.FilenameRoot+"%s-%d", eb.StartTimestamp.Unix(), batchCount)
-			if err = s.createFile(ctx, objectName, exposureKeys, eb, batchCount); err != nil {
-				return err
+	return nil
+}
+
+// exportRegions calls export for each of regions in turn. By default, the first failure is
+// returned and the remaining regions are skipped. If partial is set, every region is attempted
+// and the regions that failed are returned, as long as at least one region succeeded.
+func exportRegions(ctx context.Context, regions []string, partial bool, export func(ctx context.Context, region string) error) ([]string, error) {
+	logger := logging.FromContext(ctx)
+
+	var failed []string
+	var lastErr error
+	for _, region := range regions {
+		if err := export(ctx, region); err != nil {
+			if !partial {
+				return nil, err
 			}
+			logger.Errorf("Failed to create files for region %q: %v", region, err)
+			failed = append(failed, region)
+			lastErr = err
+		}
+	}
+	if len(failed) == len(regions) && lastErr != nil {
+		return nil, fmt.Errorf("all regions failed, last error: %w", lastErr)
+	}
+	return failed, nil
+}
 
-			// Append to files list
-			files = append(files, objectName)
-			batchCount++
-			recordCount = 1
+// infectionsCriteria returns the criteria selecting the keys exported for eb, for region or for
+// all of its included regions if region is empty. Keys created up to lookback before the end of
+// the batch are selected if that reaches further back than the start of the batch. So are keys
+// created after watermark, the newest key already exported, which arrived too late for the batch
+// whose window they fall in; watermark never reaches back more than MaxLookbackWindow.
+func infectionsCriteria(eb model.ExportBatch, region string, lookback time.Duration, watermark time.Time) database.IterateInfectionsCriteria {
+	criteria := database.IterateInfectionsCriteria{
+		SinceTimestamp:      eb.StartTimestamp,
+		UntilTimestamp:      eb.EndTimestamp,
+		IncludeRegions:      eb.IncludeRegions,
+		ExcludeRegions:      eb.ExcludeRegions,
+		OnlyLocalProvenance: false, // include federated ids
+		ExcludeRevoked:      true,
+	}
+	if region != "" {
+		criteria.IncludeRegions = []string{region}
+	}
+	if since := eb.EndTimestamp.Add(-lookback); lookback > 0 && since.Before(criteria.SinceTimestamp) {
+		criteria.SinceTimestamp = since
+	}
+	if !watermark.IsZero() && watermark.Before(criteria.SinceTimestamp) {
+		if oldest := eb.EndTimestamp.Add(-MaxLookbackWindow); watermark.Before(oldest) {
+			watermark = oldest
+		}
+		if watermark.Before(criteria.SinceTimestamp) {
+			criteria.SinceTimestamp = watermark
 		}
+	}
+	return criteria
+}
 
-		exp, done, err = it.Next()
+// trackLatest wraps next, recording in latest the creation time of the newest key it returns.
+func trackLatest(next func() (*model.Infection, bool, error), latest *time.Time) func() (*model.Infection, bool, error) {
+	return func() (*model.Infection, bool, error) {
+		inf, done, err := next()
+		if inf != nil && inf.CreatedAt.After(*latest) {
+			*latest = inf.CreatedAt
+		}
+		return inf, done, err
 	}
+}
+
+// createExportFilesForRegion writes the files holding the keys of eb for region, or for all of
+// its included regions if region is empty, and, with ExportRevocations, the revocation lists of
+// the keys revoked during eb. The creation time of the newest key read is recorded
+// in latest, if newer than its current value.
+func (s *BatchServer) createExportFilesForRegion(ctx context.Context, eb model.ExportBatch, region string, watermark time.Time, latest *time.Time) error {
+	it, err := s.db.IterateInfections(ctx, infectionsCriteria(eb, region, s.bsc.LookbackWindow, watermark))
 	if err != nil {
 		return fmt.Errorf("iterating infections: %v", err)
 	}
+	defer it.Close()
 
-	// Create a file for the remaining keys
-	objectName := fmt.Sprintf(eb.FilenameRoot+"%s-%d", eb.StartTimestamp.Unix(), batchCount)
-	if err = s.createFile(ctx, objectName, exposureKeys, eb, batchCount); err != nil {
+	// Tracked separately, so that a region which fails does not advance latest.
+	regionLatest := *latest
+	streams, err := streamExportFiles(trackLatest(it.Next, &regionLatest), s.bsc.SplitReportTypes, s.bsc.MaxRecords, s.bsc.ReportTypeMapping, func(st *exportStream) error {
+		objectName := exportStreamFilename(s.bsc.FilenameTemplate, eb, region, st.name(), st.batchCount)
+		wf, err := s.createFile(ctx, objectName, st.keys, eb, region, st.reportType, false, st.batchCount)
+		if err != nil {
+			return err
+		}
+		st.files = append(st.files, objectName)
+		st.written = append(st.written, wf)
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+	if s.bsc.ExportRevocations {
+		revocations, err := s.createRevocationFiles(ctx, eb, region)
+		if err != nil {
+			return fmt.Errorf("creating revocation files: %w", err)
+		}
+		if revocations != nil {
+			streams = append(streams, revocations)
+		}
+	}
 
-	// Append to files list
-	files = append(files, objectName)
-	batchCount++
+	if s.bsc.VerifyExports {
+		var written []*writtenExportFile
+		for _, st := range streams {
+			written = append(written, st.written...)
+		}
+		if err := verifyExportFiles(ctx, storage.ReadObject, s.bsc.Bucket, written, s.bsc.ZipExports, s.bsc.Signers); err != nil {
+			logging.FromContext(ctx).Errorf("Export self-test failed for batch %d: %v", eb.BatchID, err)
+			return fmt.Errorf("verifying export files: %v", err)
+		}
+	}
 
-	// Update ExportFile for the files created: set batchSize and update status .
+	// Update ExportFile for the files created: set batchSize and update status. Each stream is
+	// its own sequence of files, so its batch size is its own file count.
 	// TODO(lmohanan): Figure out batchCount ahead of time and do this immediately after writing to GCS
 	// for better failure protection.
+	// TODO: Knowing batchCount ahead of time would also let each zip carry the batch size the export
+	// file spec requires; see MarshalExportZip.
 	// TODO(lmohanan): Perform UpdateExportFile and CompleteBatch as a transaction.
-	for _, file := range files {
-		s.db.UpdateExportFile(ctx, file, model.ExportBatchComplete, batchCount)
-	}
-
-	// Update ExportFile for the batch to mark it complete.
-	if err := s.db.CompleteBatch(ctx, eb.BatchID); err != nil {
-		return fmt.Errorf("marking batch %v complete: %v", eb.BatchID, err)
+	for _, st := range streams {
+		for _, file := range st.files {
+			s.db.UpdateExportFile(ctx, file, model.ExportBatchComplete, st.batchCount)
+		}
 	}
-
+	*latest = regionLatest
 	return nil
 }
 
-func (s *BatchServer) createFile(ctx context.Context, objectName string, exposureKeys []*model.Infection, eb model.ExportBatch, batchCount int) error {
+func (s *BatchServer) createFile(ctx context.Context, objectName string, exposureKeys []*model.Infection, eb model.ExportBatch, region string, reportType *int, revocation bool, batchCount int) (*writtenExportFile, error) {
 	// Add ExportFile entry with Status Pending
 	ef := model.ExportFile{
-		Filename: objectName,
-		BatchID:  eb.BatchID,
-		Region:   "", // TODO(lmohanan) figure out where region comes from.
-		BatchNum: batchCount,
-		Status:   model.ExportBatchPending,
-	}
-	// TODO(lmohanan) Handle partial failure: If redoing this batch after a failure,
-	// these inserts can fail due to duplicate filename.
+		Filename:   objectName,
+		BatchID:    eb.BatchID,
+		Region:     region, // TODO(lmohanan) figure out where region comes from when not split.
+		ReportType: reportType,
+		Revocation: revocation,
+		BatchNum:   batchCount,
+		Status:     model.ExportBatchPending,
+	}
 	if err := s.db.AddExportFile(ctx, &ef); err != nil {
-		return fmt.Errorf("adding export file entry: %v", err)
+		return nil, fmt.Errorf("adding export file entry: %v", err)
 	}
 
 	// Format keys
-	data, err := MarshalExportFile(eb.StartTimestamp, eb.EndTimestamp, exposureKeys, "US")
+	start := time.Now()
+	data, err := s.marshalExport(eb, exposureKeys, region, batchCount)
+	if err != nil {
+		return nil, err
+	}
+	keyCount := len(exportKeys(exposureKeys, s.bsc.formatVersion()))
+	if s.bsc.CheckDeterminism {
+		again, err := s.marshalExport(eb, reversedKeys(exposureKeys), region, batchCount)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkExportDeterminism(data, again, s.bsc.ZipExports); err != nil {
+			return nil, fmt.Errorf("export file %s is not deterministic: %v", objectName, err)
+		}
+	}
+	info := &exportDebugInfo{
+		BatchID:        eb.BatchID,
+		Filename:       objectName,
+		Region:         region,
+		ReportType:     reportType,
+		BatchNum:       batchCount,
+		Keys:           keyCount,
+		StartTimestamp: eb.StartTimestamp,
+		EndTimestamp:   eb.EndTimestamp,
+		WrittenAt:      time.Now().UTC(),
+		MarshalTime:    time.Since(start).String(),
+	}
+
+	// Write to GCS. The payload and its signature are a single object, so clients never see one
+	// without the other.
+	err = writeExportFile(ctx, s.writer(), s.bsc.Bucket, s.bsc.DebugBucket, objectName, data, info)
 	if err != nil {
-		return fmt.Errorf("marshalling export file: %v", err)
+		return nil, fmt.Errorf("creating file: %w", err)
+	}
+	if s.bsc.DebugNDJSON && s.bsc.DebugBucket != "" {
+		writeDebugNDJSON(ctx, s.writer(), s.bsc.DebugBucket, objectName, exposureKeys)
 	}
+	return newWrittenExportFile(objectName, data, keyCount, batchCount), nil
+}
 
-	// Write to GCS
-	err = storage.CreateObject(ctx, s.bsc.Bucket, objectName, data)
+// marshalExport formats exposureKeys as the contents of file batchCount of eb for region.
+func (s *BatchServer) marshalExport(eb model.ExportBatch, exposureKeys []*model.Infection, region string, batchCount int) ([]byte, error) {
+	if region == "" {
+		region = "US"
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if s.bsc.ZipExports {
+		// Batch numbers are 1-based in the signature.
+		signers := activeSigners(s.bsc.Signers, time.Now())
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("no signing key is valid at %v", time.Now().UTC())
+		}
+		data, err = MarshalExportZip(eb.StartTimestamp, eb.EndTimestamp, exposureKeys, region, s.bsc.formatVersion(), batchCount+1, signers...)
+	} else {
+		data, err = MarshalExportFile(eb.StartTimestamp, eb.EndTimestamp, exposureKeys, region, s.bsc.formatVersion())
+	}
 	if err != nil {
-		return fmt.Errorf("creating file: %v", err)
+		return nil, fmt.Errorf("marshalling export file: %v", err)
 	}
-	return nil
+	return data, nil
 }
 
-func NewTestExportHandler(db *database.DB) http.Handler {
-	return &testExportHandler{db: db}
+// NewTestExportHandler returns a handler that writes a test export file in the format version
+// requested by the format-version parameter, handling unknown versions according to policy.
+func NewTestExportHandler(db *database.DB, policy FormatVersionPolicy) http.Handler {
+	return &testExportHandler{db: db, formatPolicy: policy}
 }
 
 type testExportHandler struct {
-	db *database.DB
+	db           *database.DB
+	formatPolicy FormatVersionPolicy
 }
 
 func (h *testExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logging.FromContext(ctx)
 
+	formatVersion, err := negotiateFormatVersion(r.URL.Query().Get(formatVersionParam), h.formatPolicy)
+	if err != nil {
+		var unsupported *UnsupportedFormatVersionError
+		if errors.As(err, &unsupported) {
+			if err := writeFormatVersionError(w, unsupported); err != nil {
+				logger.Errorf("error writing format version response: %v", err)
+			}
+			return
+		}
+		logger.Errorf("error negotiating format version: %v", err)
+		http.Error(w, "bad API request", http.StatusBadRequest)
+		return
+	}
+
 	limit := 30000
 	limits, ok := r.URL.Query()["limit"]
 	if ok && len(limits) > 0 {
@@ -363,7 +781,7 @@ func (h *testExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logger.Errorf("error getting infections: %v", err)
 		http.Error(w, "internal processing error", http.StatusInternalServerError)
 	}
-	data, err := MarshalExportFile(since, until, exposureKeys, "US")
+	data, err := MarshalExportFile(since, until, exposureKeys, "US", formatVersion)
 	if err != nil {
 		logger.Errorf("error marshalling export file: %v", err)
 		http.Error(w, "internal processing error", http.StatusInternalServerError)
@@ -0,0 +1,372 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+	"github.com/googlepartners/exposure-notifications/internal/storage"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	compactWindowParam   = "window"
+	defaultCompactWindow = oneDay
+
+	// compactedFilenameMarker, followed by the end of the merged batch, is appended to the names
+	// of merged files, so that they never take the name of a file of a batch they replace.
+	compactedFilenameMarker = "-compacted-"
+)
+
+// existingFilesFn returns those of filenames that already name an export file.
+type existingFilesFn func(ctx context.Context, filenames []string) ([]string, error)
+
+// CompactBatchesHandler merges the completed batches of the most recent full window (the
+// "window" query parameter, one day by default) into a single batch per export config.
+func (s *BatchServer) CompactBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.bsc.CreateTimeout)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+
+	window := defaultCompactWindow
+	if v := r.URL.Query().Get(compactWindowParam); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid %s %q", compactWindowParam, v), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	// Compaction replaces batches, so it must not run alongside batch creation.
+	unlockFn, err := s.db.Lock(ctx, createBatchesLock, s.bsc.CreateTimeout)
+	if err != nil {
+		if err == database.ErrAlreadyLocked {
+			msg := fmt.Sprintf("Lock %s already in use. No work will be performed.", createBatchesLock)
+			logger.Infof(msg)
+			w.Write([]byte(msg)) // We return status 200 here so that Cloud Scheduler does not retry.
+			return
+		}
+		logger.Errorf("Could not acquire lock %s: %v", createBatchesLock, err)
+		http.Error(w, fmt.Sprintf("Could not acquire lock %s, check logs.", createBatchesLock), http.StatusInternalServerError)
+		return
+	}
+	defer unlockFn()
+
+	n, err := s.CompactBatches(ctx, window)
+	if err != nil {
+		logger.Errorf("Failed to compact batches: %v", err)
+		http.Error(w, "Failed to compact batches, check logs.", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Compacted %d batch(es)", n)
+}
+
+// CompactBatches merges the completed batches of each export config in the most recent full
+// window into a single batch. The files of the new batch are rebuilt from those of the
+// originals: each region, report type and revocation list keeps its own stream of files, holding
+// the de-duplicated keys of the original files of that stream in at most MaxRecords keys each.
+// The merged files get names of their own, and compaction fails rather than overwrite any
+// existing file, so that no object changes before the new batch and its files replace the
+// originals in a single transaction, after which the original files are removed from storage. With LatestPointer, the latest pointer is first moved
+// to the new batch, unless it names a later batch. It returns the number of batches replaced. The caller
+// must hold the batch creation lock.
+func (s *BatchServer) CompactBatches(ctx context.Context, window time.Duration) (int, error) {
+	logger := logging.FromContext(ctx)
+
+	until := time.Now().UTC().Truncate(window)
+	since := until.Add(-window)
+	batches, err := s.db.ListCompletedBatches(ctx, since, until)
+	if err != nil {
+		return 0, fmt.Errorf("listing completed batches: %v", err)
+	}
+
+	compacted := 0
+	for _, group := range groupBatchesByConfig(batches) {
+		if len(group) < 2 {
+			continue
+		}
+		if err := s.compactGroup(ctx, group); err != nil {
+			return compacted, fmt.Errorf("compacting batches of config %d: %v", group[0].ConfigID, err)
+		}
+		compacted += len(group)
+		logger.Infof("Compacted %d batch(es) of config %d between %v and %v.", len(group), group[0].ConfigID, since, until)
+	}
+	return compacted, nil
+}
+
+func (s *BatchServer) compactGroup(ctx context.Context, group []*model.ExportBatch) error {
+	logger := logging.FromContext(ctx)
+
+	merged := &model.ExportBatch{
+		ConfigID:       group[0].ConfigID,
+		FilenameRoot:   group[0].FilenameRoot,
+		StartTimestamp: group[0].StartTimestamp,
+		EndTimestamp:   group[0].EndTimestamp,
+		IncludeRegions: group[0].IncludeRegions,
+		ExcludeRegions: group[0].ExcludeRegions,
+	}
+	var (
+		ids      []int64
+		oldFiles []*model.ExportFile
+	)
+	for _, eb := range group {
+		if eb.StartTimestamp.Before(merged.StartTimestamp) {
+			merged.StartTimestamp = eb.StartTimestamp
+		}
+		if eb.EndTimestamp.After(merged.EndTimestamp) {
+			merged.EndTimestamp = eb.EndTimestamp
+		}
+		ids = append(ids, eb.BatchID)
+
+		files, err := s.db.ListExportFiles(ctx, eb.BatchID)
+		if err != nil {
+			return fmt.Errorf("listing files of batch %d: %v", eb.BatchID, err)
+		}
+		oldFiles = append(oldFiles, files...)
+	}
+
+	files, err := s.compactFiles(ctx, storage.ReadObject, s.writer(), s.db.ExistingExportFiles, *merged, oldFiles)
+	if err != nil {
+		return err
+	}
+	if err := s.db.ReplaceBatches(ctx, ids, merged, files); err != nil {
+		return fmt.Errorf("replacing batches: %v", err)
+	}
+	// The pointer may name one of the originals, so it must move to the merged batch before
+	// their files are deleted. If it cannot, the originals are left in place.
+	if s.bsc.LatestPointer {
+		if err := s.pointLatestAt(ctx, *merged, files); err != nil {
+			logger.Errorf("Not deleting the files of compacted batches %v, the latest pointer may still name them: %v", ids, err)
+			return nil
+		}
+	}
+
+	// The originals are no longer referenced; failing to delete them only leaks storage.
+	for _, f := range oldFiles {
+		if err := storage.DeleteObject(ctx, s.bsc.Bucket, f.Filename); err != nil {
+			logger.Errorf("Failed to delete compacted file %s: %v", f.Filename, err)
+		}
+	}
+	return nil
+}
+
+// compactedStream collects the keys of the original files of one stream: those of a region
+// holding a single report type, or every report type, or the revocation lists of a region.
+type compactedStream struct {
+	region     string
+	reportType *int
+	revocation bool
+	sets       [][]*model.Infection
+}
+
+// compactedStreamKey identifies the stream of f.
+func compactedStreamKey(f *model.ExportFile) string {
+	reportType := ""
+	if f.ReportType != nil {
+		reportType = strconv.Itoa(*f.ReportType)
+	}
+	return fmt.Sprintf("%s/%s/%t", f.Region, reportType, f.Revocation)
+}
+
+// name returns the name of the stream's files in place of a report type; see exportStream.name.
+func (st *compactedStream) name() string {
+	if st.revocation {
+		return revocationStreamName
+	}
+	return (&exportStream{reportType: st.reportType}).name()
+}
+
+// compactFiles writes the files of merged, rebuilt from oldFiles, the files of the batches it
+// replaces, which are read from storage. The keys of the files of each stream are merged into a
+// stream of files of merged with the same region, report type and kind, so that merged holds
+// exactly the keys its originals were exported with. Nothing is written if the name of a merged
+// file is already used by one of oldFiles or, according to existing, by any other export file.
+// It returns the files written.
+func (s *BatchServer) compactFiles(ctx context.Context, read objectReader, write objectWriter, existing existingFilesFn, merged model.ExportBatch, oldFiles []*model.ExportFile) ([]*model.ExportFile, error) {
+	streams := make(map[string]*compactedStream)
+	var order []string
+	for _, f := range oldFiles {
+		data, err := read(ctx, s.bsc.Bucket, f.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", f.Filename, err)
+		}
+		keys, err := readExportKeys(data, s.bsc.ZipExports)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", f.Filename, err)
+		}
+		k := compactedStreamKey(f)
+		st, ok := streams[k]
+		if !ok {
+			st = &compactedStream{region: f.Region, reportType: f.ReportType, revocation: f.Revocation}
+			streams[k] = st
+			order = append(order, k)
+		}
+		st.sets = append(st.sets, keys)
+	}
+	sort.Strings(order)
+
+	var (
+		files []*model.ExportFile
+		keys  [][]*model.Infection
+		names []string
+	)
+	for _, k := range order {
+		st := streams[k]
+		chunks := mergeExportKeys(st.sets, s.bsc.MaxRecords)
+		for i, chunk := range chunks {
+			objectName := compactedFilename(s.bsc.FilenameTemplate, merged, st.region, st.name(), i)
+			files = append(files, &model.ExportFile{
+				Filename:   objectName,
+				Region:     st.region,
+				ReportType: st.reportType,
+				Revocation: st.revocation,
+				BatchNum:   i,
+				BatchSize:  len(chunks),
+			})
+			keys = append(keys, chunk)
+			names = append(names, objectName)
+		}
+	}
+
+	taken, err := existing(ctx, names)
+	if err != nil {
+		return nil, fmt.Errorf("checking merged file names: %v", err)
+	}
+	for _, f := range oldFiles {
+		taken = append(taken, f.Filename)
+	}
+	used := make(map[string]bool)
+	for _, name := range taken {
+		used[name] = true
+	}
+	for _, name := range names {
+		if used[name] {
+			return nil, fmt.Errorf("merged file %s would replace an existing export file", name)
+		}
+	}
+
+	for i, f := range files {
+		data, err := s.marshalExport(merged, keys[i], f.Region, f.BatchNum)
+		if err != nil {
+			return nil, err
+		}
+		if err := write(ctx, s.bsc.Bucket, f.Filename, data); err != nil {
+			return nil, fmt.Errorf("creating file: %w", err)
+		}
+	}
+	return files, nil
+}
+
+// compactedFilename names file batchNum of a stream of the merged batch eb: the name the stream
+// would get for eb, marked as compacted with the end of eb. Unmarked, it could be the name of a
+// file of a batch eb replaces, with which eb shares its start or end.
+func compactedFilename(tmpl string, eb model.ExportBatch, region, reportType string, batchNum int) string {
+	return exportStreamFilename(tmpl, eb, region, reportType, batchNum) + compactedFilenameMarker + strconv.FormatInt(eb.EndTimestamp.Unix(), 10)
+}
+
+// readExportKeys returns the keys held by an export file as marshalExport writes it, zipped or
+// not. Signatures are not checked. Only the fields the file's format carries are set.
+func readExportKeys(data []byte, zipped bool) ([]*model.Infection, error) {
+	// Unzipped files have no signature yet, so they are the bare contents; see sign.
+	contents := data
+	if zipped {
+		bin, _, err := readExportZip(data)
+		if err != nil {
+			return nil, err
+		}
+		if contents, err = exportBinaryContents(bin); err != nil {
+			return nil, err
+		}
+	}
+	var export pb.ExposureKeyExport
+	if err := proto.Unmarshal(contents, &export); err != nil {
+		return nil, fmt.Errorf("decoding keys: %v", err)
+	}
+
+	keys := make([]*model.Infection, 0, len(export.Keys))
+	for _, k := range export.Keys {
+		inf := &model.Infection{
+			ExposureKey:      k.ExposureKey,
+			IntervalNumber:   k.IntervalNumber,
+			IntervalCount:    k.IntervalCount,
+			ReportType:       int(k.ReportType),
+			TransmissionRisk: int(k.TransmissionRisk),
+		}
+		if k.SymptomOnset != nil {
+			days := k.GetDaysSinceOnsetOfSymptoms()
+			inf.DaysSinceOnsetOfSymptoms = &days
+		}
+		keys = append(keys, inf)
+	}
+	return keys, nil
+}
+
+// groupBatchesByConfig splits batches, which must be ordered by config, into runs sharing a config.
+func groupBatchesByConfig(batches []*model.ExportBatch) [][]*model.ExportBatch {
+	var groups [][]*model.ExportBatch
+	for i, eb := range batches {
+		if i == 0 || eb.ConfigID != batches[i-1].ConfigID {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], eb)
+	}
+	return groups
+}
+
+// mergeExportKeys returns the union of sets, without duplicate exposure keys, ordered by
+// creation time and split into chunks of at most maxRecords keys. The first occurrence of a
+// duplicated key wins. A maxRecords of zero or less puts all keys in a single chunk. There is
+// always at least one, possibly empty, chunk.
+func mergeExportKeys(sets [][]*model.Infection, maxRecords int) [][]*model.Infection {
+	seen := make(map[string]struct{})
+	var keys []*model.Infection
+	for _, set := range sets {
+		for _, inf := range set {
+			k := string(inf.ExposureKey)
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			keys = append(keys, inf)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	if maxRecords <= 0 || len(keys) <= maxRecords {
+		return [][]*model.Infection{keys}
+	}
+	var chunks [][]*model.Infection
+	for len(keys) > maxRecords {
+		chunks = append(chunks, keys[:maxRecords])
+		keys = keys[maxRecords:]
+	}
+	if len(keys) > 0 {
+		chunks = append(chunks, keys)
+	}
+	return chunks
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+func TestMergeExportKeys(t *testing.T) {
+	base := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	key := func(k string, minutes int) *model.Infection {
+		return &model.Infection{ExposureKey: []byte(k), CreatedAt: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+	a, b, c, d, e := key("a", 1), key("b", 2), key("c", 3), key("d", 4), key("e", 5)
+
+	testCases := []struct {
+		name       string
+		sets       [][]*model.Infection
+		maxRecords int
+		want       [][]*model.Infection
+	}{
+		{
+			name: "no keys",
+			want: [][]*model.Infection{nil},
+		},
+		{
+			name: "union in creation order",
+			sets: [][]*model.Infection{{c, d}, {a, b}, {e}},
+			want: [][]*model.Infection{{a, b, c, d, e}},
+		},
+		{
+			name: "duplicates removed",
+			sets: [][]*model.Infection{{a, b, c}, {b, c, d}, {a, e}},
+			want: [][]*model.Infection{{a, b, c, d, e}},
+		},
+		{
+			name:       "split at max records",
+			sets:       [][]*model.Infection{{a, b}, {c, d}, {e, a}},
+			maxRecords: 2,
+			want:       [][]*model.Infection{{a, b}, {c, d}, {e}},
+		},
+		{
+			name:       "exactly max records",
+			sets:       [][]*model.Infection{{a, b}, {c, d}},
+			maxRecords: 4,
+			want:       [][]*model.Infection{{a, b, c, d}},
+		},
+		{
+			name:       "first duplicate wins",
+			sets:       [][]*model.Infection{{key("a", 9)}, {key("a", 1), b}},
+			maxRecords: 10,
+			want:       [][]*model.Infection{{b, key("a", 9)}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeExportKeys(tc.sets, tc.maxRecords)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("mergeExportKeys mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupBatchesByConfig(t *testing.T) {
+	b1 := &model.ExportBatch{BatchID: 1, ConfigID: 1}
+	b2 := &model.ExportBatch{BatchID: 2, ConfigID: 1}
+	b3 := &model.ExportBatch{BatchID: 3, ConfigID: 2}
+	b4 := &model.ExportBatch{BatchID: 4, ConfigID: 3}
+	b5 := &model.ExportBatch{BatchID: 5, ConfigID: 3}
+
+	got := groupBatchesByConfig([]*model.ExportBatch{b1, b2, b3, b4, b5})
+	want := [][]*model.ExportBatch{{b1, b2}, {b3}, {b4, b5}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("groupBatchesByConfig mismatch (-want +got):\n%s", diff)
+	}
+	if got := groupBatchesByConfig(nil); got != nil {
+		t.Errorf("groupBatchesByConfig(nil) = %v, want nil", got)
+	}
+}
+
+func TestCompactFiles(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer := &ExportSigner{Key: key, KeyID: "310", KeyVersion: "v1"}
+
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	b1 := model.ExportBatch{BatchID: 1, FilenameRoot: "exports/", StartTimestamp: start, EndTimestamp: start.Add(time.Hour)}
+	b2 := model.ExportBatch{BatchID: 2, FilenameRoot: "exports/", StartTimestamp: start.Add(time.Hour), EndTimestamp: start.Add(2 * time.Hour)}
+	merged := model.ExportBatch{FilenameRoot: "exports/", StartTimestamp: b1.StartTimestamp, EndTimestamp: b2.EndTimestamp}
+
+	inf := func(k string, reportType int) *model.Infection {
+		return &model.Infection{ExposureKey: []byte(k), IntervalNumber: 1, IntervalCount: 144, ReportType: reportType, TransmissionRisk: 4}
+	}
+	confirmed, self, revoked := model.ReportTypeConfirmedTest, model.ReportTypeSelfReport, model.ReportTypeRevoked
+
+	// stream identifies a stream of files in the expectations.
+	type stream struct {
+		region     string
+		reportType int
+		revocation bool
+	}
+	type original struct {
+		eb   model.ExportBatch
+		s    stream
+		keys []*model.Infection
+	}
+	originals := []original{
+		{b1, stream{"US", confirmed, false}, []*model.Infection{inf("a", confirmed)}},
+		{b1, stream{"US", self, false}, []*model.Infection{inf("b", self)}},
+		{b1, stream{"CA", confirmed, false}, []*model.Infection{inf("c", confirmed)}},
+		{b1, stream{"US", revoked, true}, []*model.Infection{inf("r", revoked)}},
+		{b2, stream{"US", confirmed, false}, []*model.Infection{inf("d", confirmed), inf("a", confirmed)}},
+		{b2, stream{"CA", confirmed, false}, []*model.Infection{inf("e", confirmed)}},
+	}
+	want := map[stream][]*model.Infection{
+		{"CA", confirmed, false}: {inf("c", confirmed), inf("e", confirmed)},
+		{"US", confirmed, false}: {inf("a", confirmed), inf("d", confirmed)},
+		{"US", self, false}:      {inf("b", self)},
+		{"US", revoked, true}:    {inf("r", revoked)},
+	}
+
+	for _, zipped := range []bool{false, true} {
+		s := &BatchServer{bsc: BatchServerConfig{Bucket: "bucket", FormatVersion: ExportFormatV4, ZipExports: zipped, Signers: []*ExportSigner{signer}}}
+		store := newFakeObjectStore()
+		var oldFiles []*model.ExportFile
+		for _, o := range originals {
+			name := "exports/" + o.s.region
+			if o.s.revocation {
+				name += "-revocations"
+			}
+			name += "-" + reportTypeNames[o.s.reportType] + "-" + o.eb.StartTimestamp.Format("15")
+			data, err := s.marshalExport(o.eb, o.keys, o.s.region, 0)
+			if err != nil {
+				t.Fatalf("marshalExport: %v", err)
+			}
+			store.put("bucket", name, data)
+			reportType := o.s.reportType
+			oldFiles = append(oldFiles, &model.ExportFile{Filename: name, BatchID: o.eb.BatchID, Region: o.s.region, ReportType: &reportType, Revocation: o.s.revocation, BatchSize: 1})
+		}
+
+		files, err := s.compactFiles(context.Background(), store.read, store.write, noExistingFiles, merged, oldFiles)
+		if err != nil {
+			t.Fatalf("zipped %t: compactFiles returned unexpected error: %v", zipped, err)
+		}
+		got := make(map[stream][]*model.Infection)
+		for _, f := range files {
+			if f.ReportType == nil {
+				t.Fatalf("zipped %t: merged file %s has no report type", zipped, f.Filename)
+			}
+			name := reportTypeNames[*f.ReportType]
+			if f.Revocation {
+				name = revocationStreamName
+			}
+			if want := compactedFilename("", merged, f.Region, name, f.BatchNum); f.Filename != want {
+				t.Errorf("zipped %t: merged file named %s, want %s", zipped, f.Filename, want)
+			}
+			data, err := store.read(context.Background(), "bucket", f.Filename)
+			if err != nil {
+				t.Fatalf("zipped %t: reading merged file: %v", zipped, err)
+			}
+			keys, err := readExportKeys(data, zipped)
+			if err != nil {
+				t.Fatalf("zipped %t: readExportKeys: %v", zipped, err)
+			}
+			sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i].ExposureKey, keys[j].ExposureKey) < 0 })
+			got[stream{f.Region, *f.ReportType, f.Revocation}] = keys
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("zipped %t: merged streams mismatch (-want +got):\n%s", zipped, diff)
+		}
+	}
+
+	// A file that cannot be read fails the compaction rather than losing its keys.
+	s := &BatchServer{bsc: BatchServerConfig{Bucket: "bucket"}}
+	missing := []*model.ExportFile{{Filename: "exports/missing", BatchID: 1}}
+	if _, err := s.compactFiles(context.Background(), newFakeObjectStore().read, newFakeObjectStore().write, noExistingFiles, merged, missing); err == nil {
+		t.Errorf("compactFiles of a missing file returned no error")
+	}
+}
+
+// noExistingFiles is an existingFilesFn for a database without export files.
+func noExistingFiles(context.Context, []string) ([]string, error) {
+	return nil, nil
+}
+
+// TestCompactFilesNameCollision tests that compaction writes nothing when the name of a merged
+// file is already taken, rather than change a file clients may have downloaded.
+func TestCompactFilesNameCollision(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	b1 := model.ExportBatch{BatchID: 1, FilenameRoot: "exports/", StartTimestamp: start, EndTimestamp: start.Add(time.Hour)}
+	b2 := model.ExportBatch{BatchID: 2, FilenameRoot: "exports/", StartTimestamp: start.Add(time.Hour), EndTimestamp: start.Add(2 * time.Hour)}
+	merged := model.ExportBatch{FilenameRoot: "exports/", StartTimestamp: b1.StartTimestamp, EndTimestamp: b2.EndTimestamp}
+	mergedName := compactedFilename("", merged, "", "", 0)
+
+	s := &BatchServer{bsc: BatchServerConfig{Bucket: "bucket"}}
+	setup := func(t *testing.T, names ...string) (*fakeObjectStore, []*model.ExportFile) {
+		store := newFakeObjectStore()
+		var oldFiles []*model.ExportFile
+		for i, eb := range []model.ExportBatch{b1, b2} {
+			data, err := s.marshalExport(eb, []*model.Infection{{ExposureKey: []byte{byte(i)}, IntervalNumber: 1, IntervalCount: 144}}, "", 0)
+			if err != nil {
+				t.Fatalf("marshalExport: %v", err)
+			}
+			store.put("bucket", names[i], data)
+			oldFiles = append(oldFiles, &model.ExportFile{Filename: names[i], BatchID: eb.BatchID, BatchSize: 1})
+		}
+		return store, oldFiles
+	}
+
+	testCases := []struct {
+		name     string
+		oldNames []string
+		existing []string
+	}{
+		{name: "merged name of an original", oldNames: []string{mergedName, exportFilename("", b2, 0)}},
+		{name: "merged name of another file", oldNames: []string{exportFilename("", b1, 0), exportFilename("", b2, 0)}, existing: []string{mergedName}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store, oldFiles := setup(t, tc.oldNames...)
+			before := make(map[string][]byte)
+			for name, data := range store.objects["bucket"] {
+				before[name] = data
+			}
+			existing := func(ctx context.Context, filenames []string) ([]string, error) {
+				return tc.existing, nil
+			}
+
+			if _, err := s.compactFiles(context.Background(), store.read, store.write, existing, merged, oldFiles); err == nil {
+				t.Fatal("compactFiles succeeded, want error")
+			}
+			if diff := cmp.Diff(before, store.objects["bucket"]); diff != "" {
+				t.Errorf("compactFiles changed the stored objects (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// The default names of the files of the first original and of the merged batch only differ by
+	// the compaction marker.
+	store, oldFiles := setup(t, exportFilename("", b1, 0), exportFilename("", b2, 0))
+	files, err := s.compactFiles(context.Background(), store.read, store.write, noExistingFiles, merged, oldFiles)
+	if err != nil {
+		t.Fatalf("compactFiles returned unexpected error: %v", err)
+	}
+	if len(files) != 1 || files[0].Filename != mergedName {
+		t.Errorf("compactFiles wrote %v, want only %s", files, mergedName)
+	}
+}
+
+// TestCompactFilesKeepsWatermarkKeys tests that compaction keeps a key that a batch exported
+// through the export watermark, although it was created before the compacted window.
+func TestCompactFilesKeepsWatermarkKeys(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	b1 := model.ExportBatch{BatchID: 1, FilenameRoot: "exports/", StartTimestamp: start, EndTimestamp: start.Add(time.Hour)}
+	b2 := model.ExportBatch{BatchID: 2, FilenameRoot: "exports/", StartTimestamp: start.Add(time.Hour), EndTimestamp: start.Add(2 * time.Hour)}
+	merged := model.ExportBatch{FilenameRoot: "exports/", StartTimestamp: b1.StartTimestamp, EndTimestamp: b2.EndTimestamp}
+
+	// The key arrived after the batch before b1 was exported, so b1 read it from the watermark.
+	late := &model.Infection{ExposureKey: []byte("late"), IntervalNumber: 1, IntervalCount: 144, CreatedAt: start.Add(-10 * time.Minute)}
+	watermark := start.Add(-15 * time.Minute)
+	if criteria := infectionsCriteria(b1, "", 0, watermark); !criteria.SinceTimestamp.Before(late.CreatedAt) {
+		t.Fatalf("b1 reads keys since %v, which leaves out the late key", criteria.SinceTimestamp)
+	}
+	onTime := &model.Infection{ExposureKey: []byte("on-time"), IntervalNumber: 1, IntervalCount: 144, CreatedAt: start.Add(90 * time.Minute)}
+
+	s := &BatchServer{bsc: BatchServerConfig{Bucket: "bucket"}}
+	store := newFakeObjectStore()
+	var oldFiles []*model.ExportFile
+	for _, f := range []struct {
+		eb   model.ExportBatch
+		keys []*model.Infection
+	}{{b1, []*model.Infection{late}}, {b2, []*model.Infection{onTime}}} {
+		name := exportFilename("", f.eb, 0)
+		data, err := s.marshalExport(f.eb, f.keys, "", 0)
+		if err != nil {
+			t.Fatalf("marshalExport: %v", err)
+		}
+		store.put("bucket", name, data)
+		oldFiles = append(oldFiles, &model.ExportFile{Filename: name, BatchID: f.eb.BatchID, BatchSize: 1})
+	}
+
+	files, err := s.compactFiles(context.Background(), store.read, store.write, noExistingFiles, merged, oldFiles)
+	if err != nil {
+		t.Fatalf("compactFiles returned unexpected error: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("compactFiles wrote %d files, want 1", len(files))
+	}
+	data, err := store.read(context.Background(), "bucket", files[0].Filename)
+	if err != nil {
+		t.Fatalf("reading merged file: %v", err)
+	}
+	keys, err := readExportKeys(data, false)
+	if err != nil {
+		t.Fatalf("readExportKeys: %v", err)
+	}
+	var got []string
+	for _, k := range keys {
+		got = append(got, string(k.ExposureKey))
+	}
+	if diff := cmp.Diff([]string{"late", "on-time"}, got); diff != "" {
+		t.Errorf("merged keys mismatch (-want +got):\n%s", diff)
+	}
+}
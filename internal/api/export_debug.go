@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// debugInfoExtension is appended to the name of an export file to name the sidecar describing
+// its debug copy.
+const debugInfoExtension = ".debug.json"
+
+// objectWriter creates a storage object with the given contents.
+type objectWriter func(ctx context.Context, bucket, objectName string, contents []byte) error
+
+// exportDebugInfo describes how an export file was produced. It is written next to the debug
+// copy of the file.
+type exportDebugInfo struct {
+	BatchID        int64     `json:"batchID"`
+	Filename       string    `json:"filename"`
+	Region         string    `json:"region,omitempty"`
+	ReportType     *int      `json:"reportType,omitempty"`
+	BatchNum       int       `json:"batchNum"`
+	Keys           int       `json:"keys"`
+	StartTimestamp time.Time `json:"startTimestamp"`
+	EndTimestamp   time.Time `json:"endTimestamp"`
+	WrittenAt      time.Time `json:"writtenAt"`
+	MarshalTime    string    `json:"marshalTime"`
+}
+
+// writeExportFile writes data to objectName in bucket. If debugBucket is set, the file and a
+// sidecar holding info are also written to debugBucket. Only the write to bucket can fail the
+// export; failures writing the debug copy are logged.
+func writeExportFile(ctx context.Context, write objectWriter, bucket, debugBucket, objectName string, data []byte, info *exportDebugInfo) error {
+	if err := write(ctx, bucket, objectName, data); err != nil {
+		return err
+	}
+	if debugBucket == "" {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx)
+	if err := write(ctx, debugBucket, objectName, data); err != nil {
+		logger.Warnf("Failed to write debug copy of %s to %s: %v", objectName, debugBucket, err)
+		return nil
+	}
+	sidecar, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		logger.Warnf("Failed to encode debug info for %s: %v", objectName, err)
+		return nil
+	}
+	if err := write(ctx, debugBucket, objectName+debugInfoExtension, sidecar); err != nil {
+		logger.Warnf("Failed to write debug info for %s to %s: %v", objectName, debugBucket, err)
+	}
+	return nil
+}
+
+// writeDebugNDJSON writes exposureKeys as NDJSON to objectName plus ndjsonExtension in
+// debugBucket. Like the debug copy written by writeExportFile, it never fails the export;
+// failures are logged.
+func writeDebugNDJSON(ctx context.Context, write objectWriter, debugBucket, objectName string, exposureKeys []*model.Infection) {
+	logger := logging.FromContext(ctx)
+	data, err := MarshalExportNDJSON(exposureKeys)
+	if err != nil {
+		logger.Warnf("Failed to marshal NDJSON copy of %s: %v", objectName, err)
+		return
+	}
+	if err := write(ctx, debugBucket, objectName+ndjsonExtension, data); err != nil {
+		logger.Warnf("Failed to write NDJSON copy of %s to %s: %v", objectName, debugBucket, err)
+	}
+}
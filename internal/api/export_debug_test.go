@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+func TestWriteExportFile(t *testing.T) {
+	data := []byte("export contents")
+	info := &exportDebugInfo{BatchID: 7, Filename: "file-1.zip", BatchNum: 1, Keys: 3}
+	wantProduction := map[string][]byte{"file-1.zip": data}
+
+	testCases := []struct {
+		name        string
+		debugBucket string
+		fail        string
+		wantErr     bool
+		wantDebug   bool
+	}{
+		{name: "no debug bucket"},
+		{name: "debug copy", debugBucket: "debug", wantDebug: true},
+		{name: "debug write fails", debugBucket: "debug", fail: "debug"},
+		{name: "production write fails", debugBucket: "debug", fail: "prod", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buckets := newFakeObjectStore()
+			buckets.fail = map[string]bool{tc.fail: true}
+			err := writeExportFile(context.Background(), buckets.write, "prod", tc.debugBucket, "file-1.zip", data, info)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("writeExportFile succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("writeExportFile returned unexpected error: %v", err)
+			}
+
+			// The production bucket holds only the export file, whatever happens to the debug copy.
+			if diff := cmp.Diff(wantProduction, buckets.objects["prod"]); diff != "" {
+				t.Errorf("production objects mismatch (-want +got):\n%s", diff)
+			}
+
+			debug := buckets.objects["debug"]
+			if !tc.wantDebug {
+				if len(debug) != 0 {
+					t.Errorf("debug bucket holds %d objects, want none", len(debug))
+				}
+				return
+			}
+			if diff := cmp.Diff(data, debug["file-1.zip"]); diff != "" {
+				t.Errorf("debug copy mismatch (-want +got):\n%s", diff)
+			}
+			var got exportDebugInfo
+			if err := json.Unmarshal(debug["file-1.zip"+debugInfoExtension], &got); err != nil {
+				t.Fatalf("decoding debug info: %v", err)
+			}
+			if diff := cmp.Diff(*info, got); diff != "" {
+				t.Errorf("debug info mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteDebugNDJSON(t *testing.T) {
+	keys := []*model.Infection{{ExposureKey: []byte("ABC"), IntervalNumber: 100, IntervalCount: 144}}
+	want, err := MarshalExportNDJSON(keys)
+	if err != nil {
+		t.Fatalf("MarshalExportNDJSON returned unexpected error: %v", err)
+	}
+
+	buckets := newFakeObjectStore()
+	writeDebugNDJSON(context.Background(), buckets.write, "debug", "file-1.zip", keys)
+	if diff := cmp.Diff(map[string][]byte{"file-1.zip" + ndjsonExtension: want}, buckets.objects["debug"]); diff != "" {
+		t.Errorf("debug objects mismatch (-want +got):\n%s", diff)
+	}
+
+	// A failed write is logged, not returned.
+	buckets = newFakeObjectStore()
+	buckets.fail = map[string]bool{"debug": true}
+	writeDebugNDJSON(context.Background(), buckets.write, "debug", "file-1.zip", keys)
+	if len(buckets.objects) != 0 {
+		t.Errorf("store holds %d buckets after a failed write, want none", len(buckets.objects))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// reversedKeys returns a copy of exposureKeys in reverse order, so that marshalling it again
+// exposes any dependence on the order keys were read in.
+func reversedKeys(exposureKeys []*model.Infection) []*model.Infection {
+	reversed := make([]*model.Infection, len(exposureKeys))
+	for i, k := range exposureKeys {
+		reversed[len(exposureKeys)-1-i] = k
+	}
+	return reversed
+}
+
+// checkExportDeterminism returns an error if first and second, two exports of the same keys,
+// differ. ECDSA signatures are randomized, so the signatures of zips are not compared, but
+// everything they sign and describe is.
+func checkExportDeterminism(first, second []byte, zipped bool) error {
+	if !zipped {
+		if !bytes.Equal(first, second) {
+			return fmt.Errorf("export files differ")
+		}
+		return nil
+	}
+	a, err := readZipMembers(first)
+	if err != nil {
+		return err
+	}
+	b, err := readZipMembers(second)
+	if err != nil {
+		return err
+	}
+	if len(a) != len(b) {
+		return fmt.Errorf("zips hold %d and %d files", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].name != b[i].name {
+			return fmt.Errorf("zip file %d is named %s and %s", i, a[i].name, b[i].name)
+		}
+		data, other := a[i].data, b[i].data
+		if a[i].name == exportSignatureName {
+			if data, err = unsignedSignatureList(data); err != nil {
+				return err
+			}
+			if other, err = unsignedSignatureList(other); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(data, other) {
+			return fmt.Errorf("%s differs", a[i].name)
+		}
+	}
+	return nil
+}
+
+type zipMember struct {
+	name string
+	data []byte
+}
+
+// readZipMembers returns the files in a zip, in order. Files carrying a modification time are
+// rejected, as it would tie the zip to the wall clock.
+func readZipMembers(data []byte) ([]zipMember, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("opening zip: %v", err)
+	}
+	members := make([]zipMember, 0, len(zr.File))
+	for _, zf := range zr.File {
+		// The reader reports an unset MS-DOS time as 1979-11-30, so check the raw fields.
+		if zf.ModifiedDate != 0 || zf.ModifiedTime != 0 {
+			return nil, fmt.Errorf("%s has modification time %v", zf.Name, zf.Modified)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %v", zf.Name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", zf.Name, err)
+		}
+		members = append(members, zipMember{name: zf.Name, data: b})
+	}
+	return members, nil
+}
+
+// unsignedSignatureList returns a serialized TEKSignatureList with the signatures removed.
+func unsignedSignatureList(data []byte) ([]byte, error) {
+	var sigList pb.TEKSignatureList
+	if err := proto.Unmarshal(data, &sigList); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", exportSignatureName, err)
+	}
+	for _, sig := range sigList.Signatures {
+		sig.Signature = nil
+	}
+	return proto.Marshal(&sigList)
+}
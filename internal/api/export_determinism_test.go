@@ -0,0 +1,161 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TestExportDeterminism tests that exporting the same keys twice, read in a different order and
+// with a key stored once per region, produces the same export.
+func TestExportDeterminism(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer := &ExportSigner{Key: key, KeyID: "310", KeyVersion: "v1"}
+
+	since := time.Unix(1587340800, 0).UTC()
+	until := since.Add(24 * time.Hour)
+	onset := int32(2)
+	keys := []*model.Infection{
+		{ExposureKey: []byte("DEF"), IntervalNumber: 100, Regions: []string{"US"}},
+		{ExposureKey: []byte("ABC"), IntervalNumber: 200, DaysSinceOnsetOfSymptoms: &onset},
+		{ExposureKey: []byte("ABC"), IntervalNumber: 100},
+		{ExposureKey: []byte("DEF"), IntervalNumber: 100, Regions: []string{"CA"}},
+	}
+
+	testCases := []struct {
+		name    string
+		zipped  bool
+		marshal func(keys []*model.Infection) ([]byte, error)
+	}{
+		{
+			name: "file",
+			marshal: func(keys []*model.Infection) ([]byte, error) {
+				return MarshalExportFile(since, until, keys, "US", ExportFormatV3)
+			},
+		},
+		{
+			name:   "zip",
+			zipped: true,
+			marshal: func(keys []*model.Infection) ([]byte, error) {
+				return MarshalExportZip(since, until, keys, "US", ExportFormatV3, 1, signer)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			first, err := tc.marshal(keys)
+			if err != nil {
+				t.Fatalf("first export returned unexpected error: %v", err)
+			}
+			second, err := tc.marshal(reversedKeys(keys))
+			if err != nil {
+				t.Fatalf("second export returned unexpected error: %v", err)
+			}
+			if err := checkExportDeterminism(first, second, tc.zipped); err != nil {
+				t.Errorf("exports differ: %v", err)
+			}
+		})
+	}
+
+	// The duplicate DEF row is exported once.
+	if got := len(exportKeys(keys, ExportFormatV3)); got != 3 {
+		t.Errorf("exportKeys returned %d keys, want 3", got)
+	}
+}
+
+// TestCheckExportDeterminism tests that checkExportDeterminism() reports differing exports.
+func TestCheckExportDeterminism(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer := &ExportSigner{Key: key, KeyID: "310", KeyVersion: "v1"}
+	since := time.Unix(1587340800, 0).UTC()
+	until := since.Add(24 * time.Hour)
+	keys := []*model.Infection{{ExposureKey: []byte("ABC")}}
+	other := []*model.Infection{{ExposureKey: []byte("DEF")}}
+
+	zipOf := func(keys []*model.Infection, batchNum int) []byte {
+		t.Helper()
+		b, err := MarshalExportZip(since, until, keys, "US", ExportFormatV1, batchNum, signer)
+		if err != nil {
+			t.Fatalf("MarshalExportZip returned unexpected error: %v", err)
+		}
+		return b
+	}
+	fileOf := func(keys []*model.Infection) []byte {
+		t.Helper()
+		b, err := MarshalExportFile(since, until, keys, "US", ExportFormatV1)
+		if err != nil {
+			t.Fatalf("MarshalExportFile returned unexpected error: %v", err)
+		}
+		return b
+	}
+
+	// A zip with a modification time, as written by zip.Writer.Create with a clock.
+	var timestamped bytes.Buffer
+	zw := zip.NewWriter(&timestamped)
+	for _, name := range []string{exportBinaryName, exportSignatureName} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			t.Fatalf("adding %s to zip: %v", name, err)
+		}
+		sigList, err := proto.Marshal(&pb.TEKSignatureList{})
+		if err != nil {
+			t.Fatalf("marshalling signature list: %v", err)
+		}
+		w.Write(sigList)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing zip: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		first, second []byte
+		zipped        bool
+		wantErr       bool
+	}{
+		{name: "same file", first: fileOf(keys), second: fileOf(keys)},
+		{name: "different file", first: fileOf(keys), second: fileOf(other), wantErr: true},
+		{name: "same zip", first: zipOf(keys, 1), second: zipOf(keys, 1), zipped: true},
+		{name: "different keys", first: zipOf(keys, 1), second: zipOf(other, 1), zipped: true, wantErr: true},
+		{name: "different batch", first: zipOf(keys, 1), second: zipOf(keys, 2), zipped: true, wantErr: true},
+		{name: "modification time", first: timestamped.Bytes(), second: timestamped.Bytes(), zipped: true, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkExportDeterminism(tc.first, tc.second, tc.zipped)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkExportDeterminism returned error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ package api
 import (
 	"bytes"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/model"
@@ -26,8 +27,34 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
-func MarshalExportFile(since, until time.Time, exposureKeys []*model.Infection, region string) ([]byte, error) {
-	contents, err := marshalContents(since, until, exposureKeys, region)
+const (
+	// ExportFormatV1 is the original export file format.
+	ExportFormatV1 = 1
+	// ExportFormatV2 adds the report type of each key.
+	ExportFormatV2 = 2
+	// ExportFormatV3 adds the days since onset of symptoms of each key, when known.
+	ExportFormatV3 = 3
+	// ExportFormatV4 adds the transmission risk of each key.
+	ExportFormatV4 = 4
+
+	// LatestExportFormatVersion is the newest supported export format.
+	LatestExportFormatVersion = ExportFormatV4
+
+	// DefaultExportFormatVersion is the format used when none is configured.
+	DefaultExportFormatVersion = ExportFormatV1
+)
+
+// ValidateExportFormatVersion returns an *UnsupportedFormatVersionError if version is not a
+// supported export format.
+func ValidateExportFormatVersion(version int) error {
+	if version < ExportFormatV1 || version > LatestExportFormatVersion {
+		return &UnsupportedFormatVersionError{Requested: strconv.Itoa(version)}
+	}
+	return nil
+}
+
+func MarshalExportFile(since, until time.Time, exposureKeys []*model.Infection, region string, formatVersion int) ([]byte, error) {
+	contents, err := marshalContents(since, until, exposureKeys, region, formatVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -38,14 +65,18 @@ func MarshalExportFile(since, until time.Time, exposureKeys []*model.Infection,
 	return append(sig, contents...), nil
 }
 
-func marshalContents(since, until time.Time, exposureKeys []*model.Infection, region string) ([]byte, error) {
-	// We want a deterministic ordering so signatures can be generated/verified consistently.
-	// Arbitrarily sorting on the keys themselves.
-	// This could be done at the db layer but doing it here makes it explicit that its
-	// important to the serialization
-	sort.Slice(exposureKeys, func(i, j int) bool {
-		return bytes.Compare(exposureKeys[i].ExposureKey, exposureKeys[j].ExposureKey) < 0
-	})
+func marshalContents(since, until time.Time, exposureKeys []*model.Infection, region string, formatVersion int) ([]byte, error) {
+	batch := pb.ExposureKeyExport{
+		StartTimestamp: since.Unix(),
+		EndTimestamp:   until.Unix(),
+		Region:         region,
+		Keys:           exportKeys(exposureKeys, formatVersion),
+	}
+	return proto.Marshal(&batch)
+}
+
+// exportKeys returns the keys an export file of exposureKeys holds in formatVersion.
+func exportKeys(exposureKeys []*model.Infection, formatVersion int) []*pb.ExposureKeyExport_ExposureKey {
 	var pbeks []*pb.ExposureKeyExport_ExposureKey
 	for _, ek := range exposureKeys {
 		pbek := pb.ExposureKeyExport_ExposureKey{
@@ -53,15 +84,58 @@ func marshalContents(since, until time.Time, exposureKeys []*model.Infection, re
 			IntervalNumber: ek.IntervalNumber,
 			IntervalCount:  ek.IntervalCount,
 		}
+		if formatVersion >= ExportFormatV2 {
+			pbek.ReportType = int32(ek.ReportType)
+		}
+		if formatVersion >= ExportFormatV3 && ek.DaysSinceOnsetOfSymptoms != nil {
+			pbek.SymptomOnset = &pb.ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms{
+				DaysSinceOnsetOfSymptoms: *ek.DaysSinceOnsetOfSymptoms,
+			}
+		}
+		if formatVersion >= ExportFormatV4 {
+			pbek.TransmissionRisk = int32(ek.TransmissionRisk)
+		}
 		pbeks = append(pbeks, &pbek)
 	}
-	batch := pb.ExposureKeyExport{
-		StartTimestamp: since.Unix(),
-		EndTimestamp:   until.Unix(),
-		Region:         region,
-		Keys:           pbeks,
+	return sortExportKeys(pbeks)
+}
+
+// sortExportKeys sorts keys and drops exact duplicates, such as a key stored once per region,
+// so that the same set of keys always serializes to the same bytes and signatures can be
+// generated and verified consistently. This could be done at the db layer but doing it here
+// makes it explicit that it's important to the serialization.
+func sortExportKeys(keys []*pb.ExposureKeyExport_ExposureKey) []*pb.ExposureKeyExport_ExposureKey {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if c := bytes.Compare(a.ExposureKey, b.ExposureKey); c != 0 {
+			return c < 0
+		}
+		if a.IntervalNumber != b.IntervalNumber {
+			return a.IntervalNumber < b.IntervalNumber
+		}
+		if a.IntervalCount != b.IntervalCount {
+			return a.IntervalCount < b.IntervalCount
+		}
+		if a.ReportType != b.ReportType {
+			return a.ReportType < b.ReportType
+		}
+		if a.TransmissionRisk != b.TransmissionRisk {
+			return a.TransmissionRisk < b.TransmissionRisk
+		}
+		// Unknown onsets sort first.
+		if a.SymptomOnset == nil || b.SymptomOnset == nil {
+			return a.SymptomOnset == nil && b.SymptomOnset != nil
+		}
+		return a.GetDaysSinceOnsetOfSymptoms() < b.GetDaysSinceOnsetOfSymptoms()
+	})
+	unique := keys[:0]
+	for i, k := range keys {
+		if i > 0 && proto.Equal(k, keys[i-1]) {
+			continue
+		}
+		unique = append(unique, k)
 	}
-	return proto.Marshal(&batch)
+	return unique
 }
 
 func sign(contents []byte) ([]byte, error) {
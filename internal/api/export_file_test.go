@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TestMarshalContentsDaysSinceOnsetOfSymptoms tests that days since onset of symptoms round-trip
+// through an export file from format version 3 on.
+func TestMarshalContentsDaysSinceOnsetOfSymptoms(t *testing.T) {
+	since := time.Unix(1587340800, 0).UTC()
+	until := since.Add(24 * time.Hour)
+	onsetDay, daysAfter := int32(0), int32(-3)
+
+	testCases := []struct {
+		name    string
+		version int
+		days    *int32
+		wantSet bool
+		want    int32
+	}{
+		{name: "v2 omits", version: ExportFormatV2, days: &daysAfter},
+		{name: "v3 unknown", version: ExportFormatV3, days: nil},
+		{name: "v3 onset day", version: ExportFormatV3, days: &onsetDay, wantSet: true, want: 0},
+		{name: "v3 negative", version: ExportFormatV3, days: &daysAfter, wantSet: true, want: -3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := []*model.Infection{{ExposureKey: []byte("ABC"), DaysSinceOnsetOfSymptoms: tc.days}}
+			b, err := marshalContents(since, until, keys, "US", tc.version)
+			if err != nil {
+				t.Fatalf("marshalContents returned unexpected error: %v", err)
+			}
+			var got pb.ExposureKeyExport
+			if err := proto.Unmarshal(b, &got); err != nil {
+				t.Fatalf("unmarshalling export: %v", err)
+			}
+			if len(got.Keys) != 1 {
+				t.Fatalf("got %d keys, want 1", len(got.Keys))
+			}
+			key := got.Keys[0]
+			if isSet := key.SymptomOnset != nil; isSet != tc.wantSet {
+				t.Fatalf("days since onset set = %v, want %v", isSet, tc.wantSet)
+			}
+			if days := key.GetDaysSinceOnsetOfSymptoms(); days != tc.want {
+				t.Errorf("days since onset = %d, want %d", days, tc.want)
+			}
+		})
+	}
+}
+
+// TestExportKeysTransmissionRisk tests that the transmission risk of a key is only exported from
+// format version 4 on.
+func TestExportKeysTransmissionRisk(t *testing.T) {
+	keys := []*model.Infection{{ExposureKey: []byte("ABC"), TransmissionRisk: 6}}
+
+	testCases := []struct {
+		version int
+		want    int32
+	}{
+		{version: ExportFormatV1},
+		{version: ExportFormatV3},
+		{version: ExportFormatV4, want: 6},
+	}
+
+	for _, tc := range testCases {
+		got := exportKeys(keys, tc.version)
+		if len(got) != 1 {
+			t.Fatalf("v%d: got %d keys, want 1", tc.version, len(got))
+		}
+		if risk := got[0].GetTransmissionRisk(); risk != tc.want {
+			t.Errorf("v%d: transmission risk = %d, want %d", tc.version, risk, tc.want)
+		}
+	}
+}
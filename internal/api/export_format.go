@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// formatVersionParam is the query parameter a client requests an export format version with.
+const formatVersionParam = "format-version"
+
+// SupportedExportFormatVersions returns the export format versions the server can produce, oldest first.
+func SupportedExportFormatVersions() []int {
+	versions := make([]int, 0, LatestExportFormatVersion)
+	for v := ExportFormatV1; v <= LatestExportFormatVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// UnsupportedFormatVersionError is returned for an export format version the server cannot
+// produce. Its message lists the supported versions, so a client can pick one of them.
+type UnsupportedFormatVersionError struct {
+	// Requested is the version as requested, which may not be a number.
+	Requested string
+}
+
+func (e *UnsupportedFormatVersionError) Error() string {
+	return fmt.Sprintf("unsupported export format version %s, supported versions are %s", e.Requested, formatVersionList())
+}
+
+// Supported returns the versions the server can produce instead.
+func (e *UnsupportedFormatVersionError) Supported() []int {
+	return SupportedExportFormatVersions()
+}
+
+func formatVersionList() string {
+	var versions []string
+	for _, v := range SupportedExportFormatVersions() {
+		versions = append(versions, strconv.Itoa(v))
+	}
+	return strings.Join(versions, ", ")
+}
+
+// FormatVersionPolicy controls how a request for an unknown export format version is handled.
+type FormatVersionPolicy string
+
+const (
+	// FormatVersionReject rejects requests for unknown versions, listing the supported ones in
+	// the response. This is the default.
+	FormatVersionReject FormatVersionPolicy = "reject"
+	// FormatVersionDowngrade serves requests for versions newer than the server supports with
+	// LatestExportFormatVersion, which clients must be able to read as a fallback. Other unknown
+	// versions are still rejected.
+	FormatVersionDowngrade FormatVersionPolicy = "downgrade"
+)
+
+// ParseFormatVersionPolicy parses a format version policy name. An empty name selects FormatVersionReject.
+func ParseFormatVersionPolicy(name string) (FormatVersionPolicy, error) {
+	switch p := FormatVersionPolicy(name); p {
+	case "":
+		return FormatVersionReject, nil
+	case FormatVersionReject, FormatVersionDowngrade:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown format version policy %q, must be %q or %q", name, FormatVersionReject, FormatVersionDowngrade)
+	}
+}
+
+// negotiateFormatVersion returns the export format version to serve for the requested one.
+// DefaultExportFormatVersion is served if none is requested. The returned error is an
+// *UnsupportedFormatVersionError if the request cannot be served under policy.
+func negotiateFormatVersion(requested string, policy FormatVersionPolicy) (int, error) {
+	if requested == "" {
+		return DefaultExportFormatVersion, nil
+	}
+	version, err := strconv.Atoi(requested)
+	if err != nil {
+		return 0, &UnsupportedFormatVersionError{Requested: requested}
+	}
+	if policy == FormatVersionDowngrade && version > LatestExportFormatVersion {
+		return LatestExportFormatVersion, nil
+	}
+	if err := ValidateExportFormatVersion(version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// formatVersionErrorResponse is the body of a response rejecting an unknown format version.
+type formatVersionErrorResponse struct {
+	Error     string `json:"error"`
+	Supported []int  `json:"supportedFormatVersions"`
+}
+
+// writeFormatVersionError responds to a request for an unsupported format version with the
+// versions the server supports.
+func writeFormatVersionError(w http.ResponseWriter, err *UnsupportedFormatVersionError) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(&formatVersionErrorResponse{
+		Error:     err.Error(),
+		Supported: err.Supported(),
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNegotiateFormatVersion(t *testing.T) {
+	testCases := []struct {
+		name            string
+		requested       string
+		policy          FormatVersionPolicy
+		want            int
+		wantUnsupported bool
+	}{
+		{name: "default", requested: "", policy: FormatVersionReject, want: DefaultExportFormatVersion},
+		{name: "supported", requested: "2", policy: FormatVersionReject, want: ExportFormatV2},
+		{name: "newer rejected", requested: "9", policy: FormatVersionReject, wantUnsupported: true},
+		{name: "newer downgraded", requested: "9", policy: FormatVersionDowngrade, want: LatestExportFormatVersion},
+		{name: "older rejected", requested: "0", policy: FormatVersionDowngrade, wantUnsupported: true},
+		{name: "not a number", requested: "v2", policy: FormatVersionDowngrade, wantUnsupported: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := negotiateFormatVersion(tc.requested, tc.policy)
+			var unsupported *UnsupportedFormatVersionError
+			if gotUnsupported := errors.As(err, &unsupported); gotUnsupported != tc.wantUnsupported {
+				t.Fatalf("negotiateFormatVersion(%q) returned error %v, want unsupported %t", tc.requested, err, tc.wantUnsupported)
+			}
+			if tc.wantUnsupported {
+				if unsupported.Requested != tc.requested {
+					t.Errorf("error reports requested version %q, want %q", unsupported.Requested, tc.requested)
+				}
+				return
+			}
+			if got != tc.want {
+				t.Errorf("negotiateFormatVersion(%q) = %d, want %d", tc.requested, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteFormatVersionError(t *testing.T) {
+	_, err := negotiateFormatVersion("9", FormatVersionReject)
+	var unsupported *UnsupportedFormatVersionError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("negotiateFormatVersion returned error %v, want an UnsupportedFormatVersionError", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := writeFormatVersionError(w, unsupported); err != nil {
+		t.Fatalf("writeFormatVersionError returned unexpected error: %v", err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("response code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	var got formatVersionErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	want := formatVersionErrorResponse{
+		Error:     "unsupported export format version 9, supported versions are 1, 2, 3, 4",
+		Supported: []int{ExportFormatV1, ExportFormatV2, ExportFormatV3, ExportFormatV4},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("response mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFormatVersionPolicy(t *testing.T) {
+	for name, want := range map[string]FormatVersionPolicy{"": FormatVersionReject, "reject": FormatVersionReject, "downgrade": FormatVersionDowngrade} {
+		if got, err := ParseFormatVersionPolicy(name); err != nil || got != want {
+			t.Errorf("ParseFormatVersionPolicy(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseFormatVersionPolicy("latest"); err == nil {
+		t.Errorf("ParseFormatVersionPolicy(%q) returned no error", "latest")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/storage"
+)
+
+const (
+	// latestPointerName is appended to the filename root of an export config to name its pointer
+	// to the latest complete batch.
+	latestPointerName = "latest.json"
+
+	// latestPointerLockTTL bounds how long updating a pointer holds its lock.
+	latestPointerLockTTL = time.Minute
+)
+
+// latestPointer is the contents of the object naming the latest complete batch of an export
+// config, so that clients can find the newest files by fetching a single well-known object
+// instead of listing the bucket.
+type latestPointer struct {
+	BatchID        int64     `json:"batchID"`
+	StartTimestamp time.Time `json:"startTimestamp"`
+	EndTimestamp   time.Time `json:"endTimestamp"`
+	// Files are the export files of the batch, in batch order.
+	Files []string `json:"files"`
+	// RevocationFiles are the revocation lists of the batch, in batch order; clients delete the
+	// keys they hold. See BatchServerConfig.ExportRevocations.
+	RevocationFiles []string `json:"revocationFiles,omitempty"`
+}
+
+// latestPointerObject returns the name of the pointer to the latest batch of eb's export config.
+func latestPointerObject(eb model.ExportBatch) string {
+	return eb.FilenameRoot + latestPointerName
+}
+
+// newLatestPointer returns a pointer to eb and its files. It returns an error unless every file
+// is complete, so that a pointer never names a batch that is missing some of its files.
+func newLatestPointer(eb model.ExportBatch, files []*model.ExportFile) (*latestPointer, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("batch %d has no export files", eb.BatchID)
+	}
+	p := &latestPointer{
+		BatchID:        eb.BatchID,
+		StartTimestamp: eb.StartTimestamp.UTC(),
+		EndTimestamp:   eb.EndTimestamp.UTC(),
+	}
+	for _, f := range files {
+		if f.Status != model.ExportBatchComplete {
+			return nil, fmt.Errorf("export file %s of batch %d is %s, not %s", f.Filename, eb.BatchID, f.Status, model.ExportBatchComplete)
+		}
+		if f.Revocation {
+			p.RevocationFiles = append(p.RevocationFiles, f.Filename)
+			continue
+		}
+		p.Files = append(p.Files, f.Filename)
+	}
+	return p, nil
+}
+
+// updateLatestPointer points the latest pointer in bucket at eb and its files, unless it already
+// names a batch ending later, since batches may complete out of order. It reports whether the
+// pointer was written. A pointer that cannot be read or decoded is replaced. Storage replaces an
+// object in a single step, so clients read either the previous pointer or the new one.
+func updateLatestPointer(ctx context.Context, read objectReader, write objectWriter, bucket string, eb model.ExportBatch, files []*model.ExportFile) (bool, error) {
+	p, err := newLatestPointer(eb, files)
+	if err != nil {
+		return false, err
+	}
+	name := latestPointerObject(eb)
+	if data, err := read(ctx, bucket, name); err == nil {
+		var current latestPointer
+		if err := json.Unmarshal(data, &current); err == nil && current.EndTimestamp.After(p.EndTimestamp) {
+			return false, nil
+		}
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return false, fmt.Errorf("marshalling latest pointer: %v", err)
+	}
+	if err := write(ctx, bucket, name, data); err != nil {
+		return false, fmt.Errorf("writing latest pointer %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// updateLatestPointer points the latest pointer of eb's export config at eb, which must have
+// completed. Failures are logged rather than returned: the batch is complete either way, and the
+// next batch to complete updates the pointer.
+func (s *BatchServer) updateLatestPointer(ctx context.Context, eb model.ExportBatch) {
+	logger := logging.FromContext(ctx)
+
+	files, err := s.db.ListExportFiles(ctx, eb.BatchID)
+	if err != nil {
+		logger.Errorf("Not updating the latest pointer to batch %d, listing its files: %v", eb.BatchID, err)
+		return
+	}
+	if err := s.pointLatestAt(ctx, eb, files); err != nil {
+		logger.Errorf("Not updating the latest pointer to batch %d: %v", eb.BatchID, err)
+	}
+}
+
+// pointLatestAt points the latest pointer of eb's export config at eb and its files, unless it
+// already names a batch ending later.
+func (s *BatchServer) pointLatestAt(ctx context.Context, eb model.ExportBatch, files []*model.ExportFile) error {
+	// Batches of a config may complete concurrently; one at a time compares against the pointer.
+	lock := "latest_" + eb.FilenameRoot
+	unlock, err := s.db.Lock(ctx, lock, latestPointerLockTTL)
+	if err != nil {
+		return fmt.Errorf("acquiring lock %s: %v", lock, err)
+	}
+	defer unlock()
+
+	updated, err := updateLatestPointer(ctx, storage.ReadObject, storage.CreateObject, s.bsc.Bucket, eb, files)
+	if err != nil {
+		return err
+	}
+	if updated {
+		logging.FromContext(ctx).Infof("Latest pointer %s now names batch %d", latestPointerObject(eb), eb.BatchID)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpdateLatestPointer(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	batch := func(id int64, end time.Time) model.ExportBatch {
+		return model.ExportBatch{BatchID: id, FilenameRoot: "exports/us/", StartTimestamp: end.Add(-time.Hour), EndTimestamp: end}
+	}
+	file := func(name, status string) *model.ExportFile {
+		return &model.ExportFile{Filename: name, Status: status}
+	}
+	complete := []*model.ExportFile{file("exports/us/1-0", model.ExportBatchComplete), file("exports/us/1-1", model.ExportBatchComplete)}
+	pointerTo := func(eb model.ExportBatch, files ...string) *latestPointer {
+		return &latestPointer{BatchID: eb.BatchID, StartTimestamp: eb.StartTimestamp, EndTimestamp: eb.EndTimestamp, Files: files}
+	}
+	earlier, later := batch(1, start.Add(time.Hour)), batch(2, start.Add(2*time.Hour))
+	// compacted replaces earlier and later, as CompactBatches does.
+	compacted := model.ExportBatch{BatchID: 3, FilenameRoot: "exports/us/", StartTimestamp: earlier.StartTimestamp, EndTimestamp: later.EndTimestamp}
+
+	testCases := []struct {
+		name        string
+		current     *latestPointer
+		corrupt     bool
+		eb          model.ExportBatch
+		files       []*model.ExportFile
+		wantUpdated bool
+		wantErr     bool
+		want        *latestPointer
+	}{
+		{
+			name: "first batch", eb: earlier, files: complete,
+			wantUpdated: true, want: pointerTo(earlier, "exports/us/1-0", "exports/us/1-1"),
+		},
+		{
+			name: "newer batch", current: pointerTo(earlier, "old"), eb: later, files: complete,
+			wantUpdated: true, want: pointerTo(later, "exports/us/1-0", "exports/us/1-1"),
+		},
+		{
+			name: "older batch completing late", current: pointerTo(later, "newer"), eb: earlier, files: complete,
+			want: pointerTo(later, "newer"),
+		},
+		{
+			name: "compacted batch replaces the batch it merged", current: pointerTo(later, "exports/us/2-0"), eb: compacted, files: complete,
+			wantUpdated: true, want: pointerTo(compacted, "exports/us/1-0", "exports/us/1-1"),
+		},
+		{
+			name: "corrupt pointer is replaced", corrupt: true, eb: earlier, files: complete,
+			wantUpdated: true, want: pointerTo(earlier, "exports/us/1-0", "exports/us/1-1"),
+		},
+		{
+			name: "pending file", current: pointerTo(earlier, "old"), eb: later,
+			files:   []*model.ExportFile{file("exports/us/2-0", model.ExportBatchComplete), file("exports/us/2-1", model.ExportBatchPending)},
+			wantErr: true, want: pointerTo(earlier, "old"),
+		},
+		{
+			name: "no files", eb: later, wantErr: true,
+		},
+		{
+			name: "revocation files listed apart", eb: later,
+			files: []*model.ExportFile{
+				file("exports/us/2-0", model.ExportBatchComplete),
+				{Filename: "exports/us/2-0-revocations", Revocation: true, Status: model.ExportBatchComplete},
+			},
+			wantUpdated: true,
+			want: &latestPointer{BatchID: later.BatchID, StartTimestamp: later.StartTimestamp, EndTimestamp: later.EndTimestamp,
+				Files: []string{"exports/us/2-0"}, RevocationFiles: []string{"exports/us/2-0-revocations"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeObjectStore()
+			name := latestPointerObject(tc.eb)
+			if tc.current != nil {
+				data, err := json.Marshal(tc.current)
+				if err != nil {
+					t.Fatalf("marshalling current pointer: %v", err)
+				}
+				store.put("bucket", name, data)
+			}
+			if tc.corrupt {
+				store.put("bucket", name, []byte("{"))
+			}
+
+			updated, err := updateLatestPointer(context.Background(), store.read, store.write, "bucket", tc.eb, tc.files)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("updateLatestPointer returned error %v, want error %v", err, tc.wantErr)
+			}
+			if updated != tc.wantUpdated {
+				t.Errorf("updateLatestPointer updated %v, want %v", updated, tc.wantUpdated)
+			}
+
+			var got *latestPointer
+			if data, ok := store.objects["bucket"][name]; ok {
+				got = &latestPointer{}
+				if err := json.Unmarshal(data, got); err != nil {
+					t.Fatalf("decoding pointer: %v", err)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("latest pointer mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLatestPointerObject(t *testing.T) {
+	if got, want := latestPointerObject(model.ExportBatch{FilenameRoot: "exports/us/"}), "exports/us/latest.json"; got != want {
+		t.Errorf("latestPointerObject = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+const (
+	// Tokens that may appear in an export filename template.
+	filenameRootToken  = "{root}"
+	filenameStartToken = "{start}"
+	filenameEndToken   = "{end}"
+	filenameBatchToken = "{batch}"
+	// filenameRegionToken is replaced by the region of a file when BatchServerConfig.SplitRegions
+	// is set, and by nothing otherwise.
+	filenameRegionToken = "{region}"
+	// filenameReportTypeToken is replaced by the report type of a file when
+	// BatchServerConfig.SplitReportTypes is set, and by nothing otherwise.
+	filenameReportTypeToken = "{report-type}"
+
+	// DefaultFilenameTemplate is used when BatchServerConfig.FilenameTemplate is empty.
+	DefaultFilenameTemplate = filenameRootToken + filenameStartToken + "-" + filenameBatchToken
+)
+
+// ValidateFilenameTemplate checks that a filename template contains enough tokens to produce
+// a unique name for every file: the config's filename root, the window start or end, and the
+// batch index within the window.
+func ValidateFilenameTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, filenameRootToken) {
+		return fmt.Errorf("filename template %q must contain %s", tmpl, filenameRootToken)
+	}
+	if !strings.Contains(tmpl, filenameStartToken) && !strings.Contains(tmpl, filenameEndToken) {
+		return fmt.Errorf("filename template %q must contain %s or %s", tmpl, filenameStartToken, filenameEndToken)
+	}
+	if !strings.Contains(tmpl, filenameBatchToken) {
+		return fmt.Errorf("filename template %q must contain %s", tmpl, filenameBatchToken)
+	}
+	return nil
+}
+
+// exportFilename expands tmpl for the given batch and batch index. The result depends only on
+// the batch record, so a resumed batch reproduces the same names.
+func exportFilename(tmpl string, eb model.ExportBatch, batchNum int) string {
+	return exportRegionFilename(tmpl, eb, "", batchNum)
+}
+
+// exportRegionFilename is exportFilename for the files of a single region. If tmpl doesn't
+// contain the region token, the region is appended so that the names of each region's files
+// differ.
+func exportRegionFilename(tmpl string, eb model.ExportBatch, region string, batchNum int) string {
+	return exportStreamFilename(tmpl, eb, region, "", batchNum)
+}
+
+// exportStreamFilename is exportRegionFilename for the files of a single report type of a
+// region. Like the region, the report type is appended if tmpl doesn't contain its token.
+func exportStreamFilename(tmpl string, eb model.ExportBatch, region, reportType string, batchNum int) string {
+	if tmpl == "" {
+		tmpl = DefaultFilenameTemplate
+	}
+	if region != "" && !strings.Contains(tmpl, filenameRegionToken) {
+		tmpl += "-" + filenameRegionToken
+	}
+	if reportType != "" && !strings.Contains(tmpl, filenameReportTypeToken) {
+		tmpl += "-" + filenameReportTypeToken
+	}
+	r := strings.NewReplacer(
+		filenameRegionToken, region,
+		filenameReportTypeToken, reportType,
+		filenameRootToken, eb.FilenameRoot,
+		filenameStartToken, strconv.FormatInt(eb.StartTimestamp.Unix(), 10),
+		filenameEndToken, strconv.FormatInt(eb.EndTimestamp.Unix(), 10),
+		filenameBatchToken, strconv.Itoa(batchNum),
+	)
+	return r.Replace(tmpl)
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// TestExportFilename tests exportFilename().
+func TestExportFilename(t *testing.T) {
+	eb := model.ExportBatch{
+		FilenameRoot:   "exports/us/",
+		StartTimestamp: time.Unix(1587340800, 0).UTC(),
+		EndTimestamp:   time.Unix(1587427200, 0).UTC(),
+	}
+
+	testCases := []struct {
+		name     string
+		tmpl     string
+		batchNum int
+		want     string
+	}{
+		{
+			name:     "default",
+			batchNum: 2,
+			want:     "exports/us/1587340800-2",
+		},
+		{
+			name:     "window",
+			tmpl:     "{root}{start}-{end}-{batch}.pb",
+			batchNum: 0,
+			want:     "exports/us/1587340800-1587427200-0.pb",
+		},
+		{
+			name:     "repeated tokens",
+			tmpl:     "{root}{end}/{batch}-{end}",
+			batchNum: 7,
+			want:     "exports/us/1587427200/7-1587427200",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := exportFilename(tc.tmpl, eb, tc.batchNum)
+			if got != tc.want {
+				t.Errorf("exportFilename(%q) got %q, want %q", tc.tmpl, got, tc.want)
+			}
+			// Resumed batches must reproduce identical names.
+			if again := exportFilename(tc.tmpl, eb, tc.batchNum); again != got {
+				t.Errorf("exportFilename(%q) not stable, got %q then %q", tc.tmpl, got, again)
+			}
+		})
+	}
+}
+
+// TestValidateFilenameTemplate tests ValidateFilenameTemplate().
+func TestValidateFilenameTemplate(t *testing.T) {
+	testCases := []struct {
+		tmpl    string
+		wantErr bool
+	}{
+		{tmpl: DefaultFilenameTemplate},
+		{tmpl: "{root}{start}-{end}-{batch}"},
+		{tmpl: "{root}{end}-{batch}"},
+		{tmpl: "", wantErr: true},
+		{tmpl: "{start}-{batch}", wantErr: true},
+		{tmpl: "{root}-{batch}", wantErr: true},
+		{tmpl: "{root}{start}-{end}", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.tmpl, func(t *testing.T) {
+			err := ValidateFilenameTemplate(tc.tmpl)
+			if err != nil != tc.wantErr {
+				t.Errorf("ValidateFilenameTemplate(%q) got err %v, want err %t", tc.tmpl, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportRegionFilename(t *testing.T) {
+	eb := model.ExportBatch{
+		FilenameRoot:   "exports/",
+		StartTimestamp: time.Unix(1587340800, 0).UTC(),
+		EndTimestamp:   time.Unix(1587427200, 0).UTC(),
+	}
+
+	testCases := []struct {
+		name   string
+		tmpl   string
+		region string
+		want   string
+	}{
+		{name: "not split", want: "exports/1587340800-1"},
+		{name: "appended", region: "CA", want: "exports/1587340800-1-CA"},
+		{name: "token", tmpl: "{root}{region}/{start}-{batch}", region: "CA", want: "exports/CA/1587340800-1"},
+		{name: "token not split", tmpl: "{root}{region}{start}-{batch}", want: "exports/1587340800-1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exportRegionFilename(tc.tmpl, eb, tc.region, 1); got != tc.want {
+				t.Errorf("exportRegionFilename(%q, %q) got %q, want %q", tc.tmpl, tc.region, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExportStreamFilename(t *testing.T) {
+	eb := model.ExportBatch{
+		FilenameRoot:   "exports/",
+		StartTimestamp: time.Unix(1587340800, 0).UTC(),
+		EndTimestamp:   time.Unix(1587427200, 0).UTC(),
+	}
+
+	testCases := []struct {
+		name       string
+		tmpl       string
+		region     string
+		reportType string
+		want       string
+	}{
+		{name: "not split", want: "exports/1587340800-1"},
+		{name: "appended", reportType: "self-report", want: "exports/1587340800-1-self-report"},
+		{name: "appended after region", region: "CA", reportType: "self-report", want: "exports/1587340800-1-CA-self-report"},
+		{name: "token", tmpl: "{root}{report-type}/{start}-{batch}", reportType: "confirmed-test", want: "exports/confirmed-test/1587340800-1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exportStreamFilename(tc.tmpl, eb, tc.region, tc.reportType, 1); got != tc.want {
+				t.Errorf("exportStreamFilename(%q, %q, %q) got %q, want %q", tc.tmpl, tc.region, tc.reportType, got, tc.want)
+			}
+		})
+	}
+}
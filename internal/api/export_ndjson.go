@@ -0,0 +1,91 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// ndjsonExtension is appended to the name of an export file to name its NDJSON debug copy.
+const ndjsonExtension = ".ndjson"
+
+// ndjsonKey is one line of an NDJSON debug export, holding the fields of a key that are written
+// to export files. ExposureKey is base64 encoded.
+type ndjsonKey struct {
+	ExposureKey              []byte `json:"exposureKey"`
+	IntervalNumber           int32  `json:"intervalNumber"`
+	IntervalCount            int32  `json:"intervalCount"`
+	ReportType               int    `json:"reportType"`
+	DaysSinceOnsetOfSymptoms *int32 `json:"daysSinceOnsetOfSymptoms,omitempty"`
+	TransmissionRisk         int    `json:"transmissionRisk"`
+}
+
+// MarshalExportNDJSON formats exposureKeys as newline delimited JSON, one key per line, in the
+// same order as the binary export. It is meant for operators inspecting exports; clients cannot
+// consume it.
+func MarshalExportNDJSON(exposureKeys []*model.Infection) ([]byte, error) {
+	sorted := make([]*model.Infection, len(exposureKeys))
+	copy(sorted, exposureKeys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ExposureKey, sorted[j].ExposureKey) < 0
+	})
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ek := range sorted {
+		line := ndjsonKey{
+			ExposureKey:              ek.ExposureKey,
+			IntervalNumber:           ek.IntervalNumber,
+			IntervalCount:            ek.IntervalCount,
+			ReportType:               ek.ReportType,
+			DaysSinceOnsetOfSymptoms: ek.DaysSinceOnsetOfSymptoms,
+			TransmissionRisk:         ek.TransmissionRisk,
+		}
+		if err := enc.Encode(&line); err != nil {
+			return nil, fmt.Errorf("encoding key: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalExportNDJSON parses the output of MarshalExportNDJSON.
+func unmarshalExportNDJSON(data []byte) ([]*model.Infection, error) {
+	var keys []*model.Infection
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		var line ndjsonKey
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		keys = append(keys, &model.Infection{
+			ExposureKey:              line.ExposureKey,
+			IntervalNumber:           line.IntervalNumber,
+			IntervalCount:            line.IntervalCount,
+			ReportType:               line.ReportType,
+			DaysSinceOnsetOfSymptoms: line.DaysSinceOnsetOfSymptoms,
+			TransmissionRisk:         line.TransmissionRisk,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
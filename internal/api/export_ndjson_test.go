@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestMarshalExportNDJSON tests that the NDJSON debug export holds the same keys as the binary
+// export, one per line.
+func TestMarshalExportNDJSON(t *testing.T) {
+	onset := int32(3)
+	keys := []*model.Infection{
+		{ExposureKey: []byte("DEF"), IntervalNumber: 100, IntervalCount: 144, ReportType: 1},
+		{ExposureKey: []byte("ABC"), IntervalNumber: 244, IntervalCount: 144, ReportType: 2, DaysSinceOnsetOfSymptoms: &onset},
+		// Fields that are not exported are not written.
+		{ExposureKey: []byte("GHI"), IntervalNumber: 388, IntervalCount: 100, TransmissionRisk: 5, Regions: []string{"US"}},
+	}
+
+	data, err := MarshalExportNDJSON(keys)
+	if err != nil {
+		t.Fatalf("MarshalExportNDJSON returned unexpected error: %v", err)
+	}
+	if got := bytes.Count(data, []byte("\n")); got != len(keys) {
+		t.Errorf("NDJSON has %d lines, want %d", got, len(keys))
+	}
+	got, err := unmarshalExportNDJSON(data)
+	if err != nil {
+		t.Fatalf("unmarshalExportNDJSON returned unexpected error: %v", err)
+	}
+
+	since := time.Unix(1587340800, 0).UTC()
+	bin, err := marshalContents(since, since.Add(24*time.Hour), keys, "US", ExportFormatV4)
+	if err != nil {
+		t.Fatalf("marshalContents returned unexpected error: %v", err)
+	}
+	var export pb.ExposureKeyExport
+	if err := proto.Unmarshal(bin, &export); err != nil {
+		t.Fatalf("unmarshalling export: %v", err)
+	}
+	var want []*model.Infection
+	for _, k := range export.Keys {
+		inf := &model.Infection{
+			ExposureKey:      k.ExposureKey,
+			IntervalNumber:   k.IntervalNumber,
+			IntervalCount:    k.IntervalCount,
+			ReportType:       int(k.ReportType),
+			TransmissionRisk: int(k.TransmissionRisk),
+		}
+		if onset, ok := k.SymptomOnset.(*pb.ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms); ok {
+			inf.DaysSinceOnsetOfSymptoms = &onset.DaysSinceOnsetOfSymptoms
+		}
+		want = append(want, inf)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NDJSON keys mismatch with binary export (-want +got):\n%s", diff)
+	}
+}
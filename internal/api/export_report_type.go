@@ -0,0 +1,208 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+const (
+	// ReportTypeExclude is a ReportTypeMapping target that drops keys from the export.
+	ReportTypeExclude = -1
+
+	reportTypeExcludeName = "exclude"
+)
+
+// reportTypeNames name the report types in the filenames of exports split by report type.
+var reportTypeNames = map[int]string{
+	model.ReportTypeUnknown:                    "unknown",
+	model.ReportTypeConfirmedTest:              "confirmed-test",
+	model.ReportTypeConfirmedClinicalDiagnosis: "clinical-diagnosis",
+	model.ReportTypeSelfReport:                 "self-report",
+	model.ReportTypeRecursive:                  "recursive",
+	model.ReportTypeRevoked:                    "revoked",
+}
+
+// ValidateSplitReportTypes returns an error if exports cannot be split by report type in
+// formatVersion, zero being DefaultExportFormatVersion. Formats before ExportFormatV2 don't
+// carry the report type, so clients couldn't tell the files apart.
+func ValidateSplitReportTypes(formatVersion int) error {
+	if formatVersion == 0 {
+		formatVersion = DefaultExportFormatVersion
+	}
+	if formatVersion < ExportFormatV2 {
+		return fmt.Errorf("splitting exports by report type requires format version %d or later, got %d", ExportFormatV2, formatVersion)
+	}
+	return nil
+}
+
+// ParseReportTypeMapping parses a report type mapping of the form "4=1,5=exclude", where each
+// entry maps a stored report type to the report type to export, or to "exclude" to drop keys
+// of that type. An empty string yields an empty mapping.
+func ParseReportTypeMapping(s string) (map[int]int, error) {
+	mapping := map[int]int{}
+	if strings.TrimSpace(s) == "" {
+		return mapping, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid report type mapping entry %q", entry)
+		}
+		from, err := parseReportType(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid report type mapping entry %q: %v", entry, err)
+		}
+		if _, ok := mapping[from]; ok {
+			return nil, fmt.Errorf("duplicate report type mapping for %d", from)
+		}
+		to := ReportTypeExclude
+		if target := strings.TrimSpace(parts[1]); target != reportTypeExcludeName {
+			if to, err = parseReportType(target); err != nil {
+				return nil, fmt.Errorf("invalid report type mapping entry %q: %v", entry, err)
+			}
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+func parseReportType(s string) (int, error) {
+	rt, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if err := model.ValidateReportType(rt); err != nil {
+		return 0, err
+	}
+	return rt, nil
+}
+
+// remapReportType applies mapping to the report type of inf. It returns false if the key
+// should be excluded from the export. inf is not modified; a copy is returned if the report
+// type changes.
+func remapReportType(inf *model.Infection, mapping map[int]int) (*model.Infection, bool) {
+	to, ok := mapping[inf.ReportType]
+	if !ok {
+		return inf, true
+	}
+	if to == ReportTypeExclude {
+		return nil, false
+	}
+	remapped := *inf
+	remapped.ReportType = to
+	return &remapped, true
+}
+
+// exportStream is the sequence of export files of a region holding the keys of a single report
+// type, or of every report type if the export is not split by report type.
+type exportStream struct {
+	// reportType is the report type of the keys, or nil if the stream holds every report type.
+	reportType *int
+	// keys are the keys of the next file, not yet written.
+	keys []*model.Infection
+	// batchCount is the number of files written so far.
+	batchCount int
+	files      []string
+	written    []*writtenExportFile
+}
+
+// name returns the report type to name the stream's files after, or "" if it holds every report type.
+func (st *exportStream) name() string {
+	if st.reportType == nil {
+		return ""
+	}
+	if name, ok := reportTypeNames[*st.reportType]; ok {
+		return name
+	}
+	return strconv.Itoa(*st.reportType)
+}
+
+// streamExportFiles reads keys with next until it is done, remaps their report types with
+// mapping and calls write for each file of at most maxRecords keys, which then resets the
+// stream's keys. If split is set, each report type has its own stream of files; otherwise all
+// keys share one. A maxRecords of zero or less puts each stream's keys in a single file. Every
+// stream has at least one file, and there is always at least one, possibly empty, stream. The
+// streams are returned ordered by report type.
+func streamExportFiles(next func() (*model.Infection, bool, error), split bool, maxRecords int, mapping map[int]int,
+	write func(st *exportStream) error) ([]*exportStream, error) {
+	streams := make(map[int]*exportStream)
+	var unsplit exportStream
+	stream := func(reportType int) *exportStream {
+		if !split {
+			return &unsplit
+		}
+		st, ok := streams[reportType]
+		if !ok {
+			st = &exportStream{reportType: &reportType}
+			streams[reportType] = st
+		}
+		return st
+	}
+
+	exp, done, err := next()
+	// TODO(lmohanan): Watch for context deadline
+	for !done && err == nil {
+		if exp != nil {
+			if exp, ok := remapReportType(exp, mapping); ok {
+				st := stream(exp.ReportType)
+				st.keys = append(st.keys, exp)
+				if maxRecords > 0 && len(st.keys) == maxRecords {
+					if err := writeStreamFile(st, write); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		exp, done, err = next()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("iterating infections: %v", err)
+	}
+
+	all := []*exportStream{&unsplit}
+	if split && len(streams) > 0 {
+		all = make([]*exportStream, 0, len(streams))
+		for _, st := range streams {
+			all = append(all, st)
+		}
+		sort.Slice(all, func(i, j int) bool {
+			return *all[i].reportType < *all[j].reportType
+		})
+	}
+	// Create a file for the remaining keys of each stream.
+	for _, st := range all {
+		if len(st.keys) > 0 || st.batchCount == 0 {
+			if err := writeStreamFile(st, write); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return all, nil
+}
+
+func writeStreamFile(st *exportStream, write func(st *exportStream) error) error {
+	if err := write(st); err != nil {
+		return err
+	}
+	st.keys = nil
+	st.batchCount++
+	return nil
+}
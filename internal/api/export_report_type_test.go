@@ -0,0 +1,321 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestParseReportTypeMapping tests ParseReportTypeMapping().
+func TestParseReportTypeMapping(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    map[int]int
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: map[int]int{}},
+		{name: "remap", in: "4=1", want: map[int]int{4: 1}},
+		{name: "exclude", in: "5=exclude", want: map[int]int{5: ReportTypeExclude}},
+		{name: "multiple with spaces", in: "4 = 1, 5=exclude", want: map[int]int{4: 1, 5: ReportTypeExclude}},
+		{name: "missing target", in: "4", wantErr: true},
+		{name: "not a number", in: "x=1", wantErr: true},
+		{name: "unknown source", in: "9=1", wantErr: true},
+		{name: "unknown target", in: "4=9", wantErr: true},
+		{name: "duplicate", in: "4=1,4=2", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseReportTypeMapping(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParseReportTypeMapping(%q) = %v, want error", tc.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReportTypeMapping(%q) returned unexpected error: %v", tc.in, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseReportTypeMapping(%q) mismatch (-want +got):\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+// TestRemapReportType tests remapReportType().
+func TestRemapReportType(t *testing.T) {
+	mapping := map[int]int{
+		model.ReportTypeRecursive: model.ReportTypeConfirmedTest,
+		model.ReportTypeRevoked:   ReportTypeExclude,
+	}
+
+	testCases := []struct {
+		name    string
+		mapping map[int]int
+		in      int
+		want    int
+		wantOK  bool
+	}{
+		{name: "no mapping", mapping: nil, in: model.ReportTypeRecursive, want: model.ReportTypeRecursive, wantOK: true},
+		{name: "unmapped type", mapping: mapping, in: model.ReportTypeSelfReport, want: model.ReportTypeSelfReport, wantOK: true},
+		{name: "remapped", mapping: mapping, in: model.ReportTypeRecursive, want: model.ReportTypeConfirmedTest, wantOK: true},
+		{name: "excluded", mapping: mapping, in: model.ReportTypeRevoked, wantOK: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inf := &model.Infection{ExposureKey: []byte("ABC"), ReportType: tc.in}
+			got, ok := remapReportType(inf, tc.mapping)
+			if ok != tc.wantOK {
+				t.Fatalf("remapReportType ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.ReportType != tc.want {
+				t.Errorf("remapReportType report type = %d, want %d", got.ReportType, tc.want)
+			}
+			if inf.ReportType != tc.in {
+				t.Errorf("remapReportType modified its input, report type = %d, want %d", inf.ReportType, tc.in)
+			}
+		})
+	}
+}
+
+// TestMarshalContentsReportType tests that the format version gates whether report types are exported.
+func TestMarshalContentsReportType(t *testing.T) {
+	since := time.Unix(1587340800, 0).UTC()
+	until := since.Add(24 * time.Hour)
+
+	testCases := []struct {
+		name    string
+		version int
+		want    int32
+	}{
+		{name: "v1 omits report type", version: ExportFormatV1, want: 0},
+		{name: "v2 emits report type", version: ExportFormatV2, want: model.ReportTypeConfirmedTest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := []*model.Infection{{ExposureKey: []byte("ABC"), ReportType: model.ReportTypeConfirmedTest}}
+			b, err := marshalContents(since, until, keys, "US", tc.version)
+			if err != nil {
+				t.Fatalf("marshalContents returned unexpected error: %v", err)
+			}
+			var got pb.ExposureKeyExport
+			if err := proto.Unmarshal(b, &got); err != nil {
+				t.Fatalf("unmarshalling export: %v", err)
+			}
+			if len(got.Keys) != 1 {
+				t.Fatalf("got %d keys, want 1", len(got.Keys))
+			}
+			if rt := got.Keys[0].ReportType; rt != tc.want {
+				t.Errorf("report type = %d, want %d", rt, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateSplitReportTypes(t *testing.T) {
+	testCases := []struct {
+		version int
+		wantErr bool
+	}{
+		{version: 0, wantErr: true},
+		{version: ExportFormatV1, wantErr: true},
+		{version: ExportFormatV2},
+		{version: ExportFormatV3},
+	}
+	for _, tc := range testCases {
+		if err := ValidateSplitReportTypes(tc.version); (err != nil) != tc.wantErr {
+			t.Errorf("ValidateSplitReportTypes(%d) got err %v, want err %t", tc.version, err, tc.wantErr)
+		}
+	}
+}
+
+// exportStreamFile is a file written by streamExportFiles.
+type exportStreamFile struct {
+	Stream      string
+	BatchNum    int
+	ReportTypes []int
+}
+
+func TestStreamExportFiles(t *testing.T) {
+	keys := []*model.Infection{
+		{ExposureKey: []byte("1"), ReportType: model.ReportTypeSelfReport},
+		{ExposureKey: []byte("2"), ReportType: model.ReportTypeConfirmedTest},
+		{ExposureKey: []byte("3"), ReportType: model.ReportTypeSelfReport},
+		{ExposureKey: []byte("4"), ReportType: model.ReportTypeSelfReport},
+		{ExposureKey: []byte("5"), ReportType: model.ReportTypeRecursive},
+		{ExposureKey: []byte("6"), ReportType: model.ReportTypeRevoked},
+	}
+
+	testCases := []struct {
+		name       string
+		keys       []*model.Infection
+		split      bool
+		maxRecords int
+		mapping    map[int]int
+		want       []exportStreamFile
+		wantCounts map[string]int
+	}{
+		{
+			name:       "not split",
+			keys:       keys,
+			maxRecords: 4,
+			want: []exportStreamFile{
+				{BatchNum: 0, ReportTypes: []int{3, 1, 3, 3}},
+				{BatchNum: 1, ReportTypes: []int{4, 5}},
+			},
+			wantCounts: map[string]int{"": 2},
+		},
+		{
+			name:       "split",
+			keys:       keys,
+			split:      true,
+			maxRecords: 2,
+			want: []exportStreamFile{
+				{Stream: "self-report", BatchNum: 0, ReportTypes: []int{3, 3}},
+				{Stream: "confirmed-test", BatchNum: 0, ReportTypes: []int{1}},
+				{Stream: "self-report", BatchNum: 1, ReportTypes: []int{3}},
+				{Stream: "recursive", BatchNum: 0, ReportTypes: []int{4}},
+				{Stream: "revoked", BatchNum: 0, ReportTypes: []int{5}},
+			},
+			wantCounts: map[string]int{"confirmed-test": 1, "self-report": 2, "recursive": 1, "revoked": 1},
+		},
+		{
+			name:    "split after remapping",
+			keys:    keys,
+			split:   true,
+			mapping: map[int]int{model.ReportTypeRecursive: model.ReportTypeSelfReport, model.ReportTypeRevoked: ReportTypeExclude},
+			want: []exportStreamFile{
+				{Stream: "confirmed-test", BatchNum: 0, ReportTypes: []int{1}},
+				{Stream: "self-report", BatchNum: 0, ReportTypes: []int{3, 3, 3, 3}},
+			},
+			wantCounts: map[string]int{"confirmed-test": 1, "self-report": 1},
+		},
+		{
+			name:       "full stream has no empty file",
+			keys:       keys[:2],
+			split:      true,
+			maxRecords: 1,
+			want: []exportStreamFile{
+				{Stream: "self-report", BatchNum: 0, ReportTypes: []int{3}},
+				{Stream: "confirmed-test", BatchNum: 0, ReportTypes: []int{1}},
+			},
+			wantCounts: map[string]int{"confirmed-test": 1, "self-report": 1},
+		},
+		{
+			name:       "split without keys",
+			split:      true,
+			maxRecords: 2,
+			want:       []exportStreamFile{{BatchNum: 0}},
+			wantCounts: map[string]int{"": 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remaining := tc.keys
+			next := func() (*model.Infection, bool, error) {
+				if len(remaining) == 0 {
+					return nil, true, nil
+				}
+				inf := remaining[0]
+				remaining = remaining[1:]
+				return inf, false, nil
+			}
+			var got []exportStreamFile
+			write := func(st *exportStream) error {
+				f := exportStreamFile{Stream: st.name(), BatchNum: st.batchCount}
+				for _, inf := range st.keys {
+					f.ReportTypes = append(f.ReportTypes, inf.ReportType)
+				}
+				got = append(got, f)
+				return nil
+			}
+
+			streams, err := streamExportFiles(next, tc.split, tc.maxRecords, tc.mapping, write)
+			if err != nil {
+				t.Fatalf("streamExportFiles returned error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("streamExportFiles files mismatch (-want +got):\n%s", diff)
+			}
+			gotCounts := make(map[string]int)
+			for _, st := range streams {
+				gotCounts[st.name()] = st.batchCount
+			}
+			if diff := cmp.Diff(tc.wantCounts, gotCounts); diff != "" {
+				t.Errorf("streamExportFiles batch counts mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestSplitExportFileReportTypes checks that the files of an export split by report type only
+// hold keys of their own type.
+func TestSplitExportFileReportTypes(t *testing.T) {
+	keys := []*model.Infection{
+		{ExposureKey: []byte("aaaaaaaaaaaaaaaa"), IntervalNumber: 1, IntervalCount: 144, ReportType: model.ReportTypeConfirmedTest},
+		{ExposureKey: []byte("bbbbbbbbbbbbbbbb"), IntervalNumber: 1, IntervalCount: 144, ReportType: model.ReportTypeSelfReport},
+		{ExposureKey: []byte("cccccccccccccccc"), IntervalNumber: 1, IntervalCount: 144, ReportType: model.ReportTypeConfirmedTest},
+	}
+	remaining := keys
+	next := func() (*model.Infection, bool, error) {
+		if len(remaining) == 0 {
+			return nil, true, nil
+		}
+		inf := remaining[0]
+		remaining = remaining[1:]
+		return inf, false, nil
+	}
+	since, until := time.Unix(1587340800, 0), time.Unix(1587427200, 0)
+
+	files := 0
+	_, err := streamExportFiles(next, true, 0, nil, func(st *exportStream) error {
+		data, err := marshalContents(since, until, st.keys, "US", ExportFormatV2)
+		if err != nil {
+			return err
+		}
+		var export pb.ExposureKeyExport
+		if err := proto.Unmarshal(data, &export); err != nil {
+			return err
+		}
+		for _, k := range export.Keys {
+			if int(k.ReportType) != *st.reportType {
+				t.Errorf("%s file holds key %s of report type %d", st.name(), k.ExposureKey, k.ReportType)
+			}
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamExportFiles returned error: %v", err)
+	}
+	if files != 2 {
+		t.Errorf("wrote %d files, want 2", files)
+	}
+}
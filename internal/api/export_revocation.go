@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// revocationStreamName names revocation lists in place of a report type. It differs from the
+// name of the revoked report type, so that a revocation list never shares a name with the
+// files of keys published as revoked when exports are split by report type.
+const revocationStreamName = "revocations"
+
+// ValidateExportRevocations returns an error if revocation lists cannot be exported in
+// formatVersion, zero being DefaultExportFormatVersion. Revoked keys are marked by their report
+// type, which formats before ExportFormatV2 don't carry.
+func ValidateExportRevocations(formatVersion int) error {
+	if formatVersion == 0 {
+		formatVersion = DefaultExportFormatVersion
+	}
+	if formatVersion < ExportFormatV2 {
+		return fmt.Errorf("exporting revocation lists requires format version %d or later, got %d", ExportFormatV2, formatVersion)
+	}
+	return nil
+}
+
+// revocationCriteria returns the criteria selecting the keys revoked during eb, for region or
+// for all of its included regions if region is empty.
+func revocationCriteria(eb model.ExportBatch, region string) database.IterateInfectionsCriteria {
+	criteria := database.IterateInfectionsCriteria{
+		IncludeRegions: eb.IncludeRegions,
+		ExcludeRegions: eb.ExcludeRegions,
+		RevokedSince:   eb.StartTimestamp,
+		RevokedUntil:   eb.EndTimestamp,
+	}
+	if region != "" {
+		criteria.IncludeRegions = []string{region}
+	}
+	return criteria
+}
+
+// revokedKeys reads keys with next until it is done and returns copies of them with the revoked
+// report type, which tells clients to delete them.
+func revokedKeys(next func() (*model.Infection, bool, error)) ([]*model.Infection, error) {
+	var keys []*model.Infection
+	exp, done, err := next()
+	for !done && err == nil {
+		if exp != nil {
+			revoked := *exp
+			revoked.ReportType = model.ReportTypeRevoked
+			keys = append(keys, &revoked)
+		}
+		exp, done, err = next()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("iterating revoked infections: %v", err)
+	}
+	return keys, nil
+}
+
+// batchRevocations returns the keys revoked during eb for region, or for all of its included
+// regions if region is empty, split into chunks of at most MaxRecords keys. There are no chunks
+// if no key was revoked.
+func (s *BatchServer) batchRevocations(ctx context.Context, eb model.ExportBatch, region string) ([][]*model.Infection, error) {
+	it, err := s.db.IterateInfections(ctx, revocationCriteria(eb, region))
+	if err != nil {
+		return nil, fmt.Errorf("iterating revoked infections: %v", err)
+	}
+	defer it.Close()
+
+	keys, err := revokedKeys(it.Next)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return mergeExportKeys([][]*model.Infection{keys}, s.bsc.MaxRecords), nil
+}
+
+// createRevocationFiles writes the revocation lists of eb for region, or for all of its included
+// regions if region is empty. It returns nil if no key was revoked during the batch, in which case
+// no file is written.
+func (s *BatchServer) createRevocationFiles(ctx context.Context, eb model.ExportBatch, region string) (*exportStream, error) {
+	chunks, err := s.batchRevocations(ctx, eb, region)
+	if err != nil || len(chunks) == 0 {
+		return nil, err
+	}
+
+	revoked := model.ReportTypeRevoked
+	st := &exportStream{reportType: &revoked}
+	for _, keys := range chunks {
+		objectName := exportStreamFilename(s.bsc.FilenameTemplate, eb, region, revocationStreamName, st.batchCount)
+		wf, err := s.createFile(ctx, objectName, keys, eb, region, &revoked, true, st.batchCount)
+		if err != nil {
+			return nil, err
+		}
+		st.files = append(st.files, objectName)
+		st.written = append(st.written, wf)
+		st.batchCount++
+	}
+	return st, nil
+}
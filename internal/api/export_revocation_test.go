@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateExportRevocations(t *testing.T) {
+	for _, v := range []int{ExportFormatV2, ExportFormatV3, ExportFormatV4} {
+		if err := ValidateExportRevocations(v); err != nil {
+			t.Errorf("ValidateExportRevocations(%d) returned error: %v", v, err)
+		}
+	}
+	// The default format version predates the revoked report type.
+	for _, v := range []int{0, ExportFormatV1} {
+		if err := ValidateExportRevocations(v); err == nil {
+			t.Errorf("ValidateExportRevocations(%d) returned no error", v)
+		}
+	}
+}
+
+func TestRevocationCriteria(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	eb := model.ExportBatch{StartTimestamp: start, EndTimestamp: end, IncludeRegions: []string{"US", "CA"}, ExcludeRegions: []string{"MX"}}
+
+	testCases := []struct {
+		name   string
+		region string
+		want   database.IterateInfectionsCriteria
+	}{
+		{
+			name: "all regions",
+			want: database.IterateInfectionsCriteria{IncludeRegions: []string{"US", "CA"}, ExcludeRegions: []string{"MX"}, RevokedSince: start, RevokedUntil: end},
+		},
+		{
+			name:   "single region",
+			region: "CA",
+			want:   database.IterateInfectionsCriteria{IncludeRegions: []string{"CA"}, ExcludeRegions: []string{"MX"}, RevokedSince: start, RevokedUntil: end},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Revoked keys are selected by when they were revoked, whenever they were created.
+			if diff := cmp.Diff(tc.want, revocationCriteria(eb, tc.region)); diff != "" {
+				t.Errorf("revocationCriteria mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Normal exports of a later batch leave the revoked keys out.
+	if got := infectionsCriteria(eb, "", 0, time.Time{}); !got.ExcludeRevoked {
+		t.Errorf("infectionsCriteria(%+v) does not exclude revoked keys", eb)
+	}
+}
+
+// TestRevokedKeys tests that the keys of a revocation list carry the revoked report type in the
+// exported file, whatever report type they were published with.
+func TestRevokedKeys(t *testing.T) {
+	stored := []*model.Infection{
+		{ExposureKey: []byte("ABC"), IntervalNumber: 100, IntervalCount: 144, ReportType: model.ReportTypeConfirmedTest},
+		{ExposureKey: []byte("DEF"), IntervalNumber: 200, IntervalCount: 144, ReportType: model.ReportTypeSelfReport},
+	}
+	remaining := append([]*model.Infection(nil), stored...)
+	next := func() (*model.Infection, bool, error) {
+		if len(remaining) == 0 {
+			return nil, true, nil
+		}
+		inf := remaining[0]
+		remaining = remaining[1:]
+		return inf, false, nil
+	}
+
+	keys, err := revokedKeys(next)
+	if err != nil {
+		t.Fatalf("revokedKeys returned error: %v", err)
+	}
+	var got []string
+	for _, k := range exportKeys(keys, ExportFormatV2) {
+		if k.ReportType != model.ReportTypeRevoked {
+			t.Errorf("exported key %s has report type %d, want %d", k.ExposureKey, k.ReportType, model.ReportTypeRevoked)
+		}
+		got = append(got, string(k.ExposureKey))
+	}
+	if diff := cmp.Diff([]string{"ABC", "DEF"}, got); diff != "" {
+		t.Errorf("revocation list keys mismatch (-want +got):\n%s", diff)
+	}
+	// The stored keys are not modified.
+	if stored[0].ReportType != model.ReportTypeConfirmedTest {
+		t.Errorf("revokedKeys modified the stored key's report type to %d", stored[0].ReportType)
+	}
+
+	failing := func() (*model.Infection, bool, error) { return nil, false, errors.New("connection reset") }
+	if _, err := revokedKeys(failing); err == nil {
+		t.Errorf("revokedKeys with a failing iterator returned no error")
+	}
+}
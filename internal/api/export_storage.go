@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/storage"
+)
+
+const (
+	// DefaultQuotaRetryDelay is the BatchServerConfig.QuotaRetryDelay used if it is zero.
+	DefaultQuotaRetryDelay = time.Hour
+
+	// storageRetryBackoff is the wait before the first retry of a transient storage failure.
+	// It doubles before each later retry.
+	storageRetryBackoff = time.Second
+)
+
+// writer returns the objectWriter export files are written with.
+func (s *BatchServer) writer() objectWriter {
+	return retryTransient(storage.CreateObject, s.bsc.StorageRetries, storageRetryBackoff)
+}
+
+// retryTransient returns write, retrying writes that fail with a transient storage error up
+// to retries times. It waits backoff before the first retry, and twice as long before each
+// later one.
+func retryTransient(write objectWriter, retries int, backoff time.Duration) objectWriter {
+	return func(ctx context.Context, bucket, objectName string, contents []byte) error {
+		err := write(ctx, bucket, objectName, contents)
+		for i := 0; i < retries && err != nil && storage.Classify(err) == storage.ErrorTransient; i++ {
+			logging.FromContext(ctx).Warnf("Transient failure writing %s to %s, retrying in %v: %v", objectName, bucket, backoff, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			err = write(ctx, bucket, objectName, contents)
+		}
+		return err
+	}
+}
+
+// batchFailure is how a failed attempt to create the files of a batch is recorded.
+type batchFailure struct {
+	class storage.ErrorClass
+	// reason is recorded as the last error of the batch, prefixed with the class of known
+	// storage failures.
+	reason string
+	// deferUntil, if set, defers the batch until then without counting the attempt; see
+	// DeferBatch. Otherwise the attempt is recorded with FailBatch and maxAttempts.
+	deferUntil  time.Time
+	maxAttempts int
+}
+
+// newBatchFailure returns how the failed attempt of a batch is recorded given err, the error of
+// the attempt, the configured maxAttempts and quotaRetryDelay, and the current time.
+func newBatchFailure(err error, maxAttempts int, quotaRetryDelay time.Duration, now time.Time) batchFailure {
+	f := batchFailure{class: storage.Classify(err), reason: err.Error(), maxAttempts: maxAttempts}
+	if f.class != storage.ErrorUnknown {
+		f.reason = fmt.Sprintf("%s: %v", f.class, err)
+	}
+	switch f.class {
+	case storage.ErrorQuota:
+		f.deferUntil = now.Add(quotaRetryDelay)
+	case storage.ErrorPermission:
+		// No attempt succeeds until an operator grants the permission, so the first one fails
+		// the batch.
+		f.maxAttempts = 1
+	}
+	return f
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/storage"
+
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	errTransientStorage  = &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backend error"}
+	errQuotaStorage      = &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}
+	errPermissionStorage = &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}
+)
+
+// fakeObjectStore is an in-memory object store for the reads and writes of exports. Writes can be
+// made to fail: the first failures writes fail with err, as do writes to any bucket or object
+// named in fail. A nil err fails them with a generic error. attempts counts the writes tried.
+type fakeObjectStore struct {
+	objects  map[string]map[string][]byte
+	err      error
+	failures int
+	fail     map[string]bool
+	attempts int
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string]map[string][]byte)}
+}
+
+func (f *fakeObjectStore) read(ctx context.Context, bucket, objectName string) ([]byte, error) {
+	data, ok := f.objects[bucket][objectName]
+	if !ok {
+		return nil, errors.New("object not found")
+	}
+	// Hand out a copy, like a real read.
+	return append([]byte(nil), data...), nil
+}
+
+func (f *fakeObjectStore) write(ctx context.Context, bucket, objectName string, contents []byte) error {
+	f.attempts++
+	if f.attempts <= f.failures || f.fail[bucket] || f.fail[objectName] {
+		err := f.err
+		if err == nil {
+			err = errors.New("storage unavailable")
+		}
+		// As CreateObject wraps the errors of the storage client.
+		return fmt.Errorf("storage.Writer.Close: %w", err)
+	}
+	f.put(bucket, objectName, contents)
+	return nil
+}
+
+// put stores an object without counting it as a write.
+func (f *fakeObjectStore) put(bucket, objectName string, contents []byte) {
+	if f.objects[bucket] == nil {
+		f.objects[bucket] = make(map[string][]byte)
+	}
+	f.objects[bucket][objectName] = append([]byte(nil), contents...)
+}
+
+// names returns the names of the objects in bucket, sorted.
+func (f *fakeObjectStore) names(bucket string) []string {
+	var names []string
+	for name := range f.objects[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRetryTransient(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		failures     int
+		retries      int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "succeeds", retries: 3, wantAttempts: 1},
+		{name: "transient retried", err: errTransientStorage, failures: 2, retries: 3, wantAttempts: 3},
+		{name: "transient retries exhausted", err: errTransientStorage, failures: 5, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "transient without retries", err: errTransientStorage, failures: 1, wantAttempts: 1, wantErr: true},
+		{name: "quota not retried", err: errQuotaStorage, failures: 1, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "permission not retried", err: errPermissionStorage, failures: 1, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "unknown not retried", err: errors.New("no such bucket"), failures: 1, retries: 3, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeObjectStore()
+			fake.err, fake.failures = tc.err, tc.failures
+			err := retryTransient(fake.write, tc.retries, time.Millisecond)(context.Background(), "bucket", "exports/1", []byte("keys"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("write returned error %v, want error: %t", err, tc.wantErr)
+			}
+			if fake.attempts != tc.wantAttempts {
+				t.Errorf("write attempted %d times, want %d", fake.attempts, tc.wantAttempts)
+			}
+			if !tc.wantErr && string(fake.objects["bucket"]["exports/1"]) != "keys" {
+				t.Errorf("write did not store the object, got %v", fake.objects)
+			}
+		})
+	}
+
+	// The backoff stops with the lease of the batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fake := newFakeObjectStore()
+	fake.err, fake.failures = errTransientStorage, 5
+	if err := retryTransient(fake.write, 3, time.Hour)(ctx, "bucket", "exports/1", nil); err == nil {
+		t.Errorf("write with a cancelled context returned no error")
+	}
+	if fake.attempts != 1 {
+		t.Errorf("write with a cancelled context attempted %d times, want 1", fake.attempts)
+	}
+}
+
+// TestNewBatchFailure tests that each class of storage failure, as returned through the export
+// of a batch, is recorded as intended.
+func TestNewBatchFailure(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name            string
+		err             error
+		wantClass       storage.ErrorClass
+		wantDeferUntil  time.Time
+		wantMaxAttempts int
+	}{
+		{
+			name:            "transient counts the attempt",
+			err:             errTransientStorage,
+			wantClass:       storage.ErrorTransient,
+			wantMaxAttempts: 5,
+		},
+		{
+			name:           "quota defers without counting the attempt",
+			err:            errQuotaStorage,
+			wantClass:      storage.ErrorQuota,
+			wantDeferUntil: now.Add(30 * time.Minute),
+			// Unused, as the batch is deferred.
+			wantMaxAttempts: 5,
+		},
+		{
+			name:            "permission fails fast",
+			err:             errPermissionStorage,
+			wantClass:       storage.ErrorPermission,
+			wantMaxAttempts: 1,
+		},
+		{
+			name:            "unknown counts the attempt",
+			err:             errors.New("no such bucket"),
+			wantClass:       storage.ErrorUnknown,
+			wantMaxAttempts: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeObjectStore()
+			fake.err, fake.failures = tc.err, 10
+			err := writeExportFile(context.Background(), retryTransient(fake.write, 2, time.Millisecond), "bucket", "", "exports/1", []byte("keys"), nil)
+			if err == nil {
+				t.Fatal("writeExportFile returned no error")
+			}
+			// As createExportFilesForRegion returns it.
+			err = fmt.Errorf("all regions failed, last error: %w", fmt.Errorf("creating file: %w", err))
+
+			f := newBatchFailure(err, 5, 30*time.Minute, now)
+			if f.class != tc.wantClass {
+				t.Errorf("class = %q, want %q", f.class, tc.wantClass)
+			}
+			if !f.deferUntil.Equal(tc.wantDeferUntil) {
+				t.Errorf("deferUntil = %v, want %v", f.deferUntil, tc.wantDeferUntil)
+			}
+			if f.maxAttempts != tc.wantMaxAttempts {
+				t.Errorf("maxAttempts = %d, want %d", f.maxAttempts, tc.wantMaxAttempts)
+			}
+			// The class is recorded with the batch.
+			if tc.wantClass != storage.ErrorUnknown && !strings.HasPrefix(f.reason, string(tc.wantClass)+": ") {
+				t.Errorf("reason %q does not start with the class %q", f.reason, tc.wantClass)
+			}
+			if !strings.HasSuffix(f.reason, err.Error()) {
+				t.Errorf("reason %q does not hold the error %q", f.reason, err)
+			}
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/model"
 )
 
 type simpleBatchRange struct {
@@ -108,6 +113,194 @@ func TestMakeBatchRanges(t *testing.T) {
 	}
 }
 
+// TestMakeAlignedBatchRanges tests makeAlignedBatchRanges().
+func TestMakeAlignedBatchRanges(t *testing.T) {
+	testCases := []struct {
+		name      string
+		period    time.Duration
+		alignment time.Duration
+		now       string
+		latestEnd string
+		want      []simpleBatchRange
+	}{
+		{
+			name:      "unaligned uses period",
+			period:    4 * time.Hour,
+			now:       "12-10 00:20",
+			latestEnd: "12-09 20:00",
+			want:      []simpleBatchRange{{"12-09 20:00", "12-10 00:00"}},
+		},
+		{
+			name:      "snaps to top of the hour",
+			period:    4 * time.Hour,
+			alignment: 1 * time.Hour,
+			now:       "12-10 10:01",
+			latestEnd: "",
+			want:      []simpleBatchRange{{"12-10 06:00", "12-10 10:00"}},
+		},
+		{
+			name:      "snaps to top of the hour with previous batches",
+			period:    4 * time.Hour,
+			alignment: 1 * time.Hour,
+			now:       "12-10 10:01",
+			latestEnd: "12-10 05:00",
+			want:      []simpleBatchRange{{"12-10 05:00", "12-10 06:00"}, {"12-10 06:00", "12-10 10:00"}},
+		},
+		{
+			name:      "waits for a full period after the latest batch",
+			period:    4 * time.Hour,
+			alignment: 1 * time.Hour,
+			now:       "12-10 13:01",
+			latestEnd: "12-10 10:00",
+		},
+		{
+			name:      "follows the latest batch once a full period has passed",
+			period:    4 * time.Hour,
+			alignment: 1 * time.Hour,
+			now:       "12-10 14:01",
+			latestEnd: "12-10 10:00",
+			want:      []simpleBatchRange{{"12-10 10:00", "12-10 14:00"}},
+		},
+		{
+			name:      "snaps to UTC midnight across the day boundary",
+			period:    1 * time.Hour,
+			alignment: 24 * time.Hour,
+			now:       "12-10 00:20",
+			latestEnd: "12-09 22:00",
+			want:      []simpleBatchRange{{"12-09 22:00", "12-09 23:00"}, {"12-09 23:00", "12-10 00:00"}},
+		},
+		{
+			name:      "waits for next UTC midnight",
+			period:    1 * time.Hour,
+			alignment: 24 * time.Hour,
+			now:       "12-10 23:59",
+			latestEnd: "12-10 00:00",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := makeAlignedBatchRanges(tc.period, tc.alignment, fromSimpleTime(t, tc.latestEnd), fromSimpleTime(t, tc.now))
+			if diff := cmp.Diff(tc.want, toSimpleBatchRange(t, got), cmp.AllowUnexported(simpleBatchRange{})); diff != "" {
+				t.Errorf("makeAlignedBatchRanges mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestApplyMinExportKeys tests applyMinExportKeys().
+func TestApplyMinExportKeys(t *testing.T) {
+	// Two windows carried forward from earlier runs and the current one.
+	ranges := []simpleBatchRange{{"12-10 00:00", "12-10 04:00"}, {"12-10 04:00", "12-10 08:00"}, {"12-10 08:00", "12-10 12:00"}}
+
+	testCases := []struct {
+		name    string
+		ranges  []simpleBatchRange
+		keys    int
+		minKeys int
+		want    []simpleBatchRange
+	}{
+		{name: "no minimum", ranges: ranges, keys: 0, want: ranges},
+		{name: "below minimum defers", ranges: ranges, keys: 9, minKeys: 10},
+		{name: "no keys defers", ranges: ranges[2:], keys: 0, minKeys: 10},
+		{name: "at minimum publishes", ranges: ranges[2:], keys: 10, minKeys: 10, want: ranges[2:]},
+		{name: "at minimum publishes carried forward windows together", ranges: ranges, keys: 10, minKeys: 10,
+			want: []simpleBatchRange{{"12-10 00:00", "12-10 12:00"}}},
+		{name: "above minimum publishes", ranges: ranges, keys: 500, minKeys: 10,
+			want: []simpleBatchRange{{"12-10 00:00", "12-10 12:00"}}},
+		{name: "nothing due", keys: 500, minKeys: 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var in []batchRange
+			for _, r := range tc.ranges {
+				in = append(in, batchRange{start: fromSimpleTime(t, r.start), end: fromSimpleTime(t, r.end)})
+			}
+			got := applyMinExportKeys(in, tc.keys, tc.minKeys)
+			if diff := cmp.Diff(tc.want, toSimpleBatchRange(t, got), cmp.AllowUnexported(simpleBatchRange{})); diff != "" {
+				t.Errorf("applyMinExportKeys mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestCarriedBatchRangesNewConfig tests that the deferred windows of a config without batches are
+// carried forward over several runs, as maybeCreateBatches runs them, until enough keys are found.
+func TestCarriedBatchRangesNewConfig(t *testing.T) {
+	const minKeys = 3
+	keys := []string{"12-10 01:30", "12-10 02:15", "12-10 04:45"}
+
+	testCases := []struct {
+		name      string
+		alignment time.Duration
+	}{
+		{name: "period aligned"},
+		{name: "aligned to a shorter interval", alignment: 30 * time.Minute},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var deferredFrom time.Time
+			for _, run := range []struct {
+				now  string
+				want []simpleBatchRange
+			}{
+				{now: "12-10 02:01"},
+				{now: "12-10 03:01"},
+				{now: "12-10 04:01"},
+				{now: "12-10 05:01", want: []simpleBatchRange{{"12-10 01:00", "12-10 05:00"}}},
+			} {
+				ranges := carriedBatchRanges(time.Hour, tc.alignment, time.Time{}, deferredFrom, fromSimpleTime(t, run.now))
+				if len(ranges) == 0 {
+					t.Fatalf("run at %s: no ranges due", run.now)
+				}
+				start, end := ranges[0].start, ranges[len(ranges)-1].end
+				count := 0
+				for _, k := range keys {
+					if created := fromSimpleTime(t, k); !created.Before(start) && created.Before(end) {
+						count++
+					}
+				}
+				got := applyMinExportKeys(ranges, count, minKeys)
+				if len(got) == 0 && deferredFrom.IsZero() {
+					deferredFrom = start
+				}
+				if diff := cmp.Diff(run.want, toSimpleBatchRange(t, got), cmp.AllowUnexported(simpleBatchRange{})); diff != "" {
+					t.Errorf("run at %s: ranges mismatch (-want +got):\n%s", run.now, diff)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateBatchAlignment tests ValidateBatchAlignment().
+func TestValidateBatchAlignment(t *testing.T) {
+	testCases := []struct {
+		alignment time.Duration
+		wantErr   bool
+	}{
+		{alignment: 0},
+		{alignment: 15 * time.Minute},
+		{alignment: time.Hour},
+		{alignment: 24 * time.Hour},
+		{alignment: -time.Hour, wantErr: true},
+		{alignment: 7 * time.Hour, wantErr: true},
+		{alignment: 48 * time.Hour, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.alignment.String(), func(t *testing.T) {
+			err := ValidateBatchAlignment(tc.alignment)
+			if tc.wantErr && err == nil {
+				t.Errorf("ValidateBatchAlignment(%v) = nil, want error", tc.alignment)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("ValidateBatchAlignment(%v) returned unexpected error: %v", tc.alignment, err)
+			}
+		})
+	}
+}
+
 func fromSimpleTime(t *testing.T, s string) time.Time {
 	t.Helper()
 	if s == "" {
@@ -135,3 +328,181 @@ func toSimpleBatchRange(t *testing.T, batches []batchRange) []simpleBatchRange {
 	}
 	return simple
 }
+
+// TestExportRegions tests exportRegions() in fail-fast and partial modes.
+func TestExportRegions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		regions     []string
+		failRegion  string
+		partial     bool
+		wantFailed  []string
+		wantWritten []string
+		wantErr     bool
+	}{
+		{
+			name:        "all succeed",
+			regions:     []string{"US", "CA", "MX"},
+			wantWritten: []string{"exports/CA", "exports/MX", "exports/US"},
+		},
+		{
+			name:        "fail fast",
+			regions:     []string{"US", "CA", "MX"},
+			failRegion:  "CA",
+			wantWritten: []string{"exports/US"},
+			wantErr:     true,
+		},
+		{
+			name:        "partial",
+			regions:     []string{"US", "CA", "MX"},
+			failRegion:  "CA",
+			partial:     true,
+			wantFailed:  []string{"CA"},
+			wantWritten: []string{"exports/MX", "exports/US"},
+		},
+		{
+			name:       "partial all failed",
+			regions:    []string{"CA"},
+			failRegion: "CA",
+			partial:    true,
+			wantErr:    true,
+		},
+		{
+			name:        "partial all succeed",
+			regions:     []string{"US", "CA"},
+			partial:     true,
+			wantWritten: []string{"exports/CA", "exports/US"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeObjectStore()
+			store.fail = map[string]bool{"exports/" + tc.failRegion: true}
+			export := func(ctx context.Context, region string) error {
+				return store.write(ctx, "bucket", "exports/"+region, []byte(region))
+			}
+			failed, err := exportRegions(context.Background(), tc.regions, tc.partial, export)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("exportRegions returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantFailed, failed); diff != "" {
+				t.Errorf("failed regions mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantWritten, store.names("bucket")); diff != "" {
+				t.Errorf("written objects mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestInfectionsCriteria tests that infectionsCriteria() applies the lookback window, watermark and
+// region.
+func TestInfectionsCriteria(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	eb := model.ExportBatch{
+		StartTimestamp: start,
+		EndTimestamp:   end,
+		IncludeRegions: []string{"US", "CA"},
+		ExcludeRegions: []string{"MX"},
+	}
+
+	testCases := []struct {
+		name      string
+		region    string
+		lookback  time.Duration
+		watermark time.Time
+		wantSince time.Time
+		wantRegs  []string
+	}{
+		{name: "no lookback", wantSince: start, wantRegs: []string{"US", "CA"}},
+		{name: "lookback within window", lookback: 30 * time.Minute, wantSince: start, wantRegs: []string{"US", "CA"}},
+		{name: "lookback wider than window", lookback: 6 * time.Hour, wantSince: end.Add(-6 * time.Hour), wantRegs: []string{"US", "CA"}},
+		{name: "single region", region: "CA", lookback: 2 * time.Hour, wantSince: end.Add(-2 * time.Hour), wantRegs: []string{"CA"}},
+		{name: "watermark before window", watermark: start.Add(-10 * time.Minute), wantSince: start.Add(-10 * time.Minute), wantRegs: []string{"US", "CA"}},
+		{name: "watermark within window", watermark: start.Add(10 * time.Minute), wantSince: start, wantRegs: []string{"US", "CA"}},
+		{name: "watermark within lookback", lookback: 6 * time.Hour, watermark: start.Add(-time.Hour), wantSince: end.Add(-6 * time.Hour), wantRegs: []string{"US", "CA"}},
+		{name: "watermark before lookback", lookback: 2 * time.Hour, watermark: start.Add(-3 * time.Hour), wantSince: start.Add(-3 * time.Hour), wantRegs: []string{"US", "CA"}},
+		{name: "watermark capped", watermark: start.Add(-30 * oneDay), wantSince: end.Add(-MaxLookbackWindow), wantRegs: []string{"US", "CA"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := infectionsCriteria(eb, tc.region, tc.lookback, tc.watermark)
+			want := database.IterateInfectionsCriteria{
+				SinceTimestamp: tc.wantSince,
+				UntilTimestamp: end,
+				IncludeRegions: tc.wantRegs,
+				ExcludeRegions: []string{"MX"},
+				ExcludeRevoked: true,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("infectionsCriteria mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestTrackLatest tests that trackLatest() records the newest key read, which becomes the lower bound
+// of the next batch.
+func TestTrackLatest(t *testing.T) {
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	keys := []*model.Infection{
+		{CreatedAt: start.Add(20 * time.Minute)},
+		{CreatedAt: start.Add(50 * time.Minute)},
+		{CreatedAt: start.Add(10 * time.Minute)},
+	}
+	next := func() (*model.Infection, bool, error) {
+		if len(keys) == 0 {
+			return nil, true, nil
+		}
+		inf := keys[0]
+		keys = keys[1:]
+		return inf, false, nil
+	}
+
+	latest := start
+	tracked := trackLatest(next, &latest)
+	for {
+		_, done, err := tracked()
+		if err != nil {
+			t.Fatalf("next returned unexpected error: %v", err)
+		}
+		if done {
+			break
+		}
+	}
+	if want := start.Add(50 * time.Minute); !latest.Equal(want) {
+		t.Fatalf("latest = %v, want %v", latest, want)
+	}
+
+	// The next batch starts after the keys already exported, but reads from the watermark.
+	eb := model.ExportBatch{StartTimestamp: start.Add(time.Hour), EndTimestamp: start.Add(2 * time.Hour)}
+	if got := infectionsCriteria(eb, "", 0, latest).SinceTimestamp; !got.Equal(latest) {
+		t.Errorf("next batch since = %v, want watermark %v", got, latest)
+	}
+}
+
+// TestValidateLookbackWindow tests ValidateLookbackWindow().
+func TestValidateLookbackWindow(t *testing.T) {
+	testCases := []struct {
+		lookback time.Duration
+		wantErr  bool
+	}{
+		{lookback: 0},
+		{lookback: 6 * time.Hour},
+		{lookback: MaxLookbackWindow},
+		{lookback: -time.Hour, wantErr: true},
+		{lookback: MaxLookbackWindow + time.Second, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.lookback.String(), func(t *testing.T) {
+			err := ValidateLookbackWindow(tc.lookback)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ValidateLookbackWindow(%v) got err %v, want err %v", tc.lookback, err, tc.wantErr)
+			}
+		})
+	}
+}
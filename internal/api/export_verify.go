@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// objectReader returns the contents of a storage object.
+type objectReader func(ctx context.Context, bucket, objectName string) ([]byte, error)
+
+// writtenExportFile describes an export file as it was written, to check it against what is
+// read back.
+type writtenExportFile struct {
+	name     string
+	checksum [sha256.Size]byte
+	keys     int
+	batchNum int
+}
+
+func newWrittenExportFile(name string, data []byte, keys, batchNum int) *writtenExportFile {
+	return &writtenExportFile{
+		name:     name,
+		checksum: sha256.Sum256(data),
+		keys:     keys,
+		batchNum: batchNum,
+	}
+}
+
+// verifyExportFiles reads each of files back from bucket and checks that it is unchanged and
+// holds the expected number of keys. Zipped files must also carry only valid signatures by
+// signers.
+func verifyExportFiles(ctx context.Context, read objectReader, bucket string, files []*writtenExportFile, zipped bool, signers []*ExportSigner) error {
+	for _, f := range files {
+		data, err := read(ctx, bucket, f.name)
+		if err != nil {
+			return fmt.Errorf("reading back %s: %v", f.name, err)
+		}
+		if err := verifyExportFile(f, data, zipped, signers); err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+func verifyExportFile(f *writtenExportFile, data []byte, zipped bool, signers []*ExportSigner) error {
+	if sum := sha256.Sum256(data); sum != f.checksum {
+		return fmt.Errorf("checksum mismatch: wrote %x, read %x", f.checksum, sum)
+	}
+
+	contents := data
+	if zipped {
+		var err error
+		if contents, err = verifyExportZip(data, f.batchNum, signers); err != nil {
+			return err
+		}
+	}
+	// Unzipped files have no signature yet, so they are the bare contents; see sign.
+	var export pb.ExposureKeyExport
+	if err := proto.Unmarshal(contents, &export); err != nil {
+		return fmt.Errorf("decoding keys: %v", err)
+	}
+	if got := len(export.Keys); got != f.keys {
+		return fmt.Errorf("holds %d keys, wrote %d", got, f.keys)
+	}
+	return nil
+}
+
+// verifyExportZip checks the signatures of an export zip and returns the serialized keys it holds.
+func verifyExportZip(data []byte, batchNum int, signers []*ExportSigner) ([]byte, error) {
+	bin, sigData, err := readExportZip(data)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := exportBinaryContents(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigList pb.TEKSignatureList
+	if err := proto.Unmarshal(sigData, &sigList); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", exportSignatureName, err)
+	}
+	if len(sigList.Signatures) == 0 {
+		return nil, fmt.Errorf("%s holds no signatures", exportSignatureName)
+	}
+	digest := sha256.Sum256(bin)
+	for _, sig := range sigList.Signatures {
+		if err := verifyTEKSignature(sig, digest[:], batchNum, signers); err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// readExportZip returns the export.bin and export.sig members of an export zip.
+func readExportZip(data []byte) (bin, sig []byte, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening zip: %v", err)
+	}
+	members := make(map[string][]byte)
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening %s: %v", zf.Name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %v", zf.Name, err)
+		}
+		members[zf.Name] = b
+	}
+	bin, ok := members[exportBinaryName]
+	if !ok {
+		return nil, nil, fmt.Errorf("zip is missing %s", exportBinaryName)
+	}
+	sig, ok = members[exportSignatureName]
+	if !ok {
+		return nil, nil, fmt.Errorf("zip is missing %s", exportSignatureName)
+	}
+	return bin, sig, nil
+}
+
+// exportBinaryContents returns the serialized keys of an export.bin, after its header.
+func exportBinaryContents(bin []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bin, []byte(exportBinaryHeader)) {
+		return nil, fmt.Errorf("%s is missing its header", exportBinaryName)
+	}
+	return bin[len(exportBinaryHeader):], nil
+}
+
+// verifyTEKSignature checks that sig is a signature of digest, for batch batchNum, by the signer
+// holding the key it names.
+func verifyTEKSignature(sig *pb.TEKSignature, digest []byte, batchNum int, signers []*ExportSigner) error {
+	info := sig.GetSignatureInfo()
+	var signer *ExportSigner
+	for _, s := range signers {
+		if s.KeyID == info.GetVerificationKeyId() && s.KeyVersion == info.GetVerificationKeyVersion() {
+			signer = s
+			break
+		}
+	}
+	if signer == nil {
+		return fmt.Errorf("signature by unknown key %s version %s", info.GetVerificationKeyId(), info.GetVerificationKeyVersion())
+	}
+	// Batch numbers are 1-based in the signature.
+	if int(sig.BatchNum) != batchNum+1 {
+		return fmt.Errorf("signature by key %s is for batch %d, want %d", signer.KeyID, sig.BatchNum, batchNum+1)
+	}
+	pub, ok := signer.Key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("signing key %s is not an ECDSA key", signer.KeyID)
+	}
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig.Signature, &rs); err != nil {
+		return fmt.Errorf("decoding signature by key %s: %v", signer.KeyID, err)
+	}
+	if !ecdsa.Verify(pub, digest, rs.R, rs.S) {
+		return fmt.Errorf("signature by key %s does not verify", signer.KeyID)
+	}
+	return nil
+}
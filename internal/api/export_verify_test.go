@@ -0,0 +1,114 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+func TestVerifyExportFiles(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer := &ExportSigner{Key: key, KeyID: "310", KeyVersion: "v1"}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	otherSigner := &ExportSigner{Key: otherKey, KeyID: "311", KeyVersion: "v1"}
+	impostor := &ExportSigner{Key: otherKey, KeyID: "310", KeyVersion: "v1"}
+
+	since := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(time.Hour)
+	keys := []*model.Infection{
+		{ExposureKey: []byte("ABC"), IntervalNumber: 1, IntervalCount: 144},
+		{ExposureKey: []byte("DEF"), IntervalNumber: 2, IntervalCount: 144},
+	}
+
+	zipped, err := MarshalExportZip(since, until, keys, "US", ExportFormatV1, 1, signer)
+	if err != nil {
+		t.Fatalf("MarshalExportZip: %v", err)
+	}
+	plain, err := MarshalExportFile(since, until, keys, "US", ExportFormatV1)
+	if err != nil {
+		t.Fatalf("MarshalExportFile: %v", err)
+	}
+
+	corrupt := func(data []byte) []byte {
+		c := append([]byte(nil), data...)
+		c[len(c)/2] ^= 0xff
+		return c
+	}
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		read    []byte // what storage returns, if different from data
+		written *writtenExportFile
+		zipped  bool
+		signers []*ExportSigner
+		wantErr string
+	}{
+		{name: "zip", data: zipped, zipped: true, signers: []*ExportSigner{signer}},
+		{name: "plain", data: plain},
+		{name: "corrupted zip", data: zipped, read: corrupt(zipped), zipped: true, signers: []*ExportSigner{signer}, wantErr: "checksum mismatch"},
+		{name: "corrupted plain", data: plain, read: corrupt(plain), wantErr: "checksum mismatch"},
+		{name: "truncated", data: plain, read: plain[:len(plain)-1], wantErr: "checksum mismatch"},
+		{name: "wrong key count", data: plain, written: newWrittenExportFile("f", plain, 3, 0), wantErr: "holds 2 keys, wrote 3"},
+		{name: "wrong signer", data: zipped, zipped: true, signers: []*ExportSigner{otherSigner}, wantErr: "unknown key"},
+		{name: "wrong batch", data: zipped, written: newWrittenExportFile("f", zipped, 2, 1), zipped: true, signers: []*ExportSigner{signer}, wantErr: "is for batch 1, want 2"},
+		{name: "wrong key", data: zipped, zipped: true, signers: []*ExportSigner{impostor}, wantErr: "does not verify"},
+		{name: "not a zip", data: plain, zipped: true, signers: []*ExportSigner{signer}, wantErr: "opening zip"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			written := tc.written
+			if written == nil {
+				written = newWrittenExportFile("f", tc.data, len(keys), 0)
+			}
+			read := tc.read
+			if read == nil {
+				read = tc.data
+			}
+			store := newFakeObjectStore()
+			store.put("bucket", "f", read)
+
+			err := verifyExportFiles(context.Background(), store.read, "bucket", []*writtenExportFile{written}, tc.zipped, tc.signers)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyExportFiles returned unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("verifyExportFiles returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if err := verifyExportFiles(context.Background(), newFakeObjectStore().read, "bucket", []*writtenExportFile{newWrittenExportFile("missing", plain, 2, 0)}, false, nil); err == nil {
+		t.Errorf("verifyExportFiles of a missing object returned no error")
+	}
+}
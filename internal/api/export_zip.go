@@ -0,0 +1,226 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	exportBinaryName    = "export.bin"
+	exportSignatureName = "export.sig"
+
+	// exportBinaryHeader prefixes the serialized keys in export.bin, padded to 16 bytes.
+	exportBinaryHeader = "EK Export v1    "
+
+	// ecdsaWithSHA256OID identifies the signature algorithm in export.sig.
+	ecdsaWithSHA256OID = "1.2.840.10045.4.3.2"
+)
+
+// ExportSigner signs export zips with an ECDSA P-256 key.
+type ExportSigner struct {
+	Key        crypto.Signer
+	KeyID      string
+	KeyVersion string
+
+	// NotBefore and NotAfter, if set, bound when the key signs exports, so that a rotation can
+	// phase keys in and out. Zero values are unbounded.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ValidAt reports whether the key signs exports at t.
+func (s *ExportSigner) ValidAt(t time.Time) bool {
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		return false
+	}
+	if !s.NotAfter.IsZero() && t.After(s.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// LoadExportSigners loads a signer for each of the comma-separated key paths. ids, versions,
+// notBefores and notAfters are comma-separated lists matching paths, the latter two of RFC 3339
+// times; each may be empty, and an empty entry leaves that value unset.
+func LoadExportSigners(paths, ids, versions, notBefores, notAfters string) ([]*ExportSigner, error) {
+	pathList := strings.Split(paths, ",")
+	lists := make(map[string][]string)
+	for name, v := range map[string]string{"key IDs": ids, "key versions": versions, "not before times": notBefores, "not after times": notAfters} {
+		if v == "" {
+			lists[name] = make([]string, len(pathList))
+			continue
+		}
+		l := strings.Split(v, ",")
+		if len(l) != len(pathList) {
+			return nil, fmt.Errorf("got %d %s for %d signing keys", len(l), name, len(pathList))
+		}
+		lists[name] = l
+	}
+
+	parseTime := func(v string) (time.Time, error) {
+		if v = strings.TrimSpace(v); v == "" {
+			return time.Time{}, nil
+		}
+		return time.Parse(time.RFC3339, v)
+	}
+
+	signers := make([]*ExportSigner, 0, len(pathList))
+	for i, path := range pathList {
+		signer, err := LoadExportSigner(strings.TrimSpace(path), strings.TrimSpace(lists["key IDs"][i]), strings.TrimSpace(lists["key versions"][i]))
+		if err != nil {
+			return nil, err
+		}
+		if signer.NotBefore, err = parseTime(lists["not before times"][i]); err != nil {
+			return nil, fmt.Errorf("signing key %s: invalid not before time: %v", path, err)
+		}
+		if signer.NotAfter, err = parseTime(lists["not after times"][i]); err != nil {
+			return nil, fmt.Errorf("signing key %s: invalid not after time: %v", path, err)
+		}
+		if !signer.NotBefore.IsZero() && !signer.NotAfter.IsZero() && signer.NotAfter.Before(signer.NotBefore) {
+			return nil, fmt.Errorf("signing key %s: not after time is before not before time", path)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// activeSigners returns the signers valid at t, in order.
+func activeSigners(signers []*ExportSigner, t time.Time) []*ExportSigner {
+	var active []*ExportSigner
+	for _, s := range signers {
+		if s.ValidAt(t) {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// LoadExportSigner reads a PEM encoded ECDSA P-256 private key, in SEC 1 or PKCS #8 form, from path.
+func LoadExportSigner(path, keyID, keyVersion string) (*ExportSigner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("signing key %s has unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key %s must be an ECDSA P-256 key", path)
+	}
+	return &ExportSigner{Key: ecKey, KeyID: keyID, KeyVersion: keyVersion}, nil
+}
+
+// MarshalExportZip builds an export zip as consumed by exposure notification clients: export.bin
+// holds the header and serialized keys, and export.sig holds a TEKSignatureList signing it with
+// each of signers. Signing with both the old and new keys while rotating lets clients verify the
+// file with whichever verification key they have. Only the batch number of the signatures is set:
+// the batch size of the signatures, and the batch number and size of export.bin, which the export
+// file spec also requires, are left unset, since a file is written before the number of files of
+// its batch is known.
+func MarshalExportZip(since, until time.Time, exposureKeys []*model.Infection, region string, formatVersion, batchNum int, signers ...*ExportSigner) ([]byte, error) {
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("export zips require a signing key")
+	}
+	contents, err := marshalContents(since, until, exposureKeys, region, formatVersion)
+	if err != nil {
+		return nil, err
+	}
+	bin := append([]byte(exportBinaryHeader), contents...)
+
+	digest := sha256.Sum256(bin)
+	var sigs []*pb.TEKSignature
+	for _, signer := range signers {
+		if signer == nil {
+			return nil, fmt.Errorf("export zips require a signing key")
+		}
+		sig, err := signer.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("signing export with key %s: %v", signer.KeyID, err)
+		}
+		sigs = append(sigs, &pb.TEKSignature{
+			SignatureInfo: &pb.SignatureInfo{
+				VerificationKeyId:      signer.KeyID,
+				VerificationKeyVersion: signer.KeyVersion,
+				SignatureAlgorithm:     ecdsaWithSHA256OID,
+			},
+			// TODO: Set BatchSize here and BatchNum and BatchSize in export.bin, as the export file
+			// spec requires, once createExportFilesForRegion knows the file count of a stream
+			// before writing its files.
+			BatchNum:  int32(batchNum),
+			Signature: sig,
+		})
+	}
+	sigList, err := proto.Marshal(&pb.TEKSignatureList{Signatures: sigs})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling signature: %v", err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{exportBinaryName, bin},
+		{exportSignatureName, sigList},
+	} {
+		// The header is fixed, with no modification time, so that the same contents always
+		// produce the same zip.
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: member.name, Method: zip.Deflate})
+		if err != nil {
+			return nil, fmt.Errorf("adding %s to zip: %v", member.name, err)
+		}
+		if _, err := w.Write(member.data); err != nil {
+			return nil, fmt.Errorf("writing %s to zip: %v", member.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("closing zip: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func readZipMember(t *testing.T, zr *zip.Reader, name string) []byte {
+	t.Helper()
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", name, err)
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		return b
+	}
+	t.Fatalf("zip is missing %s", name)
+	return nil
+}
+
+// TestMarshalExportZip tests that MarshalExportZip() produces a zip with a signed export.bin.
+func TestMarshalExportZip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer := &ExportSigner{Key: key, KeyID: "310", KeyVersion: "v1"}
+
+	since := time.Unix(1587340800, 0).UTC()
+	until := since.Add(24 * time.Hour)
+	keys := []*model.Infection{{ExposureKey: []byte("DEF")}, {ExposureKey: []byte("ABC")}}
+
+	b, err := MarshalExportZip(since, until, keys, "US", ExportFormatV1, 2, signer)
+	if err != nil {
+		t.Fatalf("MarshalExportZip returned unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	if len(zr.File) != 2 {
+		t.Errorf("zip has %d members, want 2", len(zr.File))
+	}
+
+	bin := readZipMember(t, zr, exportBinaryName)
+	if !bytes.HasPrefix(bin, []byte(exportBinaryHeader)) {
+		t.Fatalf("export.bin does not start with %q", exportBinaryHeader)
+	}
+	var export pb.ExposureKeyExport
+	if err := proto.Unmarshal(bin[len(exportBinaryHeader):], &export); err != nil {
+		t.Fatalf("unmarshalling export.bin: %v", err)
+	}
+	if len(export.Keys) != len(keys) || export.Region != "US" {
+		t.Errorf("export.bin has %d keys for region %q, want %d keys for US", len(export.Keys), export.Region, len(keys))
+	}
+
+	var sigList pb.TEKSignatureList
+	if err := proto.Unmarshal(readZipMember(t, zr, exportSignatureName), &sigList); err != nil {
+		t.Fatalf("unmarshalling export.sig: %v", err)
+	}
+	if len(sigList.Signatures) != 1 {
+		t.Fatalf("export.sig has %d signatures, want 1", len(sigList.Signatures))
+	}
+	sig := sigList.Signatures[0]
+	if info := sig.SignatureInfo; info.VerificationKeyId != "310" || info.VerificationKeyVersion != "v1" || info.SignatureAlgorithm != ecdsaWithSHA256OID {
+		t.Errorf("unexpected signature info %v", info)
+	}
+	if sig.BatchNum != 2 {
+		t.Errorf("signature batch num = %d, want 2", sig.BatchNum)
+	}
+
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig.Signature, &rs); err != nil {
+		t.Fatalf("decoding signature: %v", err)
+	}
+	digest := sha256.Sum256(bin)
+	if !ecdsa.Verify(&key.PublicKey, digest[:], rs.R, rs.S) {
+		t.Errorf("signature does not verify export.bin")
+	}
+	tampered := append([]byte{}, bin...)
+	tampered[len(tampered)-1] ^= 0xff
+	digest = sha256.Sum256(tampered)
+	if ecdsa.Verify(&key.PublicKey, digest[:], rs.R, rs.S) {
+		t.Errorf("signature verifies tampered export.bin")
+	}
+}
+
+// TestLoadExportSigner tests LoadExportSigner().
+func TestLoadExportSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKey := func(name, pemType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(p256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(p256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384DER, err := x509.MarshalECPrivateKey(p384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "sec1", path: writeKey("sec1.pem", "EC PRIVATE KEY", sec1)},
+		{name: "pkcs8", path: writeKey("pkcs8.pem", "PRIVATE KEY", pkcs8)},
+		{name: "wrong curve", path: writeKey("p384.pem", "EC PRIVATE KEY", p384DER), wantErr: true},
+		{name: "wrong type", path: writeKey("cert.pem", "CERTIFICATE", sec1), wantErr: true},
+		{name: "missing", path: filepath.Join(dir, "missing.pem"), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, err := LoadExportSigner(tc.path, "id", "v1")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("LoadExportSigner(%s) = %v, want error", tc.path, signer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadExportSigner(%s) returned unexpected error: %v", tc.path, err)
+			}
+			if signer.KeyID != "id" || signer.KeyVersion != "v1" {
+				t.Errorf("LoadExportSigner(%s) = %+v, want key id and version set", tc.path, signer)
+			}
+		})
+	}
+}
+
+// TestMarshalExportZipRotation tests that during a key rotation overlap, export.sig lists every
+// active key and each signature verifies export.bin under its own key.
+func TestMarshalExportZipRotation(t *testing.T) {
+	now := time.Unix(1587340800, 0).UTC()
+	var signers []*ExportSigner
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for _, s := range []struct {
+		id                  string
+		notBefore, notAfter time.Time
+	}{
+		{id: "old", notAfter: now.Add(time.Hour)},
+		{id: "new", notBefore: now.Add(-time.Hour)},
+		{id: "retired", notAfter: now.Add(-time.Hour)},
+	} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		keys[s.id] = key
+		signers = append(signers, &ExportSigner{Key: key, KeyID: s.id, KeyVersion: "v1", NotBefore: s.notBefore, NotAfter: s.notAfter})
+	}
+
+	active := activeSigners(signers, now)
+	b, err := MarshalExportZip(now.Add(-24*time.Hour), now, []*model.Infection{{ExposureKey: []byte("ABC")}}, "US", ExportFormatV1, 1, active...)
+	if err != nil {
+		t.Fatalf("MarshalExportZip returned unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	bin := readZipMember(t, zr, exportBinaryName)
+	var sigList pb.TEKSignatureList
+	if err := proto.Unmarshal(readZipMember(t, zr, exportSignatureName), &sigList); err != nil {
+		t.Fatalf("unmarshalling export.sig: %v", err)
+	}
+
+	var gotIDs []string
+	digest := sha256.Sum256(bin)
+	for _, sig := range sigList.Signatures {
+		id := sig.SignatureInfo.VerificationKeyId
+		gotIDs = append(gotIDs, id)
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig.Signature, &rs); err != nil {
+			t.Fatalf("decoding signature for key %s: %v", id, err)
+		}
+		if !ecdsa.Verify(&keys[id].PublicKey, digest[:], rs.R, rs.S) {
+			t.Errorf("signature for key %s does not verify export.bin", id)
+		}
+	}
+	if diff := cmp.Diff([]string{"old", "new"}, gotIDs); diff != "" {
+		t.Errorf("export.sig key IDs mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := activeSigners(signers, now.Add(2*time.Hour)); len(got) != 1 || got[0].KeyID != "new" {
+		t.Errorf("activeSigners after the overlap = %v, want only the new key", got)
+	}
+}
+
+// TestLoadExportSigners tests LoadExportSigners().
+func TestLoadExportSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, name := range []string{"a.pem", "b.pem"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	keyPaths := strings.Join(paths, ",")
+
+	testCases := []struct {
+		name                  string
+		ids, versions         string
+		notBefores, notAfters string
+		wantIDs               []string
+		wantErr               bool
+	}{
+		{name: "ids only", ids: "a,b", wantIDs: []string{"a", "b"}},
+		{name: "overlap", ids: "a,b", versions: "v1,v1", notBefores: ",2020-05-01T00:00:00Z", notAfters: "2020-05-08T00:00:00Z,", wantIDs: []string{"a", "b"}},
+		{name: "id count mismatch", ids: "a", wantErr: true},
+		{name: "invalid time", ids: "a,b", notBefores: "yesterday,", wantErr: true},
+		{name: "reversed window", ids: "a,b", notBefores: "2020-05-08T00:00:00Z,", notAfters: "2020-05-01T00:00:00Z,", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			signers, err := LoadExportSigners(keyPaths, tc.ids, tc.versions, tc.notBefores, tc.notAfters)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("LoadExportSigners() = %v, want error", signers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadExportSigners() returned unexpected error: %v", err)
+			}
+			var gotIDs []string
+			for _, s := range signers {
+				gotIDs = append(gotIDs, s.KeyID)
+			}
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("LoadExportSigners() key IDs mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// syncLimiter bounds the number of federation syncs running at once in this process, so that
+// the scheduler starting every query together does not overwhelm the database and network.
+// Syncs beyond the bound wait for a running one to finish.
+type syncLimiter struct {
+	slots chan struct{}
+}
+
+// newSyncLimiter returns a limiter allowing n syncs at once, or nil, which does not limit, if n
+// is not positive.
+func newSyncLimiter(n int) *syncLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &syncLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a free slot and returns a function releasing it. It returns an error
+// wrapping the context error if ctx is done first, such as when the wait would outlast the
+// sync timeout.
+func (l *syncLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for one of %d running syncs to finish: %w", cap(l.slots), ctx.Err())
+	}
+}
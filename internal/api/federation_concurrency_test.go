@@ -0,0 +1,124 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// blockingSyncs runs fake syncs that hold their slot until told to finish, recording the most
+// that ran at once.
+type blockingSyncs struct {
+	limiter *syncLimiter
+	started chan int
+	finish  chan struct{}
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (b *blockingSyncs) run(t *testing.T, i int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	release, err := b.limiter.acquire(context.Background())
+	if err != nil {
+		t.Errorf("sync %d: acquire returned unexpected error: %v", i, err)
+		return
+	}
+	defer release()
+
+	b.mu.Lock()
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+	b.mu.Unlock()
+
+	b.started <- i
+	<-b.finish
+
+	b.mu.Lock()
+	b.running--
+	b.mu.Unlock()
+}
+
+func TestSyncLimiter(t *testing.T) {
+	const limit, syncs = 3, 10
+	b := &blockingSyncs{
+		limiter: newSyncLimiter(limit),
+		started: make(chan int, syncs),
+		finish:  make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < syncs; i++ {
+		wg.Add(1)
+		go b.run(t, i, &wg)
+	}
+
+	for i := 0; i < limit; i++ {
+		<-b.started
+	}
+	select {
+	case i := <-b.started:
+		t.Fatalf("sync %d started while %d were running", i, limit)
+	default:
+	}
+	// Each finished sync lets one queued sync start.
+	for i := limit; i < syncs; i++ {
+		b.finish <- struct{}{}
+		<-b.started
+	}
+	for i := 0; i < limit; i++ {
+		b.finish <- struct{}{}
+	}
+	wg.Wait()
+
+	if b.maxRunning != limit {
+		t.Errorf("at most %d syncs ran at once, want %d", b.maxRunning, limit)
+	}
+}
+
+func TestSyncLimiterContext(t *testing.T) {
+	limiter := newSyncLimiter(1)
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire returned unexpected error: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.acquire(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire with every slot taken returned error %v, want %v", err, context.Canceled)
+	}
+
+	release()
+	if _, err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after release returned unexpected error: %v", err)
+	}
+}
+
+func TestSyncLimiterUnlimited(t *testing.T) {
+	if l := newSyncLimiter(0); l != nil {
+		t.Fatalf("newSyncLimiter(0) = %+v, want nil", l)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := newSyncLimiter(0).acquire(context.Background()); err != nil {
+			t.Fatalf("acquire returned unexpected error: %v", err)
+		}
+	}
+}
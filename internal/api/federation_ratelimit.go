@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// insertLimiter paces federation inserts to a number of keys per second, so that a partner
+// sending a large region at once does not saturate the primary's write capacity.
+type insertLimiter struct {
+	rate  int
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	start    time.Time
+	inserted int
+}
+
+// newInsertLimiter returns a limiter allowing rate keys per second, or nil, which does not
+// limit, if rate is not positive.
+func newInsertLimiter(rate int) *insertLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &insertLimiter{rate: rate, now: time.Now, sleep: sleepContext}
+}
+
+// limit returns insert paced by the limiter.
+func (l *insertLimiter) limit(insert insertInfectionsFn) insertInfectionsFn {
+	if l == nil {
+		return insert
+	}
+	return func(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (int, error) {
+		if err := l.wait(ctx); err != nil {
+			return 0, err
+		}
+		l.inserted += len(infections)
+		return insert(ctx, infections, rejectDuplicates)
+	}
+}
+
+// wait blocks until the keys inserted so far are within the rate. It returns early with an
+// error if ctx is done, or would be before the wait is over, such as when the sync would
+// outlast its timeout.
+func (l *insertLimiter) wait(ctx context.Context) error {
+	now := l.now()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	due := l.start.Add(time.Duration(l.inserted) * time.Second / time.Duration(l.rate))
+	if !due.After(now) {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(due) {
+		return fmt.Errorf("inserting at %d keys per second would exceed the sync deadline: %w", l.rate, context.DeadlineExceeded)
+	}
+	return l.sleep(ctx, due.Sub(now))
+}
+
+// sleepContext waits for d, returning early with the context error if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeClock is a clock that only moves when slept on.
+type fakeClock struct {
+	now    time.Time
+	slepts []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.slepts = append(c.slepts, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestInsertLimiter(t *testing.T) {
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	batch := make([]*model.Infection, 50)
+
+	clock := &fakeClock{now: start}
+	limiter := newInsertLimiter(100)
+	limiter.now, limiter.sleep = clock.Now, clock.Sleep
+
+	var insertedAt []time.Duration
+	insert := limiter.limit(func(ctx context.Context, infections []*model.Infection, _ bool) (int, error) {
+		insertedAt = append(insertedAt, clock.now.Sub(start))
+		return len(infections), nil
+	})
+	for i := 0; i < 4; i++ {
+		if _, err := insert(context.Background(), batch, false); err != nil {
+			t.Fatalf("insert %d returned unexpected error: %v", i, err)
+		}
+	}
+
+	// 50 keys take half a second at 100 keys per second.
+	want := []time.Duration{0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond}
+	if diff := cmp.Diff(want, insertedAt); diff != "" {
+		t.Errorf("insert times mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestInsertLimiterContext(t *testing.T) {
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	batch := make([]*model.Infection, 100)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The deadline is in real time, so place the fake clock just before it.
+	withDeadline, cancelDeadline := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelDeadline()
+	deadline, _ := withDeadline.Deadline()
+
+	testCases := []struct {
+		name    string
+		ctx     context.Context
+		start   time.Time
+		wantErr error
+	}{
+		{name: "canceled", ctx: canceled, start: start, wantErr: context.Canceled},
+		{name: "deadline", ctx: withDeadline, start: deadline.Add(-500 * time.Millisecond), wantErr: context.DeadlineExceeded},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{now: tc.start}
+			limiter := newInsertLimiter(100)
+			limiter.now, limiter.sleep = clock.Now, clock.Sleep
+
+			inserts := 0
+			insert := limiter.limit(func(ctx context.Context, infections []*model.Infection, _ bool) (int, error) {
+				inserts++
+				return len(infections), nil
+			})
+			// The first batch is not delayed, the second must wait a second.
+			if _, err := insert(context.Background(), batch, false); err != nil {
+				t.Fatalf("first insert returned unexpected error: %v", err)
+			}
+			_, err := insert(tc.ctx, batch, false)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("second insert returned error %v, want %v", err, tc.wantErr)
+			}
+			if inserts != 1 {
+				t.Errorf("inserted %d batches, want 1", inserts)
+			}
+			if len(clock.slepts) != 0 {
+				t.Errorf("slept %v, want no sleep", clock.slepts)
+			}
+		})
+	}
+}
+
+func TestInsertLimiterUnlimited(t *testing.T) {
+	if l := newInsertLimiter(0); l != nil {
+		t.Fatalf("newInsertLimiter(0) = %+v, want nil", l)
+	}
+	calls := 0
+	insert := newInsertLimiter(0).limit(func(ctx context.Context, infections []*model.Infection, _ bool) (int, error) {
+		calls++
+		return len(infections), nil
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := insert(context.Background(), make([]*model.Infection, 1000), false); err != nil {
+			t.Fatalf("insert returned unexpected error: %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("inserted %d batches, want 3", calls)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// resumeParam asks a retry to resume the failed sync of the query from its checkpoint.
+const resumeParam = "resume"
+
+// retryReport is the outcome of a retried federation sync.
+type retryReport struct {
+	QueryID string `json:"queryID"`
+	// ResumedFrom is the failed sync the retry resumed from, if it resumed one.
+	ResumedFrom string `json:"resumedFrom,omitempty"`
+	// SyncID is the sync the retry ran, if it reached the remote.
+	SyncID     string `json:"syncID,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Inserted   int    `json:"inserted"`
+	Duplicates int    `json:"duplicates"`
+	Error      string `json:"error,omitempty"`
+}
+
+// record returns a startFederationSyncFn that starts syncs with start and records their outcome
+// in the report.
+func (rr *retryReport) record(start startFederationSyncFn) startFederationSyncFn {
+	return func(ctx context.Context, q *model.FederationQuery, started time.Time) (string, database.FinalizeSyncFn, error) {
+		syncID, finalize, err := start(ctx, q, started)
+		if err != nil {
+			return "", nil, err
+		}
+		rr.SyncID = syncID
+		return syncID, func(maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string) error {
+			rr.Status, rr.Inserted, rr.Duplicates = status, totalInserted, duplicates
+			return finalize(maxTimestamp, totalInserted, duplicates, completedChunks, status)
+		}, nil
+	}
+}
+
+func writeRetryReport(ctx context.Context, w http.ResponseWriter, code int, report *retryReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logging.FromContext(ctx).Errorf("Failed writing retry report for query %q: %v", report.QueryID, err)
+	}
+}
+
+// RetryHandler returns a handler that lets an operator re-run the sync of a single query at once,
+// rather than waiting for its next scheduled sync. With resume=true, a query whose latest sync
+// failed resumes from that sync's checkpoint instead of fetching everything since its last
+// timestamp again. Requests must be POSTs carrying token as a bearer token. Retries share the
+// lock and the concurrent sync limit of scheduled syncs.
+func (h *FederationPullHandler) RetryHandler(token string) http.Handler {
+	return &federationRetryHandler{pull: h, token: token}
+}
+
+type federationRetryHandler struct {
+	pull  *FederationPullHandler
+	token string
+}
+
+func (h *federationRetryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "retry-sync requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validBearerToken(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resume := false
+	if v := r.URL.Query().Get(resumeParam); v != "" {
+		var err error
+		if resume, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s value %q", resumeParam, v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query, ok := h.pull.requestedQuery(w, r)
+	if !ok {
+		return
+	}
+
+	req := pullRequest{query: query, retry: &retryReport{QueryID: query.QueryID}}
+	if resume {
+		latest, err := h.pull.db.GetLatestFederationSync(ctx, query.QueryID)
+		if err != nil && err != database.ErrNotFound {
+			logger.Errorf("Failed getting latest sync of query %q: %v", query.QueryID, err)
+			http.Error(w, fmt.Sprintf("Failed getting latest sync of query %q, check logs.", query.QueryID), http.StatusInternalServerError)
+			return
+		}
+		if latest != nil {
+			req.from = failedSyncCheckpoint(latest)
+		}
+		if req.from != nil {
+			req.retry.ResumedFrom = req.from.syncID
+		} else {
+			logger.Infof("Latest sync of query %q did not fail, retrying from its last timestamp", query.QueryID)
+		}
+	}
+	logger.Infof("Operator retry of federation query %q", query.QueryID)
+	h.pull.pull(w, r, req)
+}
+
+// validBearerToken reports whether r carries token as its bearer token. An empty token accepts
+// nothing.
+func validBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) == 1
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestRetryHandlerRejects tests that the retry handler rejects requests before looking at the
+// query unless they are authenticated POSTs.
+func TestRetryHandlerRejects(t *testing.T) {
+	h := (&FederationPullHandler{}).RetryHandler("secret")
+
+	testCases := []struct {
+		name     string
+		method   string
+		auth     string
+		wantCode int
+	}{
+		{name: "get", method: http.MethodGet, auth: "Bearer secret", wantCode: http.StatusMethodNotAllowed},
+		{name: "no token", method: http.MethodPost, wantCode: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, auth: "Bearer guess", wantCode: http.StatusUnauthorized},
+		{name: "not bearer", method: http.MethodPost, auth: "secret", wantCode: http.StatusUnauthorized},
+		{name: "bad resume", method: http.MethodPost, auth: "Bearer secret", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/retry-sync?query-id=q&resume=maybe", nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidBearerToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/retry-sync", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	if !validBearerToken(r, "secret") {
+		t.Errorf("validBearerToken rejected the configured token")
+	}
+	if validBearerToken(r, "") {
+		t.Errorf("validBearerToken accepted a request with no token configured")
+	}
+}
+
+// TestRetryReportRecord tests that a retry reports the sync it ran and how it finalized.
+func TestRetryReportRecord(t *testing.T) {
+	sdb := syncDB{}
+	report := &retryReport{QueryID: "q", ResumedFrom: "failed"}
+	start := report.record(sdb.startFederationSync)
+
+	id, finalize, err := start(context.Background(), &model.FederationQuery{QueryID: "q"}, time.Now())
+	if err != nil {
+		t.Fatalf("start returned unexpected error: %v", err)
+	}
+	if err := finalize(time.Unix(500, 0), 4, 1, 3, model.FederationSyncComplete); err != nil {
+		t.Fatalf("finalize returned unexpected error: %v", err)
+	}
+
+	want := &retryReport{QueryID: "q", ResumedFrom: "failed", SyncID: id, Status: model.FederationSyncComplete, Inserted: 4, Duplicates: 1}
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Errorf("report mismatch (-want +got):\n%s", diff)
+	}
+	if !sdb.syncCompleted || sdb.chunks != 3 {
+		t.Errorf("sync not finalized through the report, completed %v with %d chunks", sdb.syncCompleted, sdb.chunks)
+	}
+}
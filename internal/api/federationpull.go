@@ -16,9 +16,12 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,201 +31,537 @@ import (
 	"github.com/googlepartners/exposure-notifications/internal/pb"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	queryParam = "query-id"
+	queryParam  = "query-id"
+	dryRunParam = "dry-run"
 )
 
 var (
 	fetchBatchSize = database.InsertInfectionsBatchSize
+
+	// errRemoteUnreachable is returned by federationPull if the remote could not be reached before
+	// the sync started, in which case no sync is recorded.
+	errRemoteUnreachable = errors.New("remote federation server unreachable")
 )
 
 type fetchFn func(context.Context, *pb.FederationFetchRequest, ...grpc.CallOption) (*pb.FederationFetchResponse, error)
-type insertInfectionsFn func(context.Context, []*model.Infection) error
+
+// insertInfectionsFn inserts infections, skipping those already stored unless rejectDuplicates
+// is true, in which case it inserts none of them and returns an error wrapping
+// database.ErrDuplicateInfections. It returns the number inserted.
+type insertInfectionsFn func(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (int, error)
 type startFederationSyncFn func(context.Context, *model.FederationQuery, time.Time) (string, database.FinalizeSyncFn, error)
+type syncCanceledFn func(ctx context.Context, syncID string) (bool, error)
 
 type pullDependencies struct {
 	fetch               fetchFn
 	insertInfections    insertInfectionsFn
 	startFederationSync startFederationSyncFn
+	// syncCanceled is checked before each fetch of a sync after the first. If nil, the sync is
+	// never canceled.
+	syncCanceled syncCanceledFn
 }
 
 // NewFederationPullHandler returns a handler that will fetch server-to-server
-// federation results for a single federation query.
-func NewFederationPullHandler(db *database.DB, timeout time.Duration) http.Handler {
-	return &federationPullHandler{db: db, timeout: timeout}
+// federation results for a single federation query. If insertRate is positive, the keys of a
+// sync are inserted at no more than insertRate keys per second. If maxConcurrentSyncs is
+// positive, no more than maxConcurrentSyncs syncs run at once; the others wait, within their
+// timeout, for a running one to finish.
+func NewFederationPullHandler(db *database.DB, timeout time.Duration, insertRate, maxConcurrentSyncs int) *FederationPullHandler {
+	return &FederationPullHandler{db: db, timeout: timeout, insertRate: insertRate, syncs: newSyncLimiter(maxConcurrentSyncs)}
+}
+
+// FederationPullHandler runs the federation sync of the query named in each request.
+type FederationPullHandler struct {
+	db         *database.DB
+	timeout    time.Duration
+	insertRate int
+	syncs      *syncLimiter
+}
+
+// pullRequest is a sync the handler has been asked to run.
+type pullRequest struct {
+	query  *model.FederationQuery
+	dryRun bool
+	// from, if set, is the checkpoint of the failed sync to resume.
+	from *syncCheckpoint
+	// retry, if set, collects the outcome of an operator's retry for the response.
+	retry *retryReport
+}
+
+func (h *FederationPullHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, ok := h.requestedQuery(w, r)
+	if !ok {
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get(dryRunParam); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s value %q", dryRunParam, v), http.StatusBadRequest)
+			return
+		}
+	}
+	if !dryRun {
+		due, err := h.dueForSync(r.Context(), query, time.Now().UTC())
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed getting latest sync of query %q: %v", query.QueryID, err)
+			http.Error(w, fmt.Sprintf("Failed getting latest sync of query %q, check logs.", query.QueryID), http.StatusInternalServerError)
+			return
+		}
+		if !due {
+			// We return status 200 here so that Cloud Scheduler does not retry.
+			fmt.Fprintf(w, "Federation query %q skipped: last synced less than %v ago.", query.QueryID, query.SyncInterval)
+			return
+		}
+	}
+	h.pull(w, r, pullRequest{query: query, dryRun: dryRun})
 }
 
-type federationPullHandler struct {
-	db      *database.DB
-	timeout time.Duration
+// dueForSync reports whether a scheduled sync of query should run at now, given the start of its
+// latest sync as read from the primary. Retries are run regardless of the query's sync interval.
+func (h *FederationPullHandler) dueForSync(ctx context.Context, query *model.FederationQuery, now time.Time) (bool, error) {
+	if query.SyncInterval <= 0 {
+		return true, nil
+	}
+	latest, err := h.db.GetLatestFederationSync(ctx, query.QueryID)
+	if err == database.ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return query.DueForSync(latest.Started, now), nil
 }
 
-func (h *federationPullHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// requestedQuery returns the federation query named by the query-id parameter of r. If there is
+// none, the error has been written to w.
+func (h *FederationPullHandler) requestedQuery(w http.ResponseWriter, r *http.Request) (*model.FederationQuery, bool) {
 	ctx := r.Context()
 	logger := logging.FromContext(ctx)
 
 	queryIDs, ok := r.URL.Query()[queryParam]
 	if !ok {
 		http.Error(w, fmt.Sprintf("%s is required", queryParam), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	if len(queryIDs) > 1 {
 		http.Error(w, fmt.Sprintf("only one %s allowed", queryParam), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	queryID := queryIDs[0]
 	if queryID == "" {
 		http.Error(w, fmt.Sprintf("%s is required", queryParam), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	query, err := h.db.GetFederationQuery(ctx, queryID)
 	if err != nil {
 		if err == database.ErrNotFound {
 			http.Error(w, fmt.Sprintf("unknown %s", queryParam), http.StatusBadRequest)
-			return
+			return nil, false
 		}
 		logger.Errorf("Failed getting query %q: %v", queryID, err)
 		http.Error(w, fmt.Sprintf("Failed getting query %q, check logs.", queryID), http.StatusInternalServerError)
-		return
+		return nil, false
 	}
+	return query, true
+}
+
+// pull runs the sync req and writes its outcome to w. Scheduled syncs that cannot run are
+// answered with status 200, so that Cloud Scheduler does not retry them; an operator's retry is
+// told why instead.
+func (h *FederationPullHandler) pull(w http.ResponseWriter, r *http.Request, req pullRequest) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	query, queryID := req.query, req.query.QueryID
 
-	// Obtain lock to make sure there are no other processes working on this batch.
-	lock := "query_" + queryID
-	unlockFn, err := h.db.Lock(ctx, lock, h.timeout)
+	// A dry run writes nothing, so it does not need to hold the lock and hold up a real sync.
+	if !req.dryRun {
+		// Obtain lock to make sure there are no other processes working on this batch.
+		lock := "query_" + queryID
+		unlockFn, err := h.db.Lock(ctx, lock, h.timeout)
+		if err != nil {
+			if err == database.ErrAlreadyLocked {
+				msg := fmt.Sprintf("Lock %s already in use. No work will be performed.", lock)
+				logger.Infof(msg)
+				if req.retry != nil {
+					http.Error(w, msg, http.StatusConflict)
+					return
+				}
+				w.Write([]byte(msg)) // We return status 200 here so that Cloud Scheduler does not retry.
+				return
+			}
+			logger.Errorf("Could not acquire lock %s for query %s: %v", lock, queryID, err)
+			http.Error(w, fmt.Sprintf("Could not acquire lock %s for query %s, check logs.", lock, queryID), http.StatusInternalServerError)
+			return
+		}
+		defer unlockFn()
+	}
+
+	// Waiting for a free sync slot counts against the timeout, which the lock is held for.
+	timeoutContext, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	release, err := h.syncs.acquire(timeoutContext)
 	if err != nil {
-		if err == database.ErrAlreadyLocked {
-			msg := fmt.Sprintf("Lock %s already in use. No work will be performed.", lock)
-			logger.Infof(msg)
-			w.Write([]byte(msg)) // We return status 200 here so that Cloud Scheduler does not retry.
+		msg := fmt.Sprintf("Federation query %q skipped: too many syncs running.", queryID)
+		logger.Warnf("%s %v", msg, err)
+		if req.retry != nil {
+			http.Error(w, msg, http.StatusServiceUnavailable)
 			return
 		}
-		logger.Errorf("Could not acquire lock %s for query %s: %v", lock, queryID, err)
-		http.Error(w, fmt.Sprintf("Could not acquire lock %s for query %s, check logs.", lock, queryID), http.StatusInternalServerError)
+		w.Write([]byte(msg)) // We return status 200 here so that Cloud Scheduler does not retry and add to the load.
 		return
 	}
-	defer unlockFn()
+	defer release()
 
 	// TODO(jasonco): make secure
 	conn, err := grpc.Dial(query.ServerAddr, grpc.WithInsecure())
 	if err != nil {
 		logger.Errorf("Failed to dial for query %q %s: %v", queryID, query.ServerAddr, err)
 		http.Error(w, fmt.Sprintf("Failed to dial for query %q, check logs.", queryID), http.StatusInternalServerError)
+		return
 	}
 	defer conn.Close()
 	client := pb.NewFederationClient(conn)
 
-	timeoutContext, cancel := context.WithTimeout(ctx, h.timeout)
-	defer cancel()
-
 	deps := pullDependencies{
 		fetch:               client.Fetch,
-		insertInfections:    h.db.InsertInfections,
+		insertInfections:    newInsertLimiter(h.insertRate).limit(dbInsertInfections(h.db)),
 		startFederationSync: h.db.StartFederationSync,
+		syncCanceled:        h.db.FederationSyncCanceled,
+	}
+	var report *dryRunReport
+	if req.dryRun {
+		report = newDryRunReport(query)
+		deps = report.dependencies(client.Fetch)
+	}
+	if req.retry != nil {
+		deps.startFederationSync = req.retry.record(deps.startFederationSync)
 	}
 	batchStart := time.Now().UTC()
-	if err := federationPull(timeoutContext, deps, query, batchStart); err != nil {
-		logger.Errorf("Federation query %q failed: %v", queryID, err)
+	if err := federationPull(timeoutContext, deps, query, batchStart, req.from); err != nil {
+		if !req.dryRun {
+			// The pull's own deadline may have passed, so record against the request context.
+			if rerr := h.db.RecordFederationQueryError(ctx, queryID, err.Error(), time.Now().UTC()); rerr != nil {
+				logger.Errorf("Failed recording error of query %q: %v", queryID, rerr)
+			}
+		}
+		if req.retry != nil {
+			logger.Errorf("Retry of federation query %q failed: %v", queryID, err)
+			req.retry.Error = err.Error()
+			writeRetryReport(ctx, w, http.StatusInternalServerError, req.retry)
+			return
+		}
+		if errors.Is(err, errRemoteUnreachable) {
+			msg := fmt.Sprintf("Federation query %q skipped: remote %s unreachable.", queryID, query.ServerAddr)
+			logger.Warnf("%s %v", msg, err)
+			w.Write([]byte(msg)) // We return status 200 here so that Cloud Scheduler does not retry; the next scheduled sync will try again.
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Errorf("Federation puller timed out at %v before fetching entire set: %v", h.timeout, err)
+		} else {
+			logger.Errorf("Federation query %q failed: %v", queryID, err)
+		}
 		http.Error(w, fmt.Sprintf("Federation query %q fetch failed, check logs.", queryID), http.StatusInternalServerError)
+		return
 	}
 
-	if timeoutContext.Err() != nil && timeoutContext.Err() == context.DeadlineExceeded {
-		logger.Infof("Federation puller timed out at %v before fetching entire set.", h.timeout)
+	if report != nil {
+		logger.Infof("Dry run of federation query %q fetched %d keys", queryID, report.Keys)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logger.Errorf("Failed writing dry run report for query %q: %v", queryID, err)
+		}
+	}
+	if req.retry != nil {
+		writeRetryReport(ctx, w, http.StatusOK, req.retry)
 	}
 }
 
-func federationPull(ctx context.Context, deps pullDependencies, q *model.FederationQuery, batchStart time.Time) error {
-	logger := logging.FromContext(ctx)
-	logger.Infof("Processing query %q", q.QueryID)
+// dryRunReport summarizes what a federation sync would store, without storing anything.
+type dryRunReport struct {
+	QueryID string `json:"queryID"`
+	// Keys is the number of keys that would be inserted.
+	Keys int `json:"keys"`
+	// Regions is the number of keys that would be inserted for each region. A key listed for
+	// several regions is counted in each of them.
+	Regions map[string]int `json:"regions"`
+	// LastTimestamp is the cursor the sync currently starts from, NextTimestamp the one it would
+	// advance to.
+	LastTimestamp time.Time `json:"lastTimestamp"`
+	NextTimestamp time.Time `json:"nextTimestamp"`
+}
 
-	request := &pb.FederationFetchRequest{
-		RegionIdentifiers:             q.IncludeRegions,
-		ExcludeRegionIdentifiers:      q.ExcludeRegions,
-		LastFetchResponseKeyTimestamp: q.LastTimestamp.Unix(),
+func newDryRunReport(q *model.FederationQuery) *dryRunReport {
+	return &dryRunReport{
+		QueryID:       q.QueryID,
+		Regions:       make(map[string]int),
+		LastTimestamp: q.LastTimestamp,
+		NextTimestamp: q.LastTimestamp,
 	}
+}
 
-	syncID, finalizeFn, err := deps.startFederationSync(ctx, q, batchStart)
-	if err != nil {
-		return fmt.Errorf("starting federation sync for query %s: %v", q.QueryID, err)
+// dependencies returns pull dependencies that fetch with fetch and record into the report
+// instead of inserting infections or recording a sync.
+func (r *dryRunReport) dependencies(fetch fetchFn) pullDependencies {
+	return pullDependencies{
+		fetch: fetch,
+		insertInfections: func(_ context.Context, infections []*model.Infection, _ bool) (int, error) {
+			r.Keys += len(infections)
+			for _, inf := range infections {
+				for _, region := range inf.Regions {
+					r.Regions[region]++
+				}
+			}
+			return len(infections), nil
+		},
+		startFederationSync: func(context.Context, *model.FederationQuery, time.Time) (string, database.FinalizeSyncFn, error) {
+			return "", func(maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string) error {
+				// As in a real sync, the cursor only moves if a completed sync got past it.
+				if status == model.FederationSyncComplete && maxTimestamp.After(r.LastTimestamp) {
+					r.NextTimestamp = maxTimestamp
+				}
+				return nil
+			}, nil
+		},
 	}
+}
 
-	var maxTimestamp time.Time
-	total := 0
-	defer func() {
-		logger.Infof("Inserted %d keys", total)
-	}()
+// dbInsertInfections returns an insertInfectionsFn storing infections in db.
+func dbInsertInfections(db *database.DB) insertInfectionsFn {
+	return func(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (int, error) {
+		if rejectDuplicates {
+			return db.InsertInfectionsRejectingDuplicates(ctx, infections)
+		}
+		return db.InsertNewInfections(ctx, infections)
+	}
+}
 
-	createdAt := model.TruncateWindow(batchStart)
-	partial := true
-	for partial {
+// syncCheckpoint is how far a failed sync got: the number of region chunks of its query it
+// fetched completely, and the newest key timestamp among them. Each chunk starts from the last
+// timestamp of the query, which a failed sync does not advance, so a sync resuming from the
+// checkpoint only needs to fetch the remaining chunks. It is only meaningful for the latest
+// sync of a query whose region layout is still regionLayout.
+type syncCheckpoint struct {
+	syncID       string
+	chunks       int
+	maxTimestamp time.Time
+	regionLayout string
+}
+
+// failedSyncCheckpoint returns the checkpoint of s, or nil if s did not fail.
+func failedSyncCheckpoint(s *model.FederationSync) *syncCheckpoint {
+	if s.Status != model.FederationSyncFailed {
+		return nil
+	}
+	return &syncCheckpoint{syncID: s.SyncID, chunks: s.CompletedChunks, maxTimestamp: s.MaxTimestamp, regionLayout: s.RegionLayout}
+}
 
-		// TODO(jasonco): react to the context timeout and complete a chunk of work so next invocation can pick up where left off.
+// federationPull runs a sync of q, resuming from the checkpoint from if it is not nil. A sync
+// that fails once it has started is finalized as model.FederationSyncFailed with its checkpoint.
+func federationPull(ctx context.Context, deps pullDependencies, q *model.FederationQuery, batchStart time.Time, from *syncCheckpoint) (err error) {
+	logger := logging.FromContext(ctx)
+	logger.Infof("Processing query %q", q.QueryID)
 
-		response, err := deps.fetch(ctx, request)
+	// The sync is only recorded once the remote has answered, so that an unreachable remote does
+	// not leave a sync that never completes.
+	var (
+		syncID     string
+		finalizeFn database.FinalizeSyncFn
+		finalized  bool
+	)
+
+	// checkpointTimestamp is the newest key timestamp of the completedChunks chunks.
+	var maxTimestamp, checkpointTimestamp time.Time
+	total, duplicates, completedChunks := 0, 0, 0
+	defer func() {
+		logger.Infof("Inserted %d keys, skipped %d duplicates", total, duplicates)
+	}()
+	defer func() {
+		if err == nil || finalizeFn == nil || finalized {
+			return
+		}
+		if ferr := finalizeFn(checkpointTimestamp, total, duplicates, completedChunks, model.FederationSyncFailed); ferr != nil {
+			logger.Errorf("Failed recording failure of sync %s of query %q: %v", syncID, q.QueryID, ferr)
+		}
+	}()
+
+	// A query without a valid policy would have been rejected when it was stored.
+	policy, err := model.ParseDuplicatePolicy(string(q.DuplicatePolicy))
+	if err != nil {
+		return fmt.Errorf("query %s: %v", q.QueryID, err)
+	}
+	insert := func(infections []*model.Infection) error {
+		inserted, err := deps.insertInfections(ctx, infections, policy == model.DuplicatesError)
 		if err != nil {
-			return fmt.Errorf("fetching query %s: %v", q.QueryID, err)
+			return fmt.Errorf("inserting %d infections: %w", len(infections), err)
+		}
+		total += inserted
+		duplicates += len(infections) - inserted
+		if policy == model.DuplicatesCount && inserted < len(infections) {
+			logger.Warnf("Query %q fetched %d keys that were already stored", q.QueryID, len(infections)-inserted)
 		}
+		return nil
+	}
 
-		responseTimestamp := time.Unix(response.FetchResponseKeyTimestamp, 0).UTC()
-		if responseTimestamp.After(maxTimestamp) {
-			maxTimestamp = responseTimestamp
+	finalize := func(status string) error {
+		finalized = true
+		if err := finalizeFn(maxTimestamp, total, duplicates, completedChunks, status); err != nil {
+			// TODO(jasonco): how do we clean up here? Just leave the records in and have the exporter eliminate them? Other?
+			return fmt.Errorf("finalizing federation sync for query %s: %v", q.QueryID, err)
 		}
+		return nil
+	}
 
-		// Loop through the result set, storing in database.
-		var infections []*model.Infection
-		for _, ctr := range response.Response {
+	chunks := chunkRegions(q.IncludeRegions, q.RegionChunkSize)
+	if from != nil {
+		// Once the regions or chunk size of the query change, the completed chunks of the failed
+		// sync are no longer the first chunks of the query, so the sync starts over.
+		if from.regionLayout != q.RegionLayout() {
+			logger.Warnf("Not resuming failed sync %s of query %q: the regions of the query changed since", from.syncID, q.QueryID)
+		} else if from.chunks < len(chunks) {
+			logger.Infof("Resuming failed sync %s of query %q after %d of %d region chunks", from.syncID, q.QueryID, from.chunks, len(chunks))
+			completedChunks = from.chunks
+			maxTimestamp, checkpointTimestamp = from.maxTimestamp, from.maxTimestamp
+		} else {
+			logger.Warnf("Not resuming failed sync %s of query %q: it completed %d region chunks, the query has %d", from.syncID, q.QueryID, from.chunks, len(chunks))
+		}
+	}
 
-			var upperRegions []string
-			for _, region := range ctr.RegionIdentifiers {
-				upperRegions = append(upperRegions, strings.ToUpper(strings.TrimSpace(region)))
+	createdAt := model.TruncateWindow(batchStart)
+	for _, regions := range chunks[completedChunks:] {
+		request := &pb.FederationFetchRequest{
+			RegionIdentifiers:             regions,
+			ExcludeRegionIdentifiers:      q.ExcludeRegions,
+			LastFetchResponseKeyTimestamp: q.LastTimestamp.Unix(),
+		}
+		partial := true
+		for partial {
+			// Once the invocation is cancelled or times out, no further page is fetched. The sync
+			// fails with the chunks completed so far as its checkpoint, to be resumed.
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("query %s interrupted after %d of %d region chunks: %w", q.QueryID, completedChunks, len(chunks), err)
 			}
-			sort.Strings(upperRegions)
 
-			for _, cti := range ctr.ContactTracingInfo {
+			// Each fetch once the sync has started is a checkpoint at which an operator may cancel it.
+			if finalizeFn != nil && syncCanceled(ctx, deps, q, syncID) {
+				logger.Infof("Sync %s of query %q canceled after inserting %d keys", syncID, q.QueryID, total)
+				return finalize(model.FederationSyncCanceled)
+			}
 
-				verificationAuthName := strings.ToUpper(strings.TrimSpace(cti.VerificationAuthorityName))
+			// The fetch is aborted as soon as ctx is done.
+			response, err := deps.fetch(ctx, request)
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return fmt.Errorf("query %s interrupted fetching after %d of %d region chunks: %w: %v", q.QueryID, completedChunks, len(chunks), ctxErr, err)
+				}
+				if finalizeFn == nil && isUnreachable(err) {
+					return fmt.Errorf("%w: query %s: %v", errRemoteUnreachable, q.QueryID, err)
+				}
+				return fmt.Errorf("fetching query %s: %v", q.QueryID, err)
+			}
+			if finalizeFn == nil {
+				syncID, finalizeFn, err = deps.startFederationSync(ctx, q, batchStart)
+				if err != nil {
+					return fmt.Errorf("starting federation sync for query %s: %v", q.QueryID, err)
+				}
+			}
 
-				for _, key := range cti.ExposureKeys {
+			responseTimestamp := time.Unix(response.FetchResponseKeyTimestamp, 0).UTC()
+			if responseTimestamp.After(maxTimestamp) {
+				maxTimestamp = responseTimestamp
+			}
 
-					infections = append(infections, &model.Infection{
-						TransmissionRisk:          int(cti.TransmissionRisk),
-						ExposureKey:               key.ExposureKey,
-						Regions:                   upperRegions,
-						FederationSyncID:          syncID,
-						IntervalNumber:            key.IntervalNumber,
-						IntervalCount:             key.IntervalCount,
-						CreatedAt:                 createdAt,
-						LocalProvenance:           false,
-						VerificationAuthorityName: verificationAuthName,
-					})
+			// Loop through the result set, storing in database.
+			var infections []*model.Infection
+			for _, ctr := range response.Response {
 
-					if len(infections) == fetchBatchSize {
-						if err := deps.insertInfections(ctx, infections); err != nil {
-							return fmt.Errorf("inserting %d infections: %v", len(infections), err)
+				var upperRegions []string
+				for _, region := range ctr.RegionIdentifiers {
+					upperRegions = append(upperRegions, strings.ToUpper(strings.TrimSpace(region)))
+				}
+				sort.Strings(upperRegions)
+
+				for _, cti := range ctr.ContactTracingInfo {
+
+					verificationAuthName := strings.ToUpper(strings.TrimSpace(cti.VerificationAuthorityName))
+
+					for _, key := range cti.ExposureKeys {
+
+						infections = append(infections, &model.Infection{
+							TransmissionRisk:          int(cti.TransmissionRisk),
+							ExposureKey:               key.ExposureKey,
+							Regions:                   upperRegions,
+							FederationSyncID:          syncID,
+							IntervalNumber:            key.IntervalNumber,
+							IntervalCount:             key.IntervalCount,
+							CreatedAt:                 createdAt,
+							LocalProvenance:           false,
+							VerificationAuthorityName: verificationAuthName,
+						})
+
+						if len(infections) == fetchBatchSize {
+							if err := insert(infections); err != nil {
+								return err
+							}
+							infections = nil // Start a new batch.
 						}
-						total += len(infections)
-						infections = nil // Start a new batch.
 					}
 				}
 			}
-		}
-		if len(infections) > 0 {
-			if err := deps.insertInfections(ctx, infections); err != nil {
-				return fmt.Errorf("inserting %d infections: %v", len(infections), err)
+			if len(infections) > 0 {
+				if err := insert(infections); err != nil {
+					return err
+				}
 			}
-			total += len(infections)
-		}
 
-		partial = response.PartialResponse
-		request.NextFetchToken = response.NextFetchToken
+			partial = response.PartialResponse
+			request.NextFetchToken = response.NextFetchToken
+		}
+		completedChunks++
+		checkpointTimestamp = maxTimestamp
 	}
 
-	if err := finalizeFn(maxTimestamp, total); err != nil {
-		// TODO(jasonco): how do we clean up here? Just leave the records in and have the exporter eliminate them? Other?
-		return fmt.Errorf("finalizing federation sync for query %s: %v", q.QueryID, err)
+	return finalize(model.FederationSyncComplete)
+}
+
+// syncCanceled reports whether an operator has asked to cancel the sync syncID of q. Failing to
+// check is logged and does not stop the sync.
+func syncCanceled(ctx context.Context, deps pullDependencies, q *model.FederationQuery, syncID string) bool {
+	if deps.syncCanceled == nil {
+		return false
 	}
+	canceled, err := deps.syncCanceled(ctx, syncID)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Failed checking for cancellation of sync %s of query %q: %v", syncID, q.QueryID, err)
+		return false
+	}
+	return canceled
+}
 
-	return nil
+// isUnreachable reports whether err, returned by a fetch, means the remote could not be reached.
+func isUnreachable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// chunkRegions splits regions into chunks of at most size regions. If size is not positive, or
+// there are no more than size regions, a single chunk containing all regions is returned.
+func chunkRegions(regions []string, size int) [][]string {
+	if size <= 0 || len(regions) <= size {
+		return [][]string{regions}
+	}
+	var chunks [][]string
+	for len(regions) > size {
+		chunks = append(chunks, regions[:size])
+		regions = regions[size:]
+	}
+	return append(chunks, regions)
 }
@@ -16,6 +16,8 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -26,6 +28,8 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -42,13 +46,15 @@ func makeRemoteInfection(diagKey *pb.ExposureKey, diagStatus pb.TransmissionRisk
 
 // remoteFetchServer mocks responses from the remote federation server.
 type remoteFetchServer struct {
-	responses []*pb.FederationFetchResponse
-	gotTokens []string
-	index     int
+	responses  []*pb.FederationFetchResponse
+	gotTokens  []string
+	gotRegions [][]string
+	index      int
 }
 
 func (r *remoteFetchServer) fetch(ctx context.Context, req *pb.FederationFetchRequest, opts ...grpc.CallOption) (*pb.FederationFetchResponse, error) {
 	r.gotTokens = append(r.gotTokens, req.NextFetchToken)
+	r.gotRegions = append(r.gotRegions, req.RegionIdentifiers)
 	if r.responses == nil || r.index > len(r.responses) {
 		return &pb.FederationFetchResponse{}, nil
 	}
@@ -57,14 +63,41 @@ func (r *remoteFetchServer) fetch(ctx context.Context, req *pb.FederationFetchRe
 	return response, nil
 }
 
-// infectionDB mocks the database, recording infection insertions.
+// infectionDB mocks the database, recording infection insertions. Like the Infection table, it
+// skips, or rejects, infections whose exposure key is already stored, whatever its regions.
 type infectionDB struct {
 	infections []*model.Infection
+	stored     map[string]bool
 }
 
-func (idb *infectionDB) insertInfections(ctx context.Context, infections []*model.Infection) error {
-	idb.infections = append(idb.infections, infections...)
-	return nil
+func infectionDBKey(inf *model.Infection) string {
+	return fmt.Sprintf("%x/%s", inf.ExposureKey, inf.RegionCopy)
+}
+
+// store marks infections as already stored, without recording them as inserted.
+func (idb *infectionDB) store(infections ...*model.Infection) {
+	if idb.stored == nil {
+		idb.stored = make(map[string]bool)
+	}
+	for _, inf := range infections {
+		idb.stored[infectionDBKey(inf)] = true
+	}
+}
+
+func (idb *infectionDB) insertInfections(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (int, error) {
+	var inserted []*model.Infection
+	for _, inf := range infections {
+		if idb.stored[infectionDBKey(inf)] {
+			if rejectDuplicates {
+				return 0, database.ErrDuplicateInfections
+			}
+			continue
+		}
+		inserted = append(inserted, inf)
+	}
+	idb.store(inserted...)
+	idb.infections = append(idb.infections, inserted...)
+	return len(inserted), nil
 }
 
 // syncDB mocks the database, recording start and complete invocations for a sync record.
@@ -74,13 +107,19 @@ type syncDB struct {
 	completed     time.Time
 	maxTimestamp  time.Time
 	totalInserted int
+	duplicates    int
+	chunks        int
+	status        string
 }
 
 func (sdb *syncDB) startFederationSync(ctx context.Context, query *model.FederationQuery, start time.Time) (string, database.FinalizeSyncFn, error) {
 	sdb.syncStarted = true
 	timerStart := time.Now().UTC()
-	return syncID, func(maxTimestamp time.Time, totalInserted int) error {
+	return syncID, func(maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string) error {
 		sdb.syncCompleted = true
+		sdb.chunks = completedChunks
+		sdb.duplicates = duplicates
+		sdb.status = status
 		sdb.completed = start.Add(time.Now().UTC().Sub(timerStart))
 		sdb.maxTimestamp = maxTimestamp
 		sdb.totalInserted = totalInserted
@@ -240,7 +279,7 @@ func TestFederationPull(t *testing.T) {
 				startFederationSync: sdb.startFederationSync,
 			}
 
-			err := federationPull(ctx, deps, query, batchStart)
+			err := federationPull(ctx, deps, query, batchStart, nil)
 			if err != nil {
 				t.Fatalf("pull returned err=%v, want err=nil", err)
 			}
@@ -269,3 +308,776 @@ func TestFederationPull(t *testing.T) {
 		})
 	}
 }
+
+// TestFederationPullChunks tests federationPull() with the include regions split into chunks.
+func TestFederationPullChunks(t *testing.T) {
+	ctx := context.Background()
+	query := &model.FederationQuery{
+		IncludeRegions:  []string{"US", "CA", "MX", "GB", "FR"},
+		RegionChunkSize: 2,
+	}
+	remote := remoteFetchServer{
+		responses: []*pb.FederationFetchResponse{
+			{
+				PartialResponse: true,
+				NextFetchToken:  "abcdef",
+				Response: []*pb.ContactTracingResponse{
+					{
+						ContactTracingInfo: []*pb.ContactTracingInfo{
+							{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{aaa}},
+						},
+						RegionIdentifiers: []string{"US"},
+					},
+				},
+				FetchResponseKeyTimestamp: 200,
+			},
+			{
+				Response: []*pb.ContactTracingResponse{
+					{
+						ContactTracingInfo: []*pb.ContactTracingInfo{
+							{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{bbb}},
+						},
+						RegionIdentifiers: []string{"CA"},
+					},
+				},
+				FetchResponseKeyTimestamp: 300,
+			},
+			{
+				Response: []*pb.ContactTracingResponse{
+					{
+						ContactTracingInfo: []*pb.ContactTracingInfo{
+							{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{ccc}},
+						},
+						RegionIdentifiers: []string{"GB"},
+					},
+				},
+				FetchResponseKeyTimestamp: 500,
+			},
+			{
+				Response: []*pb.ContactTracingResponse{
+					{
+						ContactTracingInfo: []*pb.ContactTracingInfo{
+							{TransmissionRisk: selfver, ExposureKeys: []*pb.ExposureKey{ddd}},
+						},
+						RegionIdentifiers: []string{"FR"},
+					},
+				},
+				FetchResponseKeyTimestamp: 400,
+			},
+		},
+	}
+	idb := infectionDB{}
+	sdb := syncDB{}
+	deps := pullDependencies{
+		fetch:               remote.fetch,
+		insertInfections:    idb.insertInfections,
+		startFederationSync: sdb.startFederationSync,
+	}
+
+	if err := federationPull(ctx, deps, query, time.Now().UTC(), nil); err != nil {
+		t.Fatalf("pull returned err=%v, want err=nil", err)
+	}
+
+	wantRegions := [][]string{{"US", "CA"}, {"US", "CA"}, {"MX", "GB"}, {"FR"}}
+	if diff := cmp.Diff(wantRegions, remote.gotRegions); diff != "" {
+		t.Errorf("regions mismatch (-want +got):\n%s", diff)
+	}
+	wantTokens := []string{"", "abcdef", "", ""}
+	if diff := cmp.Diff(wantTokens, remote.gotTokens); diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+	wantInfections := []*model.Infection{
+		makeRemoteInfection(aaa, posver, "", "US"),
+		makeRemoteInfection(bbb, posver, "", "CA"),
+		makeRemoteInfection(ccc, posver, "", "GB"),
+		makeRemoteInfection(ddd, selfver, "", "FR"),
+	}
+	if diff := cmp.Diff(wantInfections, idb.infections, cmpopts.IgnoreFields(model.Infection{}, "CreatedAt")); diff != "" {
+		t.Errorf("infections mismatch (-want +got):\n%s", diff)
+	}
+	if want := time.Unix(500, 0).UTC(); sdb.maxTimestamp != want {
+		t.Errorf("federation sync max timestamp got %v, want %v", sdb.maxTimestamp, want)
+	}
+	if sdb.totalInserted != len(wantInfections) {
+		t.Errorf("federation sync total inserted got %d, want %d", sdb.totalInserted, len(wantInfections))
+	}
+}
+
+// TestFederationPullResume tests that a failed sync records the region chunks it completed, and
+// that a sync resuming from that checkpoint fetches only the remaining chunks and finalizes with
+// the newest timestamp of both.
+func TestFederationPullResume(t *testing.T) {
+	ctx := context.Background()
+	query := &model.FederationQuery{
+		IncludeRegions:  []string{"US", "CA", "MX", "GB", "FR"},
+		RegionChunkSize: 2,
+	}
+	keyResponse := func(key *pb.ExposureKey, region string, timestamp int64, partial bool) *pb.FederationFetchResponse {
+		return &pb.FederationFetchResponse{
+			PartialResponse: partial,
+			NextFetchToken:  map[bool]string{true: "next"}[partial],
+			Response: []*pb.ContactTracingResponse{
+				{
+					ContactTracingInfo: []*pb.ContactTracingInfo{{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{key}}},
+					RegionIdentifiers:  []string{region},
+				},
+			},
+			FetchResponseKeyTimestamp: timestamp,
+		}
+	}
+
+	// The first sync completes the first chunk, then fails partway through the second.
+	remote := remoteFetchServer{
+		responses: []*pb.FederationFetchResponse{
+			keyResponse(aaa, "US", 200, true),
+			keyResponse(bbb, "CA", 300, false),
+			keyResponse(ccc, "GB", 500, true),
+		},
+	}
+	failingFetch := func(ctx context.Context, req *pb.FederationFetchRequest, opts ...grpc.CallOption) (*pb.FederationFetchResponse, error) {
+		if remote.index == len(remote.responses) {
+			return nil, status.Error(codes.Internal, "partner hiccup")
+		}
+		return remote.fetch(ctx, req, opts...)
+	}
+	idb := infectionDB{}
+	failed := syncDB{}
+	deps := pullDependencies{
+		fetch:               failingFetch,
+		insertInfections:    idb.insertInfections,
+		startFederationSync: failed.startFederationSync,
+	}
+	if err := federationPull(ctx, deps, query, time.Now().UTC(), nil); err == nil {
+		t.Fatalf("pull returned err=nil, want error")
+	}
+	if failed.status != model.FederationSyncFailed {
+		t.Fatalf("failed sync finalized as %q, want %q", failed.status, model.FederationSyncFailed)
+	}
+	if failed.chunks != 1 {
+		t.Errorf("failed sync completed chunks got %d, want 1", failed.chunks)
+	}
+	// The timestamp of the unfinished chunk is not part of the checkpoint.
+	if want := time.Unix(300, 0).UTC(); failed.maxTimestamp != want {
+		t.Errorf("failed sync max timestamp got %v, want %v", failed.maxTimestamp, want)
+	}
+	if failed.totalInserted != 3 {
+		t.Errorf("failed sync total inserted got %d, want 3", failed.totalInserted)
+	}
+
+	from := failedSyncCheckpoint(&model.FederationSync{
+		SyncID:          "failed",
+		Status:          failed.status,
+		CompletedChunks: failed.chunks,
+		MaxTimestamp:    failed.maxTimestamp,
+		RegionLayout:    query.RegionLayout(),
+	})
+	if from == nil {
+		t.Fatalf("failedSyncCheckpoint returned nil for a failed sync")
+	}
+
+	// The retry refetches the second chunk from its start, skipping the key already stored.
+	retry := remoteFetchServer{
+		responses: []*pb.FederationFetchResponse{
+			keyResponse(ccc, "GB", 500, false),
+			keyResponse(ddd, "FR", 400, false),
+		},
+	}
+	resumed := syncDB{}
+	deps = pullDependencies{
+		fetch:               retry.fetch,
+		insertInfections:    idb.insertInfections,
+		startFederationSync: resumed.startFederationSync,
+	}
+	if err := federationPull(ctx, deps, query, time.Now().UTC(), from); err != nil {
+		t.Fatalf("resumed pull returned err=%v, want err=nil", err)
+	}
+
+	wantRegions := [][]string{{"MX", "GB"}, {"FR"}}
+	if diff := cmp.Diff(wantRegions, retry.gotRegions); diff != "" {
+		t.Errorf("resumed regions mismatch (-want +got):\n%s", diff)
+	}
+	wantInfections := []*model.Infection{
+		makeRemoteInfection(aaa, posver, "", "US"),
+		makeRemoteInfection(bbb, posver, "", "CA"),
+		makeRemoteInfection(ccc, posver, "", "GB"),
+		makeRemoteInfection(ddd, posver, "", "FR"),
+	}
+	if diff := cmp.Diff(wantInfections, idb.infections, cmpopts.IgnoreFields(model.Infection{}, "CreatedAt")); diff != "" {
+		t.Errorf("infections mismatch (-want +got):\n%s", diff)
+	}
+	if resumed.status != model.FederationSyncComplete {
+		t.Errorf("resumed sync finalized as %q, want %q", resumed.status, model.FederationSyncComplete)
+	}
+	if resumed.chunks != 3 {
+		t.Errorf("resumed sync completed chunks got %d, want 3", resumed.chunks)
+	}
+	if want := time.Unix(500, 0).UTC(); resumed.maxTimestamp != want {
+		t.Errorf("resumed sync max timestamp got %v, want %v", resumed.maxTimestamp, want)
+	}
+	if resumed.totalInserted != 1 || resumed.duplicates != 1 {
+		t.Errorf("resumed sync inserted %d, skipped %d duplicates, want 1 and 1", resumed.totalInserted, resumed.duplicates)
+	}
+}
+
+// TestFederationPullResumeRegionsChanged tests that a failed sync is not resumed once the regions
+// of its query changed, since its completed chunks are not those of the query any more.
+func TestFederationPullResumeRegionsChanged(t *testing.T) {
+	before := &model.FederationQuery{QueryID: "query", IncludeRegions: []string{"US", "CA", "MX"}, RegionChunkSize: 2}
+	from := failedSyncCheckpoint(&model.FederationSync{
+		SyncID:          "failed",
+		Status:          model.FederationSyncFailed,
+		CompletedChunks: 1,
+		MaxTimestamp:    time.Unix(300, 0).UTC(),
+		RegionLayout:    before.RegionLayout(),
+	})
+
+	testCases := []struct {
+		name   string
+		change func(q *model.FederationQuery)
+		want   [][]string
+	}{
+		{name: "region added", change: func(q *model.FederationQuery) { q.IncludeRegions = []string{"GB", "US", "CA", "MX"} }, want: [][]string{{"GB", "US"}, {"CA", "MX"}}},
+		{name: "chunk size", change: func(q *model.FederationQuery) { q.RegionChunkSize = 1 }, want: [][]string{{"US"}, {"CA"}, {"MX"}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := *before
+			tc.change(&query)
+			remote := remoteFetchServer{}
+			for range tc.want {
+				remote.responses = append(remote.responses, &pb.FederationFetchResponse{FetchResponseKeyTimestamp: 200})
+			}
+			idb := infectionDB{}
+			sdb := syncDB{}
+			deps := pullDependencies{
+				fetch:               remote.fetch,
+				insertInfections:    idb.insertInfections,
+				startFederationSync: sdb.startFederationSync,
+			}
+
+			if err := federationPull(context.Background(), deps, &query, time.Now().UTC(), from); err != nil {
+				t.Fatalf("pull returned err=%v, want err=nil", err)
+			}
+			// Every chunk of the new layout is fetched, and the checkpoint timestamp is not used.
+			if diff := cmp.Diff(tc.want, remote.gotRegions); diff != "" {
+				t.Errorf("fetched regions mismatch (-want +got):\n%s", diff)
+			}
+			if sdb.chunks != len(tc.want) {
+				t.Errorf("sync completed chunks got %d, want %d", sdb.chunks, len(tc.want))
+			}
+			if want := time.Unix(200, 0).UTC(); sdb.maxTimestamp != want {
+				t.Errorf("sync max timestamp got %v, want %v", sdb.maxTimestamp, want)
+			}
+		})
+	}
+}
+
+// TestFailedSyncCheckpoint tests that only failed syncs have a checkpoint.
+func TestFailedSyncCheckpoint(t *testing.T) {
+	for _, status := range []string{"", model.FederationSyncComplete, model.FederationSyncCanceled} {
+		if got := failedSyncCheckpoint(&model.FederationSync{Status: status, CompletedChunks: 1}); got != nil {
+			t.Errorf("failedSyncCheckpoint(%q) = %+v, want nil", status, got)
+		}
+	}
+}
+
+// TestFederationPullDuplicatePolicy tests federationPull() with each duplicate policy against a
+// batch containing keys that are already stored.
+func TestFederationPullDuplicatePolicy(t *testing.T) {
+	response := &pb.FederationFetchResponse{
+		Response: []*pb.ContactTracingResponse{
+			{
+				ContactTracingInfo: []*pb.ContactTracingInfo{
+					{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{aaa, bbb, ccc}},
+				},
+				RegionIdentifiers: []string{"US"},
+			},
+		},
+		FetchResponseKeyTimestamp: 200,
+	}
+	stored := []*model.Infection{
+		makeRemoteInfection(aaa, posver, "", "US"),
+		makeRemoteInfection(ccc, posver, "", "US"),
+	}
+
+	testCases := []struct {
+		name           string
+		policy         model.DuplicatePolicy
+		wantInfections []*model.Infection
+		wantDuplicates int
+		wantErr        error
+	}{
+		{name: "default", wantInfections: []*model.Infection{makeRemoteInfection(bbb, posver, "", "US")}, wantDuplicates: 2},
+		{name: "skip", policy: model.DuplicatesSkip, wantInfections: []*model.Infection{makeRemoteInfection(bbb, posver, "", "US")}, wantDuplicates: 2},
+		{name: "count", policy: model.DuplicatesCount, wantInfections: []*model.Infection{makeRemoteInfection(bbb, posver, "", "US")}, wantDuplicates: 2},
+		{name: "error", policy: model.DuplicatesError, wantErr: database.ErrDuplicateInfections},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := &model.FederationQuery{QueryID: "query", DuplicatePolicy: tc.policy}
+			remote := remoteFetchServer{responses: []*pb.FederationFetchResponse{response}}
+			idb := infectionDB{}
+			idb.store(stored...)
+			sdb := syncDB{}
+			deps := pullDependencies{
+				fetch:               remote.fetch,
+				insertInfections:    idb.insertInfections,
+				startFederationSync: sdb.startFederationSync,
+			}
+
+			err := federationPull(context.Background(), deps, query, time.Now().UTC(), nil)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("pull returned err=%v, want err=%v", err, tc.wantErr)
+				}
+				if len(idb.infections) != 0 {
+					t.Errorf("inserted %d infections, want none", len(idb.infections))
+				}
+				if sdb.status != model.FederationSyncFailed {
+					t.Errorf("federation sync finalized as %q, want %q", sdb.status, model.FederationSyncFailed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pull returned err=%v, want err=nil", err)
+			}
+			if diff := cmp.Diff(tc.wantInfections, idb.infections, cmpopts.IgnoreFields(model.Infection{}, "CreatedAt")); diff != "" {
+				t.Errorf("infections mismatch (-want +got):\n%s", diff)
+			}
+			if sdb.totalInserted != len(tc.wantInfections) {
+				t.Errorf("federation sync total inserted got %d, want %d", sdb.totalInserted, len(tc.wantInfections))
+			}
+			if sdb.duplicates != tc.wantDuplicates {
+				t.Errorf("federation sync duplicates got %d, want %d", sdb.duplicates, tc.wantDuplicates)
+			}
+		})
+	}
+}
+
+// TestFederationPullAllDuplicates tests that a sync fetching only keys that are already stored
+// completes with the timestamp of the response, so that the query's cursor still advances.
+func TestFederationPullAllDuplicates(t *testing.T) {
+	response := &pb.FederationFetchResponse{
+		Response: []*pb.ContactTracingResponse{
+			{
+				ContactTracingInfo: []*pb.ContactTracingInfo{
+					{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{aaa, bbb}},
+				},
+				RegionIdentifiers: []string{"US"},
+			},
+		},
+		FetchResponseKeyTimestamp: 200,
+	}
+	query := &model.FederationQuery{QueryID: "query", LastTimestamp: time.Unix(100, 0).UTC()}
+	remote := remoteFetchServer{responses: []*pb.FederationFetchResponse{response}}
+	idb := infectionDB{}
+	idb.store(makeRemoteInfection(aaa, posver, "", "US"), makeRemoteInfection(bbb, posver, "", "US"))
+	sdb := syncDB{}
+	deps := pullDependencies{
+		fetch:               remote.fetch,
+		insertInfections:    idb.insertInfections,
+		startFederationSync: sdb.startFederationSync,
+	}
+
+	if err := federationPull(context.Background(), deps, query, time.Now().UTC(), nil); err != nil {
+		t.Fatalf("pull returned err=%v, want err=nil", err)
+	}
+	if sdb.status != model.FederationSyncComplete {
+		t.Errorf("federation sync finalized as %q, want %q", sdb.status, model.FederationSyncComplete)
+	}
+	if sdb.totalInserted != 0 || sdb.duplicates != 2 {
+		t.Errorf("federation sync inserted %d, skipped %d duplicates, want 0 and 2", sdb.totalInserted, sdb.duplicates)
+	}
+	if want := time.Unix(200, 0).UTC(); !sdb.maxTimestamp.Equal(want) {
+		t.Errorf("federation sync max timestamp got %v, want %v", sdb.maxTimestamp, want)
+	}
+}
+
+// TestFederationPullCancel tests that federationPull() stops at the checkpoint after a
+// cancellation is requested and finalizes the sync as canceled.
+func TestFederationPullCancel(t *testing.T) {
+	response := func(key *pb.ExposureKey, region string, ts int64) *pb.FederationFetchResponse {
+		return &pb.FederationFetchResponse{
+			Response: []*pb.ContactTracingResponse{{
+				ContactTracingInfo: []*pb.ContactTracingInfo{{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{key}}},
+				RegionIdentifiers:  []string{region},
+			}},
+			FetchResponseKeyTimestamp: ts,
+		}
+	}
+
+	testCases := []struct {
+		name string
+		// canceledAfter is the number of checks after which the sync is canceled; 0 never cancels.
+		canceledAfter  int
+		checkErr       error
+		wantFetches    int
+		wantInfections []*model.Infection
+		wantStatus     string
+	}{
+		{
+			name:          "canceled at second checkpoint",
+			canceledAfter: 2,
+			wantFetches:   2,
+			wantInfections: []*model.Infection{
+				makeRemoteInfection(aaa, posver, "", "US"),
+				makeRemoteInfection(bbb, posver, "", "CA"),
+			},
+			wantStatus: model.FederationSyncCanceled,
+		},
+		{
+			name:          "canceled at first checkpoint",
+			canceledAfter: 1,
+			wantFetches:   1,
+			wantInfections: []*model.Infection{
+				makeRemoteInfection(aaa, posver, "", "US"),
+			},
+			wantStatus: model.FederationSyncCanceled,
+		},
+		{
+			name:        "not canceled",
+			wantFetches: 3,
+			wantInfections: []*model.Infection{
+				makeRemoteInfection(aaa, posver, "", "US"),
+				makeRemoteInfection(bbb, posver, "", "CA"),
+				makeRemoteInfection(ccc, posver, "", "MX"),
+			},
+			wantStatus: model.FederationSyncComplete,
+		},
+		{
+			name:        "check fails",
+			checkErr:    errors.New("database unavailable"),
+			wantFetches: 3,
+			wantInfections: []*model.Infection{
+				makeRemoteInfection(aaa, posver, "", "US"),
+				makeRemoteInfection(bbb, posver, "", "CA"),
+				makeRemoteInfection(ccc, posver, "", "MX"),
+			},
+			wantStatus: model.FederationSyncComplete,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := &model.FederationQuery{QueryID: "q", IncludeRegions: []string{"US", "CA", "MX"}, RegionChunkSize: 1}
+			remote := remoteFetchServer{
+				responses: []*pb.FederationFetchResponse{
+					response(aaa, "US", 100),
+					response(bbb, "CA", 200),
+					response(ccc, "MX", 300),
+				},
+			}
+			idb := infectionDB{}
+			sdb := syncDB{}
+			checks := 0
+			deps := pullDependencies{
+				fetch:               remote.fetch,
+				insertInfections:    idb.insertInfections,
+				startFederationSync: sdb.startFederationSync,
+				syncCanceled: func(ctx context.Context, gotSyncID string) (bool, error) {
+					if gotSyncID != syncID {
+						t.Errorf("checked cancellation of sync %q, want %q", gotSyncID, syncID)
+					}
+					checks++
+					if tc.checkErr != nil {
+						return false, tc.checkErr
+					}
+					return tc.canceledAfter > 0 && checks >= tc.canceledAfter, nil
+				},
+			}
+
+			if err := federationPull(context.Background(), deps, query, time.Now().UTC(), nil); err != nil {
+				t.Fatalf("pull returned err=%v, want err=nil", err)
+			}
+			if got := len(remote.gotRegions); got != tc.wantFetches {
+				t.Errorf("fetched %d times, want %d", got, tc.wantFetches)
+			}
+			if diff := cmp.Diff(tc.wantInfections, idb.infections, cmpopts.IgnoreFields(model.Infection{}, "CreatedAt")); diff != "" {
+				t.Errorf("infections mismatch (-want +got):\n%s", diff)
+			}
+			if !sdb.syncCompleted {
+				t.Fatalf("sync not finalized")
+			}
+			if sdb.status != tc.wantStatus {
+				t.Errorf("sync finalized as %q, want %q", sdb.status, tc.wantStatus)
+			}
+			if sdb.totalInserted != len(tc.wantInfections) {
+				t.Errorf("federation sync total inserted got %d, want %d", sdb.totalInserted, len(tc.wantInfections))
+			}
+		})
+	}
+}
+
+// TestFederationPullContextCancel tests that federationPull() aborts the fetch in flight, and
+// fetches no further page, once its context is done, and finalizes the sync as failed with the
+// chunks completed so far.
+func TestFederationPullContextCancel(t *testing.T) {
+	response := func(key *pb.ExposureKey, region string, ts int64) *pb.FederationFetchResponse {
+		return &pb.FederationFetchResponse{
+			Response: []*pb.ContactTracingResponse{{
+				ContactTracingInfo: []*pb.ContactTracingInfo{{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{key}}},
+				RegionIdentifiers:  []string{region},
+			}},
+			FetchResponseKeyTimestamp: ts,
+		}
+	}
+	responses := []*pb.FederationFetchResponse{response(aaa, "US", 100), response(bbb, "CA", 200), response(ccc, "MX", 300)}
+
+	testCases := []struct {
+		name string
+		// cancelFetch is the fetch, counting from 1, that cancels the context and waits for the
+		// cancellation to abort it, as a gRPC call does.
+		cancelFetch int
+		// cancelInsert cancels the context while the keys of the first page are inserted.
+		cancelInsert bool
+		wantFetches  int
+		wantAborted  bool
+	}{
+		{name: "cancelled mid-fetch", cancelFetch: 2, wantFetches: 2, wantAborted: true},
+		{name: "cancelled between pages", cancelInsert: true, wantFetches: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			query := &model.FederationQuery{QueryID: "q", IncludeRegions: []string{"US", "CA", "MX"}, RegionChunkSize: 1}
+			remote := remoteFetchServer{responses: responses}
+			aborted := false
+			fetch := func(ctx context.Context, req *pb.FederationFetchRequest, opts ...grpc.CallOption) (*pb.FederationFetchResponse, error) {
+				if len(remote.gotRegions)+1 == tc.cancelFetch {
+					remote.gotRegions = append(remote.gotRegions, req.RegionIdentifiers)
+					cancel()
+					select {
+					case <-ctx.Done():
+						aborted = true
+						return nil, status.Error(codes.Canceled, ctx.Err().Error())
+					case <-time.After(5 * time.Second):
+						return nil, errors.New("fetch not aborted")
+					}
+				}
+				return remote.fetch(ctx, req, opts...)
+			}
+			idb := infectionDB{}
+			insert := func(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (int, error) {
+				if tc.cancelInsert {
+					cancel()
+				}
+				return idb.insertInfections(ctx, infections, rejectDuplicates)
+			}
+			sdb := syncDB{}
+			deps := pullDependencies{
+				fetch:               fetch,
+				insertInfections:    insert,
+				startFederationSync: sdb.startFederationSync,
+			}
+
+			err := federationPull(ctx, deps, query, time.Now().UTC(), nil)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("pull returned err=%v, want %v", err, context.Canceled)
+			}
+			if got := len(remote.gotRegions); got != tc.wantFetches {
+				t.Errorf("fetched %d times, want %d", got, tc.wantFetches)
+			}
+			if aborted != tc.wantAborted {
+				t.Errorf("fetch aborted: %t, want %t", aborted, tc.wantAborted)
+			}
+			// The first chunk was fetched and stored before the cancellation.
+			want := []*model.Infection{makeRemoteInfection(aaa, posver, "", "US")}
+			if diff := cmp.Diff(want, idb.infections, cmpopts.IgnoreFields(model.Infection{}, "CreatedAt")); diff != "" {
+				t.Errorf("infections mismatch (-want +got):\n%s", diff)
+			}
+			if !sdb.syncCompleted {
+				t.Fatalf("sync not finalized")
+			}
+			if sdb.status != model.FederationSyncFailed {
+				t.Errorf("sync finalized as %q, want %q", sdb.status, model.FederationSyncFailed)
+			}
+			if sdb.chunks != 1 || sdb.totalInserted != 1 {
+				t.Errorf("sync finalized with %d chunks and %d keys, want 1 and 1", sdb.chunks, sdb.totalInserted)
+			}
+			if wantTS := time.Unix(100, 0).UTC(); !sdb.maxTimestamp.Equal(wantTS) {
+				t.Errorf("sync checkpoint timestamp %v, want %v", sdb.maxTimestamp, wantTS)
+			}
+		})
+	}
+
+	// A pull whose context is done before it starts fetches nothing and records no sync.
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	remote := remoteFetchServer{responses: responses}
+	sdb := syncDB{}
+	deps := pullDependencies{fetch: remote.fetch, insertInfections: (&infectionDB{}).insertInfections, startFederationSync: sdb.startFederationSync}
+	query := &model.FederationQuery{QueryID: "q", IncludeRegions: []string{"US"}}
+	if err := federationPull(ctx, deps, query, time.Now().UTC(), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pull returned err=%v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(remote.gotRegions) != 0 || sdb.syncStarted {
+		t.Errorf("pull with an expired context fetched %d times and started a sync: %t", len(remote.gotRegions), sdb.syncStarted)
+	}
+}
+
+// TestFederationPullUnreachable tests that federationPull() does not record a sync when the
+// remote cannot be reached.
+func TestFederationPullUnreachable(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	testCases := []struct {
+		name            string
+		errs            []error
+		wantUnreachable bool
+		wantSyncStarted bool
+	}{
+		{name: "unreachable", errs: []error{unavailable}, wantUnreachable: true},
+		{name: "other error before sync", errs: []error{status.Error(codes.PermissionDenied, "denied")}},
+		{name: "unreachable after first fetch", errs: []error{nil, unavailable}, wantSyncStarted: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := &model.FederationQuery{QueryID: "query", IncludeRegions: []string{"US", "CA"}, RegionChunkSize: 1}
+			calls := 0
+			fetch := func(ctx context.Context, req *pb.FederationFetchRequest, opts ...grpc.CallOption) (*pb.FederationFetchResponse, error) {
+				err := tc.errs[calls]
+				calls++
+				if err != nil {
+					return nil, err
+				}
+				return &pb.FederationFetchResponse{}, nil
+			}
+			idb := infectionDB{}
+			sdb := syncDB{}
+			deps := pullDependencies{
+				fetch:               fetch,
+				insertInfections:    idb.insertInfections,
+				startFederationSync: sdb.startFederationSync,
+			}
+
+			err := federationPull(context.Background(), deps, query, time.Now().UTC(), nil)
+			if err == nil {
+				t.Fatal("pull returned err=nil, want error")
+			}
+			if got := errors.Is(err, errRemoteUnreachable); got != tc.wantUnreachable {
+				t.Errorf("pull returned err=%v, unreachable %t, want %t", err, got, tc.wantUnreachable)
+			}
+			if sdb.syncStarted != tc.wantSyncStarted {
+				t.Errorf("federation sync started %t, want %t", sdb.syncStarted, tc.wantSyncStarted)
+			}
+		})
+	}
+}
+
+// TestChunkRegions tests chunkRegions().
+func TestChunkRegions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		regions []string
+		size    int
+		want    [][]string
+	}{
+		{
+			name: "no regions",
+			size: 2,
+			want: [][]string{nil},
+		},
+		{
+			name:    "no chunking",
+			regions: []string{"US", "CA", "MX"},
+			want:    [][]string{{"US", "CA", "MX"}},
+		},
+		{
+			name:    "fits in one chunk",
+			regions: []string{"US", "CA"},
+			size:    2,
+			want:    [][]string{{"US", "CA"}},
+		},
+		{
+			name:    "even chunks",
+			regions: []string{"US", "CA", "MX", "GB"},
+			size:    2,
+			want:    [][]string{{"US", "CA"}, {"MX", "GB"}},
+		},
+		{
+			name:    "uneven chunks",
+			regions: []string{"US", "CA", "MX"},
+			size:    2,
+			want:    [][]string{{"US", "CA"}, {"MX"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := chunkRegions(tc.regions, tc.size)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("chunkRegions mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestFederationPullDryRun tests that a dry run reports what would be stored without inserting
+// infections or recording a sync.
+func TestFederationPullDryRun(t *testing.T) {
+	lastTimestamp := time.Unix(100, 0).UTC()
+	query := &model.FederationQuery{QueryID: "query", IncludeRegions: []string{"US", "CA"}, LastTimestamp: lastTimestamp}
+
+	testCases := []struct {
+		name      string
+		responses []*pb.FederationFetchResponse
+		want      *dryRunReport
+	}{
+		{
+			name: "no keys",
+			want: &dryRunReport{QueryID: "query", Regions: map[string]int{}, LastTimestamp: lastTimestamp, NextTimestamp: lastTimestamp},
+		},
+		{
+			name: "keys",
+			responses: []*pb.FederationFetchResponse{
+				{
+					Response: []*pb.ContactTracingResponse{
+						{
+							ContactTracingInfo: []*pb.ContactTracingInfo{
+								{TransmissionRisk: posver, ExposureKeys: []*pb.ExposureKey{aaa, bbb}},
+							},
+							RegionIdentifiers: []string{"US", "ca"},
+						},
+						{
+							ContactTracingInfo: []*pb.ContactTracingInfo{
+								{TransmissionRisk: selfver, ExposureKeys: []*pb.ExposureKey{ccc}},
+							},
+							RegionIdentifiers: []string{"US"},
+						},
+					},
+					FetchResponseKeyTimestamp: 400,
+				},
+			},
+			want: &dryRunReport{
+				QueryID:       "query",
+				Keys:          3,
+				Regions:       map[string]int{"US": 3, "CA": 2},
+				LastTimestamp: lastTimestamp,
+				NextTimestamp: time.Unix(400, 0).UTC(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := remoteFetchServer{responses: tc.responses}
+			report := newDryRunReport(query)
+
+			if err := federationPull(context.Background(), report.dependencies(remote.fetch), query, time.Now().UTC(), nil); err != nil {
+				t.Fatalf("pull returned err=%v, want err=nil", err)
+			}
+
+			if diff := cmp.Diff(tc.want, report); diff != "" {
+				t.Errorf("report mismatch (-want +got):\n%s", diff)
+			}
+			if !query.LastTimestamp.Equal(lastTimestamp) {
+				t.Errorf("query last timestamp changed to %v, want %v", query.LastTimestamp, lastTimestamp)
+			}
+		})
+	}
+}
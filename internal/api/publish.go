@@ -16,6 +16,10 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -26,13 +30,120 @@ import (
 	"github.com/googlepartners/exposure-notifications/internal/verification"
 )
 
-func NewPublishHandler(db *database.DB, cfg *config.Config) http.Handler {
-	return &publishHandler{db: db}
+var (
+	// ErrPublishUnauthorized is returned by ProcessPublish when verification rejects a publish.
+	ErrPublishUnauthorized = errors.New("publish unauthorized")
+	// ErrPublishInvalid is returned by ProcessPublish when a publish holds invalid data.
+	ErrPublishInvalid = errors.New("invalid publish")
+)
+
+// publishError classifies an error from ProcessPublish as one of its sentinel errors, while
+// keeping the underlying error available to errors.Is and errors.As.
+type publishError struct {
+	kind error
+	err  error
+}
+
+func (e *publishError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *publishError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *publishError) Unwrap() error {
+	return e.err
+}
+
+// insertNewInfectionsFn stores infections, skipping those already stored, and returns the number inserted.
+type insertNewInfectionsFn func(ctx context.Context, infections []*model.Infection) (int, error)
+
+// Publisher verifies and stores published keys, independently of how they were received.
+type Publisher struct {
+	insert       insertNewInfectionsFn
+	regionPolicy model.RegionPolicy
+	defaultRisk  int
+}
+
+// NewPublisher returns a Publisher storing keys in db, materializing keys published for several
+// regions according to policy, and buffering the keys of concurrent publishes according to
+// batching. Keys published without a transmission risk are stored with defaultRisk.
+func NewPublisher(db *database.DB, policy model.RegionPolicy, batching PublishBatching, defaultRisk int) *Publisher {
+	insert := db.InsertNewInfections
+	if batching.MaxDelay > 0 {
+		insert = newPublishBatcher(db.InsertNewInfectionGroups, batching).insert
+	}
+	return &Publisher{insert: insert, regionPolicy: policy, defaultRisk: defaultRisk}
+}
+
+// PublishResult is the outcome of a stored publish.
+type PublishResult struct {
+	// Inserted is the number of rows newly stored.
+	Inserted int
+	// Duplicates is the number of rows that were already stored, or repeated in the publish.
+	Duplicates int
+}
+
+// ProcessPublish verifies that data may be published under cfg, the config of its app, and
+// stores its keys. The returned error wraps ErrPublishUnauthorized if verification rejected the
+// publish, and ErrPublishInvalid if data is malformed; other errors are storage failures.
+func (p *Publisher) ProcessPublish(ctx context.Context, cfg *model.APIConfig, data model.Publish) (*PublishResult, error) {
+	ctx, err := authorizePublish(ctx, cfg, &data)
+	if err != nil {
+		return nil, err
+	}
+	return p.store(ctx, &data)
+}
+
+// authorizePublish verifies a publish is allowed for its app, regions and attestation, and
+// returns a copy of ctx carrying the resolved config, app package and normalized regions. See
+// APIConfigFromContext, AppPackageFromContext and RegionsFromContext.
+func authorizePublish(ctx context.Context, cfg *model.APIConfig, data *model.Publish) (context.Context, error) {
+	// Malformed regions are reported as such, rather than as regions the app may not publish for.
+	regions, err := model.NormalizeRegions(data.Regions)
+	if err != nil {
+		return nil, &publishError{kind: ErrPublishInvalid, err: fmt.Errorf("normalizing regions: %w", err)}
+	}
+
+	if err := verification.VerifyRegions(cfg, *data); err != nil {
+		return nil, &publishError{kind: ErrPublishUnauthorized, err: fmt.Errorf("verification.VerifyRegions: %w", err)}
+	}
+
+	requestTime := time.Now().UTC()
+	if err := verification.VerifySafetyNet(ctx, requestTime, cfg, *data); err != nil {
+		return nil, &publishError{kind: ErrPublishUnauthorized, err: fmt.Errorf("unable to verify safetynet payload: %w", err)}
+	}
+	return withPublishAuth(ctx, cfg, data.AppPackageName, regions), nil
+}
+
+// store stores the keys of an authorized publish.
+func (p *Publisher) store(ctx context.Context, data *model.Publish) (*PublishResult, error) {
+	batchTime := time.Now().UTC()
+	infections, err := model.TransformPublish(data, batchTime, p.defaultRisk)
+	if err != nil {
+		return nil, &publishError{kind: ErrPublishInvalid, err: fmt.Errorf("transforming publish data: %w", err)}
+	}
+	infections = p.regionPolicy.Apply(infections)
+
+	inserted, err := p.insert(ctx, infections)
+	if err != nil {
+		return nil, fmt.Errorf("writing infection records: %v", err)
+	}
+	logging.FromContext(ctx).Infof("Inserted %d infections, %d duplicates, for app %v in regions %v.", inserted, len(infections)-inserted, AppPackageFromContext(ctx), RegionsFromContext(ctx))
+	return &PublishResult{Inserted: inserted, Duplicates: len(infections) - inserted}, nil
+}
+
+// NewPublishHandler returns a handler that stores published keys, materializing keys
+// published for several regions according to policy and buffering them according to batching.
+// Keys published without a transmission risk are stored with defaultRisk.
+func NewPublishHandler(db *database.DB, cfg *config.Config, policy model.RegionPolicy, batching PublishBatching, defaultRisk int) http.Handler {
+	return &publishHandler{config: cfg, publisher: NewPublisher(db, policy, batching, defaultRisk)}
 }
 
 type publishHandler struct {
-	config *config.Config
-	db     *database.DB
+	config    *config.Config
+	publisher *Publisher
 }
 
 func (h *publishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,50 +155,44 @@ func (h *publishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		logger.Errorf("error unmarhsaling API call, code: %v: %v", code, err)
 		// Log but don't return internal decode error message reason.
-		http.Error(w, "bad API request", code)
+		status, resp := decodeFailure(code)
+		writePublishError(ctx, w, status, resp)
 		return
 	}
 
-	cfg := h.config.AppPkgConfig(ctx, data.AppPackageName)
-	if cfg == nil {
-		// configs were loaded, but the request app isn't configured.
-		logger.Errorf("unauthorized applicaiton: %v", data.AppPackageName)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	err = verification.VerifyRegions(cfg, data)
+	cfg, err := verification.AppConfig(ctx, h.config.AppPkgConfig(ctx, data.AppPackageName), data.AppPackageName)
 	if err != nil {
-		logger.Errorf("verification.VerifyRegions: %v", err)
-		// TODO(mikehelmick) change error code after clients verify functionality.
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		// configs were loaded, but the request app isn't configured.
+		logger.Errorf("verification.AppConfig: %v", err)
+		recordRejection(ctx, err)
+		status, resp := publishFailure(err, &data)
+		writePublishError(ctx, w, status, resp)
 		return
 	}
 
-	requestTime := time.Now().UTC()
-	err = verification.VerifySafetyNet(ctx, requestTime, cfg, data)
+	result, err := h.publisher.ProcessPublish(ctx, cfg, data)
 	if err != nil {
-		logger.Errorf("unable to verify safetynet payload: %v", err)
-		// TODO(mikehelmick) change error code after clients verify functionality.
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		logger.Errorf("error processing publish: %v", err)
+		if errors.Is(err, ErrPublishUnauthorized) {
+			recordRejection(ctx, err)
+		}
+		status, resp := publishFailure(err, &data)
+		writePublishError(ctx, w, status, resp)
 		return
 	}
+	resp := newPublishResponse(result.Inserted+result.Duplicates, result.Inserted)
 
-	batchTime := time.Now().UTC()
-	infections, err := model.TransformPublish(&data, batchTime)
-	if err != nil {
-		logger.Errorf("error transforming publish data: %v", err)
-		http.Error(w, "bad API request", http.StatusBadRequest)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Errorf("error writing publish response: %v", err)
 	}
+}
 
-	err = h.db.InsertInfections(ctx, infections)
-	if err != nil {
-		logger.Errorf("error writing infection record: %v", err)
-		http.Error(w, "internal processing error", http.StatusInternalServerError)
-		return
+// newPublishResponse summarizes the insertion of total keys, of which inserted were new.
+func newPublishResponse(total, inserted int) *model.PublishResponse {
+	return &model.PublishResponse{
+		Inserted:   inserted,
+		Duplicates: total - inserted,
 	}
-	logger.Infof("Inserted %d infections.", len(infections))
-
-	w.WriteHeader(http.StatusOK)
 }
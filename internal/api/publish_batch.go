@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// insertInfectionGroupsFn stores the infections of several publishes at once, skipping those
+// already stored, and returns the number inserted from each.
+type insertInfectionGroupsFn func(ctx context.Context, groups [][]*model.Infection) ([]int, error)
+
+// PublishBatching configures buffering the keys of concurrent publishes to store them together,
+// trading a little latency for far fewer, larger writes.
+type PublishBatching struct {
+	// MaxDelay is the longest a publish waits for others to share its write. Batching is
+	// disabled if it is not positive.
+	MaxDelay time.Duration
+	// MaxKeys flushes the buffer as soon as it holds this many keys, without waiting for MaxDelay.
+	// database.InsertInfectionsBatchSize is used if it is not positive.
+	MaxKeys int
+}
+
+// pendingPublish is a publish waiting for its buffer to be flushed.
+type pendingPublish struct {
+	infections []*model.Infection
+	done       chan publishFlushResult
+}
+
+type publishFlushResult struct {
+	inserted int
+	err      error
+}
+
+// publishBatcher buffers the infections of publishes and stores them with a single call,
+// once MaxKeys are buffered or MaxDelay after the first was, giving each publish the outcome
+// of its own infections.
+type publishBatcher struct {
+	store      insertInfectionGroupsFn
+	opts       PublishBatching
+	startTimer func(d time.Duration, f func()) (stop func() bool)
+
+	mu        sync.Mutex
+	pending   []*pendingPublish
+	keys      int
+	stopTimer func() bool
+}
+
+func newPublishBatcher(store insertInfectionGroupsFn, opts PublishBatching) *publishBatcher {
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = database.InsertInfectionsBatchSize
+	}
+	return &publishBatcher{
+		store: store,
+		opts:  opts,
+		startTimer: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+	}
+}
+
+// insert buffers infections and waits for them to be stored, returning the number inserted.
+// If ctx is done first, it returns the context error, though the infections may still be
+// stored by the flush.
+func (b *publishBatcher) insert(ctx context.Context, infections []*model.Infection) (int, error) {
+	p := &pendingPublish{infections: infections, done: make(chan publishFlushResult, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, p)
+	b.keys += len(infections)
+	var full []*pendingPublish
+	if b.keys >= b.opts.MaxKeys {
+		full = b.take()
+	} else if b.stopTimer == nil {
+		b.stopTimer = b.startTimer(b.opts.MaxDelay, b.flushPending)
+	}
+	b.mu.Unlock()
+
+	if full != nil {
+		b.flush(full)
+	}
+	select {
+	case r := <-p.done:
+		return r.inserted, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// take empties the buffer, returning the publishes it held. b.mu must be held.
+func (b *publishBatcher) take() []*pendingPublish {
+	if b.stopTimer != nil {
+		b.stopTimer()
+		b.stopTimer = nil
+	}
+	pending := b.pending
+	b.pending, b.keys = nil, 0
+	return pending
+}
+
+// flushPending flushes whatever the buffer holds, when MaxDelay has passed.
+func (b *publishBatcher) flushPending() {
+	b.mu.Lock()
+	pending := b.take()
+	b.mu.Unlock()
+	if len(pending) > 0 {
+		b.flush(pending)
+	}
+}
+
+// flush stores the infections of pending and hands each its result. A failed write fails every
+// publish in it, and only those. The publishes' own contexts may be done before the write is, so
+// it is not bound to any of them.
+func (b *publishBatcher) flush(pending []*pendingPublish) {
+	groups := make([][]*model.Infection, len(pending))
+	for i, p := range pending {
+		groups[i] = p.infections
+	}
+	counts, err := b.store(context.Background(), groups)
+	for i, p := range pending {
+		if err != nil {
+			p.done <- publishFlushResult{err: err}
+			continue
+		}
+		p.done <- publishFlushResult{inserted: counts[i]}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// groupStore mimics InsertNewInfectionGroups, recording the groups of each call. A call holding
+// failKey fails.
+type groupStore struct {
+	keys    map[string]bool
+	failKey string
+	calls   [][][]*model.Infection
+}
+
+func (s *groupStore) insert(ctx context.Context, groups [][]*model.Infection) ([]int, error) {
+	s.calls = append(s.calls, groups)
+	for _, g := range groups {
+		for _, inf := range g {
+			if string(inf.ExposureKey) == s.failKey {
+				return nil, errors.New("write failed")
+			}
+		}
+	}
+	counts := make([]int, len(groups))
+	for i, g := range groups {
+		for _, inf := range g {
+			if !s.keys[string(inf.ExposureKey)] {
+				s.keys[string(inf.ExposureKey)] = true
+				counts[i]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// manualTimer replaces the batcher timer with one fired by the test.
+type manualTimer struct {
+	started chan func()
+}
+
+func (m *manualTimer) start(d time.Duration, f func()) func() bool {
+	m.started <- f
+	return func() bool { return true }
+}
+
+func keys(names ...string) []*model.Infection {
+	var infs []*model.Infection
+	for _, n := range names {
+		infs = append(infs, &model.Infection{ExposureKey: []byte(n)})
+	}
+	return infs
+}
+
+type insertResult struct {
+	inserted int
+	err      error
+}
+
+// insertAsync inserts infections with b in the background, once b has buffered them.
+func insertAsync(b *publishBatcher, timer *manualTimer, infections []*model.Infection) (<-chan insertResult, func()) {
+	done := make(chan insertResult, 1)
+	go func() {
+		n, err := b.insert(context.Background(), infections)
+		done <- insertResult{n, err}
+	}()
+	return done, <-timer.started
+}
+
+func TestPublishBatcherSizeTrigger(t *testing.T) {
+	store := &groupStore{keys: map[string]bool{"dup": true}}
+	timer := &manualTimer{started: make(chan func(), 1)}
+	b := newPublishBatcher(store.insert, PublishBatching{MaxDelay: time.Minute, MaxKeys: 4})
+	b.startTimer = timer.start
+
+	first, _ := insertAsync(b, timer, keys("a", "dup"))
+	// Reaching MaxKeys flushes without waiting for the timer.
+	inserted, err := b.insert(context.Background(), keys("b", "c"))
+	if err != nil {
+		t.Fatalf("insert returned unexpected error: %v", err)
+	}
+	if inserted != 2 {
+		t.Errorf("second publish inserted %d, want 2", inserted)
+	}
+	if r := <-first; r.err != nil || r.inserted != 1 {
+		t.Errorf("first publish inserted %d, error %v, want 1 and no error", r.inserted, r.err)
+	}
+
+	want := [][][]*model.Infection{{keys("a", "dup"), keys("b", "c")}}
+	if diff := cmp.Diff(want, store.calls); diff != "" {
+		t.Errorf("stored groups mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPublishBatcherTimeTrigger(t *testing.T) {
+	store := &groupStore{keys: make(map[string]bool)}
+	timer := &manualTimer{started: make(chan func(), 1)}
+	b := newPublishBatcher(store.insert, PublishBatching{MaxDelay: time.Minute, MaxKeys: 100})
+	b.startTimer = timer.start
+
+	done, fire := insertAsync(b, timer, keys("a", "b"))
+	select {
+	case r := <-done:
+		t.Fatalf("publish returned %+v before the delay passed", r)
+	default:
+	}
+	fire()
+	if r := <-done; r.err != nil || r.inserted != 2 {
+		t.Errorf("publish inserted %d, error %v, want 2 and no error", r.inserted, r.err)
+	}
+	if len(store.calls) != 1 {
+		t.Errorf("stored %d times, want 1", len(store.calls))
+	}
+}
+
+func TestPublishBatcherFlushError(t *testing.T) {
+	store := &groupStore{keys: make(map[string]bool), failKey: "bad"}
+	timer := &manualTimer{started: make(chan func(), 1)}
+	b := newPublishBatcher(store.insert, PublishBatching{MaxDelay: time.Minute, MaxKeys: 4})
+	b.startTimer = timer.start
+
+	// The first flush holds the failing key, the second does not.
+	failedA, _ := insertAsync(b, timer, keys("a", "bad"))
+	if _, err := b.insert(context.Background(), keys("b", "c")); err == nil {
+		t.Errorf("publish flushed with the failing key returned no error")
+	}
+	if r := <-failedA; r.err == nil {
+		t.Errorf("publish holding the failing key returned no error")
+	}
+
+	ok, fire := insertAsync(b, timer, keys("d"))
+	fire()
+	if r := <-ok; r.err != nil || r.inserted != 1 {
+		t.Errorf("publish in a later flush inserted %d, error %v, want 1 and no error", r.inserted, r.err)
+	}
+}
+
+func TestPublishBatcherContext(t *testing.T) {
+	store := &groupStore{keys: make(map[string]bool)}
+	timer := &manualTimer{started: make(chan func(), 1)}
+	b := newPublishBatcher(store.insert, PublishBatching{MaxDelay: time.Minute, MaxKeys: 100})
+	b.startTimer = timer.start
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.insert(ctx, keys("a"))
+		done <- err
+	}()
+	fire := <-timer.started
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("insert returned error %v, want %v", err, context.Canceled)
+	}
+	// The canceled publish is still flushed, without blocking on its result.
+	fire()
+	if len(store.calls) != 1 {
+		t.Errorf("stored %d times, want 1", len(store.calls))
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+type publishAuthKey struct{}
+
+// publishAuth holds what was resolved while authorizing a publish request.
+type publishAuth struct {
+	config     *model.APIConfig
+	appPackage string
+	regions    []string
+}
+
+// withPublishAuth returns a copy of ctx carrying the resolved config, app package and
+// normalized regions of an authorized publish.
+func withPublishAuth(ctx context.Context, cfg *model.APIConfig, appPackage string, regions []string) context.Context {
+	return context.WithValue(ctx, publishAuthKey{}, &publishAuth{config: cfg, appPackage: appPackage, regions: regions})
+}
+
+func publishAuthFromContext(ctx context.Context) *publishAuth {
+	if auth, ok := ctx.Value(publishAuthKey{}).(*publishAuth); ok {
+		return auth
+	}
+	return &publishAuth{}
+}
+
+// APIConfigFromContext returns the config of the app an authorized publish was made for,
+// or nil if ctx does not belong to an authorized publish.
+func APIConfigFromContext(ctx context.Context) *model.APIConfig {
+	return publishAuthFromContext(ctx).config
+}
+
+// AppPackageFromContext returns the app package of an authorized publish, or "" if ctx does
+// not belong to an authorized publish.
+func AppPackageFromContext(ctx context.Context) string {
+	return publishAuthFromContext(ctx).appPackage
+}
+
+// RegionsFromContext returns the normalized regions of an authorized publish, or nil if ctx
+// does not belong to an authorized publish.
+func RegionsFromContext(ctx context.Context) []string {
+	return publishAuthFromContext(ctx).regions
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/googlepartners/exposure-notifications/internal/android"
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/verification"
+)
+
+// decodeFailure returns the response to a publish request that unmarshal rejected with status.
+// The reason is only logged, so the body does not echo the decoder's internals.
+func decodeFailure(status int) (int, *model.PublishErrorResponse) {
+	switch status {
+	case http.StatusUnsupportedMediaType:
+		return status, &model.PublishErrorResponse{Code: model.PublishErrorUnsupportedMediaType, Message: "content type must be application/json"}
+	case http.StatusRequestEntityTooLarge:
+		return status, &model.PublishErrorResponse{Code: model.PublishErrorRequestTooLarge, Message: "request body is too large"}
+	case http.StatusBadRequest:
+		return status, &model.PublishErrorResponse{Code: model.PublishErrorBadRequest, Message: "bad API request"}
+	default:
+		return http.StatusInternalServerError, &model.PublishErrorResponse{Code: model.PublishErrorInternal, Message: "internal processing error"}
+	}
+}
+
+// publishFailure returns the response to the publish data that failed with err, an error of
+// verification.AppConfig or ProcessPublish.
+func publishFailure(err error, data *model.Publish) (int, *model.PublishErrorResponse) {
+	var regionErr *verification.RegionError
+	var keyErr *model.KeyError
+	var fieldErr *model.FieldError
+	switch {
+	case errors.Is(err, verification.ErrUnknownApplication):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorUnknownApp,
+			Message: "application is not configured on this server", Field: "appPackageName"}
+	case errors.As(err, &regionErr):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorUnauthorizedRegion,
+			Message: "application may not publish for these regions", Field: "regions", Regions: regionErr.Regions}
+	case errors.Is(err, verification.ErrDeclaredRegion):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorDeclaredRegion,
+			Message: "regions do not match the region declared by the attestation", Field: "regions", Regions: data.Regions}
+	case errors.Is(err, android.ErrNonceMismatch):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorNonceMismatch,
+			Message: "attestation nonce does not match the publish", Field: "verificationPayload"}
+	case errors.Is(err, android.ErrAttestationTime), errors.Is(err, android.ErrCertificateExpired):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorAttestationExpired,
+			Message: "attestation is expired or not yet valid", Field: "verificationPayload"}
+	case errors.Is(err, android.ErrIntegrity):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorIntegrity,
+			Message: "attestation reports a device that failed the integrity checks", Field: "verificationPayload"}
+	case errors.Is(err, android.ErrMalformedAttestation), errors.Is(err, android.ErrInvalidCertificateChain), errors.Is(err, android.ErrInvalidSignature),
+		errors.Is(err, android.ErrAttestationTooLarge):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorInvalidAttestation,
+			Message: "attestation is malformed or not signed by a trusted certificate", Field: "verificationPayload"}
+	case errors.Is(err, ErrPublishUnauthorized):
+		return http.StatusUnauthorized, &model.PublishErrorResponse{Code: model.PublishErrorUnauthorized, Message: "unauthorized"}
+	case errors.Is(err, model.ErrInvalidRegion):
+		return http.StatusBadRequest, &model.PublishErrorResponse{Code: model.PublishErrorInvalidRegion,
+			Message: "regions must be 2 to 5 letters, digits or hyphens, starting with a letter", Field: "regions", Regions: invalidRegions(data.Regions)}
+	case errors.As(err, &keyErr):
+		return http.StatusBadRequest, &model.PublishErrorResponse{Code: model.PublishErrorInvalidKey,
+			Message: keyErr.Error(), Field: keyErr.Field, KeyIndices: []int{keyErr.Index}}
+	case errors.As(err, &fieldErr):
+		return http.StatusBadRequest, &model.PublishErrorResponse{Code: model.PublishErrorInvalidPublish,
+			Message: fieldErr.Error(), Field: fieldErr.Field}
+	case errors.Is(err, ErrPublishInvalid):
+		return http.StatusBadRequest, &model.PublishErrorResponse{Code: model.PublishErrorInvalidPublish, Message: "bad API request"}
+	default:
+		return http.StatusInternalServerError, &model.PublishErrorResponse{Code: model.PublishErrorInternal, Message: "internal processing error"}
+	}
+}
+
+// invalidRegions returns those of regions that are not valid region codes.
+func invalidRegions(regions []string) []string {
+	var invalid []string
+	for _, r := range regions {
+		if _, err := model.ParseRegion(r); err != nil {
+			invalid = append(invalid, r)
+		}
+	}
+	return invalid
+}
+
+// writePublishError writes resp to w as a JSON body with status.
+func writePublishError(ctx context.Context, w http.ResponseWriter, status int, resp *model.PublishErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.FromContext(ctx).Errorf("error writing publish error response: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/googlepartners/exposure-notifications/internal/android"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/verification"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPublishFailure(t *testing.T) {
+	cfg := &model.APIConfig{AppPackageName: "com.example.app", AllowedRegions: map[string]bool{"US": true}, BypassSafetynet: true}
+	unauthorized := func(err error) error { return &publishError{kind: ErrPublishUnauthorized, err: err} }
+	// processErr returns the error of publishing data under cfg.
+	processErr := func(data model.Publish) error {
+		p := &Publisher{insert: (&keyStore{rows: make(map[string]bool)}).insert, regionPolicy: model.RegionPolicyGlobal}
+		_, err := p.ProcessPublish(context.Background(), cfg, data)
+		if err == nil {
+			t.Fatalf("ProcessPublish(%+v) succeeded, want error", data)
+		}
+		return err
+	}
+
+	testCases := []struct {
+		name       string
+		err        error
+		data       model.Publish
+		wantStatus int
+		want       *model.PublishErrorResponse
+	}{
+		{
+			name:       "unknown app",
+			err:        fmt.Errorf("%w: %q", verification.ErrUnknownApplication, "com.other.app"),
+			wantStatus: http.StatusUnauthorized,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorUnknownApp, Message: "application is not configured on this server", Field: "appPackageName"},
+		},
+		{
+			name:       "unauthorized regions",
+			err:        processErr(model.Publish{Regions: []string{"MX", "US", "ca"}}),
+			wantStatus: http.StatusUnauthorized,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorUnauthorizedRegion, Message: "application may not publish for these regions",
+				Field: "regions", Regions: []string{"MX", "ca"}},
+		},
+		{
+			name:       "declared region",
+			err:        unauthorized(fmt.Errorf("%w: attestation declares 'CA'", verification.ErrDeclaredRegion)),
+			data:       model.Publish{Regions: []string{"US"}},
+			wantStatus: http.StatusUnauthorized,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorDeclaredRegion, Message: "regions do not match the region declared by the attestation",
+				Field: "regions", Regions: []string{"US"}},
+		},
+		{
+			name:       "nonce mismatch",
+			err:        unauthorized(android.ErrNonceMismatch),
+			wantStatus: http.StatusUnauthorized,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorNonceMismatch, Message: "attestation nonce does not match the publish", Field: "verificationPayload"},
+		},
+		{
+			name:       "attestation time",
+			err:        unauthorized(android.ErrAttestationTime),
+			wantStatus: http.StatusUnauthorized,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorAttestationExpired, Message: "attestation is expired or not yet valid", Field: "verificationPayload"},
+		},
+		{
+			name:       "certificate expired",
+			err:        unauthorized(android.ErrCertificateExpired),
+			wantStatus: http.StatusUnauthorized,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorAttestationExpired, Message: "attestation is expired or not yet valid", Field: "verificationPayload"},
+		},
+		{
+			name:       "integrity",
+			err:        unauthorized(android.ErrIntegrity),
+			wantStatus: http.StatusUnauthorized,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorIntegrity, Message: "attestation reports a device that failed the integrity checks",
+				Field: "verificationPayload"},
+		},
+		{
+			name:       "malformed attestation",
+			err:        unauthorized(android.ErrMalformedAttestation),
+			wantStatus: http.StatusUnauthorized,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidAttestation, Message: "attestation is malformed or not signed by a trusted certificate",
+				Field: "verificationPayload"},
+		},
+		{
+			name:       "attestation too large",
+			err:        unauthorized(android.ErrAttestationTooLarge),
+			wantStatus: http.StatusUnauthorized,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidAttestation, Message: "attestation is malformed or not signed by a trusted certificate",
+				Field: "verificationPayload"},
+		},
+		{
+			name:       "other verification failure",
+			err:        unauthorized(errors.New("no allowed regions configured")),
+			wantStatus: http.StatusUnauthorized,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorUnauthorized, Message: "unauthorized"},
+		},
+		{
+			name: "invalid region",
+			err: func() error {
+				_, err := authorizePublish(context.Background(), cfg, &model.Publish{Regions: []string{"US", "not a region"}})
+				return err
+			}(),
+			data:       model.Publish{Regions: []string{"US", "not a region"}},
+			wantStatus: http.StatusBadRequest,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidRegion, Message: "regions must be 2 to 5 letters, digits or hyphens, starting with a letter",
+				Field: "regions", Regions: []string{"not a region"}},
+		},
+		{
+			name:       "invalid key",
+			err:        processErr(model.Publish{Regions: []string{"US"}, Keys: []model.ExposureKey{{Key: "QUJD"}, {Key: "not base64!"}}}),
+			wantStatus: http.StatusBadRequest,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidKey, Message: "key 1: illegal base64 data at input byte 3",
+				Field: "key", KeyIndices: []int{1}},
+		},
+		{
+			name: "invalid transmission risk",
+			err: processErr(model.Publish{Regions: []string{"US"}, TransmissionRisk: model.MaxTransmissionRisk + 1,
+				Keys: []model.ExposureKey{{Key: "QUJD"}}}),
+			wantStatus: http.StatusBadRequest,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidKey, Message: "key 0: transmissionRisk 9 is out of range [0, 8]",
+				Field: "transmissionRisk", KeyIndices: []int{0}},
+		},
+		{
+			name:       "unknown report type",
+			err:        processErr(model.Publish{Regions: []string{"US"}, ReportType: model.ReportTypeRevoked + 1, Keys: []model.ExposureKey{{Key: "QUJD"}}}),
+			wantStatus: http.StatusBadRequest,
+			want: &model.PublishErrorResponse{Code: model.PublishErrorInvalidPublish, Message: "reportType 6 is not a known report type",
+				Field: "reportType"},
+		},
+		{
+			name:       "other invalid publish",
+			err:        &publishError{kind: ErrPublishInvalid, err: errors.New("bad")},
+			wantStatus: http.StatusBadRequest,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorInvalidPublish, Message: "bad API request"},
+		},
+		{
+			name:       "storage failure",
+			err:        errors.New("writing infection records: connection refused"),
+			wantStatus: http.StatusInternalServerError,
+			want:       &model.PublishErrorResponse{Code: model.PublishErrorInternal, Message: "internal processing error"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, got := publishFailure(tc.err, &tc.data)
+			if status != tc.wantStatus {
+				t.Errorf("publishFailure(%v) status = %d, want %d", tc.err, status, tc.wantStatus)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("publishFailure(%v) mismatch (-want +got):\n%s", tc.err, diff)
+			}
+		})
+	}
+}
+
+func TestDecodeFailure(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    model.PublishErrorCode
+	}{
+		{name: "content type", contentType: "text/plain", body: "{}", wantStatus: http.StatusUnsupportedMediaType, wantCode: model.PublishErrorUnsupportedMediaType},
+		{name: "malformed", contentType: "application/json", body: "{", wantStatus: http.StatusBadRequest, wantCode: model.PublishErrorBadRequest},
+		{name: "too large", contentType: "application/json", body: `{"appPackageName": "` + strings.Repeat("a", maxRequestBodySize) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge, wantCode: model.PublishErrorRequestTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			var data model.Publish
+			err, code := unmarshal(httptest.NewRecorder(), r, &data)
+			if err == nil {
+				t.Fatalf("unmarshal(%q) succeeded, want error", tc.body)
+			}
+			status, got := decodeFailure(code)
+			if status != tc.wantStatus || got.Code != tc.wantCode {
+				t.Errorf("decodeFailure(%d) = %d, %q, want %d, %q", code, status, got.Code, tc.wantStatus, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestWritePublishError(t *testing.T) {
+	w := httptest.NewRecorder()
+	resp := &model.PublishErrorResponse{Code: model.PublishErrorInvalidKey, Message: "key 2: transmissionRisk 9 is out of range [0, 8]",
+		Field: "transmissionRisk", KeyIndices: []int{2}}
+	writePublishError(context.Background(), w, http.StatusBadRequest, resp)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	want := `{"code":"invalid_key","message":"key 2: transmissionRisk 9 is out of range [0, 8]","field":"transmissionRisk","keyIndices":[2]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+
+	var decoded model.PublishErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if diff := cmp.Diff(resp, &decoded); diff != "" {
+		t.Errorf("decoded body mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/verification"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	publishRejections  = stats.Int64("publish/rejections", "Publish requests rejected by verification", stats.UnitDimensionless)
+	rejectionReasonKey = tag.MustNewKey("reason")
+
+	// PublishRejectionsView counts the publish requests rejected by verification, by the reason
+	// returned by verification.RejectionReason.
+	PublishRejectionsView = &view.View{
+		Name:        "publish/rejections",
+		Measure:     publishRejections,
+		Description: "Count of publish requests rejected by verification, by reason",
+		TagKeys:     []tag.Key{rejectionReasonKey},
+		Aggregation: view.Count(),
+	}
+)
+
+// recordRejection counts a publish rejected by the verification error err.
+func recordRejection(ctx context.Context, err error) {
+	reason := verification.RejectionReason(err)
+	if err := stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(rejectionReasonKey, reason)}, publishRejections.M(1)); err != nil {
+		logging.FromContext(ctx).Errorf("recording publish rejection %s: %v", reason, err)
+	}
+}
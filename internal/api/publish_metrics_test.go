@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/googlepartners/exposure-notifications/internal/android"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/verification"
+
+	"go.opencensus.io/stats/view"
+)
+
+// rejectionCount returns the number of rejections recorded for reason.
+func rejectionCount(t *testing.T, reason string) int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(PublishRejectionsView.Name)
+	if err != nil {
+		t.Fatalf("retrieving view data: %v", err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == rejectionReasonKey && tag.Value == reason {
+				return row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	return 0
+}
+
+func TestRecordRejection(t *testing.T) {
+	if err := view.Register(PublishRejectionsView); err != nil {
+		t.Fatalf("registering view: %v", err)
+	}
+	defer view.Unregister(PublishRejectionsView)
+
+	ctx := context.Background()
+	_, unknownApp := verification.AppConfig(ctx, nil, "com.example.unknown")
+	usOnly := &model.APIConfig{AppPackageName: "com.example.app", AllowedRegions: map[string]bool{"US": true}}
+	region := verification.VerifyRegions(usOnly, model.Publish{Regions: []string{"MX"}})
+	// Shaped like the errors returned by verification.VerifySafetyNet.
+	attestationErr := func(err error) error {
+		return fmt.Errorf("android.ValidateAttestation: %w", fmt.Errorf("ParseAndVerifyAttestation: %w", err))
+	}
+
+	testCases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "unknown app", err: unknownApp, want: verification.ReasonUnknownApp},
+		{name: "region", err: region, want: verification.ReasonRegion},
+		{name: "declared region", err: fmt.Errorf("%w: attestation has no region claim", verification.ErrDeclaredRegion), want: verification.ReasonRegion},
+		{name: "nonce", err: fmt.Errorf("android.ValidateAttestation: %w", android.ErrNonceMismatch), want: verification.ReasonNonce},
+		{name: "attestation time", err: fmt.Errorf("android.ValidateAttestation: %w", android.ErrAttestationTime), want: verification.ReasonAttestationTime},
+		{name: "expired certificate", err: attestationErr(android.ErrCertificateExpired), want: verification.ReasonAttestationTime},
+		{name: "integrity", err: fmt.Errorf("android.ValidateAttestation: %w", android.ErrIntegrity), want: verification.ReasonIntegrity},
+		{name: "bad signature", err: attestationErr(android.ErrInvalidSignature), want: verification.ReasonAttestation},
+		{name: "unclassified", err: fmt.Errorf("cannot enforce safetynet, no application config"), want: verification.ReasonOther},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.err == nil {
+				t.Fatal("test case has no error")
+			}
+			before := rejectionCount(t, tc.want)
+			recordRejection(ctx, tc.err)
+			if got := rejectionCount(t, tc.want) - before; got != 1 {
+				t.Errorf("recordRejection(%v) incremented %s by %d, want 1", tc.err, tc.want, got)
+			}
+		})
+	}
+}
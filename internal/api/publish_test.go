@@ -0,0 +1,216 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+	"github.com/googlepartners/exposure-notifications/internal/verification"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewPublishResponse(t *testing.T) {
+	resp := newPublishResponse(5, 3)
+	if resp.Inserted != 3 || resp.Duplicates != 2 {
+		t.Errorf("newPublishResponse(5, 3) = %+v, want 3 inserted and 2 duplicates", resp)
+	}
+
+	// Only counts are returned, never the keys themselves.
+	got, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("marshalling response: %v", err)
+	}
+	if want := `{"insertedExposureKeys":3,"duplicateExposureKeys":2}`; string(got) != want {
+		t.Errorf("publish response got %s, want %s", got, want)
+	}
+}
+
+func TestAuthorizePublish(t *testing.T) {
+	cfg := &model.APIConfig{
+		AppPackageName:  "com.example.app",
+		AllowedRegions:  map[string]bool{"US": true, "CA": true},
+		BypassSafetynet: true,
+	}
+
+	testCases := []struct {
+		name        string
+		data        *model.Publish
+		wantErr     error
+		wantRegions []string
+	}{
+		{
+			name:        "authorized",
+			data:        &model.Publish{AppPackageName: "com.example.app", Regions: []string{"us", " ca"}},
+			wantRegions: []string{"US", "CA"},
+		},
+		{
+			name:    "unauthorized region",
+			data:    &model.Publish{AppPackageName: "com.example.app", Regions: []string{"US", "MX"}},
+			wantErr: ErrPublishUnauthorized,
+		},
+		{
+			name:    "invalid region",
+			data:    &model.Publish{AppPackageName: "com.example.app", Regions: []string{"US", "not a region"}},
+			wantErr: ErrPublishInvalid,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, err := authorizePublish(context.Background(), cfg, tc.data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("authorizePublish returned error %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := APIConfigFromContext(ctx); got != cfg {
+				t.Errorf("APIConfigFromContext = %+v, want %+v", got, cfg)
+			}
+			if got := AppPackageFromContext(ctx); got != tc.data.AppPackageName {
+				t.Errorf("AppPackageFromContext = %q, want %q", got, tc.data.AppPackageName)
+			}
+			if diff := cmp.Diff(tc.wantRegions, RegionsFromContext(ctx)); diff != "" {
+				t.Errorf("RegionsFromContext mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// keyStore fakes the infection table, deduplicating rows by exposure key and regions.
+type keyStore struct {
+	rows       map[string]bool
+	gotRegions [][]string
+}
+
+func (s *keyStore) insert(ctx context.Context, infections []*model.Infection) (int, error) {
+	s.gotRegions = append(s.gotRegions, RegionsFromContext(ctx))
+	inserted := 0
+	for _, inf := range infections {
+		id := string(inf.ExposureKey) + "/" + strings.Join(inf.Regions, ",")
+		if !s.rows[id] {
+			s.rows[id] = true
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func TestProcessPublish(t *testing.T) {
+	cfg := &model.APIConfig{
+		AppPackageName:  "com.example.app",
+		AllowedRegions:  map[string]bool{"US": true, "CA": true},
+		BypassSafetynet: true,
+	}
+	intervalNumber := int32(time.Now().Add(-24*time.Hour).Unix() / 600)
+	key := func(k string) model.ExposureKey {
+		return model.ExposureKey{Key: base64.StdEncoding.EncodeToString([]byte(k)), IntervalNumber: intervalNumber, IntervalCount: 144}
+	}
+	publish := func(regions []string, keys ...model.ExposureKey) model.Publish {
+		return model.Publish{AppPackageName: "com.example.app", Regions: regions, Keys: keys}
+	}
+
+	testCases := []struct {
+		name     string
+		previous []model.Publish
+		data     model.Publish
+		want     *PublishResult
+		wantErr  error
+	}{
+		{
+			name: "accept",
+			data: publish([]string{"us"}, key("ABC"), key("DEF")),
+			want: &PublishResult{Inserted: 2},
+		},
+		{
+			name:    "region reject",
+			data:    publish([]string{"US", "MX"}, key("ABC")),
+			wantErr: ErrPublishUnauthorized,
+		},
+		{
+			name:     "duplicate dedup",
+			previous: []model.Publish{publish([]string{"US"}, key("ABC"))},
+			data:     publish([]string{"US"}, key("ABC"), key("DEF"), key("DEF")),
+			want:     &PublishResult{Inserted: 1, Duplicates: 2},
+		},
+		{
+			name:    "invalid key",
+			data:    publish([]string{"US"}, model.ExposureKey{Key: "not base64!"}),
+			wantErr: ErrPublishInvalid,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &keyStore{rows: make(map[string]bool)}
+			p := &Publisher{insert: store.insert, regionPolicy: model.RegionPolicyGlobal}
+			ctx := context.Background()
+			for _, prev := range tc.previous {
+				if _, err := p.ProcessPublish(ctx, cfg, prev); err != nil {
+					t.Fatalf("ProcessPublish of earlier publish returned unexpected error: %v", err)
+				}
+			}
+			store.gotRegions = nil
+
+			got, err := p.ProcessPublish(ctx, cfg, tc.data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ProcessPublish returned error %v, want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ProcessPublish mismatch (-want +got):\n%s", diff)
+			}
+			if err != nil {
+				if len(store.gotRegions) != 0 {
+					t.Errorf("rejected publish was stored")
+				}
+				return
+			}
+			// Storage sees the regions normalized during authorization.
+			if diff := cmp.Diff([][]string{{"US"}}, store.gotRegions); diff != "" {
+				t.Errorf("stored regions mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessPublishRejectionReason(t *testing.T) {
+	cfg := &model.APIConfig{AppPackageName: "com.example.app", AllowedRegions: map[string]bool{"US": true}}
+	p := &Publisher{insert: (&keyStore{rows: make(map[string]bool)}).insert}
+	_, err := p.ProcessPublish(context.Background(), cfg, model.Publish{AppPackageName: "com.example.app", Regions: []string{"MX"}})
+	if got := verification.RejectionReason(err); got != verification.ReasonRegion {
+		t.Errorf("RejectionReason(%v) = %q, want %q", err, got, verification.ReasonRegion)
+	}
+}
+
+func TestPublishContextUnset(t *testing.T) {
+	ctx := context.Background()
+	if got := APIConfigFromContext(ctx); got != nil {
+		t.Errorf("APIConfigFromContext = %+v, want nil", got)
+	}
+	if got := AppPackageFromContext(ctx); got != "" {
+		t.Errorf("AppPackageFromContext = %q, want empty", got)
+	}
+	if got := RegionsFromContext(ctx); got != nil {
+		t.Errorf("RegionsFromContext = %v, want nil", got)
+	}
+}
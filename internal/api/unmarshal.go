@@ -23,6 +23,10 @@ import (
 	"strings"
 )
 
+// maxRequestBodySize bounds the body of a publish request. It must leave room for an
+// attestation of android.DefaultMaxAttestationSize.
+const maxRequestBodySize = 64000
+
 func unmarshal(w http.ResponseWriter, r *http.Request, data interface{}) (error, int) {
 	if t := r.Header.Get("Content-type"); t != "application/json" {
 		return fmt.Errorf("content-type is not application/json"), http.StatusUnsupportedMediaType
@@ -32,7 +36,7 @@ func unmarshal(w http.ResponseWriter, r *http.Request, data interface{}) (error,
 	// TODO - Max Size may need to be adjusted. Starting with 64K
 	// Publish API only needs about 1K
 	// leaving room for safetyNet attestation payloads.
-	r.Body = http.MaxBytesReader(w, r.Body, 64000)
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 
 	d := json.NewDecoder(r.Body)
 	d.DisallowUnknownFields()
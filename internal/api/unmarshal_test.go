@@ -16,13 +16,16 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/googlepartners/exposure-notifications/internal/android"
 	"github.com/googlepartners/exposure-notifications/internal/model"
 
 	"github.com/google/go-cmp/cmp"
@@ -181,3 +184,24 @@ func unmarshalTestHelper(t *testing.T, payloads []string, errors []string, expCo
 		}
 	}
 }
+
+// TestMaxRequestBodySize checks that a publish of the longest attestation the verifier accepts
+// by default, with a full set of keys, fits in a request body.
+func TestMaxRequestBodySize(t *testing.T) {
+	publish := model.Publish{
+		Regions:        []string{"US", "CA", "MX"},
+		AppPackageName: "com.example.android.app",
+		Verification:   strings.Repeat("a", android.DefaultMaxAttestationSize),
+	}
+	for i := 0; i < 14; i++ {
+		publish.Keys = append(publish.Keys, model.ExposureKey{Key: "ABC/DEF/GHI/JKL/MNOPqg==", IntervalNumber: 2650000 + int32(i)*144, IntervalCount: 144})
+	}
+	body, err := json.Marshal(publish)
+	if err != nil {
+		t.Fatalf("marshalling publish: %v", err)
+	}
+	if len(body) > maxRequestBodySize {
+		t.Errorf("publish with a %d byte attestation is %d bytes, over the %d byte request body limit",
+			android.DefaultMaxAttestationSize, len(body), maxRequestBodySize)
+	}
+}
@@ -29,6 +29,11 @@ import (
 const (
 	ttlEnvVar         = "TTL_DURATION"
 	minCutoffDuration = "10d"
+
+	retainParam = "retain"
+	// minPurgeRetention is the shortest retention allowed for exposure keys; a key can match
+	// exposures for 14 days after its rolling period.
+	minPurgeRetention = 14 * oneDay
 )
 
 func NewInfectionWipeoutHandler(db *database.DB, timeout time.Duration) http.Handler {
@@ -70,6 +75,61 @@ func (h *infectionWipeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusOK)
 }
 
+// NewExposurePurgeHandler returns a handler that deletes the exposure keys whose rolling period
+// ended longer ago than the "retain" query parameter, a duration of at least 14 days.
+func NewExposurePurgeHandler(db *database.DB, timeout time.Duration) http.Handler {
+	return &exposurePurgeHandler{
+		db:      db,
+		timeout: timeout,
+	}
+}
+
+type exposurePurgeHandler struct {
+	db      *database.DB
+	timeout time.Duration
+}
+
+func (h *exposurePurgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	retain, err := parseRetention(r.URL.Query().Get(retainParam))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cutoff := time.Now().UTC().Add(-retain)
+	logger.Infof("Starting purge of exposure keys older than %v", cutoff)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	count, err := h.db.PurgeExposures(timeoutCtx, cutoff)
+	if err != nil {
+		logger.Errorf("Failed purging exposure keys: %v", err)
+		http.Error(w, "internal processing error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Infof("purge run complete, deleted %v keys.", count)
+	fmt.Fprintf(w, "Purged %d exposure key(s)", count)
+}
+
+// parseRetention parses the retain query parameter, which must be at least minPurgeRetention.
+func parseRetention(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, fmt.Errorf("%s is required", retainParam)
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", retainParam, v, err)
+	}
+	if d < minPurgeRetention {
+		return 0, fmt.Errorf("%s %v is less than the minimum of %v", retainParam, d, minPurgeRetention)
+	}
+	return d, nil
+}
+
 func NewExportWipeoutHandler(db *database.DB, timeout time.Duration) http.Handler {
 	return &exportWipeoutHandler{
 		db:      db,
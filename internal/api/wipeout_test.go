@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "336h", want: 14 * 24 * time.Hour},
+		{value: "720h", want: 30 * 24 * time.Hour},
+		{value: "24h", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "two weeks", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseRetention(tc.value)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseRetention(%q) = %v, want error", tc.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseRetention(%q) = %v, %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+}
@@ -18,14 +18,29 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/googlepartners/exposure-notifications/internal/logging"
 	"github.com/googlepartners/exposure-notifications/internal/model"
 
 	pgx "github.com/jackc/pgx/v4"
 )
 
+// readAPIConfigsQuery returns the query selecting every APIConfig, with allowed regions bounded
+// to maxRegions entries by boundedRegionArray.
+func readAPIConfigsQuery(maxRegions int) string {
+	return `
+    SELECT
+    app_package_name, apk_digest, enforce_apk_digest, cts_profile_match, basic_integrity, max_age_seconds, clock_skew_seconds,
+    ` + boundedRegionArray("allowed_regions", maxRegions) + `, all_regions, bypass_safetynet,
+    verify_declared_region
+    FROM APIConfig`
+}
+
 func (db *DB) ReadAPIConfigs(ctx context.Context) ([]*model.APIConfig, error) {
-	conn, err := db.pool.Acquire(ctx)
+	logger := logging.FromContext(ctx)
+	conn, err := db.acquireRead(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("untable to obtain database connection: %v", err)
 	}
@@ -38,11 +53,7 @@ func (db *DB) ReadAPIConfigs(ctx context.Context) ([]*model.APIConfig, error) {
 	}
 	defer finishTx(ctx, tx, &commit, &err)
 
-	query := `
-    SELECT
-    app_package_name, apk_digest, enforce_apk_digest, cts_profile_match, basic_integrity, max_age_seconds, clock_skew_seconds, allowed_regions, all_regions, bypass_safetynet
-    FROM APIConfig`
-	rows, err := conn.Query(ctx, query)
+	rows, err := conn.Query(ctx, readAPIConfigsQuery(db.maxRegions))
 	if err != nil {
 		return nil, err
 	}
@@ -51,20 +62,23 @@ func (db *DB) ReadAPIConfigs(ctx context.Context) ([]*model.APIConfig, error) {
 	// In most instances, we expect a single config entry.
 	result := make([]*model.APIConfig, 0, 1)
 	for rows.Next() {
-		var regions []string
-		config := model.NewAPIConfig()
-		var apkDigest sql.NullString
-		if err := rows.Scan(&config.AppPackageName, &apkDigest,
-			&config.EnforceApkDigest, &config.CTSProfileMatch, &config.BasicIntegrity, &config.MaxAgeSeconds,
-			&config.ClockSkewSeconds, &regions, &config.AllowAllRegions, &config.BypassSafetynet); err != nil {
+		config, regions, numRegions, err := scanAPIConfig(rows)
+		if err != nil {
 			return nil, err
 		}
-		if apkDigest.Valid {
-			config.ApkDigestSHA256 = apkDigest.String
+		if err := checkRegionArray("allowed_regions", numRegions, db.maxRegions); err != nil {
+			// Skipping the config leaves the app unconfigured, so its publishes are rejected.
+			logger.Warnf("Skipping APIConfig for %v: %v", config.AppPackageName, err)
+			continue
 		}
 
 		// build the regions map
-		for _, r := range regions {
+		allowed, err := model.NormalizeRegions(regions)
+		if err != nil {
+			logger.Warnf("Skipping APIConfig for %v: allowed_regions: %v", config.AppPackageName, err)
+			continue
+		}
+		for _, r := range allowed {
 			config.AllowedRegions[r] = true
 		}
 
@@ -73,3 +87,141 @@ func (db *DB) ReadAPIConfigs(ctx context.Context) ([]*model.APIConfig, error) {
 
 	return result, nil
 }
+
+// scanAPIConfig scans a row of readAPIConfigsQuery. The allowed regions are returned as stored,
+// and not added to the config, followed by their number, which is all that is read of an
+// oversized array.
+func scanAPIConfig(row pgx.Row) (*model.APIConfig, []string, int, error) {
+	var regions []string
+	var numRegions int
+	config := model.NewAPIConfig()
+	var apkDigest sql.NullString
+	if err := row.Scan(&config.AppPackageName, &apkDigest,
+		&config.EnforceApkDigest, &config.CTSProfileMatch, &config.BasicIntegrity, &config.MaxAgeSeconds,
+		&config.ClockSkewSeconds, &regions, &numRegions, &config.AllowAllRegions, &config.BypassSafetynet,
+		&config.VerifyDeclaredRegion); err != nil {
+		return nil, nil, 0, err
+	}
+	if apkDigest.Valid {
+		config.ApkDigestSHA256 = apkDigest.String
+	}
+	return config, regions, numRegions, nil
+}
+
+// ConfigIssueCode identifies the kind of a ConfigIssue.
+type ConfigIssueCode string
+
+const (
+	// ConfigIssueDuplicatePackage is an app package name that equals another but for case or
+	// surrounding space. Publishes match only the one they name exactly.
+	ConfigIssueDuplicatePackage ConfigIssueCode = "duplicate_package_name"
+	// ConfigIssueEmptyDigest is a config enforcing the APK digest without setting one, so that no
+	// digest is enforced.
+	ConfigIssueEmptyDigest ConfigIssueCode = "enforced_digest_empty"
+	// ConfigIssueBypassedRequirements is a config bypassing SafetyNet while requiring attestation
+	// checks to pass, whose failures the bypass then ignores.
+	ConfigIssueBypassedRequirements ConfigIssueCode = "bypass_with_requirements"
+	// ConfigIssueNoRegions is a config allowing neither all regions nor any listed region, so that
+	// every publish is rejected.
+	ConfigIssueNoRegions ConfigIssueCode = "no_regions"
+	// ConfigIssueInvalidRegions is a config whose allowed regions are not valid, which is skipped
+	// when configs are loaded, so that every publish is rejected.
+	ConfigIssueInvalidRegions ConfigIssueCode = "invalid_regions"
+)
+
+// ConfigIssue is a problem found in an APIConfig by LintAPIConfigs.
+type ConfigIssue struct {
+	AppPackageName string
+	Code           ConfigIssueCode
+	Message        string
+}
+
+// LintAPIConfigs checks every APIConfig, alone and against the others, and returns the issues
+// found, ordered by app package name. Configs that ReadAPIConfigs skips are checked too.
+func (db *DB) LintAPIConfigs(ctx context.Context) ([]ConfigIssue, error) {
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, readAPIConfigsQuery(db.maxRegions))
+	if err != nil {
+		return nil, fmt.Errorf("querying APIConfigs: %v", err)
+	}
+	defer rows.Close()
+
+	var configs []storedAPIConfig
+	for rows.Next() {
+		config, regions, numRegions, err := scanAPIConfig(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning results: %v", err)
+		}
+		configs = append(configs, storedAPIConfig{config: config, regions: regions, numRegions: numRegions})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating APIConfigs: %v", err)
+	}
+	return lintAPIConfigs(configs, db.maxRegions), nil
+}
+
+// storedAPIConfig is an APIConfig with its allowed regions as stored, and their number.
+type storedAPIConfig struct {
+	config     *model.APIConfig
+	regions    []string
+	numRegions int
+}
+
+// lintAPIConfigs returns the issues of configs, ordered by app package name; see LintAPIConfigs.
+func lintAPIConfigs(configs []storedAPIConfig, maxRegions int) []ConfigIssue {
+	sorted := append([]storedAPIConfig(nil), configs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].config.AppPackageName < sorted[j].config.AppPackageName
+	})
+
+	var issues []ConfigIssue
+	add := func(c *model.APIConfig, code ConfigIssueCode, format string, args ...interface{}) {
+		issues = append(issues, ConfigIssue{AppPackageName: c.AppPackageName, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	seen := make(map[string]string)
+	for _, sc := range sorted {
+		c := sc.config
+
+		folded := strings.ToLower(strings.TrimSpace(c.AppPackageName))
+		if other, ok := seen[folded]; ok {
+			add(c, ConfigIssueDuplicatePackage, "app package name %q duplicates %q", c.AppPackageName, other)
+		} else {
+			seen[folded] = c.AppPackageName
+		}
+
+		if c.EnforceApkDigest && strings.TrimSpace(c.ApkDigestSHA256) == "" {
+			add(c, ConfigIssueEmptyDigest, "enforce_apk_digest is set but apk_digest is empty, so no digest is enforced")
+		}
+
+		if c.BypassSafetynet {
+			var required []string
+			if c.CTSProfileMatch {
+				required = append(required, "cts_profile_match")
+			}
+			if c.BasicIntegrity {
+				required = append(required, "basic_integrity")
+			}
+			if c.EnforceApkDigest {
+				required = append(required, "enforce_apk_digest")
+			}
+			if len(required) > 0 {
+				add(c, ConfigIssueBypassedRequirements, "bypass_safetynet is set, so the failures of %s are ignored", strings.Join(required, ", "))
+			}
+		}
+
+		if err := checkRegionArray("allowed_regions", sc.numRegions, maxRegions); err != nil {
+			add(c, ConfigIssueInvalidRegions, "%v; the config is skipped when loaded", err)
+		} else if _, err := model.NormalizeRegions(sc.regions); err != nil {
+			add(c, ConfigIssueInvalidRegions, "allowed_regions: %v; the config is skipped when loaded", err)
+		} else if !c.AllowAllRegions && len(sc.regions) == 0 {
+			add(c, ConfigIssueNoRegions, "all_regions is not set and allowed_regions is empty, so every publish is rejected")
+		}
+	}
+	return issues
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"testing"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLintAPIConfigs(t *testing.T) {
+	config := func(name string, modify func(c *model.APIConfig)) *model.APIConfig {
+		c := model.NewAPIConfig()
+		c.AppPackageName = name
+		c.CTSProfileMatch = true
+		c.BasicIntegrity = true
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	us := []string{"US"}
+
+	configs := []storedAPIConfig{
+		{config: config("com.example.ok", nil), regions: us, numRegions: 1},
+		{config: config("com.example.all", func(c *model.APIConfig) { c.AllowAllRegions = true })},
+		{config: config("com.example.dup", nil), regions: us, numRegions: 1},
+		{config: config("COM.example.dup ", nil), regions: us, numRegions: 1},
+		{config: config("com.example.nodigest", func(c *model.APIConfig) { c.EnforceApkDigest = true }), regions: us, numRegions: 1},
+		{config: config("com.example.digest", func(c *model.APIConfig) {
+			c.EnforceApkDigest = true
+			c.ApkDigestSHA256 = "aGVsbG8="
+		}), regions: us, numRegions: 1},
+		{config: config("com.example.bypass", func(c *model.APIConfig) { c.BypassSafetynet = true }), regions: us, numRegions: 1},
+		{config: config("com.example.bypassonly", func(c *model.APIConfig) {
+			c.BypassSafetynet = true
+			c.CTSProfileMatch = false
+			c.BasicIntegrity = false
+		}), regions: us, numRegions: 1},
+		{config: config("com.example.noregions", nil)},
+		{config: config("com.example.badregion", nil), regions: []string{"US", "not a region"}, numRegions: 2},
+		// An oversized array is read as its number of entries only.
+		{config: config("com.example.toomany", nil), numRegions: 3},
+	}
+
+	// Issues are ordered by package name, and the duplicate is reported on the later name.
+	want := []ConfigIssue{
+		{AppPackageName: "com.example.badregion", Code: ConfigIssueInvalidRegions},
+		{AppPackageName: "com.example.bypass", Code: ConfigIssueBypassedRequirements},
+		{AppPackageName: "com.example.dup", Code: ConfigIssueDuplicatePackage},
+		{AppPackageName: "com.example.nodigest", Code: ConfigIssueEmptyDigest},
+		{AppPackageName: "com.example.noregions", Code: ConfigIssueNoRegions},
+		{AppPackageName: "com.example.toomany", Code: ConfigIssueInvalidRegions},
+	}
+
+	got := lintAPIConfigs(configs, 2)
+	for _, issue := range got {
+		if issue.Message == "" {
+			t.Errorf("issue %+v has no message", issue)
+		}
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b ConfigIssue) bool {
+		return a.AppPackageName == b.AppPackageName && a.Code == b.Code
+	})); diff != "" {
+		t.Errorf("lintAPIConfigs mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := lintAPIConfigs(configs[:2], 0); len(got) != 0 {
+		t.Errorf("lintAPIConfigs of consistent configs returned issues %+v", got)
+	}
+}
+
+func TestLintAPIConfigsBypassedRequirements(t *testing.T) {
+	c := model.NewAPIConfig()
+	c.AppPackageName = "com.example.bypass"
+	c.AllowAllRegions = true
+	c.BypassSafetynet = true
+	c.BasicIntegrity = true
+	c.EnforceApkDigest = true
+	c.ApkDigestSHA256 = "aGVsbG8="
+
+	got := lintAPIConfigs([]storedAPIConfig{{config: c}}, 0)
+	want := []ConfigIssue{{
+		AppPackageName: "com.example.bypass",
+		Code:           ConfigIssueBypassedRequirements,
+		Message:        "bypass_safetynet is set, so the failures of basic_integrity, enforce_apk_digest are ignored",
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lintAPIConfigs mismatch (-want +got):\n%s", diff)
+	}
+}
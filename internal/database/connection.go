@@ -74,11 +74,24 @@ type config struct {
 
 type DB struct {
 	pool *pgxpool.Pool
+	// replica, if set, serves read-only queries; see acquireRead.
+	replica *pgxpool.Pool
+
+	acquirePrimary acquireConnFn
+	acquireReplica acquireConnFn
+
+	// maxRegions bounds the size of region arrays read from the database; see checkRegionArray.
+	maxRegions int
+	// maxLockTTL, if positive, bounds the ttl of locks; see Lock.
+	maxLockTTL time.Duration
 }
 
 // NewFromEnv sets up the database connections using the configuration in the
 // process's environment variables. This should be called just once per server
-// instance.
+// instance. If $DB_POOL_WARMUP is true, the pool's minimum number of connections
+// ($DB_POOL_MIN_CONNS) is established before it returns. If $DB_REPLICA_HOST is set, a second
+// pool connects to the read replica there, otherwise configured like the primary, to serve
+// read-only queries.
 func NewFromEnv(ctx context.Context) (*DB, error) {
 	logger := logging.FromContext(ctx)
 	logger.Infof("Creating connection pool.")
@@ -88,12 +101,68 @@ func NewFromEnv(ctx context.Context) (*DB, error) {
 		return nil, fmt.Errorf("invalid database config: %v", err)
 	}
 
-	pool, err := pgxpool.Connect(ctx, connStr)
+	maxRegions := defaultMaxRegions
+	if v := os.Getenv(maxRegionsEnvVar); v != "" {
+		if maxRegions, err = strconv.Atoi(v); err != nil || maxRegions < 0 {
+			return nil, fmt.Errorf("invalid database config: $%s %q must be a non-negative integer, or 0 for no limit", maxRegionsEnvVar, v)
+		}
+	}
+
+	maxLockTTL := defaultMaxLockTTL
+	if v := os.Getenv(maxLockTTLEnvVar); v != "" {
+		if maxLockTTL, err = time.ParseDuration(v); err != nil || maxLockTTL < 0 {
+			return nil, fmt.Errorf("invalid database config: $%s %q must be a non-negative duration", maxLockTTLEnvVar, v)
+		}
+	}
+
+	warm := false
+	if v := os.Getenv(poolWarmUpEnvVar); v != "" {
+		if warm, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid database config: $%s %q must be a boolean", poolWarmUpEnvVar, v)
+		}
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing connection string: %v", err)
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, fmt.Errorf("creating connection pool: %v", err)
 	}
 
-	return &DB{pool: pool}, nil
+	if warm {
+		start := time.Now()
+		n, err := warmUp(ctx, int(poolConfig.MinConns), poolAcquirer(pool))
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("warming up connection pool: %v", err)
+		}
+		if n < int(poolConfig.MinConns) {
+			logger.Warnf("Warmed up %d of %d connections in %v.", n, poolConfig.MinConns, time.Since(start))
+		} else {
+			logger.Infof("Warmed up %d connections in %v.", n, time.Since(start))
+		}
+	}
+
+	db := &DB{pool: pool, acquirePrimary: pool.Acquire, maxRegions: maxRegions, maxLockTTL: maxLockTTL}
+	if os.Getenv(replicaHostEnvVar) != "" {
+		replicaConnStr, err := processEnv(ctx, replicaConfigs(configs))
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("invalid database replica config: %v", err)
+		}
+		replica, err := pgxpool.Connect(ctx, replicaConnStr)
+		if err != nil {
+			// Reads fall back to the primary.
+			logger.Warnf("Failed to create read replica connection pool, using primary for all queries: %v", err)
+		} else {
+			logger.Infof("Using read replica at $%s for read-only queries.", replicaHostEnvVar)
+			db.replica = replica
+			db.acquireReplica = replica.Acquire
+		}
+	}
+	return db, nil
 }
 
 // Close releases database connections.
@@ -101,6 +170,9 @@ func (db *DB) Close(ctx context.Context) {
 	logger := logging.FromContext(ctx)
 	logger.Infof("Closing connection pool.")
 	db.pool.Close()
+	if db.replica != nil {
+		db.replica.Close()
+	}
 }
 
 func processEnv(ctx context.Context, configs []config) (string, error) {
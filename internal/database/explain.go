@@ -0,0 +1,152 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// hotQuery is a query run often enough against a growing table that it needs an index.
+type hotQuery struct {
+	name string
+	sql  string
+	args []interface{}
+	// fullTable is set for queries meant to read the whole table, for which a sequential scan
+	// is expected.
+	fullTable bool
+}
+
+// QueryPlan describes how the database plans to run one of the hot queries.
+type QueryPlan struct {
+	Name string
+	// SeqScans lists the tables the plan reads with a sequential scan.
+	SeqScans []string
+	// IndexScans lists the indexes the plan uses.
+	IndexScans []string
+	// FullTable is set if the query is meant to read the whole table.
+	FullTable bool
+}
+
+// MissingIndex reports whether the plan reads a table with a sequential scan although the query
+// is not meant to read the whole table.
+func (p *QueryPlan) MissingIndex() bool {
+	return !p.FullTable && len(p.SeqScans) > 0
+}
+
+// hotQueries returns the federation, export and APIConfig queries to check, with representative
+// arguments for a run at now.
+func hotQueries(now time.Time) ([]hotQuery, error) {
+	since := now.Add(-24 * time.Hour)
+	var queries []hotQuery
+	for _, c := range []struct {
+		name     string
+		criteria IterateInfectionsCriteria
+	}{
+		{name: "export infections", criteria: IterateInfectionsCriteria{IncludeRegions: []string{"US"}, SinceTimestamp: since, UntilTimestamp: now}},
+		{name: "federation fetch", criteria: IterateInfectionsCriteria{SinceTimestamp: since, UntilTimestamp: now, OnlyLocalProvenance: true}},
+	} {
+		sql, args, err := generateQuery(c.criteria)
+		if err != nil {
+			return nil, fmt.Errorf("generating %s query: %v", c.name, err)
+		}
+		queries = append(queries, hotQuery{name: c.name, sql: sql, args: args})
+	}
+	return append(queries,
+		hotQuery{name: "lease export batch", sql: leasableBatchesQuery, args: []interface{}{model.ExportBatchOpen, model.ExportBatchPending, now}},
+		hotQuery{name: "latest export batch end", sql: latestExportBatchEndQuery, args: []interface{}{1}},
+		hotQuery{name: "read api configs", sql: readAPIConfigsQuery(defaultMaxRegions), fullTable: true},
+	), nil
+}
+
+// ExplainHotQueries runs EXPLAIN on the queries the federation, export and APIConfig paths depend
+// on and reports the scans each plan uses, logging a warning for each one that reads a table
+// with a sequential scan where an index is needed. The planner prefers sequential scans of small
+// tables, so the result is only meaningful against a database holding production volumes.
+func (db *DB) ExplainHotQueries(ctx context.Context) ([]*QueryPlan, error) {
+	queries, err := hotQueries(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+	return explainQueries(ctx, queries, conn.QueryRow)
+}
+
+func explainQueries(ctx context.Context, queries []hotQuery, queryRow queryRowFn) ([]*QueryPlan, error) {
+	logger := logging.FromContext(ctx)
+	plans := make([]*QueryPlan, 0, len(queries))
+	for _, q := range queries {
+		var out []byte
+		if err := queryRow(ctx, "EXPLAIN (FORMAT JSON) "+q.sql, q.args...).Scan(&out); err != nil {
+			return nil, fmt.Errorf("explaining %s query: %v", q.name, err)
+		}
+		plan, err := parseExplain(out)
+		if err != nil {
+			return nil, fmt.Errorf("parsing plan of %s query: %v", q.name, err)
+		}
+		plan.Name = q.name
+		plan.FullTable = q.fullTable
+		if plan.MissingIndex() {
+			logger.Warnf("Query %q reads %v with a sequential scan, check that its index exists", q.name, plan.SeqScans)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// explainNode is a node of the plan produced by EXPLAIN (FORMAT JSON).
+type explainNode struct {
+	NodeType     string        `json:"Node Type"`
+	RelationName string        `json:"Relation Name"`
+	IndexName    string        `json:"Index Name"`
+	Plans        []explainNode `json:"Plans"`
+}
+
+// parseExplain parses the output of EXPLAIN (FORMAT JSON) into the scans of its plan.
+func parseExplain(out []byte) (*QueryPlan, error) {
+	var statements []struct {
+		Plan *explainNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(out, &statements); err != nil {
+		return nil, err
+	}
+	if len(statements) != 1 || statements[0].Plan == nil {
+		return nil, fmt.Errorf("expected a single plan, got %d", len(statements))
+	}
+	plan := &QueryPlan{}
+	var walk func(n *explainNode)
+	walk = func(n *explainNode) {
+		switch n.NodeType {
+		case "Seq Scan":
+			plan.SeqScans = append(plan.SeqScans, n.RelationName)
+		case "Index Scan", "Index Only Scan", "Bitmap Index Scan":
+			plan.IndexScans = append(plan.IndexScans, n.IndexName)
+		}
+		for i := range n.Plans {
+			walk(&n.Plans[i])
+		}
+	}
+	walk(statements[0].Plan)
+	return plan, nil
+}
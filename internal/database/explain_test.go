@@ -0,0 +1,103 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pgx "github.com/jackc/pgx/v4"
+)
+
+const (
+	seqScanPlan = `[{"Plan": {"Node Type": "Limit", "Plans": [
+		{"Node Type": "Seq Scan", "Parent Relationship": "Outer", "Relation Name": "exportbatch", "Alias": "exportbatch"}
+	]}}]`
+	indexScanPlan = `[{"Plan": {"Node Type": "Sort", "Plans": [
+		{"Node Type": "Bitmap Heap Scan", "Relation Name": "infection", "Plans": [
+			{"Node Type": "Bitmap Index Scan", "Index Name": "infection_created_at"}
+		]}
+	]}}]`
+)
+
+func TestParseExplain(t *testing.T) {
+	testCases := []struct {
+		name    string
+		out     string
+		want    *QueryPlan
+		wantErr bool
+	}{
+		{name: "seq scan", out: seqScanPlan, want: &QueryPlan{SeqScans: []string{"exportbatch"}}},
+		{name: "index scan", out: indexScanPlan, want: &QueryPlan{IndexScans: []string{"infection_created_at"}}},
+		{name: "index only scan", out: `[{"Plan": {"Node Type": "Index Only Scan", "Index Name": "exportbatch_pkey", "Relation Name": "exportbatch"}}]`,
+			want: &QueryPlan{IndexScans: []string{"exportbatch_pkey"}}},
+		{name: "not json", out: "Seq Scan on exportbatch", wantErr: true},
+		{name: "no plan", out: `[]`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseExplain([]byte(tc.out))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("parseExplain returned error %v, want error %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseExplain mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExplainQueries(t *testing.T) {
+	queries := []hotQuery{
+		{name: "lease export batch", sql: "SELECT batch_id FROM ExportBatch"},
+		{name: "export infections", sql: "SELECT exposure_key FROM Infection"},
+		{name: "read api configs", sql: "SELECT * FROM APIConfig", fullTable: true},
+	}
+	var explained []string
+	queryRow := func(_ context.Context, query string, _ ...interface{}) pgx.Row {
+		explained = append(explained, query)
+		if strings.Contains(query, "Infection") {
+			return &fakeRow{values: []interface{}{[]byte(indexScanPlan)}}
+		}
+		return &fakeRow{values: []interface{}{[]byte(seqScanPlan)}}
+	}
+
+	plans, err := explainQueries(context.Background(), queries, queryRow)
+	if err != nil {
+		t.Fatalf("explainQueries returned unexpected error: %v", err)
+	}
+
+	wantExplained := []string{
+		"EXPLAIN (FORMAT JSON) SELECT batch_id FROM ExportBatch",
+		"EXPLAIN (FORMAT JSON) SELECT exposure_key FROM Infection",
+		"EXPLAIN (FORMAT JSON) SELECT * FROM APIConfig",
+	}
+	if diff := cmp.Diff(wantExplained, explained); diff != "" {
+		t.Errorf("explained queries mismatch (-want +got):\n%s", diff)
+	}
+	var missing []string
+	for _, p := range plans {
+		if p.MissingIndex() {
+			missing = append(missing, p.Name)
+		}
+	}
+	// The APIConfig sequential scan is expected, since the query reads the whole table.
+	if diff := cmp.Diff([]string{"lease export batch"}, missing); diff != "" {
+		t.Errorf("queries missing an index mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -43,7 +43,7 @@ func (db *DB) AddExportConfig(ctx context.Context, ec *model.ExportConfig) (err
 		return errors.New("period must divide equally into 24 hours (e.g., 2h, 4h, 12h, 15m, 30m)")
 	}
 
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -86,7 +86,7 @@ type ExportConfigIterator interface {
 
 // IterateExportConfigs returns an ExportConfigIterator to iterate the ExportConfigs.
 func (db *DB) IterateExportConfigs(ctx context.Context, now time.Time) (ExportConfigIterator, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquireRead(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -146,13 +146,26 @@ func (i *postgresExportConfigIterator) Close() error {
 // for a given ExportConfig. Minimum time (i.e., time.Time{}) is returned
 // if no previous ExportBatch exists.
 func (db *DB) LatestExportBatchEnd(ctx context.Context, ec *model.ExportConfig) (time.Time, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
 	defer conn.Release()
 
-	row := conn.QueryRow(ctx, `
+	row := conn.QueryRow(ctx, latestExportBatchEndQuery, ec.ConfigID)
+
+	var latestEnd time.Time
+	if err := row.Scan(&latestEnd); err != nil {
+		if err == pgx.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("scanning result: %v", err)
+	}
+	return latestEnd, nil
+}
+
+// latestExportBatchEndQuery selects the end timestamps of the batches of config $1, latest first.
+const latestExportBatchEndQuery = `
 		SELECT
 			end_timestamp
 		FROM
@@ -161,21 +174,142 @@ func (db *DB) LatestExportBatchEnd(ctx context.Context, ec *model.ExportConfig)
 		    config_id = $1
 		ORDER BY
 		    end_timestamp DESC
-		`, ec.ConfigID)
+		`
 
-	var latestEnd time.Time
-	if err := row.Scan(&latestEnd); err != nil {
+// GetExportWatermark returns the creation time of the newest key exported by a completed batch
+// of config configID, or the zero time if none has been recorded.
+func (db *DB) GetExportWatermark(ctx context.Context, configID int64) (time.Time, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	return getExportWatermark(ctx, configID, conn.QueryRow)
+}
+
+func getExportWatermark(ctx context.Context, configID int64, queryRow queryRowFn) (time.Time, error) {
+	row := queryRow(ctx, `
+		SELECT
+			watermark
+		FROM
+			ExportConfig
+		WHERE
+			config_id = $1
+		`, configID)
+
+	var watermark *time.Time
+	if err := row.Scan(&watermark); err != nil {
 		if err == pgx.ErrNoRows {
-			return time.Time{}, nil
+			return time.Time{}, ErrNotFound
 		}
 		return time.Time{}, fmt.Errorf("scanning result: %v", err)
 	}
-	return latestEnd, nil
+	if watermark == nil {
+		return time.Time{}, nil
+	}
+	return *watermark, nil
+}
+
+// AdvanceExportWatermark records watermark as the export watermark of config configID, unless the
+// recorded watermark is already later, so that batches completing out of order never move it back.
+func (db *DB) AdvanceExportWatermark(ctx context.Context, configID int64, watermark time.Time) error {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := conn.Exec(ctx, query, args...)
+		return err
+	}
+	return advanceExportWatermark(ctx, configID, watermark, exec)
+}
+
+func advanceExportWatermark(ctx context.Context, configID int64, watermark time.Time, exec execFn) error {
+	err := exec(ctx, `
+		UPDATE ExportConfig
+		SET
+			watermark = $2
+		WHERE
+			config_id = $1 AND (watermark IS NULL OR watermark < $2)
+		`, configID, watermark)
+	if err != nil {
+		return fmt.Errorf("advancing export watermark of config %d: %v", configID, err)
+	}
+	return nil
+}
+
+// GetExportDeferredFrom returns the start of the first window of config configID deferred for
+// having too few keys before the config had a batch, or the zero time if none was deferred.
+func (db *DB) GetExportDeferredFrom(ctx context.Context, configID int64) (time.Time, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	return getExportDeferredFrom(ctx, configID, conn.QueryRow)
+}
+
+func getExportDeferredFrom(ctx context.Context, configID int64, queryRow queryRowFn) (time.Time, error) {
+	row := queryRow(ctx, `
+		SELECT
+			deferred_from
+		FROM
+			ExportConfig
+		WHERE
+			config_id = $1
+		`, configID)
+
+	var deferredFrom *time.Time
+	if err := row.Scan(&deferredFrom); err != nil {
+		if err == pgx.ErrNoRows {
+			return time.Time{}, ErrNotFound
+		}
+		return time.Time{}, fmt.Errorf("scanning result: %v", err)
+	}
+	if deferredFrom == nil {
+		return time.Time{}, nil
+	}
+	return *deferredFrom, nil
+}
+
+// DeferExportConfig records that the window of config configID starting at from was deferred for
+// having too few keys. Only the first deferral is kept, so that later runs carry every deferred
+// window forward.
+func (db *DB) DeferExportConfig(ctx context.Context, configID int64, from time.Time) error {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := conn.Exec(ctx, query, args...)
+		return err
+	}
+	return deferExportConfig(ctx, configID, from, exec)
+}
+
+func deferExportConfig(ctx context.Context, configID int64, from time.Time, exec execFn) error {
+	err := exec(ctx, `
+		UPDATE ExportConfig
+		SET
+			deferred_from = $2
+		WHERE
+			config_id = $1 AND deferred_from IS NULL
+		`, configID, from)
+	if err != nil {
+		return fmt.Errorf("recording deferral of config %d: %v", configID, err)
+	}
+	return nil
 }
 
 // AddExportBatches inserts new export batches.
 func (db *DB) AddExportBatches(ctx context.Context, batches []*model.ExportBatch) (err error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -210,9 +344,11 @@ func (db *DB) AddExportBatches(ctx context.Context, batches []*model.ExportBatch
 	return nil
 }
 
-// AddExportFile adds a new export file entry for the given ExportFile.
+// AddExportFile adds a new export file entry for the given ExportFile. If the batch registered
+// the same file on an earlier attempt, such as before a retry or a re-queue, the entry is reset
+// to ef. It is an error for the file to belong to another batch.
 func (db *DB) AddExportFile(ctx context.Context, ef *model.ExportFile) error {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -225,23 +361,41 @@ func (db *DB) AddExportFile(ctx context.Context, ef *model.ExportFile) error {
 	}
 	defer finishTx(ctx, tx, &commit, &err)
 
-	_, err = tx.Exec(ctx, `
+	if err := addExportFile(ctx, ef, tx.QueryRow); err != nil {
+		return err
+	}
+
+	commit = true
+	return nil
+}
+
+func addExportFile(ctx context.Context, ef *model.ExportFile, queryRow queryRowFn) error {
+	row := queryRow(ctx, `
 		INSERT INTO ExportFile
-			(filename, batch_id, region, batch_num, batch_size, status)
+			(filename, batch_id, region, report_type, revocation, batch_num, batch_size, status)
 		VALUES
-			($1, $2, $3, $4, $5, $6)
-		`, ef.Filename, ef.BatchID, ef.Region, ef.BatchNum, ef.BatchSize, ef.Status)
-	if err != nil {
+			($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (filename) DO UPDATE
+		SET
+			region = EXCLUDED.region, report_type = EXCLUDED.report_type, revocation = EXCLUDED.revocation,
+			batch_num = EXCLUDED.batch_num, batch_size = EXCLUDED.batch_size, status = EXCLUDED.status
+		WHERE
+			ExportFile.batch_id = EXCLUDED.batch_id
+		RETURNING filename
+		`, ef.Filename, ef.BatchID, ef.Region, ef.ReportType, ef.Revocation, ef.BatchNum, ef.BatchSize, ef.Status)
+	var filename string
+	if err := row.Scan(&filename); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("export file %s belongs to another batch than %d", ef.Filename, ef.BatchID)
+		}
 		return fmt.Errorf("inserting to ExportFile: %v", err)
 	}
-
-	commit = true
 	return nil
 }
 
 // UpdateExportFile updates batchsize and status for the rows correcponding to the files passed in.
 func (db *DB) UpdateExportFile(ctx context.Context, filename, status string, batchCount int) error {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -269,18 +423,9 @@ func (db *DB) UpdateExportFile(ctx context.Context, filename, status string, bat
 	return nil
 }
 
-// LeaseBatch returns a leased ExportBatch for the worker to process. If no work to do, nil will be returned.
-func (db *DB) LeaseBatch(ctx context.Context, ttl time.Duration, now time.Time) (eb *model.ExportBatch, err error) {
-	conn, err := db.pool.Acquire(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
-	}
-	defer conn.Release()
-
-	// Query for batches that are OPEN or PENDING with expired lease. Also, only return batches with end timestamp
-	// in the past (i.e., the batch is complete).
-	// TODO(jasonco): Should we wait even a bit longer to allow the batch to be completely full?
-	rows, err := conn.Query(ctx, `
+// leasableBatchesQuery selects up to 100 complete batches that are OPEN ($1), or PENDING ($2) with
+// a lease that expired before $3.
+const leasableBatchesQuery = `
 		SELECT
 			batch_id
 		FROM
@@ -294,7 +439,20 @@ func (db *DB) LeaseBatch(ctx context.Context, ttl time.Duration, now time.Time)
 		AND
 			end_timestamp < $3
 		LIMIT 100
-		`, model.ExportBatchOpen, model.ExportBatchPending, now)
+		`
+
+// LeaseBatch returns a leased ExportBatch for the worker to process. If no work to do, nil will be returned.
+func (db *DB) LeaseBatch(ctx context.Context, ttl time.Duration, now time.Time) (eb *model.ExportBatch, err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Query for batches that are OPEN or PENDING with expired lease. Also, only return batches with end timestamp
+	// in the past (i.e., the batch is complete).
+	// TODO(jasonco): Should we wait even a bit longer to allow the batch to be completely full?
+	rows, err := conn.Query(ctx, leasableBatchesQuery, model.ExportBatchOpen, model.ExportBatchPending, now)
 	if err != nil {
 		return nil, err
 	}
@@ -341,14 +499,14 @@ func (db *DB) LeaseBatch(ctx context.Context, ttl time.Duration, now time.Time)
 			if err := row.Scan(&status, &expires); err != nil {
 				return false, err
 			}
-			if status == model.ExportBatchComplete || (expires != nil && status == model.ExportBatchPending && now.Before(*expires)) {
+			if status == model.ExportBatchComplete || status == model.ExportBatchFailed || status == model.ExportBatchPartial || (expires != nil && status == model.ExportBatchPending && now.Before(*expires)) {
 				return false, nil
 			}
 
 			_, err = tx.Exec(ctx, `
 					UPDATE ExportBatch
 					SET
-						status = $1, lease_expires = $2
+						status = $1, lease_expires = $2, attempts = attempts + 1
 					WHERE
 					    batch_id = $3
 					`, model.ExportBatchPending, now.Add(ttl), bid)
@@ -386,27 +544,36 @@ func (db *DB) LeaseBatch(ctx context.Context, ttl time.Duration, now time.Time)
 func lookupExportBatch(ctx context.Context, batchID int64, queryRow queryRowFn) (*model.ExportBatch, error) {
 	row := queryRow(ctx, `
 		SELECT
-			batch_id, config_id, filename_root, start_timestamp, end_timestamp, include_regions, exclude_regions, status, lease_expires
+			batch_id, config_id, filename_root, start_timestamp, end_timestamp, include_regions, exclude_regions, status, lease_expires,
+			attempts, last_error, failed_regions
 		FROM
 			ExportBatch
 		WHERE
 			batch_id = $1
 		`, batchID)
+	return scanExportBatch(row)
+}
 
+func scanExportBatch(row pgx.Row) (*model.ExportBatch, error) {
 	var expires *time.Time
+	var lastError *string
 	eb := model.ExportBatch{}
-	if err := row.Scan(&eb.BatchID, &eb.ConfigID, &eb.FilenameRoot, &eb.StartTimestamp, &eb.EndTimestamp, &eb.IncludeRegions, &eb.ExcludeRegions, &eb.Status, &expires); err != nil {
+	if err := row.Scan(&eb.BatchID, &eb.ConfigID, &eb.FilenameRoot, &eb.StartTimestamp, &eb.EndTimestamp, &eb.IncludeRegions, &eb.ExcludeRegions, &eb.Status, &expires,
+		&eb.Attempts, &lastError, &eb.FailedRegions); err != nil {
 		return nil, err
 	}
 	if expires != nil {
 		eb.LeaseExpires = *expires
 	}
+	if lastError != nil {
+		eb.LastError = *lastError
+	}
 	return &eb, nil
 }
 
 // CompleteBatch marks a batch as completed.
 func (db *DB) CompleteBatch(ctx context.Context, batchID int64) (err error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -435,7 +602,7 @@ func (db *DB) CompleteBatch(ctx context.Context, batchID int64) (err error) {
 		UPDATE
 			ExportBatch
 		SET
-			status = $1, lease_expires = NULL
+			status = $1, lease_expires = NULL, failed_regions = NULL
 		WHERE
 			batch_id = $2
 		`, model.ExportBatchComplete, batchID)
@@ -447,6 +614,437 @@ func (db *DB) CompleteBatch(ctx context.Context, batchID int64) (err error) {
 	return nil
 }
 
+// PartiallyCompleteBatch marks a batch whose files were written for some of its regions but not
+// for failedRegions. Like a failed batch, it is not leased again until it is re-queued with
+// RequeueBatch, after which only failedRegions are exported.
+func (db *DB) PartiallyCompleteBatch(ctx context.Context, batchID int64, failedRegions []string, reason string) (err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	commit := false
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return err
+	}
+	defer finishTx(ctx, tx, &commit, &err)
+
+	batch, err := lookupExportBatch(ctx, batchID, tx.QueryRow)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if batch.Status == model.ExportBatchComplete {
+		return fmt.Errorf("batch %d is already marked completed", batchID)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE
+			ExportBatch
+		SET
+			status = $1, lease_expires = NULL, failed_regions = $2, last_error = $3
+		WHERE
+			batch_id = $4
+		`, model.ExportBatchPartial, failedRegions, reason, batchID)
+	if err != nil {
+		return err
+	}
+
+	commit = true
+	return nil
+}
+
+// FailBatch records a failed attempt to create the files of a leased batch. If the batch has
+// been attempted maxAttempts times, it is marked failed and is not leased again until it is
+// re-queued with RequeueBatch; otherwise it is retried once its lease expires. A maxAttempts
+// of zero or less retries indefinitely. Returns true if the batch was marked failed.
+func (db *DB) FailBatch(ctx context.Context, batchID int64, reason string, maxAttempts int) (failed bool, err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+	return failBatch(ctx, batchID, reason, maxAttempts, conn.QueryRow)
+}
+
+func failBatch(ctx context.Context, batchID int64, reason string, maxAttempts int, queryRow queryRowFn) (bool, error) {
+	// The attempts are compared in the UPDATE, so that an attempt counted by a concurrent lease
+	// is not missed.
+	row := queryRow(ctx, `
+		UPDATE
+			ExportBatch
+		SET
+			status = CASE WHEN $2 > 0 AND attempts >= $2 THEN $3 ELSE status END, last_error = $4
+		WHERE
+			batch_id = $1
+		RETURNING status
+		`, batchID, maxAttempts, model.ExportBatchFailed, reason)
+
+	var status string
+	if err := row.Scan(&status); err != nil {
+		if err == pgx.ErrNoRows {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("failing batch %d: %v", batchID, err)
+	}
+	return status == model.ExportBatchFailed, nil
+}
+
+// DeferBatch records a failed attempt to create the files of a leased batch that does not count
+// towards its maximum attempts, such as a failure because a storage quota is exhausted, and keeps
+// the batch from being leased again until retryAt.
+func (db *DB) DeferBatch(ctx context.Context, batchID int64, reason string, retryAt time.Time) error {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := conn.Exec(ctx, query, args...)
+		return err
+	}
+	return deferBatch(ctx, batchID, reason, retryAt, exec)
+}
+
+func deferBatch(ctx context.Context, batchID int64, reason string, retryAt time.Time, exec execFn) error {
+	// The batch stays pending, so that LeaseBatch passes over it until its lease expires; the
+	// attempt counted by LeaseBatch is taken back.
+	err := exec(ctx, `
+		UPDATE
+			ExportBatch
+		SET
+			status = $2, lease_expires = $3, last_error = $4, attempts = GREATEST(attempts - 1, 0)
+		WHERE
+			batch_id = $1
+		`, batchID, model.ExportBatchPending, retryAt, reason)
+	if err != nil {
+		return fmt.Errorf("deferring batch %d: %v", batchID, err)
+	}
+	return nil
+}
+
+// ListFailedBatches returns a page of the batches that exhausted their attempts or completed for
+// only some of their regions, oldest first, and the cursor of the next page, or "" if there are
+// no more.
+func (db *DB) ListFailedBatches(ctx context.Context, page Page) ([]*model.ExportBatch, string, error) {
+	after, err := page.validate()
+	if err != nil {
+		return nil, "", err
+	}
+	first, afterStart, afterID, err := after.timeKeyset()
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT
+			batch_id, config_id, filename_root, start_timestamp, end_timestamp, include_regions, exclude_regions, status, lease_expires,
+			attempts, last_error, failed_regions
+		FROM
+			ExportBatch
+		WHERE
+			(status = $1 OR status = $2)
+			AND ($3 OR (start_timestamp, batch_id) > ($4, $5))
+		ORDER BY
+			start_timestamp, batch_id
+		LIMIT $6
+		`, model.ExportBatchFailed, model.ExportBatchPartial, first, afterStart, afterID, page.queryLimit())
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var batches []*model.ExportBatch
+	for rows.Next() {
+		eb, err := scanExportBatch(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		batches = append(batches, eb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	n, more := page.truncate(len(batches))
+	batches = batches[:n]
+	if !more {
+		return batches, "", nil
+	}
+	last := batches[n-1]
+	return batches, encodePageCursor(timeCursor(last.StartTimestamp, last.BatchID)), nil
+}
+
+// RequeueBatch resets a failed or partially completed batch so that it is leased again with a
+// fresh set of attempts. The failed regions of a partially completed batch are kept, so that
+// only they are exported again.
+func (db *DB) RequeueBatch(ctx context.Context, batchID int64) (err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	commit := false
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return err
+	}
+	defer finishTx(ctx, tx, &commit, &err)
+
+	batch, err := lookupExportBatch(ctx, batchID, tx.QueryRow)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := checkRequeue(batch); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE
+			ExportBatch
+		SET
+			status = $1, lease_expires = NULL, attempts = 0, last_error = NULL
+		WHERE
+			batch_id = $2
+		`, model.ExportBatchOpen, batchID)
+	if err != nil {
+		return err
+	}
+
+	commit = true
+	return nil
+}
+
+// checkRequeue returns an error if eb cannot be re-queued.
+func checkRequeue(eb *model.ExportBatch) error {
+	if eb.Status != model.ExportBatchFailed && eb.Status != model.ExportBatchPartial {
+		return fmt.Errorf("batch %d has status %s, only %s and %s batches can be re-queued", eb.BatchID, eb.Status, model.ExportBatchFailed, model.ExportBatchPartial)
+	}
+	return nil
+}
+
+// ListCompletedBatches returns the completed batches whose windows lie within [since, until],
+// ordered by config and start time.
+func (db *DB) ListCompletedBatches(ctx context.Context, since, until time.Time) ([]*model.ExportBatch, error) {
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT
+			batch_id, config_id, filename_root, start_timestamp, end_timestamp, include_regions, exclude_regions, status, lease_expires,
+			attempts, last_error, failed_regions
+		FROM
+			ExportBatch
+		WHERE
+			status = $1
+			AND start_timestamp >= $2
+			AND end_timestamp <= $3
+		ORDER BY
+			config_id, start_timestamp
+		`, model.ExportBatchComplete, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []*model.ExportBatch
+	for rows.Next() {
+		eb, err := scanExportBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, eb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// ListExportFiles returns the export files of a batch, ordered by batch number.
+func (db *DB) ListExportFiles(ctx context.Context, batchID int64) ([]*model.ExportFile, error) {
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT
+			filename, batch_id, region, report_type, revocation, batch_num, batch_size, status
+		FROM
+			ExportFile
+		WHERE
+			batch_id = $1
+		ORDER BY
+			batch_num
+		`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*model.ExportFile
+	for rows.Next() {
+		var f model.ExportFile
+		var region *string
+		if err := rows.Scan(&f.Filename, &f.BatchID, &region, &f.ReportType, &f.Revocation, &f.BatchNum, &f.BatchSize, &f.Status); err != nil {
+			return nil, err
+		}
+		if region != nil {
+			f.Region = *region
+		}
+		files = append(files, &f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ExistingExportFiles returns those of filenames that name an export file, whatever its batch
+// and status. It reads from the primary, since the names are checked before files are written.
+func (db *DB) ExistingExportFiles(ctx context.Context, filenames []string) ([]string, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT
+			filename
+		FROM
+			ExportFile
+		WHERE
+			filename = ANY($1)
+		ORDER BY
+			filename
+		`, filenames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var existing []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		existing = append(existing, filename)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// ReplaceBatches replaces the completed batches in oldBatchIDs with merged, whose files must
+// already have been written, in a single transaction. The replaced batches and their files are
+// marked deleted; the caller is responsible for removing their objects from storage. The merged
+// files must have names of their own: if one is already an export file, nothing is replaced.
+// The merged batch's BatchID is set on success.
+func (db *DB) ReplaceBatches(ctx context.Context, oldBatchIDs []int64, merged *model.ExportBatch, files []*model.ExportFile) (err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	commit := false
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return fmt.Errorf("starting transaction: %v", err)
+	}
+	defer finishTx(ctx, tx, &commit, &err)
+
+	for _, id := range oldBatchIDs {
+		batch, err := lookupExportBatch(ctx, id, tx.QueryRow)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+		if batch.Status != model.ExportBatchComplete {
+			return fmt.Errorf("batch %d has status %s, only %s batches can be replaced", id, batch.Status, model.ExportBatchComplete)
+		}
+	}
+
+	row := tx.QueryRow(ctx, `
+		INSERT INTO ExportBatch
+			(config_id, filename_root, start_timestamp, end_timestamp, include_regions, exclude_regions, status)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7)
+		RETURNING batch_id
+		`, merged.ConfigID, merged.FilenameRoot, merged.StartTimestamp, merged.EndTimestamp, merged.IncludeRegions, merged.ExcludeRegions, model.ExportBatchComplete)
+	var batchID int64
+	if err := row.Scan(&batchID); err != nil {
+		return fmt.Errorf("inserting merged batch: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE ExportFile
+		SET
+			status = $1
+		WHERE
+			batch_id = ANY($2)
+		`, model.ExportBatchDeleted, oldBatchIDs)
+	if err != nil {
+		return fmt.Errorf("marking replaced export files deleted: %v", err)
+	}
+	for _, f := range files {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO ExportFile
+				(filename, batch_id, region, report_type, revocation, batch_num, batch_size, status)
+			VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8)
+			`, f.Filename, batchID, f.Region, f.ReportType, f.Revocation, f.BatchNum, f.BatchSize, model.ExportBatchComplete)
+		if err != nil {
+			return fmt.Errorf("inserting merged export file %s: %v", f.Filename, err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE ExportBatch
+		SET
+			status = $1
+		WHERE
+			batch_id = ANY($2)
+		`, model.ExportBatchDeleted, oldBatchIDs)
+	if err != nil {
+		return fmt.Errorf("marking replaced batches deleted: %v", err)
+	}
+
+	commit = true
+	merged.BatchID = batchID
+	merged.Status = model.ExportBatchComplete
+	for _, f := range files {
+		f.BatchID = batchID
+		f.Status = model.ExportBatchComplete
+	}
+	return nil
+}
+
 func shuffle(vals []int64) []int64 {
 	r := rand.New(rand.NewSource(time.Now().Unix()))
 	ret := make([]int64, len(vals))
@@ -468,7 +1066,7 @@ type joinedExportBatchFile struct {
 // DeleteFilesBefore deletes the export batch files for batches ending before the time passed in.
 func (db *DB) DeleteFilesBefore(ctx context.Context, before time.Time) (count int, err error) {
 	logger := logging.FromContext(ctx)
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -0,0 +1,273 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+	pgx "github.com/jackc/pgx/v4"
+)
+
+func TestFailBatch(t *testing.T) {
+	testCases := []struct {
+		name       string
+		row        *fakeRow
+		wantFailed bool
+		wantErr    error
+	}{
+		{name: "attempts remaining", row: &fakeRow{values: []interface{}{model.ExportBatchPending}}},
+		{name: "attempts exhausted", row: &fakeRow{values: []interface{}{model.ExportBatchFailed}}, wantFailed: true},
+		{name: "unknown batch", row: &fakeRow{err: pgx.ErrNoRows}, wantErr: ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotSQL string
+			var gotArgs []interface{}
+			queryRow := func(ctx context.Context, query string, args ...interface{}) pgx.Row {
+				gotSQL, gotArgs = strings.Join(strings.Fields(query), " "), args
+				return tc.row
+			}
+
+			failed, err := failBatch(context.Background(), 7, "boom", 3, queryRow)
+			if err != tc.wantErr {
+				t.Fatalf("failBatch returned err=%v, want %v", err, tc.wantErr)
+			}
+			if failed != tc.wantFailed {
+				t.Errorf("failBatch returned failed=%t, want %t", failed, tc.wantFailed)
+			}
+			// The decision is taken on the stored attempts, not on those read before the update.
+			if want := "status = CASE WHEN $2 > 0 AND attempts >= $2 THEN $3 ELSE status END"; !strings.Contains(gotSQL, want) {
+				t.Errorf("failBatch query %q does not contain %q", gotSQL, want)
+			}
+			if diff := cmp.Diff([]interface{}{int64(7), 3, model.ExportBatchFailed, "boom"}, gotArgs); diff != "" {
+				t.Errorf("failBatch args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckRequeue(t *testing.T) {
+	testCases := []struct {
+		status  string
+		wantErr bool
+	}{
+		{status: model.ExportBatchFailed},
+		{status: model.ExportBatchPartial},
+		{status: model.ExportBatchOpen, wantErr: true},
+		{status: model.ExportBatchPending, wantErr: true},
+		{status: model.ExportBatchComplete, wantErr: true},
+		{status: model.ExportBatchDeleted, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.status, func(t *testing.T) {
+			err := checkRequeue(&model.ExportBatch{BatchID: 1, Status: tc.status})
+			if tc.wantErr && err == nil {
+				t.Errorf("checkRequeue(%s) = nil, want error", tc.status)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("checkRequeue(%s) returned unexpected error: %v", tc.status, err)
+			}
+		})
+	}
+}
+
+func TestGetExportWatermark(t *testing.T) {
+	watermark := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		row     *fakeRow
+		want    time.Time
+		wantErr error
+	}{
+		{name: "recorded", row: &fakeRow{values: []interface{}{&watermark}}, want: watermark},
+		{name: "never exported", row: &fakeRow{values: []interface{}{(*time.Time)(nil)}}},
+		{name: "unknown config", row: &fakeRow{err: pgx.ErrNoRows}, wantErr: ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getExportWatermark(context.Background(), 1, queryRowReturning(tc.row))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("getExportWatermark returned error %v, want %v", err, tc.wantErr)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("getExportWatermark = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdvanceExportWatermark(t *testing.T) {
+	watermark := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tx := &fakeTx{}
+	if err := advanceExportWatermark(context.Background(), 7, watermark, tx.exec); err != nil {
+		t.Fatalf("advanceExportWatermark returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"UPDATE ExportConfig SET"}, tx.prefixes()); diff != "" {
+		t.Errorf("statements mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([][]interface{}{{int64(7), watermark}}, tx.args); diff != "" {
+		t.Errorf("args mismatch (-want +got):\n%s", diff)
+	}
+
+	failing := &fakeTx{failOn: "UPDATE ExportConfig"}
+	if err := advanceExportWatermark(context.Background(), 7, watermark, failing.exec); err == nil {
+		t.Errorf("advanceExportWatermark returned nil error for a failed update")
+	}
+}
+
+func TestGetExportDeferredFrom(t *testing.T) {
+	deferredFrom := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		row     *fakeRow
+		want    time.Time
+		wantErr error
+	}{
+		{name: "deferred", row: &fakeRow{values: []interface{}{&deferredFrom}}, want: deferredFrom},
+		{name: "never deferred", row: &fakeRow{values: []interface{}{(*time.Time)(nil)}}},
+		{name: "unknown config", row: &fakeRow{err: pgx.ErrNoRows}, wantErr: ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getExportDeferredFrom(context.Background(), 1, queryRowReturning(tc.row))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("getExportDeferredFrom returned error %v, want %v", err, tc.wantErr)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("getExportDeferredFrom = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeferExportConfig(t *testing.T) {
+	from := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tx := &fakeTx{}
+	if err := deferExportConfig(context.Background(), 7, from, tx.exec); err != nil {
+		t.Fatalf("deferExportConfig returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"UPDATE ExportConfig SET"}, tx.prefixes()); diff != "" {
+		t.Errorf("statements mismatch (-want +got):\n%s", diff)
+	}
+	// A later deferral must not move the start of the deferred windows.
+	if !strings.Contains(tx.statements[0], "deferred_from IS NULL") {
+		t.Errorf("deferExportConfig statement %q overwrites an earlier deferral", tx.statements[0])
+	}
+	if diff := cmp.Diff([][]interface{}{{int64(7), from}}, tx.args); diff != "" {
+		t.Errorf("args mismatch (-want +got):\n%s", diff)
+	}
+
+	failing := &fakeTx{failOn: "UPDATE ExportConfig"}
+	if err := deferExportConfig(context.Background(), 7, from, failing.exec); err == nil {
+		t.Errorf("deferExportConfig returned nil error for a failed update")
+	}
+}
+
+func TestDeferBatch(t *testing.T) {
+	retryAt := time.Date(2020, 5, 1, 13, 0, 0, 0, time.UTC)
+
+	tx := &fakeTx{}
+	if err := deferBatch(context.Background(), 7, "quota_exceeded: out of quota", retryAt, tx.exec); err != nil {
+		t.Fatalf("deferBatch returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"UPDATE ExportBatch SET"}, tx.prefixes()); diff != "" {
+		t.Errorf("statements mismatch (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(tx.statements[0], "attempts = GREATEST(attempts - 1, 0)") {
+		t.Errorf("deferBatch statement %q does not take back the attempt", tx.statements[0])
+	}
+	want := [][]interface{}{{int64(7), model.ExportBatchPending, retryAt, "quota_exceeded: out of quota"}}
+	if diff := cmp.Diff(want, tx.args); diff != "" {
+		t.Errorf("args mismatch (-want +got):\n%s", diff)
+	}
+
+	failing := &fakeTx{failOn: "UPDATE ExportBatch"}
+	if err := deferBatch(context.Background(), 7, "quota_exceeded", retryAt, failing.exec); err == nil {
+		t.Errorf("deferBatch returned nil error for a failed update")
+	}
+}
+
+// fakeExportFiles is an ExportFile table keyed by filename, applying the upsert of addExportFile.
+type fakeExportFiles map[string]model.ExportFile
+
+func (f fakeExportFiles) queryRow(ctx context.Context, query string, args ...interface{}) pgx.Row {
+	ef := model.ExportFile{
+		Filename: args[0].(string), BatchID: args[1].(int64), Region: args[2].(string), ReportType: args[3].(*int),
+		Revocation: args[4].(bool), BatchNum: args[5].(int), BatchSize: args[6].(int), Status: args[7].(string),
+	}
+	if existing, ok := f[ef.Filename]; ok && existing.BatchID != ef.BatchID {
+		return &fakeRow{err: pgx.ErrNoRows}
+	}
+	f[ef.Filename] = ef
+	return &fakeRow{values: []interface{}{ef.Filename}}
+}
+
+func TestAddExportFileAfterRequeue(t *testing.T) {
+	files := fakeExportFiles{}
+	ef := &model.ExportFile{Filename: "root/1-1.zip", BatchID: 7, Region: "US", BatchNum: 1, Status: model.ExportBatchPending}
+
+	// The first attempt registers the file, then fails and exhausts the batch's attempts.
+	if err := addExportFile(context.Background(), ef, files.queryRow); err != nil {
+		t.Fatalf("first attempt: addExportFile returned unexpected error: %v", err)
+	}
+	if err := checkRequeue(&model.ExportBatch{BatchID: 7, Status: model.ExportBatchFailed}); err != nil {
+		t.Fatalf("checkRequeue returned unexpected error: %v", err)
+	}
+
+	// The re-queued batch registers the same file again.
+	if err := addExportFile(context.Background(), ef, files.queryRow); err != nil {
+		t.Fatalf("after re-queue: addExportFile returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(fakeExportFiles{ef.Filename: *ef}, files); diff != "" {
+		t.Errorf("export files mismatch (-want +got):\n%s", diff)
+	}
+
+	other := *ef
+	other.BatchID = 8
+	if err := addExportFile(context.Background(), &other, files.queryRow); err == nil {
+		t.Errorf("addExportFile returned nil error for a file of another batch")
+	}
+}
+
+func TestAddExportFileStatement(t *testing.T) {
+	var gotSQL string
+	queryRow := func(ctx context.Context, query string, args ...interface{}) pgx.Row {
+		gotSQL = strings.Join(strings.Fields(query), " ")
+		return &fakeRow{values: []interface{}{args[0]}}
+	}
+	if err := addExportFile(context.Background(), &model.ExportFile{Filename: "f", BatchID: 1}, queryRow); err != nil {
+		t.Fatalf("addExportFile returned unexpected error: %v", err)
+	}
+	for _, want := range []string{"ON CONFLICT (filename) DO UPDATE", "WHERE ExportFile.batch_id = EXCLUDED.batch_id", "RETURNING filename"} {
+		if !strings.Contains(gotSQL, want) {
+			t.Errorf("addExportFile statement %q does not contain %q", gotSQL, want)
+		}
+	}
+}
@@ -16,10 +16,12 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	"github.com/googlepartners/exposure-notifications/internal/logging"
 	"github.com/googlepartners/exposure-notifications/internal/model"
 
 	"github.com/google/uuid"
@@ -31,67 +33,296 @@ var (
 	ErrNotFound = errors.New("record not found")
 )
 
-// FinalizeSyncFn is used to finalize a historical sync record.
-type FinalizeSyncFn func(maxTimestamp time.Time, totalInserted int) error
+// FinalizeSyncFn is used to finalize a historical sync record with the number of keys inserted,
+// the number of fetched keys that were already stored, the number of region chunks fetched
+// completely, and status, one of model.FederationSyncComplete, model.FederationSyncCanceled or
+// model.FederationSyncFailed.
+type FinalizeSyncFn func(maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string) error
 
 type queryRowFn func(ctx context.Context, query string, args ...interface{}) pgx.Row
 
+type execFn func(ctx context.Context, query string, args ...interface{}) error
+
 // GetFederationQuery returns a query for given queryID. If not found, ErrNotFound will be returned.
 func (db *DB) GetFederationQuery(ctx context.Context, queryID string) (*model.FederationQuery, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
 	defer conn.Release()
-	return getFederationQuery(ctx, queryID, conn.QueryRow)
+	return getFederationQuery(ctx, queryID, db.maxRegions, conn.QueryRow)
 }
 
-func getFederationQuery(ctx context.Context, queryID string, queryRow queryRowFn) (*model.FederationQuery, error) {
+func getFederationQuery(ctx context.Context, queryID string, maxRegions int, queryRow queryRowFn) (*model.FederationQuery, error) {
 	row := queryRow(ctx, `
 		SELECT
-			query_id, server_addr, include_regions, exclude_regions, last_timestamp
+			`+federationQueryColumns(maxRegions)+`
 		FROM FederationQuery 
 		WHERE 
 			query_id=$1
 		`, queryID)
 
-	// See https://www.opsdash.com/blog/postgres-arrays-golang.html for working with Postgres arrays in Go.
-	q := model.FederationQuery{}
-	if err := row.Scan(&q.QueryID, &q.ServerAddr, &q.IncludeRegions, &q.ExcludeRegions, &q.LastTimestamp); err != nil {
+	q, err := scanFederationQuery(row, maxRegions)
+	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, ErrNotFound
 		}
+		if errors.Is(err, errTooManyRegions) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("scanning results: %v", err)
 	}
+	return q, nil
+}
+
+// federationQueryColumns returns the columns of FederationQuery read by scanFederationQuery,
+// with region arrays bounded to maxRegions entries by boundedRegionArray.
+func federationQueryColumns(maxRegions int) string {
+	return `query_id, server_addr, ` + boundedRegionArray("include_regions", maxRegions) + `,
+			` + boundedRegionArray("exclude_regions", maxRegions) + `, last_timestamp, region_chunk_size,
+			duplicate_policy, last_error, last_error_time, sync_interval_seconds`
+}
+
+// scanFederationQuery scans federationQueryColumns(maxRegions), followed by extra, from row. A
+// query with more than maxRegions included or excluded regions is rejected with an error
+// wrapping errTooManyRegions, returned along with the query so that callers can name it.
+func scanFederationQuery(row pgx.Row, maxRegions int, extra ...interface{}) (*model.FederationQuery, error) {
+	// See https://www.opsdash.com/blog/postgres-arrays-golang.html for working with Postgres arrays in Go.
+	q := model.FederationQuery{}
+	var numInclude, numExclude int
+	var lastError *string
+	var lastErrorTime *time.Time
+	var syncIntervalSeconds int
+	dest := append([]interface{}{&q.QueryID, &q.ServerAddr, &q.IncludeRegions, &numInclude, &q.ExcludeRegions, &numExclude,
+		&q.LastTimestamp, &q.RegionChunkSize, &q.DuplicatePolicy, &lastError, &lastErrorTime, &syncIntervalSeconds}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if err := checkRegionArray("include_regions", numInclude, maxRegions); err != nil {
+		return &q, fmt.Errorf("federation query %s: %w", q.QueryID, err)
+	}
+	if err := checkRegionArray("exclude_regions", numExclude, maxRegions); err != nil {
+		return &q, fmt.Errorf("federation query %s: %w", q.QueryID, err)
+	}
+	setLastError(&q, lastError, lastErrorTime)
+	q.SyncInterval = time.Duration(syncIntervalSeconds) * time.Second
 	return &q, nil
 }
 
-// AddFederationQuery adds a FederationQuery entity. It will overwrite a query with matching q.queryID if it exists.
-func (db *DB) AddFederationQuery(ctx context.Context, q *model.FederationQuery) (err error) {
-	conn, err := db.pool.Acquire(ctx)
+// federationQueryRows are rows selecting federationQueryColumns, as read by scanFederationQueries.
+type federationQueryRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
+// scanFederationQueries scans each of rows with scanFederationQuery, passing the query to add
+// once its extra columns have been scanned. Like an oversized APIConfig, a query with more than
+// maxRegions included or excluded regions is skipped with a logged warning, rather than failing
+// every query. It returns the IDs of all the rows read, skipped or not.
+func scanFederationQueries(ctx context.Context, rows federationQueryRows, maxRegions int, add func(q *model.FederationQuery), extra ...interface{}) ([]string, error) {
+	logger := logging.FromContext(ctx)
+	var ids []string
+	for rows.Next() {
+		q, err := scanFederationQuery(rows, maxRegions, extra...)
+		if err != nil && !errors.Is(err, errTooManyRegions) {
+			return nil, fmt.Errorf("scanning results: %v", err)
+		}
+		ids = append(ids, q.QueryID)
+		if err != nil {
+			logger.Warnf("Skipping federation query %s: %v", q.QueryID, errors.Unwrap(err))
+			continue
+		}
+		add(q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating federation queries: %v", err)
+	}
+	return ids, nil
+}
+
+// ListFederationQueries returns a page of the federation queries, ordered by query ID, and the
+// cursor of the next page, or "" if there are no more.
+func (db *DB) ListFederationQueries(ctx context.Context, page Page) ([]*model.FederationQuery, string, error) {
+	after, err := page.validate()
 	if err != nil {
-		return fmt.Errorf("unable to obtain database connection: %v", err)
+		return nil, "", err
+	}
+
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Query IDs are unique and never empty, so they need no tiebreaker and the first page
+	// follows "".
+	rows, err := conn.Query(ctx, `
+		SELECT
+			`+federationQueryColumns(db.maxRegions)+`
+		FROM FederationQuery
+		WHERE query_id > $1
+		ORDER BY query_id
+		LIMIT $2
+		`, after.Key, page.queryLimit())
+	if err != nil {
+		return nil, "", fmt.Errorf("querying federation queries: %v", err)
+	}
+	defer rows.Close()
+
+	var queries []*model.FederationQuery
+	ids, err := scanFederationQueries(ctx, rows, db.maxRegions, func(q *model.FederationQuery) {
+		queries = append(queries, q)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	queries, next := pageFederationQueries(page, queries, ids)
+	return queries, next, nil
+}
+
+// pageFederationQueries returns those of queries on page, and the cursor of the next page, or ""
+// if there are no more, given the IDs of the rows read for page. Pages are counted in rows read,
+// skipped or not, so that a skipped query never ends the listing early.
+func pageFederationQueries(page Page, queries []*model.FederationQuery, ids []string) ([]*model.FederationQuery, string) {
+	n, more := page.truncate(len(ids))
+	if !more {
+		return queries, ""
+	}
+	// The row read beyond the page only tells that another page follows.
+	last := ids[n-1]
+	for len(queries) > 0 && queries[len(queries)-1].QueryID > last {
+		queries = queries[:len(queries)-1]
+	}
+	return queries, encodePageCursor(pageCursor{Key: last})
+}
+
+// listAllFederationQueries returns every federation query, ordered by query ID.
+func (db *DB) listAllFederationQueries(ctx context.Context) ([]*model.FederationQuery, error) {
+	queries, _, err := db.ListFederationQueries(ctx, Page{})
+	return queries, err
+}
+
+// GetFederationQueriesToRun returns the federation queries due for a scheduled sync at now,
+// ordered by query ID: those whose last sync started at least their SyncInterval before now, and
+// those that have never synced. It reads from the primary, so that a sync that has just started
+// is seen and not started again.
+func (db *DB) GetFederationQueriesToRun(ctx context.Context, now time.Time) ([]*model.FederationQuery, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
 	defer conn.Release()
 
-	commit := false
-	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	rows, err := conn.Query(ctx, `
+		SELECT
+			`+federationQueryColumns(db.maxRegions)+`,
+			(SELECT MAX(started) FROM FederationSync WHERE FederationSync.query_id = FederationQuery.query_id)
+		FROM FederationQuery
+		ORDER BY query_id
+		`)
 	if err != nil {
-		return fmt.Errorf("starting transaction: %v", err)
+		return nil, fmt.Errorf("querying federation queries: %v", err)
 	}
-	defer finishTx(ctx, tx, &commit, &err)
+	defer rows.Close()
 
-	existing := true
-	if _, err := getFederationQuery(ctx, q.QueryID, tx.QueryRow); err != nil {
-		if err == ErrNotFound {
-			existing = false
-		} else {
-			return fmt.Errorf("getting existing federation query %s: %v", q.QueryID, err)
+	var (
+		queries  []*model.FederationQuery
+		lastSync *time.Time
+	)
+	lastSyncs := make(map[string]time.Time)
+	_, err = scanFederationQueries(ctx, rows, db.maxRegions, func(q *model.FederationQuery) {
+		if lastSync != nil {
+			lastSyncs[q.QueryID] = *lastSync
+		}
+		queries = append(queries, q)
+	}, &lastSync)
+	if err != nil {
+		return nil, err
+	}
+	return queriesToRun(queries, lastSyncs, now), nil
+}
+
+// queriesToRun returns those of queries that are due for a sync at now, given when the last sync
+// of each started. Queries missing from lastSyncs have never synced.
+func queriesToRun(queries []*model.FederationQuery, lastSyncs map[string]time.Time, now time.Time) []*model.FederationQuery {
+	var due []*model.FederationQuery
+	for _, q := range queries {
+		if q.DueForSync(lastSyncs[q.QueryID], now) {
+			due = append(due, q)
 		}
 	}
+	return due
+}
+
+// setLastError sets the last error of q from its nullable columns.
+func setLastError(q *model.FederationQuery, lastError *string, lastErrorTime *time.Time) {
+	if lastError != nil {
+		q.LastError = *lastError
+	}
+	if lastErrorTime != nil {
+		q.LastErrorTime = *lastErrorTime
+	}
+}
+
+// RecordFederationQueryError records that the most recent sync of queryID failed at failed with
+// syncErr, replacing any previously recorded error. It is cleared by the next successful sync.
+func (db *DB) RecordFederationQueryError(ctx context.Context, queryID, syncErr string, failed time.Time) error {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
 
-	if existing {
-		_, err := tx.Exec(ctx, `
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := conn.Exec(ctx, query, args...)
+		return err
+	}
+	return recordFederationQueryError(ctx, queryID, syncErr, failed, exec)
+}
+
+func recordFederationQueryError(ctx context.Context, queryID, syncErr string, failed time.Time, exec execFn) error {
+	err := exec(ctx, `
+		UPDATE FederationQuery
+		SET
+			last_error = $1, last_error_time = $2
+		WHERE
+			query_id = $3
+		`, syncErr, failed, queryID)
+	if err != nil {
+		return fmt.Errorf("recording federation query error: %v", err)
+	}
+	return nil
+}
+
+// FindOverlappingFederationQueries returns the pairs of federation queries that fetch a common
+// region, ordered by query ID.
+func (db *DB) FindOverlappingFederationQueries(ctx context.Context) ([]*model.FederationQueryOverlap, error) {
+	queries, err := db.listAllFederationQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return model.FindOverlappingQueries(queries), nil
+}
+
+// AddFederationQuery adds a FederationQuery entity. It will overwrite a query with matching q.queryID if it exists.
+// The change is recorded in the FederationQueryAudit table, attributed to actor, in the same transaction.
+func (db *DB) AddFederationQuery(ctx context.Context, q *model.FederationQuery, actor string) error {
+	return db.WithinTx(ctx, pgx.Serializable, func(tx TxRunner) error {
+		return tx.AddFederationQuery(ctx, q, actor)
+	})
+}
+
+func addFederationQuery(ctx context.Context, q *model.FederationQuery, actor string, now time.Time, queryRow queryRowFn, exec execFn) error {
+	// The region bound isn't applied here so that an oversized query can be overwritten.
+	existing, err := getFederationQuery(ctx, q.QueryID, 0, queryRow)
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("getting existing federation query %s: %v", q.QueryID, err)
+	}
+
+	if existing != nil {
+		err := exec(ctx, `
 			DELETE FROM FederationQuery
 			WHERE
 				query_id=$1
@@ -101,23 +332,187 @@ func (db *DB) AddFederationQuery(ctx context.Context, q *model.FederationQuery)
 		}
 	}
 
-	_, err = tx.Exec(ctx, `
+	duplicatePolicy := q.DuplicatePolicy
+	if duplicatePolicy == "" {
+		duplicatePolicy = model.DuplicatesSkip
+	}
+	err = exec(ctx, `
 		INSERT INTO FederationQuery
-			(query_id, server_addr, include_regions, exclude_regions, last_timestamp)
+			(query_id, server_addr, include_regions, exclude_regions, last_timestamp, region_chunk_size, duplicate_policy,
+			 sync_interval_seconds)
 		VALUES
-			($1, $2, $3, $4, $5)
-		`, q.QueryID, q.ServerAddr, q.IncludeRegions, q.ExcludeRegions, q.LastTimestamp)
+			($1, $2, $3, $4, $5, $6, $7, $8)
+		`, q.QueryID, q.ServerAddr, q.IncludeRegions, q.ExcludeRegions, q.LastTimestamp, q.RegionChunkSize, string(duplicatePolicy),
+		int(q.SyncInterval/time.Second))
 	if err != nil {
 		return fmt.Errorf("inserting federation query: %v", err)
 	}
 
-	commit = true
+	action := model.FederationQueryCreated
+	if existing != nil {
+		action = model.FederationQueryUpdated
+	}
+	if err := auditFederationQuery(ctx, exec, q.QueryID, action, actor, existing, q, now); err != nil {
+		return err
+	}
 	return nil
 }
 
+// UpdateFederationRegions replaces the included and excluded regions of the federation query
+// queryID, leaving its last timestamp and other fields unchanged, so that the query continues from
+// where it left off. The regions are normalized, and an error is returned if a region is both
+// included and excluded. ErrNotFound is returned if the query does not exist. The change is
+// recorded in the FederationQueryAudit table, attributed to actor, in the same transaction.
+func (db *DB) UpdateFederationRegions(ctx context.Context, queryID string, include, exclude []string, actor string) error {
+	return db.WithinTx(ctx, pgx.Serializable, func(tx TxRunner) error {
+		return tx.UpdateFederationRegions(ctx, queryID, include, exclude, actor)
+	})
+}
+
+func updateFederationRegions(ctx context.Context, queryID string, include, exclude []string, actor string, now time.Time, queryRow queryRowFn, exec execFn) error {
+	include, err := model.NormalizeRegions(include)
+	if err != nil {
+		return fmt.Errorf("include regions: %v", err)
+	}
+	exclude, err = model.NormalizeRegions(exclude)
+	if err != nil {
+		return fmt.Errorf("exclude regions: %v", err)
+	}
+	included := make(map[string]bool)
+	for _, r := range include {
+		included[r] = true
+	}
+	for _, r := range exclude {
+		if included[r] {
+			return fmt.Errorf("region %s is both included and excluded", r)
+		}
+	}
+
+	existing, err := getFederationQuery(ctx, queryID, 0, queryRow)
+	if err != nil {
+		if err == ErrNotFound {
+			return err
+		}
+		return fmt.Errorf("getting existing federation query %s: %v", queryID, err)
+	}
+
+	err = exec(ctx, `
+		UPDATE FederationQuery
+		SET
+			include_regions = $1,
+			exclude_regions = $2
+		WHERE
+			query_id = $3
+		`, include, exclude, queryID)
+	if err != nil {
+		return fmt.Errorf("updating federation query regions: %v", err)
+	}
+
+	updated := *existing
+	updated.IncludeRegions = include
+	updated.ExcludeRegions = exclude
+	return auditFederationQuery(ctx, exec, queryID, model.FederationQueryUpdated, actor, existing, &updated, now)
+}
+
+// auditFederationQuery records a change from oldQuery to newQuery; either may be nil.
+func auditFederationQuery(ctx context.Context, exec execFn, queryID, action, actor string, oldQuery, newQuery *model.FederationQuery, now time.Time) error {
+	oldValue, err := encodeAuditValue(oldQuery)
+	if err != nil {
+		return fmt.Errorf("encoding old federation query %s: %v", queryID, err)
+	}
+	newValue, err := encodeAuditValue(newQuery)
+	if err != nil {
+		return fmt.Errorf("encoding new federation query %s: %v", queryID, err)
+	}
+	err = exec(ctx, `
+		INSERT INTO FederationQueryAudit
+			(query_id, action, actor, old_value, new_value, changed)
+		VALUES
+			($1, $2, $3, $4, $5, $6)
+		`, queryID, action, actor, oldValue, newValue, now)
+	if err != nil {
+		return fmt.Errorf("inserting federation query audit: %v", err)
+	}
+	return nil
+}
+
+func encodeAuditValue(q *model.FederationQuery) (*string, error) {
+	if q == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
+}
+
+// ListFederationQueryAudit returns a page of the audit entries, newest first, for queryID, or
+// for all queries if queryID is empty, and the cursor of the next page, or "" if there are no
+// more.
+func (db *DB) ListFederationQueryAudit(ctx context.Context, queryID string, page Page) ([]*model.FederationQueryAudit, string, error) {
+	after, err := page.validate()
+	if err != nil {
+		return nil, "", err
+	}
+	first, afterChanged, afterID, err := after.timeKeyset()
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT
+			audit_id, query_id, action, actor, old_value, new_value, changed
+		FROM FederationQueryAudit
+		WHERE
+			($1 = '' OR query_id = $1)
+			AND ($2 OR (changed, audit_id) < ($3, $4))
+		ORDER BY changed DESC, audit_id DESC
+		LIMIT $5
+		`, queryID, first, afterChanged, afterID, page.queryLimit())
+	if err != nil {
+		return nil, "", fmt.Errorf("querying federation query audit: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []*model.FederationQueryAudit
+	for rows.Next() {
+		var a model.FederationQueryAudit
+		var oldValue, newValue *string
+		if err := rows.Scan(&a.AuditID, &a.QueryID, &a.Action, &a.Actor, &oldValue, &newValue, &a.Changed); err != nil {
+			return nil, "", fmt.Errorf("scanning results: %v", err)
+		}
+		if oldValue != nil {
+			a.OldValue = *oldValue
+		}
+		if newValue != nil {
+			a.NewValue = *newValue
+		}
+		entries = append(entries, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("iterating federation query audit: %v", err)
+	}
+
+	n, more := page.truncate(len(entries))
+	entries = entries[:n]
+	if !more {
+		return entries, "", nil
+	}
+	last := entries[n-1]
+	return entries, encodePageCursor(timeCursor(last.Changed, last.AuditID)), nil
+}
+
 // GetFederationSync returns a federation sync record for given syncID. If not found, ErrNotFound will be returned.
 func (db *DB) GetFederationSync(ctx context.Context, syncID string) (*model.FederationSync, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquireRead(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -128,44 +523,172 @@ func (db *DB) GetFederationSync(ctx context.Context, syncID string) (*model.Fede
 func getFederationSync(ctx context.Context, syncID string, queryRowContext queryRowFn) (*model.FederationSync, error) {
 	row := queryRowContext(ctx, `
 		SELECT
-			sync_id, query_id, started, completed, insertions, max_timestamp
+			`+federationSyncColumns+`
 		FROM FederationSync
 		WHERE
 			sync_id=$1
 		`, syncID)
+	return scanFederationSync(row)
+}
+
+// GetLatestFederationSync returns the most recently started sync of queryID. If the query has
+// never synced, ErrNotFound will be returned. It reads from the primary, since callers decide
+// whether and where to start a sync on it.
+func (db *DB) GetLatestFederationSync(ctx context.Context, queryID string) (*model.FederationSync, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+	return getLatestFederationSync(ctx, queryID, conn.QueryRow)
+}
 
+func getLatestFederationSync(ctx context.Context, queryID string, queryRow queryRowFn) (*model.FederationSync, error) {
+	row := queryRow(ctx, `
+		SELECT
+			`+federationSyncColumns+`
+		FROM FederationSync
+		WHERE
+			query_id=$1
+		ORDER BY started DESC
+		LIMIT 1
+		`, queryID)
+	return scanFederationSync(row)
+}
+
+// federationSyncColumns are the columns of FederationSync read by scanFederationSync.
+const federationSyncColumns = `sync_id, query_id, started, completed, insertions, duplicates, max_timestamp, status, cancel_requested, completed_chunks, region_layout`
+
+func scanFederationSync(row pgx.Row) (*model.FederationSync, error) {
+	// The columns set when a sync finalizes are NULL while it is in progress.
 	s := model.FederationSync{}
-	if err := row.Scan(&s.SyncID, &s.QueryID, &s.Started, &s.Completed, &s.Insertions, &s.MaxTimestamp); err != nil {
+	var completed, maxTimestamp *time.Time
+	var insertions, duplicates, completedChunks *int
+	var status, regionLayout *string
+	if err := row.Scan(&s.SyncID, &s.QueryID, &s.Started, &completed, &insertions, &duplicates, &maxTimestamp, &status, &s.CancelRequested, &completedChunks, &regionLayout); err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, ErrNotFound
 		}
 		return nil, fmt.Errorf("scanning results: %v", err)
 	}
+	if completed != nil {
+		s.Completed = *completed
+	}
+	if insertions != nil {
+		s.Insertions = *insertions
+	}
+	if maxTimestamp != nil {
+		s.MaxTimestamp = *maxTimestamp
+	}
+	if duplicates != nil {
+		s.Duplicates = *duplicates
+	}
+	if status != nil {
+		s.Status = *status
+	}
+	if completedChunks != nil {
+		s.CompletedChunks = *completedChunks
+	}
+	// Syncs recorded before the layout was stored have none, and cannot be resumed.
+	if regionLayout != nil {
+		s.RegionLayout = *regionLayout
+	}
 	return &s, nil
 }
 
+// CancelFederationSync asks the sync of queryID in progress to stop at its next checkpoint,
+// returning its key. The sync then finalizes as model.FederationSyncCanceled, keeping the keys
+// it inserted. If no sync of queryID is in progress, ErrNotFound is returned.
+func (db *DB) CancelFederationSync(ctx context.Context, queryID string) (string, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+	return cancelFederationSync(ctx, queryID, conn.QueryRow)
+}
+
+func cancelFederationSync(ctx context.Context, queryID string, queryRow queryRowFn) (string, error) {
+	row := queryRow(ctx, `
+		UPDATE FederationSync
+		SET
+			cancel_requested = TRUE
+		WHERE
+			query_id = $1 AND completed IS NULL
+		RETURNING sync_id
+		`, queryID)
+
+	var syncID string
+	if err := row.Scan(&syncID); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("requesting federation sync cancellation: %v", err)
+	}
+	return syncID, nil
+}
+
+// FederationSyncCanceled reports whether cancellation of the sync syncID has been requested. The
+// flag is read from the primary, so that a sync sees a request as soon as it is made.
+func (db *DB) FederationSyncCanceled(ctx context.Context, syncID string) (bool, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	var canceled bool
+	row := conn.QueryRow(ctx, `
+		SELECT cancel_requested FROM FederationSync WHERE sync_id = $1
+		`, syncID)
+	if err := row.Scan(&canceled); err != nil {
+		if err == pgx.ErrNoRows {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("reading federation sync: %v", err)
+	}
+	return canceled, nil
+}
+
+// finalizeSyncTimeout bounds the finalization of a sync, which does not end with the context of
+// the sync.
+const finalizeSyncTimeout = 30 * time.Second
+
+// detachedContext carries the values of its parent, such as its logger, but neither its deadline
+// nor its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
 // StartFederationSync stores a historical record of a query sync starting. It returns a FederationSync key, and a FinalizeSyncFn that must be invoked to finalize the historical record.
 func (db *DB) StartFederationSync(ctx context.Context, q *model.FederationQuery, started time.Time) (string, FinalizeSyncFn, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return "", nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
 	defer conn.Release()
 
 	startedTimer := time.Now().UTC()
-	syncID := uuid.New().String()
-	_, err = conn.Exec(ctx, `
-		INSERT INTO FederationSync
-			(sync_id, query_id, started)
-		VALUES
-			($1, $2, $3)
-		`, syncID, q.QueryID, started)
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := conn.Exec(ctx, query, args...)
+		return err
+	}
+	syncID, err := startFederationSync(ctx, q, started, exec)
 	if err != nil {
-		return "", nil, fmt.Errorf("inserting federation sync: %v", err)
+		return "", nil, err
 	}
 
-	finalize := func(maxTimestamp time.Time, totalInserted int) (err error) {
-		conn, err := db.pool.Acquire(ctx)
+	finalize := func(maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string) (err error) {
+		// A sync interrupted by the end of its context is still finalized, with its progress.
+		ctx, cancel := context.WithTimeout(detachedContext{parent: ctx}, finalizeSyncTimeout)
+		defer cancel()
+
+		conn, err := db.acquire(ctx)
 		if err != nil {
 			return fmt.Errorf("unable to obtain database connection: %v", err)
 		}
@@ -179,37 +702,85 @@ func (db *DB) StartFederationSync(ctx context.Context, q *model.FederationQuery,
 		}
 		defer finishTx(ctx, tx, &commit, &err)
 
-		// Special case: when no keys are pulled, the maxTimestamp will be 0, so we don't update the
-		// FederationQuery in this case to prevent it from going back and fetching old keys from the past.
-		if totalInserted > 0 {
-			_, err = tx.Exec(ctx, `
+		exec := func(ctx context.Context, query string, args ...interface{}) error {
+			_, err := tx.Exec(ctx, query, args...)
+			return err
+		}
+		if err := finalizeFederationSync(ctx, q, syncID, completed, maxTimestamp, totalInserted, duplicates, completedChunks, status, exec); err != nil {
+			return err
+		}
+
+		commit = true
+		return nil
+	}
+
+	return syncID, finalize, nil
+}
+
+// startFederationSync inserts a FederationSync record for q started at started, returning its key.
+func startFederationSync(ctx context.Context, q *model.FederationQuery, started time.Time, exec execFn) (string, error) {
+	syncID := uuid.New().String()
+	err := exec(ctx, `
+		INSERT INTO FederationSync
+			(sync_id, query_id, started, region_layout)
+		VALUES
+			($1, $2, $3, $4)
+		`, syncID, q.QueryID, started, q.RegionLayout())
+	if err != nil {
+		return "", fmt.Errorf("inserting federation sync: %v", err)
+	}
+	return syncID, nil
+}
+
+// finalizeFederationSync completes the FederationSync record syncID of q with status and, unless
+// it failed, clears the last error of q, which has now synced successfully. A canceled or failed
+// sync does not advance the query, since it may not have fetched every key before its last
+// timestamp; the next sync fetches them again and the duplicates are skipped on insert.
+func finalizeFederationSync(ctx context.Context, q *model.FederationQuery, syncID string, completed, maxTimestamp time.Time, totalInserted, duplicates, completedChunks int, status string, exec execFn) error {
+	// The cursor moves on whenever a completed sync got past it, even if every key it fetched was
+	// already stored, or a resumed sync's remaining chunks were empty. When no keys are pulled, the
+	// maxTimestamp will be 0, so it is not after the last timestamp and the FederationQuery is not
+	// sent back to fetch old keys from the past.
+	if status == model.FederationSyncComplete && maxTimestamp.After(q.LastTimestamp) {
+		err := exec(ctx, `
 			UPDATE FederationQuery
 			SET
 				last_timestamp = $1
 			WHERE
 				query_id = $2
 			`, maxTimestamp, q.QueryID)
-			if err != nil {
-				return fmt.Errorf("updating federation query: %v", err)
-			}
+		if err != nil {
+			return fmt.Errorf("updating federation query: %v", err)
 		}
+	}
 
-		_, err = tx.Exec(ctx, `
-			UPDATE FederationSync
+	if status != model.FederationSyncFailed {
+		err := exec(ctx, `
+			UPDATE FederationQuery
 			SET
-				completed = $1,
-				insertions = $2,
-				max_timestamp = $3
+				last_error = NULL, last_error_time = NULL
 			WHERE
-				sync_id = $4
-			`, completed, totalInserted, maxTimestamp, syncID)
+				query_id = $1
+			`, q.QueryID)
 		if err != nil {
-			return fmt.Errorf("updating federation sync: %v", err)
+			return fmt.Errorf("clearing federation query error: %v", err)
 		}
-
-		commit = true
-		return nil
 	}
 
-	return syncID, finalize, nil
+	err := exec(ctx, `
+		UPDATE FederationSync
+		SET
+			completed = $1,
+			insertions = $2,
+			duplicates = $3,
+			max_timestamp = $4,
+			status = $5,
+			completed_chunks = $6
+		WHERE
+			sync_id = $7
+		`, completed, totalInserted, duplicates, maxTimestamp, status, completedChunks, syncID)
+	if err != nil {
+		return fmt.Errorf("updating federation sync: %v", err)
+	}
+	return nil
 }
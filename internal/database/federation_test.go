@@ -0,0 +1,506 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+	pgx "github.com/jackc/pgx/v4"
+)
+
+// fakeRow is a pgx.Row that scans values, or returns err.
+type fakeRow struct {
+	values []interface{}
+	err    error
+}
+
+func (r *fakeRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r.values[i]))
+	}
+	return nil
+}
+
+func queryRowReturning(row pgx.Row) queryRowFn {
+	return func(context.Context, string, ...interface{}) pgx.Row {
+		return row
+	}
+}
+
+// fakeTx records the statements executed against it, failing those that contain failOn.
+type fakeTx struct {
+	failOn     string
+	statements []string
+	args       [][]interface{}
+}
+
+func (tx *fakeTx) exec(ctx context.Context, query string, args ...interface{}) error {
+	stmt := strings.Join(strings.Fields(query), " ")
+	if tx.failOn != "" && strings.Contains(stmt, tx.failOn) {
+		return errors.New("statement failed")
+	}
+	tx.statements = append(tx.statements, stmt)
+	tx.args = append(tx.args, args)
+	return nil
+}
+
+func (tx *fakeTx) prefixes() []string {
+	var prefixes []string
+	for _, s := range tx.statements {
+		prefixes = append(prefixes, strings.Join(strings.Fields(s)[:3], " "))
+	}
+	return prefixes
+}
+
+func TestAddFederationQueryAudit(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	oldQuery := &model.FederationQuery{QueryID: "q", ServerAddr: "old:443", IncludeRegions: []string{"US"}, DuplicatePolicy: model.DuplicatesSkip}
+	newQuery := &model.FederationQuery{QueryID: "q", ServerAddr: "new:443", IncludeRegions: []string{"US", "CA"}}
+	existingRow := &fakeRow{values: []interface{}{oldQuery.QueryID, oldQuery.ServerAddr, oldQuery.IncludeRegions, 1, []string(nil), 0, time.Time{}, 0,
+		model.DuplicatesSkip, (*string)(nil), (*time.Time)(nil), 0}}
+	encode := func(q *model.FederationQuery) string {
+		b, err := json.Marshal(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	testCases := []struct {
+		name           string
+		row            pgx.Row
+		failOn         string
+		wantErr        bool
+		wantStatements []string
+		wantAction     string
+		wantOld        *string
+	}{
+		{
+			name:           "create",
+			row:            &fakeRow{err: pgx.ErrNoRows},
+			wantStatements: []string{"INSERT INTO FederationQuery", "INSERT INTO FederationQueryAudit"},
+			wantAction:     model.FederationQueryCreated,
+		},
+		{
+			name:           "update",
+			row:            existingRow,
+			wantStatements: []string{"DELETE FROM FederationQuery", "INSERT INTO FederationQuery", "INSERT INTO FederationQueryAudit"},
+			wantAction:     model.FederationQueryUpdated,
+			wantOld:        func() *string { s := encode(oldQuery); return &s }(),
+		},
+		{
+			name:    "mutation fails before audit",
+			row:     existingRow,
+			failOn:  "INSERT INTO FederationQuery (",
+			wantErr: true,
+			// Only the delete ran; nothing is committed because an error is returned.
+			wantStatements: []string{"DELETE FROM FederationQuery"},
+		},
+		{
+			name:           "audit failure fails the mutation",
+			row:            &fakeRow{err: pgx.ErrNoRows},
+			failOn:         "INSERT INTO FederationQueryAudit",
+			wantErr:        true,
+			wantStatements: []string{"INSERT INTO FederationQuery"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := &fakeTx{failOn: tc.failOn}
+			err := addFederationQuery(context.Background(), newQuery, "alice", now, queryRowReturning(tc.row), tx.exec)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("addFederationQuery returned error %v, want error %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantStatements, tx.prefixes()); diff != "" {
+				t.Fatalf("statements mismatch (-want +got):\n%s", diff)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			auditArgs := tx.args[len(tx.args)-1]
+			newValue := encode(newQuery)
+			wantArgs := []interface{}{"q", tc.wantAction, "alice", tc.wantOld, &newValue, now}
+			if diff := cmp.Diff(wantArgs, auditArgs); diff != "" {
+				t.Errorf("audit args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUpdateFederationRegions(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	last := time.Date(2020, 4, 30, 8, 0, 0, 0, time.UTC)
+	existingRow := &fakeRow{values: []interface{}{"q", "server:443", []string{"US"}, 1, []string(nil), 0, last, 5, model.DuplicatesError, (*string)(nil), (*time.Time)(nil), 0}}
+
+	testCases := []struct {
+		name           string
+		row            pgx.Row
+		include        []string
+		exclude        []string
+		wantErr        error
+		wantStatements []string
+	}{
+		{
+			name:           "update",
+			row:            existingRow,
+			include:        []string{"us", "CA"},
+			exclude:        []string{"MX"},
+			wantStatements: []string{"UPDATE FederationQuery SET", "INSERT INTO FederationQueryAudit"},
+		},
+		{
+			name:    "not found",
+			row:     &fakeRow{err: pgx.ErrNoRows},
+			include: []string{"US"},
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "included and excluded",
+			row:     existingRow,
+			include: []string{"US", "CA"},
+			exclude: []string{"ca"},
+		},
+		{
+			name:    "invalid region",
+			row:     existingRow,
+			include: []string{"not a region"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := &fakeTx{}
+			err := updateFederationRegions(context.Background(), "q", tc.include, tc.exclude, "alice", now, queryRowReturning(tc.row), tx.exec)
+			if diff := cmp.Diff(tc.wantStatements, tx.prefixes()); diff != "" {
+				t.Fatalf("statements mismatch (-want +got):\n%s", diff)
+			}
+			if tc.wantStatements == nil {
+				if err == nil {
+					t.Fatalf("updateFederationRegions succeeded, want error")
+				}
+				if tc.wantErr != nil && err != tc.wantErr {
+					t.Errorf("updateFederationRegions returned error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("updateFederationRegions returned unexpected error: %v", err)
+			}
+
+			// Only the region columns are written.
+			if diff := cmp.Diff([]interface{}{[]string{"US", "CA"}, []string{"MX"}, "q"}, tx.args[0]); diff != "" {
+				t.Errorf("update args mismatch (-want +got):\n%s", diff)
+			}
+			// The audited query keeps its cursor and other fields.
+			var got model.FederationQuery
+			if err := json.Unmarshal([]byte(*tx.args[1][4].(*string)), &got); err != nil {
+				t.Fatalf("decoding audited query: %v", err)
+			}
+			want := model.FederationQuery{QueryID: "q", ServerAddr: "server:443", IncludeRegions: []string{"US", "CA"}, ExcludeRegions: []string{"MX"}, LastTimestamp: last, RegionChunkSize: 5, DuplicatePolicy: model.DuplicatesError}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("audited query mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetFederationQueryLastError(t *testing.T) {
+	failed := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	lastError := "fetching query q: unavailable"
+	row := &fakeRow{values: []interface{}{"q", "server:443", []string{"US"}, 1, []string(nil), 0, time.Time{}, 0, model.DuplicatesSkip, &lastError, &failed, 0}}
+
+	got, err := getFederationQuery(context.Background(), "q", 0, queryRowReturning(row))
+	if err != nil {
+		t.Fatalf("getFederationQuery returned error: %v", err)
+	}
+	if got.LastError != lastError || !got.LastErrorTime.Equal(failed) {
+		t.Errorf("getFederationQuery last error = %q at %v, want %q at %v", got.LastError, got.LastErrorTime, lastError, failed)
+	}
+}
+
+func TestGetFederationQuerySyncInterval(t *testing.T) {
+	row := &fakeRow{values: []interface{}{"q", "server:443", []string{"US"}, 1, []string(nil), 0, time.Time{}, 0, model.DuplicatesSkip,
+		(*string)(nil), (*time.Time)(nil), 900}}
+
+	got, err := getFederationQuery(context.Background(), "q", 0, queryRowReturning(row))
+	if err != nil {
+		t.Fatalf("getFederationQuery returned error: %v", err)
+	}
+	if want := 15 * time.Minute; got.SyncInterval != want {
+		t.Errorf("getFederationQuery sync interval = %v, want %v", got.SyncInterval, want)
+	}
+}
+
+func TestQueriesToRun(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	queries := []*model.FederationQuery{
+		{QueryID: "every-run"},
+		{QueryID: "hourly-due", SyncInterval: time.Hour},
+		{QueryID: "hourly-not-due", SyncInterval: time.Hour},
+		{QueryID: "daily-not-due", SyncInterval: 24 * time.Hour},
+		{QueryID: "daily-never-synced", SyncInterval: 24 * time.Hour},
+	}
+	lastSyncs := map[string]time.Time{
+		"every-run":      now.Add(-time.Minute),
+		"hourly-due":     now.Add(-time.Hour),
+		"hourly-not-due": now.Add(-30 * time.Minute),
+		"daily-not-due":  now.Add(-2 * time.Hour),
+	}
+
+	var got []string
+	for _, q := range queriesToRun(queries, lastSyncs, now) {
+		got = append(got, q.QueryID)
+	}
+	want := []string{"every-run", "hourly-due", "daily-never-synced"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("queriesToRun mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFederationQueryLastError(t *testing.T) {
+	failed := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	q := &model.FederationQuery{QueryID: "q"}
+
+	t.Run("failed sync records error", func(t *testing.T) {
+		tx := &fakeTx{}
+		if err := recordFederationQueryError(context.Background(), "q", "fetching query q: unavailable", failed, tx.exec); err != nil {
+			t.Fatalf("recordFederationQueryError returned error: %v", err)
+		}
+		want := []string{"UPDATE FederationQuery SET last_error = $1, last_error_time = $2 WHERE query_id = $3"}
+		if diff := cmp.Diff(want, tx.statements); diff != "" {
+			t.Errorf("statements mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]interface{}{"fetching query q: unavailable", failed, "q"}, tx.args[0]); diff != "" {
+			t.Errorf("args mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("successful sync clears error", func(t *testing.T) {
+		for _, inserted := range []int{0, 10} {
+			tx := &fakeTx{}
+			if err := finalizeFederationSync(context.Background(), q, "sync", failed, failed, inserted, 0, 1, model.FederationSyncComplete, tx.exec); err != nil {
+				t.Fatalf("finalizeFederationSync returned error: %v", err)
+			}
+			cleared := false
+			for i, stmt := range tx.statements {
+				if stmt == "UPDATE FederationQuery SET last_error = NULL, last_error_time = NULL WHERE query_id = $1" {
+					cleared = true
+					if diff := cmp.Diff([]interface{}{"q"}, tx.args[i]); diff != "" {
+						t.Errorf("clear args mismatch (-want +got):\n%s", diff)
+					}
+				}
+			}
+			if !cleared {
+				t.Errorf("finalizeFederationSync with %d insertions did not clear the last error, statements %v", inserted, tx.statements)
+			}
+		}
+	})
+
+	t.Run("clear failure fails the sync", func(t *testing.T) {
+		tx := &fakeTx{failOn: "last_error = NULL"}
+		if err := finalizeFederationSync(context.Background(), q, "sync", failed, failed, 1, 0, 1, model.FederationSyncComplete, tx.exec); err == nil {
+			t.Fatalf("finalizeFederationSync succeeded, want error")
+		}
+	})
+}
+
+func TestFinalizeFederationSyncStatus(t *testing.T) {
+	completed := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	maxTimestamp := time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC)
+	q := &model.FederationQuery{QueryID: "q"}
+
+	testCases := []struct {
+		status      string
+		wantAdvance bool
+		wantClear   bool
+	}{
+		{status: model.FederationSyncComplete, wantAdvance: true, wantClear: true},
+		{status: model.FederationSyncCanceled, wantAdvance: false, wantClear: true},
+		{status: model.FederationSyncFailed, wantAdvance: false, wantClear: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.status, func(t *testing.T) {
+			tx := &fakeTx{}
+			if err := finalizeFederationSync(context.Background(), q, "sync", completed, maxTimestamp, 10, 3, 2, tc.status, tx.exec); err != nil {
+				t.Fatalf("finalizeFederationSync returned error: %v", err)
+			}
+			advanced, cleared := false, false
+			for _, stmt := range tx.statements {
+				if strings.Contains(stmt, "last_timestamp = $1") {
+					advanced = true
+				}
+				if strings.Contains(stmt, "last_error = NULL") {
+					cleared = true
+				}
+			}
+			if advanced != tc.wantAdvance {
+				t.Errorf("finalizeFederationSync(%s) advanced last timestamp %t, want %t", tc.status, advanced, tc.wantAdvance)
+			}
+			if cleared != tc.wantClear {
+				t.Errorf("finalizeFederationSync(%s) cleared last error %t, want %t", tc.status, cleared, tc.wantClear)
+			}
+			syncArgs := tx.args[len(tx.args)-1]
+			if diff := cmp.Diff([]interface{}{completed, 10, 3, maxTimestamp, tc.status, 2, "sync"}, syncArgs); diff != "" {
+				t.Errorf("sync args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestFinalizeFederationSyncCursor tests that a completed sync advances the last timestamp of its
+// query whenever it got past it, however many of its keys were new.
+func TestFinalizeFederationSyncCursor(t *testing.T) {
+	completed := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	last := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	next := time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name         string
+		maxTimestamp time.Time
+		inserted     int
+		duplicates   int
+		wantAdvance  bool
+	}{
+		{name: "new keys", maxTimestamp: next, inserted: 3, wantAdvance: true},
+		{name: "every key a duplicate", maxTimestamp: next, duplicates: 3, wantAdvance: true},
+		{name: "resumed with empty remaining chunks", maxTimestamp: next, wantAdvance: true},
+		{name: "no keys", maxTimestamp: time.Unix(0, 0).UTC()},
+		{name: "not past the cursor", maxTimestamp: last, duplicates: 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &model.FederationQuery{QueryID: "q", LastTimestamp: last}
+			tx := &fakeTx{}
+			if err := finalizeFederationSync(context.Background(), q, "sync", completed, tc.maxTimestamp, tc.inserted, tc.duplicates, 1, model.FederationSyncComplete, tx.exec); err != nil {
+				t.Fatalf("finalizeFederationSync returned error: %v", err)
+			}
+			advanced := false
+			for i, stmt := range tx.statements {
+				if strings.Contains(stmt, "last_timestamp = $1") {
+					advanced = true
+					if diff := cmp.Diff([]interface{}{tc.maxTimestamp, "q"}, tx.args[i]); diff != "" {
+						t.Errorf("cursor args mismatch (-want +got):\n%s", diff)
+					}
+				}
+			}
+			if advanced != tc.wantAdvance {
+				t.Errorf("finalizeFederationSync advanced last timestamp %t, want %t", advanced, tc.wantAdvance)
+			}
+		})
+	}
+}
+
+func TestCancelFederationSync(t *testing.T) {
+	got, err := cancelFederationSync(context.Background(), "q", queryRowReturning(&fakeRow{values: []interface{}{"sync"}}))
+	if err != nil {
+		t.Fatalf("cancelFederationSync returned error: %v", err)
+	}
+	if got != "sync" {
+		t.Errorf("cancelFederationSync = %q, want %q", got, "sync")
+	}
+
+	if _, err := cancelFederationSync(context.Background(), "q", queryRowReturning(&fakeRow{err: pgx.ErrNoRows})); err != ErrNotFound {
+		t.Errorf("cancelFederationSync without a sync in progress returned error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestGetLatestFederationSync(t *testing.T) {
+	started := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	maxTimestamp := started.Add(-time.Hour)
+	completed := started.Add(time.Minute)
+	failed := model.FederationSyncFailed
+	insertions, chunks := 10, 2
+	layout := "layout"
+
+	testCases := []struct {
+		name string
+		row  *fakeRow
+		want *model.FederationSync
+	}{
+		{
+			name: "failed",
+			row:  &fakeRow{values: []interface{}{"sync", "q", started, &completed, &insertions, (*int)(nil), &maxTimestamp, &failed, false, &chunks, &layout}},
+			want: &model.FederationSync{
+				SyncID:          "sync",
+				QueryID:         "q",
+				Started:         started,
+				Completed:       completed,
+				Insertions:      10,
+				MaxTimestamp:    maxTimestamp,
+				Status:          model.FederationSyncFailed,
+				CompletedChunks: 2,
+				RegionLayout:    "layout",
+			},
+		},
+		{
+			name: "in progress",
+			row:  &fakeRow{values: []interface{}{"sync", "q", started, (*time.Time)(nil), (*int)(nil), (*int)(nil), (*time.Time)(nil), (*string)(nil), false, (*int)(nil), (*string)(nil)}},
+			want: &model.FederationSync{SyncID: "sync", QueryID: "q", Started: started},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getLatestFederationSync(context.Background(), "q", queryRowReturning(tc.row))
+			if err != nil {
+				t.Fatalf("getLatestFederationSync returned error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("getLatestFederationSync mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := getLatestFederationSync(context.Background(), "q", queryRowReturning(&fakeRow{err: pgx.ErrNoRows})); err != ErrNotFound {
+		t.Errorf("getLatestFederationSync of a query that never synced returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "logger"))
+	cancel()
+
+	ctx := detachedContext{parent: parent}
+	if err := ctx.Err(); err != nil {
+		t.Errorf("detached context of a cancelled parent returned error %v", err)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("detached context has a deadline")
+	}
+	if got := ctx.Value(key{}); got != "logger" {
+		t.Errorf("detached context value = %v, want %q", got, "logger")
+	}
+
+	// The finalization of a sync is still bounded.
+	bounded, cancelBounded := context.WithTimeout(ctx, time.Millisecond)
+	defer cancelBounded()
+	<-bounded.Done()
+	if !errors.Is(bounded.Err(), context.DeadlineExceeded) {
+		t.Errorf("bounded detached context returned error %v, want %v", bounded.Err(), context.DeadlineExceeded)
+	}
+}
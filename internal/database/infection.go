@@ -17,6 +17,7 @@ package database
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -30,8 +31,15 @@ import (
 const (
 	// InsertInfectionsBatchSize is the maximum number of infections that can be inserted at once.
 	InsertInfectionsBatchSize = 500
+
+	// intervalLength is the length of the intervals that IntervalNumber and IntervalCount count.
+	intervalLength = 10 * time.Minute
 )
 
+// ErrDuplicateInfections is returned by InsertInfectionsRejectingDuplicates when an infection
+// is already stored.
+var ErrDuplicateInfections = errors.New("infection already stored")
+
 // InfectionIterator iterates over a set of infections.
 type InfectionIterator interface {
 	// Next returns an infection and a flag indicating if the iterator is done (the infection will be nil when done==true).
@@ -52,11 +60,18 @@ type IterateInfectionsCriteria struct {
 
 	// OnlyLocalProvenance indicates that only infections with LocalProvenance=true will be returned.
 	OnlyLocalProvenance bool
+
+	// ExcludeRevoked leaves out infections that have been revoked; see RevokeInfection.
+	ExcludeRevoked bool
+	// RevokedUntil, if set, selects only the infections revoked after RevokedSince and at or
+	// before RevokedUntil, whenever they were created.
+	RevokedSince time.Time
+	RevokedUntil time.Time
 }
 
 // IterateInfections returns an iterator for infections meeting the criteria. Must call iterator's Close() method when done.
 func (db *DB) IterateInfections(ctx context.Context, criteria IterateInfectionsCriteria) (InfectionIterator, error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquireRead(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -102,8 +117,8 @@ func (i *postgresInfectionIterator) Next() (*model.Infection, bool, error) {
 
 	var m model.Infection
 	var encodedExposureKey string
-	if err := i.rows.Scan(&encodedExposureKey, &m.TransmissionRisk, &m.AppPackageName, &m.Regions, &m.IntervalNumber,
-		&m.IntervalCount, &m.CreatedAt, &m.LocalProvenance, &m.VerificationAuthorityName, &m.FederationSyncID); err != nil {
+	if err := i.rows.Scan(&encodedExposureKey, &m.TransmissionRisk, &m.ReportType, &m.AppPackageName, &m.Regions, &m.IntervalNumber,
+		&m.IntervalCount, &m.DaysSinceOnsetOfSymptoms, &m.CreatedAt, &m.LocalProvenance, &m.VerificationAuthorityName, &m.FederationSyncID); err != nil {
 		return nil, false, err
 	}
 
@@ -130,11 +145,39 @@ func (i *postgresInfectionIterator) Close() error {
 	return nil
 }
 
+// CountInfections returns the number of infections meeting the criteria.
+func (db *DB) CountInfections(ctx context.Context, criteria IterateInfectionsCriteria) (int, error) {
+	conn, err := db.acquireRead(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	query, args, err := generateCountQuery(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("generating query: %v", err)
+	}
+	var count int
+	if err := conn.QueryRow(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("counting infections: %v", err)
+	}
+	return count, nil
+}
+
+// generateCountQuery returns a query counting the rows generateQuery selects.
+func generateCountQuery(criteria IterateInfectionsCriteria) (string, []interface{}, error) {
+	q, args, err := generateQuery(criteria)
+	if err != nil {
+		return "", nil, err
+	}
+	return "SELECT COUNT(*) FROM (" + q + ") AS matching", args, nil
+}
+
 func generateQuery(criteria IterateInfectionsCriteria) (string, []interface{}, error) {
 	q := `
 		SELECT
-			exposure_key, transmission_risk, app_package_name, regions, interval_number, interval_count,
-			created_at, local_provenance, verification_authority_name, sync_id
+			exposure_key, transmission_risk, report_type, app_package_name, regions, interval_number, interval_count,
+			days_since_onset_of_symptoms, created_at, local_provenance, verification_authority_name, sync_id
 		FROM Infection
 		WHERE 1=1
 		`
@@ -165,6 +208,15 @@ func generateQuery(criteria IterateInfectionsCriteria) (string, []interface{}, e
 		q += fmt.Sprintf(" AND local_provenance = $%d", len(args))
 	}
 
+	if criteria.ExcludeRevoked {
+		q += " AND revoked_at IS NULL"
+	}
+
+	if !criteria.RevokedUntil.IsZero() {
+		args = append(args, criteria.RevokedSince, criteria.RevokedUntil)
+		q += fmt.Sprintf(" AND revoked_at > $%d AND revoked_at <= $%d", len(args)-1, len(args))
+	}
+
 	q += " ORDER BY created_at"
 
 	if criteria.LastCursor != "" {
@@ -181,48 +233,121 @@ func generateQuery(criteria IterateInfectionsCriteria) (string, []interface{}, e
 }
 
 // InsertInfections inserts a set of infections.
-func (db *DB) InsertInfections(ctx context.Context, infections []*model.Infection) (err error) {
-	conn, err := db.pool.Acquire(ctx)
+func (db *DB) InsertInfections(ctx context.Context, infections []*model.Infection) error {
+	_, err := db.InsertNewInfections(ctx, infections)
+	return err
+}
+
+// InsertNewInfections inserts a set of infections, skipping those already stored, and returns the
+// number inserted. A key is already stored if it was published before for any regions, or, for a
+// per-region copy, if it was copied for the same region before.
+func (db *DB) InsertNewInfections(ctx context.Context, infections []*model.Infection) (int, error) {
+	return db.insertNewInfections(ctx, infections, false)
+}
+
+// InsertInfectionsRejectingDuplicates inserts a set of infections, or none of them if any is
+// already stored, as InsertNewInfections decides it, in which case the returned error wraps
+// ErrDuplicateInfections. It returns the number inserted.
+func (db *DB) InsertInfectionsRejectingDuplicates(ctx context.Context, infections []*model.Infection) (int, error) {
+	return db.insertNewInfections(ctx, infections, true)
+}
+
+func (db *DB) insertNewInfections(ctx context.Context, infections []*model.Infection, rejectDuplicates bool) (inserted int, err error) {
+	conn, err := db.acquire(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to obtain database connection: %v", err)
+		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
 	defer conn.Release()
 
 	commit := false
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer finishTx(ctx, tx, &commit, &err)
 
 	const stmtName = "insert infections"
 	_, err = tx.Prepare(ctx, stmtName, `
 		INSERT INTO Infection
-		  (exposure_key, transmission_risk, app_package_name, regions, interval_number, interval_count,
-		  created_at, local_provenance, verification_authority_name, sync_id)
+		  (exposure_key, transmission_risk, report_type, app_package_name, regions, interval_number, interval_count,
+		  days_since_onset_of_symptoms, created_at, local_provenance, verification_authority_name, sync_id, region_copy)
 		VALUES
-		  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (exposure_key) DO NOTHING
+		  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (exposure_key, region_copy) DO NOTHING
 		`)
 	if err != nil {
-		return fmt.Errorf("preparing insert statment: %v", err)
+		return 0, fmt.Errorf("preparing insert statment: %v", err)
 	}
 
-	for _, inf := range infections {
-		_, err := tx.Exec(ctx, stmtName, encodeExposureKey(inf.ExposureKey), inf.TransmissionRisk, inf.AppPackageName, inf.Regions, inf.IntervalNumber, inf.IntervalCount,
-			inf.CreatedAt, inf.LocalProvenance, inf.VerificationAuthorityName, inf.FederationSyncID)
+	insert := func(ctx context.Context, inf *model.Infection) (bool, error) {
+		tag, err := tx.Exec(ctx, stmtName, encodeExposureKey(inf.ExposureKey), inf.TransmissionRisk, inf.ReportType, inf.AppPackageName, inf.Regions, inf.IntervalNumber, inf.IntervalCount,
+			inf.DaysSinceOnsetOfSymptoms, inf.CreatedAt, inf.LocalProvenance, inf.VerificationAuthorityName, inf.FederationSyncID, inf.RegionCopy)
 		if err != nil {
-			return fmt.Errorf("inserting infection: %v", err)
+			return false, err
 		}
+		return tag.RowsAffected() > 0, nil
+	}
+	inserted, err = insertInfections(ctx, infections, insert, rejectDuplicates)
+	if err != nil {
+		return 0, err
 	}
 
 	commit = true
-	return nil
+	return inserted, nil
+}
+
+// insertFn inserts a single infection, returning false if it was already stored.
+type insertFn func(ctx context.Context, inf *model.Infection) (bool, error)
+
+// insertInfections inserts infections with insert and returns the number inserted. If
+// rejectDuplicates is true, it stops at the first infection already stored with an error
+// wrapping ErrDuplicateInfections.
+func insertInfections(ctx context.Context, infections []*model.Infection, insert insertFn, rejectDuplicates bool) (int, error) {
+	inserted := 0
+	for _, inf := range infections {
+		ok, err := insert(ctx, inf)
+		if err != nil {
+			return 0, fmt.Errorf("inserting infection: %v", err)
+		}
+		if ok {
+			inserted++
+		} else if rejectDuplicates {
+			return 0, fmt.Errorf("%w: exposure key %s", ErrDuplicateInfections, encodeExposureKey(inf.ExposureKey))
+		}
+	}
+	return inserted, nil
+}
+
+// RevokeInfection marks every stored row of exposureKey revoked at revokedAt, so that it is left
+// out of later exports and listed in the revocation list of the export batch covering
+// revokedAt. It returns the number of rows revoked, or ErrNotFound if the key is not stored or
+// already revoked.
+func (db *DB) RevokeInfection(ctx context.Context, exposureKey []byte, revokedAt time.Time) (int, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	result, err := conn.Exec(ctx, `
+		UPDATE Infection
+		SET
+			revoked_at = $1
+		WHERE
+			exposure_key = $2 AND revoked_at IS NULL
+		`, revokedAt, encodeExposureKey(exposureKey))
+	if err != nil {
+		return 0, fmt.Errorf("revoking infection: %v", err)
+	}
+	if result.RowsAffected() == 0 {
+		return 0, ErrNotFound
+	}
+	return int(result.RowsAffected()), nil
 }
 
 // DeleteInfections deletes infections created before "before" date. Returns the number of records deleted.
 func (db *DB) DeleteInfections(ctx context.Context, before time.Time) (count int64, err error) {
-	conn, err := db.pool.Acquire(ctx)
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -248,6 +373,77 @@ func (db *DB) DeleteInfections(ctx context.Context, before time.Time) (count int
 	return result.RowsAffected(), nil
 }
 
+// PurgeExposures deletes the keys whose rolling period ended before olderThan, so that they can no
+// longer match an exposure, and which were created before olderThan. Keys that an export batch
+// which has not completed yet may still cover are kept, so that no export misses them. Returns
+// the number of keys deleted.
+func (db *DB) PurgeExposures(ctx context.Context, olderThan time.Time) (count int, err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	commit := false
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %v", err)
+	}
+	defer finishTx(ctx, tx, &commit, &err)
+
+	var activeStart *time.Time
+	row := tx.QueryRow(ctx, `
+		SELECT
+			MIN(start_timestamp)
+		FROM ExportBatch
+		WHERE
+			status NOT IN ($1, $2)
+		`, model.ExportBatchComplete, model.ExportBatchDeleted)
+	if err := row.Scan(&activeStart); err != nil {
+		return 0, fmt.Errorf("finding active export batches: %v", err)
+	}
+
+	c := newPurgeCriteria(olderThan, activeStart)
+	result, err := tx.Exec(ctx, `
+		DELETE FROM Infection
+		WHERE
+			interval_number + interval_count <= $1
+			AND created_at < $2
+		`, c.intervalBefore, c.createdBefore)
+	if err != nil {
+		return 0, fmt.Errorf("purging infections: %v", err)
+	}
+
+	commit = true
+	return int(result.RowsAffected()), nil
+}
+
+// purgeCriteria selects the keys deleted by PurgeExposures.
+type purgeCriteria struct {
+	// intervalBefore is the interval number at or before which a key's rolling period must end.
+	intervalBefore int32
+	// createdBefore is the time before which a key must have been created.
+	createdBefore time.Time
+}
+
+// newPurgeCriteria returns the criteria purging keys older than olderThan, excluding any created
+// at or after activeStart, the start of the earliest export batch yet to complete, if any.
+func newPurgeCriteria(olderThan time.Time, activeStart *time.Time) purgeCriteria {
+	c := purgeCriteria{
+		intervalBefore: int32(olderThan.Unix() / int64(intervalLength.Seconds())),
+		createdBefore:  olderThan,
+	}
+	if activeStart != nil && activeStart.Before(c.createdBefore) {
+		c.createdBefore = *activeStart
+	}
+	return c
+}
+
+// matches reports whether inf is deleted, matching the DELETE statement of PurgeExposures.
+func (c purgeCriteria) matches(inf *model.Infection) bool {
+	return inf.IntervalNumber+inf.IntervalCount <= c.intervalBefore && inf.CreatedAt.Before(c.createdBefore)
+}
+
 func encodeCursor(s string) string {
 	return base64.StdEncoding.EncodeToString([]byte(s))
 }
@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	pgx "github.com/jackc/pgx/v4"
+)
+
+const (
+	// infectionColumns is the number of columns set by infectionInsertStatement for each row.
+	infectionColumns = 13
+	// maxRowsPerInsert keeps the parameters of a multi-row insert well under the 65535 that
+	// Postgres allows in a statement.
+	maxRowsPerInsert = 1000
+)
+
+// InsertNewInfectionGroups inserts the infections of several groups, such as several publishes,
+// in a single transaction of multi-row inserts, skipping those already stored as
+// InsertNewInfections does. It returns the number inserted from each group. An infection
+// repeated across groups is counted as inserted in the first group holding it.
+func (db *DB) InsertNewInfectionGroups(ctx context.Context, groups [][]*model.Infection) (counts []int, err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	commit := false
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+	defer finishTx(ctx, tx, &commit, &err)
+
+	var all []*model.Infection
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	inserted := make(map[string]bool)
+	for len(all) > 0 {
+		n := len(all)
+		if n > maxRowsPerInsert {
+			n = maxRowsPerInsert
+		}
+		if err := insertInfectionRows(ctx, tx, all[:n], inserted); err != nil {
+			return nil, err
+		}
+		all = all[n:]
+	}
+
+	commit = true
+	return attributeInserted(groups, inserted), nil
+}
+
+// insertInfectionRows inserts infections with a single statement, adding the infections it
+// inserted to inserted.
+func insertInfectionRows(ctx context.Context, tx pgx.Tx, infections []*model.Infection, inserted map[string]bool) error {
+	args := make([]interface{}, 0, len(infections)*infectionColumns)
+	for _, inf := range infections {
+		args = append(args, encodeExposureKey(inf.ExposureKey), inf.TransmissionRisk, inf.ReportType, inf.AppPackageName, inf.Regions, inf.IntervalNumber, inf.IntervalCount,
+			inf.DaysSinceOnsetOfSymptoms, inf.CreatedAt, inf.LocalProvenance, inf.VerificationAuthorityName, inf.FederationSyncID, inf.RegionCopy)
+	}
+	rows, err := tx.Query(ctx, infectionInsertStatement(len(infections)), args...)
+	if err != nil {
+		return fmt.Errorf("inserting %d infections: %v", len(infections), err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var encodedKey, regionCopy string
+		if err := rows.Scan(&encodedKey, &regionCopy); err != nil {
+			return fmt.Errorf("scanning inserted infection: %v", err)
+		}
+		inserted[storedKey(encodedKey, regionCopy)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inserting %d infections: %v", len(infections), err)
+	}
+	return nil
+}
+
+// infectionInsertStatement returns an insert of n infections that skips those already stored and
+// returns the primary key of those inserted.
+func infectionInsertStatement(n int) string {
+	var values strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		values.WriteString("(")
+		for c := 1; c <= infectionColumns; c++ {
+			if c > 1 {
+				values.WriteString(", ")
+			}
+			fmt.Fprintf(&values, "$%d", i*infectionColumns+c)
+		}
+		values.WriteString(")")
+	}
+	return `
+		INSERT INTO Infection
+		  (exposure_key, transmission_risk, report_type, app_package_name, regions, interval_number, interval_count,
+		  days_since_onset_of_symptoms, created_at, local_provenance, verification_authority_name, sync_id, region_copy)
+		VALUES
+		  ` + values.String() + `
+		ON CONFLICT (exposure_key, region_copy) DO NOTHING
+		RETURNING exposure_key, region_copy
+		`
+}
+
+// attributeInserted returns the number of infections of each group in inserted, counting each
+// inserted infection once, in the first group holding it.
+func attributeInserted(groups [][]*model.Infection, inserted map[string]bool) []int {
+	counts := make([]int, len(groups))
+	for i, g := range groups {
+		for _, inf := range g {
+			k := storedKey(encodeExposureKey(inf.ExposureKey), inf.RegionCopy)
+			if inserted[k] {
+				counts[i]++
+				delete(inserted, k)
+			}
+		}
+	}
+	return counts
+}
+
+// storedKey identifies an infection by its primary key. Keys stored once for all their regions
+// have an empty regionCopy, so they are identified by the exposure key alone.
+func storedKey(encodedKey, regionCopy string) string {
+	return encodedKey + "/" + regionCopy
+}
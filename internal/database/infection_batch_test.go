@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInfectionInsertStatement(t *testing.T) {
+	got := strings.Join(strings.Fields(infectionInsertStatement(2)), " ")
+	want := "INSERT INTO Infection (exposure_key, transmission_risk, report_type, app_package_name, regions, interval_number, interval_count, " +
+		"days_since_onset_of_symptoms, created_at, local_provenance, verification_authority_name, sync_id, region_copy) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13), ($14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26) " +
+		"ON CONFLICT (exposure_key, region_copy) DO NOTHING RETURNING exposure_key, region_copy"
+	if got != want {
+		t.Errorf("infectionInsertStatement(2) =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAttributeInserted(t *testing.T) {
+	inf := func(key string, regions ...string) *model.Infection {
+		return &model.Infection{ExposureKey: []byte(key), Regions: regions}
+	}
+	perRegion := func(key string, region string) *model.Infection {
+		return &model.Infection{ExposureKey: []byte(key), Regions: []string{region}, RegionCopy: region}
+	}
+	stored := func(infs ...*model.Infection) map[string]bool {
+		m := make(map[string]bool)
+		for _, i := range infs {
+			m[storedKey(encodeExposureKey(i.ExposureKey), i.RegionCopy)] = true
+		}
+		return m
+	}
+
+	testCases := []struct {
+		name     string
+		groups   [][]*model.Infection
+		inserted map[string]bool
+		want     []int
+	}{
+		{
+			name:     "all inserted",
+			groups:   [][]*model.Infection{{inf("a", "US"), inf("b", "US")}, {inf("c", "CA")}},
+			inserted: stored(inf("a", "US"), inf("b", "US"), inf("c", "CA")),
+			want:     []int{2, 1},
+		},
+		{
+			name:     "already stored",
+			groups:   [][]*model.Infection{{inf("a", "US"), inf("b", "US")}, {inf("c", "CA")}},
+			inserted: stored(inf("b", "US")),
+			want:     []int{1, 0},
+		},
+		{
+			name:     "same key in other regions",
+			groups:   [][]*model.Infection{{inf("a", "US")}, {inf("a", "CA")}},
+			inserted: stored(inf("a", "CA")),
+			want:     []int{1, 0},
+		},
+		{
+			name:     "republished with permuted regions",
+			groups:   [][]*model.Infection{{inf("a", "US", "CA")}, {inf("a", "CA", "US")}},
+			inserted: stored(inf("a", "US", "CA")),
+			want:     []int{1, 0},
+		},
+		{
+			name:     "per-region copies",
+			groups:   [][]*model.Infection{{perRegion("a", "US")}, {perRegion("a", "CA"), perRegion("a", "US")}},
+			inserted: stored(perRegion("a", "US"), perRegion("a", "CA")),
+			want:     []int{1, 1},
+		},
+		{
+			name:     "repeated across groups",
+			groups:   [][]*model.Infection{{inf("a", "US")}, {inf("a", "US"), inf("b", "US")}},
+			inserted: stored(inf("a", "US"), inf("b", "US")),
+			want:     []int{1, 1},
+		},
+		{
+			name:     "missing regions",
+			groups:   [][]*model.Infection{{inf("a")}},
+			inserted: stored(inf("a")),
+			want:     []int{1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, attributeInserted(tc.groups, tc.inserted)); diff != "" {
+				t.Errorf("attributeInserted mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStoredKeyRegionPolicy(t *testing.T) {
+	publish := func(policy model.RegionPolicy, regions ...string) []string {
+		rows := policy.Apply([]*model.Infection{{ExposureKey: []byte("a"), Regions: regions}})
+		keys := make([]string, 0, len(rows))
+		for _, r := range rows {
+			keys = append(keys, storedKey(encodeExposureKey(r.ExposureKey), r.RegionCopy))
+		}
+		return keys
+	}
+
+	// Under the default policy, republishing a key for the same regions in another order, or for
+	// other regions, stores nothing new.
+	first := publish(model.RegionPolicyGlobal, "US", "CA")
+	for _, regions := range [][]string{{"CA", "US"}, {"GB"}} {
+		if diff := cmp.Diff(first, publish(model.RegionPolicyGlobal, regions...)); diff != "" {
+			t.Errorf("global republish for %v stores a new row (-first +republish):\n%s", regions, diff)
+		}
+	}
+
+	// Under the per-region policy, each region gets its own copy.
+	want := []string{storedKey(encodeExposureKey([]byte("a")), "CA"), storedKey(encodeExposureKey([]byte("a")), "GB")}
+	if diff := cmp.Diff(want, publish(model.RegionPolicyPerRegion, "CA", "GB")); diff != "" {
+		t.Errorf("per-region stored keys mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeInfectionTable mimics the exposure key uniqueness constraint of the Infection table.
+type fakeInfectionTable struct {
+	keys    map[string]bool
+	failKey string
+}
+
+func (f *fakeInfectionTable) insert(ctx context.Context, inf *model.Infection) (bool, error) {
+	k := string(inf.ExposureKey)
+	if k == f.failKey {
+		return false, errors.New("insert failed")
+	}
+	if f.keys[k] {
+		return false, nil
+	}
+	f.keys[k] = true
+	return true, nil
+}
+
+func TestInsertInfections(t *testing.T) {
+	infections := func(keys ...string) []*model.Infection {
+		var infs []*model.Infection
+		for _, k := range keys {
+			infs = append(infs, &model.Infection{ExposureKey: []byte(k)})
+		}
+		return infs
+	}
+
+	testCases := []struct {
+		name             string
+		existing         []string
+		insert           []string
+		failKey          string
+		rejectDuplicates bool
+		wantInserted     int
+		wantErr          bool
+	}{
+		{name: "all new", insert: []string{"a", "b", "c"}, wantInserted: 3},
+		{name: "all duplicates", existing: []string{"a", "b"}, insert: []string{"a", "b"}, wantInserted: 0},
+		{name: "mix", existing: []string{"b", "d"}, insert: []string{"a", "b", "c", "d"}, wantInserted: 2},
+		{name: "repeated in request", insert: []string{"a", "a", "b"}, wantInserted: 2},
+		{name: "error", insert: []string{"a", "b"}, failKey: "b", wantErr: true},
+		{name: "rejecting all new", insert: []string{"a", "b"}, rejectDuplicates: true, wantInserted: 2},
+		{name: "rejecting duplicate", existing: []string{"b"}, insert: []string{"a", "b", "c"}, rejectDuplicates: true, wantErr: true},
+		{name: "rejecting repeated in request", insert: []string{"a", "a"}, rejectDuplicates: true, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			table := &fakeInfectionTable{keys: make(map[string]bool), failKey: tc.failKey}
+			for _, k := range tc.existing {
+				table.keys[k] = true
+			}
+
+			got, err := insertInfections(context.Background(), infections(tc.insert...), table.insert, tc.rejectDuplicates)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("insertInfections returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.rejectDuplicates && err != nil && !errors.Is(err, ErrDuplicateInfections) {
+				t.Errorf("insertInfections returned error %v, want %v", err, ErrDuplicateInfections)
+			}
+			if got != tc.wantInserted {
+				t.Errorf("insertInfections inserted %d, want %d", got, tc.wantInserted)
+			}
+		})
+	}
+}
+
+func TestPurgeCriteria(t *testing.T) {
+	now := time.Date(2020, 5, 20, 0, 0, 0, 0, time.UTC)
+	olderThan := now.Add(-21 * 24 * time.Hour)
+	// interval returns the interval number of t.
+	interval := func(t time.Time) int32 {
+		return int32(t.Unix() / int64(intervalLength.Seconds()))
+	}
+	key := func(name string, rollingStart time.Time, count int32, created time.Time) *model.Infection {
+		return &model.Infection{ExposureKey: []byte(name), IntervalNumber: interval(rollingStart), IntervalCount: count, CreatedAt: created}
+	}
+
+	keys := []*model.Infection{
+		key("stale", olderThan.Add(-48*time.Hour), 144, olderThan.Add(-24*time.Hour)),
+		key("ends at cutoff", olderThan.Add(-24*time.Hour), 144, olderThan.Add(-time.Hour)),
+		key("still rolling at cutoff", olderThan.Add(-12*time.Hour), 144, olderThan.Add(-time.Hour)),
+		key("recent", now.Add(-48*time.Hour), 144, now.Add(-24*time.Hour)),
+		// An old key that only recently arrived, e.g. through federation.
+		key("old key created recently", olderThan.Add(-48*time.Hour), 144, now.Add(-time.Hour)),
+	}
+
+	testCases := []struct {
+		name        string
+		activeStart *time.Time
+		want        []string
+	}{
+		{name: "no active exports", want: []string{"stale", "ends at cutoff"}},
+		{name: "active export after cutoff", activeStart: func() *time.Time { t := now.Add(-time.Hour); return &t }(), want: []string{"stale", "ends at cutoff"}},
+		// An unfinished export still covers the key created an hour before the cutoff.
+		{name: "active export before cutoff", activeStart: func() *time.Time { t := olderThan.Add(-2 * time.Hour); return &t }(), want: []string{"stale"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newPurgeCriteria(olderThan, tc.activeStart)
+			var got []string
+			for _, k := range keys {
+				if c.matches(k) {
+					got = append(got, string(k.ExposureKey))
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("purged keys mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGenerateQueryRevocations(t *testing.T) {
+	since := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(time.Hour)
+
+	testCases := []struct {
+		name     string
+		criteria IterateInfectionsCriteria
+		wantSQL  []string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "exclude revoked",
+			criteria: IterateInfectionsCriteria{SinceTimestamp: since, UntilTimestamp: until, ExcludeRevoked: true},
+			wantSQL:  []string{"created_at > $1", "created_at <= $2", "revoked_at IS NULL"},
+			wantArgs: []interface{}{since, until},
+		},
+		{
+			name:     "revoked during",
+			criteria: IterateInfectionsCriteria{IncludeRegions: []string{"US"}, RevokedSince: since, RevokedUntil: until},
+			wantSQL:  []string{"regions && $1", "revoked_at > $2 AND revoked_at <= $3"},
+			wantArgs: []interface{}{[]string{"US"}, since, until},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sql, args, err := generateQuery(tc.criteria)
+			if err != nil {
+				t.Fatalf("generateQuery returned error: %v", err)
+			}
+			for _, want := range tc.wantSQL {
+				if !strings.Contains(sql, want) {
+					t.Errorf("generateQuery SQL %q does not contain %q", sql, want)
+				}
+			}
+			if diff := cmp.Diff(tc.wantArgs, args); diff != "" {
+				t.Errorf("generateQuery args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGenerateCountQuery(t *testing.T) {
+	since := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	criteria := IterateInfectionsCriteria{SinceTimestamp: since, ExcludeRevoked: true}
+
+	want, wantArgs, err := generateQuery(criteria)
+	if err != nil {
+		t.Fatalf("generateQuery returned error: %v", err)
+	}
+	got, args, err := generateCountQuery(criteria)
+	if err != nil {
+		t.Fatalf("generateCountQuery returned error: %v", err)
+	}
+	if !strings.HasPrefix(got, "SELECT COUNT(*) FROM (") || !strings.Contains(got, want) {
+		t.Errorf("generateCountQuery returned %q, want a count of %q", got, want)
+	}
+	if diff := cmp.Diff(wantArgs, args); diff != "" {
+		t.Errorf("generateCountQuery args mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, _, err := generateCountQuery(IterateInfectionsCriteria{LastCursor: "not base64!"}); err == nil {
+		t.Errorf("generateCountQuery with an invalid cursor returned no error")
+	}
+}
@@ -18,24 +18,47 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/googlepartners/exposure-notifications/internal/logging"
 	"github.com/googlepartners/exposure-notifications/internal/model"
 
 	pgx "github.com/jackc/pgx/v4"
 )
 
+const (
+	// maxLockTTLEnvVar bounds the ttl of every lock; 0 removes the bound.
+	maxLockTTLEnvVar = "DB_MAX_LOCK_TTL"
+	// defaultMaxLockTTL is longer than any batch of work holding a lock should take, but short
+	// enough that the lock of a crashed worker is soon available again.
+	defaultMaxLockTTL = time.Hour
+
+	// DefaultLockTTL is the ttl of LockWithDefaultTTL.
+	DefaultLockTTL = 5 * time.Minute
+)
+
 var (
 	// ErrAlreadyLocked is returned if the lock is already in use.
 	ErrAlreadyLocked = errors.New("lock already in use")
+	// ErrInvalidLockTTL is returned if a lock is requested with a zero or negative ttl, which
+	// would create a lock that has already expired.
+	ErrInvalidLockTTL = errors.New("lock ttl must be positive")
 )
 
 // UnlockFn can be deferred to release a lock.
 type UnlockFn func() error
 
 // Lock acquires lock with given name that times out after ttl. Returns an UnlockFn that can be used to unlock the lock. ErrAlreadyLocked will be returned if there is already a lock in use.
+// A ttl longer than $DB_MAX_LOCK_TTL is shortened to it, and a zero or negative ttl is rejected
+// with ErrInvalidLockTTL.
 func (db *DB) Lock(ctx context.Context, lockID string, ttl time.Duration) (unlockFn UnlockFn, err error) {
-	conn, err := db.pool.Acquire(ctx)
+	ttl, err = lockTTL(ctx, lockID, ttl, db.maxLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.acquire(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
 	}
@@ -105,9 +128,128 @@ func (db *DB) Lock(ctx context.Context, lockID string, ttl time.Duration) (unloc
 	return buildUnlockFn(ctx, db, lockID), nil
 }
 
+// LockWithDefaultTTL acquires the lock with the given name for DefaultLockTTL, shortened to
+// $DB_MAX_LOCK_TTL if that is less. See Lock.
+func (db *DB) LockWithDefaultTTL(ctx context.Context, lockID string) (UnlockFn, error) {
+	return db.Lock(ctx, lockID, DefaultLockTTL)
+}
+
+// lockTTL returns the ttl to acquire lockID for when ttl is requested, clamping it to max if
+// max is positive. It returns an error wrapping ErrInvalidLockTTL if ttl is not positive.
+func lockTTL(ctx context.Context, lockID string, ttl, max time.Duration) (time.Duration, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("%w: lock %q requested for %v", ErrInvalidLockTTL, lockID, ttl)
+	}
+	if max > 0 && ttl > max {
+		logging.FromContext(ctx).Warnf("Lock %q requested for %v, more than the maximum of %v; using the maximum (override with $%s).", lockID, ttl, max, maxLockTTLEnvVar)
+		return max, nil
+	}
+	return ttl, nil
+}
+
+// LockAll acquires all of the locks with the given names, each timing out after ttl, and returns
+// a single UnlockFn that releases them all. The locks are acquired in sorted order, so that
+// callers locking overlapping sets cannot each hold a lock the other needs. If any lock is
+// unavailable, the locks already acquired are released and the error, ErrAlreadyLocked if the
+// lock is in use, is returned.
+func (db *DB) LockAll(ctx context.Context, lockIDs []string, ttl time.Duration) (UnlockFn, error) {
+	return lockAll(ctx, lockIDs, ttl, db.Lock)
+}
+
+type lockFn func(ctx context.Context, lockID string, ttl time.Duration) (UnlockFn, error)
+
+func lockAll(ctx context.Context, lockIDs []string, ttl time.Duration, lock lockFn) (UnlockFn, error) {
+	sorted := make([]string, 0, len(lockIDs))
+	seen := make(map[string]bool)
+	for _, id := range lockIDs {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Strings(sorted)
+
+	var unlockFns []UnlockFn
+	unlockAll := func() error {
+		var firstErr error
+		// Release in reverse order of acquisition.
+		for i := len(unlockFns) - 1; i >= 0; i-- {
+			if err := unlockFns[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	for _, id := range sorted {
+		unlock, err := lock(ctx, id, ttl)
+		if err != nil {
+			if unlockErr := unlockAll(); unlockErr != nil {
+				return nil, fmt.Errorf("acquiring lock %q: %v (and releasing acquired locks: %v)", id, err, unlockErr)
+			}
+			if err == ErrAlreadyLocked {
+				return nil, err
+			}
+			return nil, fmt.Errorf("acquiring lock %q: %v", id, err)
+		}
+		unlockFns = append(unlockFns, unlock)
+	}
+	return unlockAll, nil
+}
+
+// GetLock returns the current state of the lock with the given name. ErrNotFound is returned if
+// the lock is not held. An expired lock is still returned until it is acquired again.
+func (db *DB) GetLock(ctx context.Context, lockID string) (*model.Lock, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	row := conn.QueryRow(ctx, `
+		SELECT
+			lock_id, expires
+		FROM Lock
+		WHERE
+			lock_id=$1
+		`, lockID)
+
+	var l model.Lock
+	if err := row.Scan(&l.LockID, &l.Expires); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("scanning results: %v", err)
+	}
+	return &l, nil
+}
+
+// ForceUnlock releases the lock with the given name regardless of its expiry. ErrNotFound is
+// returned if the lock is not held.
+func (db *DB) ForceUnlock(ctx context.Context, lockID string) (err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	result, err := conn.Exec(ctx, `
+		DELETE FROM Lock
+		WHERE
+			lock_id=$1
+		`, lockID)
+	if err != nil {
+		return fmt.Errorf("deleting lock: %v", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func buildUnlockFn(ctx context.Context, db *DB, lockID string) UnlockFn {
 	return func() (err error) {
-		conn, err := db.pool.Acquire(ctx)
+		conn, err := db.acquire(ctx)
 		if err != nil {
 			return fmt.Errorf("unable to obtain database connection: %v", err)
 		}
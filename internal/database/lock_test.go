@@ -0,0 +1,220 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeLocks holds named locks in memory, recording the order they are acquired in.
+type fakeLocks struct {
+	mu       sync.Mutex
+	held     map[string]bool
+	acquired []string
+	fail     map[string]error
+}
+
+func newFakeLocks() *fakeLocks {
+	return &fakeLocks{held: make(map[string]bool), fail: make(map[string]error)}
+}
+
+func (f *fakeLocks) lock(ctx context.Context, lockID string, ttl time.Duration) (UnlockFn, error) {
+	// Yield so that concurrent callers interleave between acquisitions.
+	runtime.Gosched()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail[lockID]; err != nil {
+		return nil, err
+	}
+	if f.held[lockID] {
+		return nil, ErrAlreadyLocked
+	}
+	f.held[lockID] = true
+	f.acquired = append(f.acquired, lockID)
+	return func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.held, lockID)
+		return nil
+	}, nil
+}
+
+func (f *fakeLocks) heldCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.held)
+}
+
+func TestLockAll(t *testing.T) {
+	testCases := []struct {
+		name         string
+		ids          []string
+		alreadyHeld  string
+		fail         string
+		wantErr      error
+		wantAcquired []string
+	}{
+		{name: "sorted and deduplicated", ids: []string{"query_b", "server_a", "query_b"}, wantAcquired: []string{"query_b", "server_a"}},
+		{name: "one in use", ids: []string{"c", "a", "b"}, alreadyHeld: "b", wantErr: ErrAlreadyLocked, wantAcquired: []string{"a"}},
+		{name: "database error", ids: []string{"a", "b"}, fail: "b", wantAcquired: []string{"a"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			locks := newFakeLocks()
+			if tc.alreadyHeld != "" {
+				locks.held[tc.alreadyHeld] = true
+			}
+			if tc.fail != "" {
+				locks.fail[tc.fail] = errors.New("connection refused")
+			}
+
+			unlock, err := lockAll(context.Background(), tc.ids, time.Minute, locks.lock)
+			if diff := cmp.Diff(tc.wantAcquired, locks.acquired); diff != "" {
+				t.Errorf("acquisition order mismatch (-want +got):\n%s", diff)
+			}
+			if tc.alreadyHeld != "" || tc.fail != "" {
+				if err == nil {
+					t.Fatalf("lockAll succeeded, want error")
+				}
+				if tc.wantErr != nil && err != tc.wantErr {
+					t.Errorf("lockAll returned error %v, want %v", err, tc.wantErr)
+				}
+				// All or nothing: only the lock held beforehand remains.
+				want := 0
+				if tc.alreadyHeld != "" {
+					want = 1
+				}
+				if got := locks.heldCount(); got != want {
+					t.Errorf("%d locks held after failed lockAll, want %d", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lockAll returned unexpected error: %v", err)
+			}
+			if got := locks.heldCount(); got != len(tc.wantAcquired) {
+				t.Errorf("%d locks held, want %d", got, len(tc.wantAcquired))
+			}
+			if err := unlock(); err != nil {
+				t.Fatalf("unlock returned unexpected error: %v", err)
+			}
+			if got := locks.heldCount(); got != 0 {
+				t.Errorf("%d locks held after unlock, want 0", got)
+			}
+		})
+	}
+}
+
+// TestLockAllConcurrent tests that two callers locking the same locks in opposite orders never
+// both fail by each holding one of them.
+func TestLockAllConcurrent(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		locks := newFakeLocks()
+		var wg sync.WaitGroup
+		results := make([]error, 2)
+		unlocks := make([]UnlockFn, 2)
+		for j, ids := range [][]string{{"a", "b"}, {"b", "a"}} {
+			wg.Add(1)
+			go func(j int, ids []string) {
+				defer wg.Done()
+				unlocks[j], results[j] = lockAll(context.Background(), ids, time.Minute, locks.lock)
+			}(j, ids)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for j, err := range results {
+			if err == nil {
+				succeeded++
+				unlocks[j]()
+			} else if err != ErrAlreadyLocked {
+				t.Fatalf("lockAll returned unexpected error: %v", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("run %d: %d callers acquired all locks, want exactly 1", i, succeeded)
+		}
+		if got := locks.heldCount(); got != 0 {
+			t.Fatalf("run %d: %d locks held after unlocking, want 0", i, got)
+		}
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ttl     time.Duration
+		max     time.Duration
+		want    time.Duration
+		wantErr error
+	}{
+		{name: "within max", ttl: 5 * time.Minute, max: time.Hour, want: 5 * time.Minute},
+		{name: "at max", ttl: time.Hour, max: time.Hour, want: time.Hour},
+		{name: "clamped to max", ttl: 6 * time.Hour, max: time.Hour, want: time.Hour},
+		{name: "no max", ttl: 6 * time.Hour, want: 6 * time.Hour},
+		{name: "zero", ttl: 0, max: time.Hour, wantErr: ErrInvalidLockTTL},
+		{name: "negative", ttl: -time.Minute, max: time.Hour, wantErr: ErrInvalidLockTTL},
+		{name: "negative without max", ttl: -time.Minute, wantErr: ErrInvalidLockTTL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := lockTTL(context.Background(), "lock", tc.ttl, tc.max)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("lockTTL(%v, %v) returned error %v, want %v", tc.ttl, tc.max, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("lockTTL(%v, %v) = %v, want %v", tc.ttl, tc.max, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLockRejectsInvalidTTL(t *testing.T) {
+	pools := &fakePools{fail: map[string]bool{"primary": true}}
+	db := &DB{acquirePrimary: pools.acquirer("primary"), maxLockTTL: time.Hour}
+
+	if _, err := db.Lock(context.Background(), "lock", 0); !errors.Is(err, ErrInvalidLockTTL) {
+		t.Errorf("Lock with zero ttl returned error %v, want %v", err, ErrInvalidLockTTL)
+	}
+	if len(pools.acquired) != 0 {
+		t.Errorf("Lock with zero ttl acquired %v, want no connection", pools.acquired)
+	}
+}
+
+func TestLockWithDefaultTTL(t *testing.T) {
+	if DefaultLockTTL <= 0 || DefaultLockTTL > defaultMaxLockTTL {
+		t.Fatalf("DefaultLockTTL %v must be positive and at most defaultMaxLockTTL %v", DefaultLockTTL, defaultMaxLockTTL)
+	}
+
+	// The default ttl is accepted, so the lock goes on to acquire a connection.
+	pools := &fakePools{fail: map[string]bool{"primary": true}}
+	db := &DB{acquirePrimary: pools.acquirer("primary"), maxLockTTL: defaultMaxLockTTL}
+	_, err := db.LockWithDefaultTTL(context.Background(), "lock")
+	if err == nil || errors.Is(err, ErrInvalidLockTTL) {
+		t.Errorf("LockWithDefaultTTL returned error %v, want the connection error", err)
+	}
+	if diff := cmp.Diff([]string{"primary"}, pools.acquired); diff != "" {
+		t.Errorf("acquired mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidCursor is returned by list methods when Page.After is not a cursor they returned.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// Page selects a page of the rows of a list method. Each list method orders its rows by a key
+// and a unique tiebreaker, and a page continues after the last row of the previous one rather
+// than at an offset, so that rows inserted or deleted between pages are neither skipped nor
+// returned twice.
+type Page struct {
+	// After is the cursor returned with the previous page, or empty for the first page.
+	After string
+	// Limit is the most rows returned. Zero returns all of the remaining rows.
+	Limit int
+}
+
+// validate returns an error if p is not a valid page, and the decoded cursor of its After.
+func (p Page) validate() (pageCursor, error) {
+	if p.Limit < 0 {
+		return pageCursor{}, fmt.Errorf("page limit must not be negative, got %d", p.Limit)
+	}
+	if p.After == "" {
+		return pageCursor{}, nil
+	}
+	return decodePageCursor(p.After)
+}
+
+// queryLimit returns the LIMIT argument of a page's query: one more row than the page holds,
+// to learn whether another page follows, or nil, for no limit, if p has no limit.
+func (p Page) queryLimit() interface{} {
+	if p.Limit == 0 {
+		return nil
+	}
+	return p.Limit + 1
+}
+
+// truncate returns the number of the n rows read for p that it holds, and whether another
+// page follows them.
+func (p Page) truncate(n int) (int, bool) {
+	if p.Limit == 0 || n <= p.Limit {
+		return n, false
+	}
+	return p.Limit, true
+}
+
+// pageCursor is the position of a row in a keyset ordering: its ordering key and, for keys
+// that are not unique, its tiebreaker. Time keys are in RFC 3339 format.
+type pageCursor struct {
+	Key string `json:"k"`
+	ID  string `json:"i,omitempty"`
+}
+
+// timeCursor returns the position of a row ordered by the time t and tiebroken by id.
+func timeCursor(t time.Time, id int64) pageCursor {
+	return pageCursor{Key: t.UTC().Format(time.RFC3339Nano), ID: strconv.FormatInt(id, 10)}
+}
+
+// timeAndID decodes a cursor returned by timeCursor.
+func (c pageCursor) timeAndID() (time.Time, int64, error) {
+	t, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	id, err := strconv.ParseInt(c.ID, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return t, id, nil
+}
+
+// timeKeyset returns the arguments of the keyset condition of a query ordered by time and
+// tiebroken by an ID: whether c is the start of the list, and otherwise its time and ID.
+func (c pageCursor) timeKeyset() (bool, time.Time, int64, error) {
+	if c.Key == "" {
+		return true, time.Time{}, 0, nil
+	}
+	t, id, err := c.timeAndID()
+	return false, t, id, err
+}
+
+// after reports whether the row at time t with the given id follows c in ascending order, or
+// in descending order if desc is set, matching the keyset condition of the list queries.
+func (c pageCursor) after(t time.Time, id int64, desc bool) bool {
+	first, ct, cid, err := c.timeKeyset()
+	if first {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if desc {
+		return t.Before(ct) || (t.Equal(ct) && id < cid)
+	}
+	return t.After(ct) || (t.Equal(ct) && id > cid)
+}
+
+// encodePageCursor returns c as an opaque string, safe to use in URLs and flags.
+func encodePageCursor(c pageCursor) string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// A struct of strings always marshals.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageCursor decodes a cursor returned by encodePageCursor.
+func decodePageCursor(encoded string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return pageCursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if c.Key == "" {
+		return pageCursor{}, fmt.Errorf("%w: missing key", ErrInvalidCursor)
+	}
+	return c, nil
+}
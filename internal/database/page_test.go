@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	changed := time.Date(2020, 5, 1, 12, 30, 0, 123456789, time.UTC)
+
+	for _, c := range []pageCursor{
+		{Key: "query-a"},
+		{Key: "a query/with ?odd=characters&"},
+		timeCursor(changed, 42),
+		timeCursor(changed.In(time.FixedZone("UTC+2", 2*60*60)), 1<<40),
+	} {
+		encoded := encodePageCursor(c)
+		got, err := decodePageCursor(encoded)
+		if err != nil {
+			t.Fatalf("decodePageCursor(%q) returned error: %v", encoded, err)
+		}
+		if diff := cmp.Diff(c, got); diff != "" {
+			t.Errorf("cursor round trip mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	gotTime, gotID, err := timeCursor(changed, 42).timeAndID()
+	if err != nil {
+		t.Fatalf("timeAndID returned error: %v", err)
+	}
+	if !gotTime.Equal(changed) || gotID != 42 {
+		t.Errorf("timeAndID returned %v, %d, want %v, 42", gotTime, gotID, changed)
+	}
+}
+
+func TestPageValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		page    Page
+		want    pageCursor
+		wantErr bool
+		invalid bool
+	}{
+		{name: "first page", page: Page{Limit: 10}},
+		{name: "next page", page: Page{After: encodePageCursor(pageCursor{Key: "a"}), Limit: 10}, want: pageCursor{Key: "a"}},
+		{name: "negative limit", page: Page{Limit: -1}, wantErr: true},
+		{name: "not base64", page: Page{After: "not a cursor!"}, wantErr: true, invalid: true},
+		{name: "not json", page: Page{After: "bm90IGpzb24"}, wantErr: true, invalid: true},
+		{name: "no key", page: Page{After: encodePageCursor(pageCursor{ID: "1"})}, wantErr: true, invalid: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.page.validate()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("validate returned no error")
+				}
+				if invalid := errors.Is(err, ErrInvalidCursor); invalid != tc.invalid {
+					t.Errorf("validate returned error %v, wrapping ErrInvalidCursor: %t, want %t", err, invalid, tc.invalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validate returned error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("validate mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Cursors of time ordered lists also decode their keys.
+	bad := pageCursor{Key: "yesterday", ID: "1"}
+	if _, _, _, err := bad.timeKeyset(); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("timeKeyset(%+v) returned error %v, want %v", bad, err, ErrInvalidCursor)
+	}
+}
+
+// keysetRow is a row of a list ordered by a non-unique time and tiebroken by its ID.
+type keysetRow struct {
+	Time time.Time
+	ID   int64
+}
+
+// keysetTable mimics a list query ordered by time and ID, ascending or descending.
+type keysetTable struct {
+	rows []keysetRow
+	desc bool
+}
+
+// list returns the page of the table, in the way of ListFailedBatches and
+// ListFederationQueryAudit.
+func (f *keysetTable) list(t *testing.T, page Page) ([]keysetRow, string) {
+	t.Helper()
+	after, err := page.validate()
+	if err != nil {
+		t.Fatalf("validate returned error: %v", err)
+	}
+	var rows []keysetRow
+	for _, r := range f.rows {
+		if after.after(r.Time, r.ID, f.desc) {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Time.Equal(rows[j].Time) {
+			return rows[i].Time.Before(rows[j].Time) != f.desc
+		}
+		return (rows[i].ID < rows[j].ID) != f.desc
+	})
+	if limit, ok := page.queryLimit().(int); ok && len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	n, more := page.truncate(len(rows))
+	rows = rows[:n]
+	if !more {
+		return rows, ""
+	}
+	return rows, encodePageCursor(timeCursor(rows[n-1].Time, rows[n-1].ID))
+}
+
+func TestKeysetTraversal(t *testing.T) {
+	base := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+	testCases := []struct {
+		name string
+		desc bool
+		// want lists the IDs of the rows returned, page by page.
+		want [][]int64
+	}{
+		{
+			name: "ascending",
+			// Row 6 is inserted before the second page is read, after its cursor, and row 7
+			// before it, where an offset would have returned row 2 twice.
+			want: [][]int64{{1, 2}, {3, 4}, {5, 6}},
+		},
+		{
+			name: "descending",
+			desc: true,
+			want: [][]int64{{6, 5}, {4, 3}, {2, 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Rows 2, 3 and 4 share a time, and are ordered by their ID.
+			table := &keysetTable{desc: tc.desc, rows: []keysetRow{
+				{at(0), 1}, {at(10), 3}, {at(10), 2}, {at(10), 4}, {at(20), 5},
+			}}
+			if tc.desc {
+				table.rows = append(table.rows, keysetRow{at(30), 6})
+			}
+
+			var got [][]int64
+			page := Page{Limit: 2}
+			for i := 0; ; i++ {
+				if i > len(table.rows) {
+					t.Fatalf("paging did not end after %d pages", i)
+				}
+				rows, next := table.list(t, page)
+				var ids []int64
+				for _, r := range rows {
+					ids = append(ids, r.ID)
+				}
+				got = append(got, ids)
+				if next == "" {
+					break
+				}
+				if i == 0 && !tc.desc {
+					table.rows = append(table.rows, keysetRow{at(30), 6}, keysetRow{at(5), 7})
+				}
+				page.After = next
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("pages mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPageTruncate(t *testing.T) {
+	testCases := []struct {
+		limit, rows int
+		wantN       int
+		wantMore    bool
+	}{
+		{limit: 0, rows: 5, wantN: 5},
+		{limit: 2, rows: 0, wantN: 0},
+		{limit: 2, rows: 2, wantN: 2},
+		{limit: 2, rows: 3, wantN: 2, wantMore: true},
+	}
+	for _, tc := range testCases {
+		n, more := Page{Limit: tc.limit}.truncate(tc.rows)
+		if n != tc.wantN || more != tc.wantMore {
+			t.Errorf("Page{Limit: %d}.truncate(%d) = %d, %t, want %d, %t", tc.limit, tc.rows, n, more, tc.wantN, tc.wantMore)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	maxRegionsEnvVar = "DB_MAX_REGIONS"
+	// defaultMaxRegions is far beyond any legitimate region list, but small enough to bound memory.
+	defaultMaxRegions = 500
+)
+
+// errTooManyRegions is returned, wrapped, by checkRegionArray.
+var errTooManyRegions = errors.New("too many regions")
+
+// boundedRegionArray returns the SQL selecting the region array column followed by its number of
+// entries. When max is positive, arrays of more than max entries are selected as NULL, so that
+// they are never transferred or scanned; checkRegionArray then rejects them by their count.
+func boundedRegionArray(column string, max int) string {
+	if max <= 0 {
+		return fmt.Sprintf("%[1]s, COALESCE(cardinality(%[1]s), 0)", column)
+	}
+	return fmt.Sprintf("CASE WHEN cardinality(%[1]s) > %[2]d THEN NULL ELSE %[1]s END, COALESCE(cardinality(%[1]s), 0)", column, max)
+}
+
+// checkRegionArray returns an error if a region array read from column, of n entries, exceeds
+// max entries. A pathological array indicates misconfiguration; the record is rejected rather
+// than truncated, since dropping exclusions would silently widen a query.
+func checkRegionArray(column string, n, max int) error {
+	if max > 0 && n > max {
+		return fmt.Errorf("%w: %s has %d regions, more than the maximum of %d (override with $%s)", errTooManyRegions, column, n, max, maxRegionsEnvVar)
+	}
+	return nil
+}
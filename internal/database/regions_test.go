@@ -0,0 +1,209 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+	pgx "github.com/jackc/pgx/v4"
+)
+
+// TestCheckRegionArray tests checkRegionArray().
+func TestCheckRegionArray(t *testing.T) {
+	testCases := []struct {
+		name    string
+		n       int
+		max     int
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			max:  defaultMaxRegions,
+		},
+		{
+			name: "at limit",
+			n:    defaultMaxRegions,
+			max:  defaultMaxRegions,
+		},
+		{
+			name:    "oversized",
+			n:       defaultMaxRegions + 1,
+			max:     defaultMaxRegions,
+			wantErr: true,
+		},
+		{
+			name: "unbounded",
+			n:    defaultMaxRegions + 1,
+			max:  0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkRegionArray("include_regions", tc.n, tc.max)
+			if err != nil != tc.wantErr {
+				t.Errorf("checkRegionArray got err %v, want err %t", err, tc.wantErr)
+			}
+			if tc.wantErr && !errors.Is(err, errTooManyRegions) {
+				t.Errorf("checkRegionArray got err %v, want %v", err, errTooManyRegions)
+			}
+		})
+	}
+}
+
+// TestBoundedRegionArray tests that oversized region arrays are selected as NULL, so that they
+// are never scanned, along with their number of entries.
+func TestBoundedRegionArray(t *testing.T) {
+	want := "CASE WHEN cardinality(include_regions) > 500 THEN NULL ELSE include_regions END, COALESCE(cardinality(include_regions), 0)"
+	if got := boundedRegionArray("include_regions", defaultMaxRegions); got != want {
+		t.Errorf("boundedRegionArray got %q, want %q", got, want)
+	}
+	want = "include_regions, COALESCE(cardinality(include_regions), 0)"
+	if got := boundedRegionArray("include_regions", 0); got != want {
+		t.Errorf("boundedRegionArray unbounded got %q, want %q", got, want)
+	}
+}
+
+// TestGetFederationQueryTooManyRegions tests that a federation query whose oversized region
+// array was read only as its number of entries is rejected.
+func TestGetFederationQueryTooManyRegions(t *testing.T) {
+	row := &fakeRow{values: []interface{}{"q", "server:443", []string(nil), defaultMaxRegions + 1, []string(nil), 0, time.Time{}, 0,
+		model.DuplicatesSkip, (*string)(nil), (*time.Time)(nil), 0}}
+	var gotSQL string
+	queryRow := func(ctx context.Context, query string, args ...interface{}) pgx.Row {
+		gotSQL = query
+		return row
+	}
+
+	_, err := getFederationQuery(context.Background(), "q", defaultMaxRegions, queryRow)
+	if !errors.Is(err, errTooManyRegions) {
+		t.Errorf("getFederationQuery got err %v, want %v", err, errTooManyRegions)
+	}
+	if want := boundedRegionArray("include_regions", defaultMaxRegions); !strings.Contains(gotSQL, want) {
+		t.Errorf("getFederationQuery query %q does not bound include_regions", gotSQL)
+	}
+}
+
+// fakeRows are rows of fakeRow.
+type fakeRows struct {
+	rows []*fakeRow
+	next int
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	return r.rows[r.next-1].Scan(dest...)
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+// federationQueryRow returns a row of federationQueryColumns for query id with numInclude
+// included regions, followed by extra.
+func federationQueryRow(id string, numInclude int, extra ...interface{}) *fakeRow {
+	include := []string{"US"}
+	if numInclude > defaultMaxRegions {
+		include = nil
+	}
+	values := []interface{}{id, "server:443", include, numInclude, []string(nil), 0, time.Time{}, 0,
+		model.DuplicatesSkip, (*string)(nil), (*time.Time)(nil), 0}
+	return &fakeRow{values: append(values, extra...)}
+}
+
+// TestScanFederationQueriesTooManyRegions tests that a federation query with an oversized region
+// array is skipped without hiding the others.
+func TestScanFederationQueriesTooManyRegions(t *testing.T) {
+	synced := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	rows := &fakeRows{rows: []*fakeRow{
+		federationQueryRow("a", 1, &synced),
+		federationQueryRow("b", defaultMaxRegions+1, &synced),
+		federationQueryRow("c", 1, (*time.Time)(nil)),
+	}}
+
+	var (
+		got      []string
+		lastSync *time.Time
+	)
+	lastSyncs := make(map[string]time.Time)
+	ids, err := scanFederationQueries(context.Background(), rows, defaultMaxRegions, func(q *model.FederationQuery) {
+		got = append(got, q.QueryID)
+		if lastSync != nil {
+			lastSyncs[q.QueryID] = *lastSync
+		}
+	}, &lastSync)
+	if err != nil {
+		t.Fatalf("scanFederationQueries returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a", "c"}, got); diff != "" {
+		t.Errorf("queries mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, ids); diff != "" {
+		t.Errorf("row IDs mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]time.Time{"a": synced}, lastSyncs); diff != "" {
+		t.Errorf("last syncs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestPageFederationQueries tests that skipped queries count towards a page, so that the next
+// page follows them.
+func TestPageFederationQueries(t *testing.T) {
+	queries := func(ids ...string) []*model.FederationQuery {
+		var qs []*model.FederationQuery
+		for _, id := range ids {
+			qs = append(qs, &model.FederationQuery{QueryID: id})
+		}
+		return qs
+	}
+
+	testCases := []struct {
+		name     string
+		queries  []string
+		ids      []string
+		want     []string
+		wantNext string
+	}{
+		{name: "skipped in page", queries: []string{"a", "c"}, ids: []string{"a", "b", "c"}, want: []string{"a"}, wantNext: "b"},
+		{name: "skipped after page", queries: []string{"a", "b"}, ids: []string{"a", "b", "c"}, want: []string{"a", "b"}, wantNext: "b"},
+		{name: "skipped last", queries: []string{"a"}, ids: []string{"a", "b"}, want: []string{"a"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, next := pageFederationQueries(Page{Limit: 2}, queries(tc.queries...), tc.ids)
+			if diff := cmp.Diff(queries(tc.want...), got); diff != "" {
+				t.Errorf("page mismatch (-want +got):\n%s", diff)
+			}
+			wantNext := ""
+			if tc.wantNext != "" {
+				wantNext = encodePageCursor(pageCursor{Key: tc.wantNext})
+			}
+			if next != wantNext {
+				t.Errorf("next cursor got %q, want %q", next, wantNext)
+			}
+		})
+	}
+}
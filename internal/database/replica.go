@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// replicaHostEnvVar, if set, is the host of a read replica that serves read-only queries.
+	// The replica shares the rest of the primary's configuration, apart from its port.
+	replicaHostEnvVar = "DB_REPLICA_HOST"
+	replicaPortEnvVar = "DB_REPLICA_PORT"
+)
+
+type acquireConnFn func(ctx context.Context) (*pgxpool.Conn, error)
+
+// replicaConfigs returns configs with the host and port read from the replica variables.
+func replicaConfigs(configs []config) []config {
+	replica := make([]config, len(configs))
+	for i, c := range configs {
+		switch c.env {
+		case "DB_HOST":
+			c.env = replicaHostEnvVar
+		case "DB_PORT":
+			c.env = replicaPortEnvVar
+		}
+		replica[i] = c
+	}
+	return replica
+}
+
+// acquire returns a connection to the primary. Use it for writes, and for reads that must see
+// the latest writes.
+func (db *DB) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return db.acquirePrimary(ctx)
+}
+
+// acquireRead returns a connection for a read-only query that tolerates replication lag: to the
+// replica if there is one, or to the primary if there is not or the replica is unavailable.
+func (db *DB) acquireRead(ctx context.Context) (*pgxpool.Conn, error) {
+	if db.acquireReplica != nil {
+		conn, err := db.acquireReplica(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		logging.FromContext(ctx).Warnf("Read replica unavailable, using primary: %v", err)
+	}
+	return db.acquirePrimary(ctx)
+}
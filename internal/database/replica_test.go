@@ -0,0 +1,160 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// fakePools records which pool each connection is acquired from. Acquisitions fail for the
+// pools in fail, and otherwise return a nil connection.
+type fakePools struct {
+	acquired []string
+	fail     map[string]bool
+}
+
+func (f *fakePools) acquirer(name string) acquireConnFn {
+	return func(context.Context) (*pgxpool.Conn, error) {
+		f.acquired = append(f.acquired, name)
+		if f.fail[name] {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+}
+
+func TestAcquireRead(t *testing.T) {
+	testCases := []struct {
+		name         string
+		replica      bool
+		fail         map[string]bool
+		wantAcquired []string
+		wantErr      bool
+	}{
+		{name: "no replica", wantAcquired: []string{"primary"}},
+		{name: "replica", replica: true, wantAcquired: []string{"replica"}},
+		{name: "replica unavailable", replica: true, fail: map[string]bool{"replica": true}, wantAcquired: []string{"replica", "primary"}},
+		{name: "both unavailable", replica: true, fail: map[string]bool{"replica": true, "primary": true}, wantAcquired: []string{"replica", "primary"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pools := &fakePools{fail: tc.fail}
+			db := &DB{acquirePrimary: pools.acquirer("primary")}
+			if tc.replica {
+				db.acquireReplica = pools.acquirer("replica")
+			}
+			_, err := db.acquireRead(context.Background())
+			if err != nil != tc.wantErr {
+				t.Errorf("acquireRead() got err %v, want err %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantAcquired, pools.acquired); diff != "" {
+				t.Errorf("acquired pools mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestReplicaRouting tests that read-only methods query the replica and writes the primary.
+func TestReplicaRouting(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	testCases := []struct {
+		name string
+		call func(db *DB) error
+		want string
+	}{
+		{name: "ReadAPIConfigs", want: "replica", call: func(db *DB) error { _, err := db.ReadAPIConfigs(ctx); return err }},
+		{name: "LintAPIConfigs", want: "replica", call: func(db *DB) error { _, err := db.LintAPIConfigs(ctx); return err }},
+		{name: "IterateInfections", want: "replica", call: func(db *DB) error {
+			_, err := db.IterateInfections(ctx, IterateInfectionsCriteria{})
+			return err
+		}},
+		{name: "CountInfections", want: "replica", call: func(db *DB) error {
+			_, err := db.CountInfections(ctx, IterateInfectionsCriteria{})
+			return err
+		}},
+		{name: "IterateExportConfigs", want: "replica", call: func(db *DB) error { _, err := db.IterateExportConfigs(ctx, now); return err }},
+		{name: "ListExportFiles", want: "replica", call: func(db *DB) error { _, err := db.ListExportFiles(ctx, 1); return err }},
+		{name: "ListFederationQueries", want: "replica", call: func(db *DB) error { _, _, err := db.ListFederationQueries(ctx, Page{}); return err }},
+		{name: "ListFederationQueryAudit", want: "replica", call: func(db *DB) error {
+			_, _, err := db.ListFederationQueryAudit(ctx, "", Page{Limit: 10})
+			return err
+		}},
+		{name: "ListFailedBatches", want: "replica", call: func(db *DB) error { _, _, err := db.ListFailedBatches(ctx, Page{}); return err }},
+		{name: "InsertNewInfections", want: "primary", call: func(db *DB) error {
+			_, err := db.InsertNewInfections(ctx, []*model.Infection{{ExposureKey: []byte("ABC")}})
+			return err
+		}},
+		{name: "AddExportFile", want: "primary", call: func(db *DB) error { return db.AddExportFile(ctx, &model.ExportFile{}) }},
+		// Compaction checks that the names of the files it is about to write are unused.
+		{name: "ExistingExportFiles", want: "primary", call: func(db *DB) error { _, err := db.ExistingExportFiles(ctx, []string{"file"}); return err }},
+		{name: "LeaseBatch", want: "primary", call: func(db *DB) error { _, err := db.LeaseBatch(ctx, time.Minute, now); return err }},
+		{name: "Lock", want: "primary", call: func(db *DB) error { _, err := db.Lock(ctx, "lock", time.Minute); return err }},
+		// The cursor of a query must be current, so it is read from the primary.
+		{name: "GetFederationQuery", want: "primary", call: func(db *DB) error { _, err := db.GetFederationQuery(ctx, "query"); return err }},
+		// Scheduling must see the syncs that just started, so as not to start them again.
+		{name: "GetFederationQueriesToRun", want: "primary", call: func(db *DB) error { _, err := db.GetFederationQueriesToRun(ctx, now); return err }},
+		// A retry resumes from the checkpoint of the latest sync, which must be current.
+		{name: "GetLatestFederationSync", want: "primary", call: func(db *DB) error { _, err := db.GetLatestFederationSync(ctx, "query"); return err }},
+		// A cancellation request must reach the sync it stops without waiting for replication.
+		{name: "FederationSyncCanceled", want: "primary", call: func(db *DB) error { _, err := db.FederationSyncCanceled(ctx, "sync"); return err }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Fail every acquisition so that the methods return before using the connection.
+			pools := &fakePools{fail: map[string]bool{"primary": true, "replica": true}}
+			db := &DB{acquirePrimary: pools.acquirer("primary"), acquireReplica: pools.acquirer("replica")}
+			if err := tc.call(db); err == nil {
+				t.Fatalf("%s succeeded, want error", tc.name)
+			}
+			if len(pools.acquired) == 0 || pools.acquired[0] != tc.want {
+				t.Errorf("%s acquired %v, want %s first", tc.name, pools.acquired, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplicaConfigs(t *testing.T) {
+	got := replicaConfigs([]config{
+		{env: "DB_DBNAME", part: "dbname", req: true},
+		{env: "DB_HOST", part: "host", def: defaultHost},
+		{env: "DB_PORT", part: "port", def: defaultPort},
+	})
+	var gotEnv []string
+	for _, c := range got {
+		gotEnv = append(gotEnv, c.env)
+	}
+	if diff := cmp.Diff([]string{"DB_DBNAME", replicaHostEnvVar, replicaPortEnvVar}, gotEnv); diff != "" {
+		t.Errorf("replica config env mismatch (-want +got):\n%s", diff)
+	}
+
+	replicaConfigs(configs)
+	for _, c := range configs {
+		if c.env == replicaHostEnvVar || c.env == replicaPortEnvVar {
+			t.Errorf("replicaConfigs modified the primary configs")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/logging"
+
+	pgx "github.com/jackc/pgx/v4"
+)
+
+const (
+	// DefaultSettingsTTL is how long a setting value is cached by Settings.
+	DefaultSettingsTTL = 30 * time.Second
+)
+
+// GetSetting returns the value of the setting with the given key. If not found, ErrNotFound will be returned.
+func (db *DB) GetSetting(ctx context.Context, key string) (string, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	row := conn.QueryRow(ctx, `
+		SELECT
+			value
+		FROM Settings
+		WHERE
+			name=$1
+		`, key)
+
+	var value string
+	if err := row.Scan(&value); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("scanning results: %v", err)
+	}
+	return value, nil
+}
+
+// SetSetting stores the value of the setting with the given key, overwriting any existing value.
+func (db *DB) SetSetting(ctx context.Context, key, value string) error {
+	return db.WithinTx(ctx, pgx.Serializable, func(tx TxRunner) error {
+		return tx.SetSetting(ctx, key, value)
+	})
+}
+
+func setSetting(ctx context.Context, key, value string, exec execFn) error {
+	err := exec(ctx, `
+		INSERT INTO Settings
+			(name, value)
+		VALUES
+			($1, $2)
+		ON CONFLICT (name) DO UPDATE
+			SET value = EXCLUDED.value
+		`, key, value)
+	if err != nil {
+		return fmt.Errorf("upserting setting %q: %v", key, err)
+	}
+	return nil
+}
+
+type settingStore interface {
+	GetSetting(ctx context.Context, key string) (string, error)
+	SetSetting(ctx context.Context, key, value string) error
+}
+
+type cachedSetting struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// Settings provides typed, cached access to settings stored in the database. A setting's key is
+// the name of the environment variable that provides its value when the setting is absent from the
+// database, so env vars remain the default and the database acts as an override. No binary reads
+// its configuration through Settings yet; a knob only becomes runtime-controllable once its
+// handler is changed to look it up here instead of reading the env var at startup.
+type Settings struct {
+	store settingStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedSetting
+	// gen counts the Set calls for each key, so that a lookup racing with Set doesn't cache the
+	// value it read before the Set.
+	gen map[string]uint64
+}
+
+// NewSettings returns a Settings backed by db, caching values for ttl.
+func NewSettings(db *DB, ttl time.Duration) *Settings {
+	return newSettings(db, ttl)
+}
+
+func newSettings(store settingStore, ttl time.Duration) *Settings {
+	return &Settings{
+		store: store,
+		ttl:   ttl,
+		now:   time.Now,
+		cache: make(map[string]cachedSetting),
+		gen:   make(map[string]uint64),
+	}
+}
+
+// Set stores a setting in the database and updates the cache.
+func (s *Settings) Set(ctx context.Context, key, value string) error {
+	if err := s.store.SetSetting(ctx, key, value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache[key] = cachedSetting{value: value, found: true, expires: s.now().Add(s.ttl)}
+	s.gen[key]++
+	return nil
+}
+
+// lookup returns the value of a setting, first from the database (cached), and then from the
+// environment. The bool result is false if neither has a value. The cache lock is not held while
+// the database is read, so a slow read doesn't block lookups of cached settings. The value read is
+// only cached if no Set for the key happened meanwhile.
+func (s *Settings) lookup(ctx context.Context, key string) (string, bool) {
+	s.mu.Lock()
+	c, ok := s.cache[key]
+	gen := s.gen[key]
+	s.mu.Unlock()
+
+	if now := s.now(); !ok || now.After(c.expires) {
+		value, err := s.store.GetSetting(ctx, key)
+		switch {
+		case err == nil:
+			c = cachedSetting{value: value, found: true, expires: now.Add(s.ttl)}
+		case err == ErrNotFound:
+			c = cachedSetting{expires: now.Add(s.ttl)}
+		default:
+			// Don't cache failures; fall back to the environment for this call only.
+			logging.FromContext(ctx).Warnf("Failed to read setting %s, using environment: %v", key, err)
+			c = cachedSetting{}
+		}
+		if err == nil || err == ErrNotFound {
+			s.mu.Lock()
+			if s.gen[key] == gen {
+				s.cache[key] = c
+			}
+			s.mu.Unlock()
+		}
+	}
+	if c.found {
+		return c.value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// String returns the setting for key, or def if not set.
+func (s *Settings) String(ctx context.Context, key, def string) string {
+	if v, ok := s.lookup(ctx, key); ok {
+		return v
+	}
+	return def
+}
+
+// Bool returns the setting for key parsed as a bool, or def if not set or invalid.
+func (s *Settings) Bool(ctx context.Context, key string, def bool) bool {
+	v, ok := s.lookup(ctx, key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Setting %s %q is not a valid bool, using default %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+// Int returns the setting for key parsed as an int, or def if not set or invalid.
+func (s *Settings) Int(ctx context.Context, key string, def int) int {
+	v, ok := s.lookup(ctx, key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Setting %s %q is not a valid integer, using default %d", key, v, def)
+		return def
+	}
+	return i
+}
+
+// Duration returns the setting for key parsed as a time.Duration, or def if not set or invalid.
+func (s *Settings) Duration(ctx context.Context, key string, def time.Duration) time.Duration {
+	v, ok := s.lookup(ctx, key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Setting %s %q is not a valid duration, using default %v", key, v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeSettingStore mocks the Settings table.
+type fakeSettingStore struct {
+	values map[string]string
+	gets   int
+	// onGet, if set, is called by GetSetting before the value is returned.
+	onGet func(key string)
+}
+
+func (f *fakeSettingStore) GetSetting(ctx context.Context, key string) (string, error) {
+	f.gets++
+	if f.onGet != nil {
+		f.onGet(key)
+	}
+	v, ok := f.values[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+func (f *fakeSettingStore) SetSetting(ctx context.Context, key, value string) error {
+	f.values[key] = value
+	return nil
+}
+
+// TestSettingsRoundTrip tests that values written with Settings.Set are read back by the typed helpers.
+func TestSettingsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeSettingStore{values: map[string]string{}}
+	s := newSettings(store, time.Minute)
+
+	for key, value := range map[string]string{"BOOL": "true", "INT": "42", "DURATION": "90s", "STRING": "abc"} {
+		if err := s.Set(ctx, key, value); err != nil {
+			t.Fatalf("Set(%s) returned err=%v, want err=nil", key, err)
+		}
+	}
+
+	if got := s.Bool(ctx, "BOOL", false); got != true {
+		t.Errorf("Bool got %t, want true", got)
+	}
+	if got := s.Int(ctx, "INT", 0); got != 42 {
+		t.Errorf("Int got %d, want 42", got)
+	}
+	if got := s.Duration(ctx, "DURATION", 0); got != 90*time.Second {
+		t.Errorf("Duration got %v, want 90s", got)
+	}
+	if got := s.String(ctx, "STRING", ""); got != "abc" {
+		t.Errorf("String got %q, want abc", got)
+	}
+	if store.gets != 0 {
+		t.Errorf("store read %d times, want values served from cache", store.gets)
+	}
+
+	// A fresh Settings reads the stored values from the store.
+	s = newSettings(store, time.Minute)
+	if got := s.Int(ctx, "INT", 0); got != 42 {
+		t.Errorf("Int from store got %d, want 42", got)
+	}
+}
+
+// TestSettingsFallback tests that absent settings fall back to the environment and then the default.
+func TestSettingsFallback(t *testing.T) {
+	ctx := context.Background()
+	setupEnv(t, []string{"SETTINGS_TEST_INT=7", "SETTINGS_TEST_BAD_BOOL=not-a-bool"})
+	store := &fakeSettingStore{values: map[string]string{"SETTINGS_TEST_DB_INT": "9"}}
+	s := newSettings(store, time.Minute)
+
+	if got := s.Int(ctx, "SETTINGS_TEST_INT", 1); got != 7 {
+		t.Errorf("Int with env got %d, want 7", got)
+	}
+	if got := s.Int(ctx, "SETTINGS_TEST_DB_INT", 1); got != 9 {
+		t.Errorf("Int with database value got %d, want 9", got)
+	}
+	if got := s.Int(ctx, "SETTINGS_TEST_ABSENT", 1); got != 1 {
+		t.Errorf("Int absent got %d, want default 1", got)
+	}
+	if got := s.Bool(ctx, "SETTINGS_TEST_BAD_BOOL", true); got != true {
+		t.Errorf("Bool invalid got %t, want default true", got)
+	}
+	if got := s.Duration(ctx, "SETTINGS_TEST_ABSENT", time.Hour); got != time.Hour {
+		t.Errorf("Duration absent got %v, want default 1h", got)
+	}
+}
+
+// TestSettingsTTL tests that cached values, including absent ones, are refreshed after the TTL.
+func TestSettingsTTL(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeSettingStore{values: map[string]string{}}
+	s := newSettings(store, time.Minute)
+	now := time.Date(2020, 4, 20, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	if got := s.Bool(ctx, "SETTINGS_TEST_TOGGLE", false); got != false {
+		t.Errorf("Bool absent got %t, want false", got)
+	}
+
+	// Another process sets the value; it's not seen until the cached absence expires.
+	store.values["SETTINGS_TEST_TOGGLE"] = "true"
+	if got := s.Bool(ctx, "SETTINGS_TEST_TOGGLE", false); got != false {
+		t.Errorf("Bool before TTL got %t, want cached false", got)
+	}
+	now = now.Add(time.Minute + time.Second)
+	if got := s.Bool(ctx, "SETTINGS_TEST_TOGGLE", false); got != true {
+		t.Errorf("Bool after TTL got %t, want true", got)
+	}
+	if store.gets != 2 {
+		t.Errorf("store read %d times, want 2", store.gets)
+	}
+}
+
+// TestSettingsReadUnlocked tests that the cache isn't locked while a setting is read from the
+// store, so that cached settings can be read meanwhile.
+func TestSettingsReadUnlocked(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeSettingStore{values: map[string]string{"SLOW": "1"}}
+	s := newSettings(store, time.Minute)
+	if err := s.Set(ctx, "CACHED", "2"); err != nil {
+		t.Fatalf("Set returned err=%v, want err=nil", err)
+	}
+
+	var cached int
+	store.onGet = func(key string) {
+		if key == "SLOW" {
+			cached = s.Int(ctx, "CACHED", 0)
+		}
+	}
+	done := make(chan int)
+	go func() { done <- s.Int(ctx, "SLOW", 0) }()
+	select {
+	case got := <-done:
+		if got != 1 || cached != 2 {
+			t.Errorf("Int got %d and %d while reading, want 1 and 2", got, cached)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached setting could not be read while another setting was read from the store")
+	}
+}
+
+// TestSettingsSetDuringRead tests that a value read from the store before a concurrent Set
+// doesn't replace the value cached by the Set.
+func TestSettingsSetDuringRead(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeSettingStore{values: map[string]string{"TOGGLE": "false"}}
+	s := newSettings(store, time.Minute)
+
+	store.onGet = func(key string) {
+		store.onGet = nil
+		// The read has already seen the old value; Set writes the new one before the read returns.
+		v := store.values[key]
+		if err := s.Set(ctx, key, "true"); err != nil {
+			t.Fatalf("Set returned err=%v, want err=nil", err)
+		}
+		store.values[key] = v
+	}
+	if got := s.Bool(ctx, "TOGGLE", false); got != false {
+		t.Errorf("Bool racing with Set got %t, want false", got)
+	}
+
+	store.values["TOGGLE"] = "true"
+	if got := s.Bool(ctx, "TOGGLE", false); got != true {
+		t.Errorf("Bool after Set got %t, want true", got)
+	}
+	if store.gets != 1 {
+		t.Errorf("store read %d times, want the Set value served from cache", store.gets)
+	}
+}
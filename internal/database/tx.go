@@ -17,14 +17,22 @@ package database
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/logging"
+	"github.com/googlepartners/exposure-notifications/internal/model"
 
 	pgx "github.com/jackc/pgx/v4"
 )
 
+// txFinisher ends a transaction.
+type txFinisher interface {
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
 // finish is a convenience function that can be deferred to commit or rollback a transaction according to boolean commit flag. err will be populated if there is an error.
-func finishTx(ctx context.Context, tx pgx.Tx, commit *bool, err *error) {
+func finishTx(ctx context.Context, tx txFinisher, commit *bool, err *error) {
 	if *commit {
 		if err1 := tx.Commit(ctx); err1 != nil {
 			*err = fmt.Errorf("failed to commit: %v", err1)
@@ -38,3 +46,72 @@ func finishTx(ctx context.Context, tx pgx.Tx, commit *bool, err *error) {
 		}
 	}
 }
+
+// TxRunner runs DB operations within a single transaction, so that several of them are
+// committed or rolled back together. See DB.WithinTx.
+type TxRunner interface {
+	// AddFederationQuery is DB.AddFederationQuery within the transaction.
+	AddFederationQuery(ctx context.Context, q *model.FederationQuery, actor string) error
+	// UpdateFederationRegions is DB.UpdateFederationRegions within the transaction.
+	UpdateFederationRegions(ctx context.Context, queryID string, include, exclude []string, actor string) error
+	// StartFederationSync records a query sync starting, like DB.StartFederationSync, and returns
+	// its key. The sync is finalized by the federation puller, outside the transaction.
+	StartFederationSync(ctx context.Context, q *model.FederationQuery, started time.Time) (string, error)
+	// SetSetting is DB.SetSetting within the transaction.
+	SetSetting(ctx context.Context, key, value string) error
+}
+
+// WithinTx runs fn in a transaction with isoLevel, committing it if fn returns nil and rolling
+// it back otherwise. The TxRunner must not be used after fn returns.
+func (db *DB) WithinTx(ctx context.Context, isoLevel pgx.TxIsoLevel, fn func(tx TxRunner) error) (err error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain database connection: %v", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: isoLevel})
+	if err != nil {
+		return fmt.Errorf("starting transaction: %v", err)
+	}
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := tx.Exec(ctx, query, args...)
+		return err
+	}
+	return runInTx(ctx, tx, &txRunner{queryRow: tx.QueryRow, exec: exec, now: time.Now}, fn)
+}
+
+// runInTx runs fn with runner, then commits tx if fn succeeded and rolls it back otherwise.
+func runInTx(ctx context.Context, tx txFinisher, runner TxRunner, fn func(tx TxRunner) error) (err error) {
+	commit := false
+	defer finishTx(ctx, tx, &commit, &err)
+
+	if err := fn(runner); err != nil {
+		return err
+	}
+	commit = true
+	return nil
+}
+
+// txRunner implements TxRunner with the tx-accepting variants of the DB methods.
+type txRunner struct {
+	queryRow queryRowFn
+	exec     execFn
+	now      func() time.Time
+}
+
+func (r *txRunner) AddFederationQuery(ctx context.Context, q *model.FederationQuery, actor string) error {
+	return addFederationQuery(ctx, q, actor, r.now().UTC(), r.queryRow, r.exec)
+}
+
+func (r *txRunner) UpdateFederationRegions(ctx context.Context, queryID string, include, exclude []string, actor string) error {
+	return updateFederationRegions(ctx, queryID, include, exclude, actor, r.now().UTC(), r.queryRow, r.exec)
+}
+
+func (r *txRunner) StartFederationSync(ctx context.Context, q *model.FederationQuery, started time.Time) (string, error) {
+	return startFederationSync(ctx, q, started, r.exec)
+}
+
+func (r *txRunner) SetSetting(ctx context.Context, key, value string) error {
+	return setSetting(ctx, key, value, r.exec)
+}
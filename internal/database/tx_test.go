@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+
+	"github.com/google/go-cmp/cmp"
+	pgx "github.com/jackc/pgx/v4"
+)
+
+// bufferedTx holds the statements executed against it until it is committed, discarding them if
+// it is rolled back.
+type bufferedTx struct {
+	pending    []string
+	committed  []string
+	rolledBack bool
+}
+
+func (tx *bufferedTx) exec(ctx context.Context, query string, args ...interface{}) error {
+	tx.pending = append(tx.pending, strings.Join(strings.Fields(query)[:3], " "))
+	return nil
+}
+
+func (tx *bufferedTx) Commit(ctx context.Context) error {
+	tx.committed, tx.pending = tx.pending, nil
+	return nil
+}
+
+func (tx *bufferedTx) Rollback(ctx context.Context) error {
+	tx.pending = nil
+	tx.rolledBack = true
+	return nil
+}
+
+func TestRunInTx(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	query := &model.FederationQuery{QueryID: "q", ServerAddr: "remote:443", IncludeRegions: []string{"US"}}
+	errLater := errors.New("later step failed")
+
+	testCases := []struct {
+		name           string
+		fnErr          error
+		wantCommitted  []string
+		wantRolledBack bool
+	}{
+		{
+			name:          "commit",
+			wantCommitted: []string{"INSERT INTO FederationQuery", "INSERT INTO FederationQueryAudit", "INSERT INTO FederationSync"},
+		},
+		{
+			name:           "rollback",
+			fnErr:          errLater,
+			wantRolledBack: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := &bufferedTx{}
+			runner := &txRunner{
+				queryRow: queryRowReturning(&fakeRow{err: pgx.ErrNoRows}),
+				exec:     tx.exec,
+				now:      func() time.Time { return now },
+			}
+
+			err := runInTx(context.Background(), tx, runner, func(tx TxRunner) error {
+				if err := tx.AddFederationQuery(context.Background(), query, "alice"); err != nil {
+					return err
+				}
+				if _, err := tx.StartFederationSync(context.Background(), query, now); err != nil {
+					return err
+				}
+				return tc.fnErr
+			})
+			if err != tc.fnErr {
+				t.Fatalf("runInTx returned error %v, want %v", err, tc.fnErr)
+			}
+
+			if diff := cmp.Diff(tc.wantCommitted, tx.committed); diff != "" {
+				t.Errorf("committed statements mismatch (-want +got):\n%s", diff)
+			}
+			if tx.rolledBack != tc.wantRolledBack {
+				t.Errorf("rolled back %t, want %t", tx.rolledBack, tc.wantRolledBack)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// poolWarmUpEnvVar enables establishing DB_POOL_MIN_CONNS connections before NewFromEnv returns.
+	poolWarmUpEnvVar = "DB_POOL_WARMUP"
+)
+
+type warmConn interface {
+	Ping(ctx context.Context) error
+	Release()
+}
+
+type acquireFn func(ctx context.Context) (warmConn, error)
+
+// poolConn adapts a pooled connection to warmConn.
+type poolConn struct {
+	*pgxpool.Conn
+}
+
+func (c poolConn) Ping(ctx context.Context) error {
+	return c.Conn.Conn().Ping(ctx)
+}
+
+func poolAcquirer(pool *pgxpool.Pool) acquireFn {
+	return func(ctx context.Context) (warmConn, error) {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return poolConn{conn}, nil
+	}
+}
+
+// warmUp establishes n connections by holding them all at once, so the pool has to open each
+// one, and pinging them before they are released back to the pool. It returns the number of
+// connections established. An error is returned only if none could be established.
+func warmUp(ctx context.Context, n int, acquire acquireFn) (int, error) {
+	var (
+		held        []warmConn
+		established int
+		firstErr    error
+	)
+	defer func() {
+		for _, c := range held {
+			c.Release()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		c, err := acquire(ctx)
+		if err == nil {
+			held = append(held, c)
+			err = c.Ping(ctx)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		established++
+	}
+
+	if n > 0 && established == 0 {
+		return 0, fmt.Errorf("unable to establish any of %d connections: %v", n, firstErr)
+	}
+	return established, nil
+}
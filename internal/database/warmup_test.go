@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakePool hands out connections, failing the ones whose index is in fail.
+type fakePool struct {
+	fail     map[int]bool
+	acquired int
+	held     int
+	maxHeld  int
+	pinged   int
+}
+
+type fakeConn struct {
+	pool *fakePool
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.pool.pinged++
+	return nil
+}
+
+func (c *fakeConn) Release() {
+	c.pool.held--
+}
+
+func (p *fakePool) acquire(context.Context) (warmConn, error) {
+	i := p.acquired
+	p.acquired++
+	if p.fail[i] {
+		return nil, errors.New("connection refused")
+	}
+	p.held++
+	if p.held > p.maxHeld {
+		p.maxHeld = p.held
+	}
+	return &fakeConn{pool: p}, nil
+}
+
+func TestWarmUp(t *testing.T) {
+	testCases := []struct {
+		name    string
+		n       int
+		fail    map[int]bool
+		want    int
+		wantErr bool
+	}{
+		{name: "disabled", n: 0, want: 0},
+		{name: "all established", n: 4, want: 4},
+		{name: "partial", n: 4, fail: map[int]bool{1: true, 3: true}, want: 2},
+		{name: "unreachable", n: 3, fail: map[int]bool{0: true, 1: true, 2: true}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pool := &fakePool{fail: tc.fail}
+			got, err := warmUp(context.Background(), tc.n, pool.acquire)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("warmUp returned error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("warmUp established %d connections, want %d", got, tc.want)
+			}
+			if !tc.wantErr && (pool.maxHeld != tc.want || pool.pinged != tc.want) {
+				t.Errorf("connections held at once = %d, pinged = %d, want %d", pool.maxHeld, pool.pinged, tc.want)
+			}
+			if pool.held != 0 {
+				t.Errorf("%d connections not released", pool.held)
+			}
+		})
+	}
+}
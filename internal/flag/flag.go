@@ -17,9 +17,11 @@ package flag
 import (
 	"fmt"
 	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
 )
 
-// RegionListVar is a list of upper-cased, unique regions derived from a comma-separated list.
+// RegionListVar is a list of normalized, unique regions derived from a comma-separated list.
 type RegionListVar []string
 
 func (l *RegionListVar) String() string {
@@ -34,7 +36,11 @@ func (l *RegionListVar) Set(val string) error {
 
 	unique := map[string]struct{}{}
 	for _, v := range strings.Split(val, ",") {
-		vf := strings.ToUpper(strings.TrimSpace(v))
+		r, err := model.ParseRegion(v)
+		if err != nil {
+			return err
+		}
+		vf := r.String()
 		if _, seen := unique[vf]; !seen {
 			*l = append(*l, vf)
 			unique[vf] = struct{}{}
@@ -31,13 +31,62 @@ type APIConfig struct {
 	AllowedRegions   map[string]bool `db:"allowed_regions"`
 	AllowAllRegions  bool            `db:"all_regions"`
 	BypassSafetynet  bool            `db:"bypass_safetynet"`
+	// VerifyDeclaredRegion requires the attestation of each publish to declare a region, and
+	// the publish to be for that region only. Only for deployments whose attestations carry a
+	// region claim.
+	VerifyDeclaredRegion bool `db:"verify_declared_region"`
 }
 
 func NewAPIConfig() *APIConfig {
 	return &APIConfig{AllowedRegions: make(map[string]bool)}
 }
 
-func (c *APIConfig) VerifyOpts(from time.Time) android.VerifyOpts {
+// AuthorizesRegion returns true if the application may publish keys for region, which is
+// normalized first. An invalid region is never authorized.
+func (c *APIConfig) AuthorizesRegion(region string) bool {
+	r, err := ParseRegion(region)
+	if err != nil {
+		return false
+	}
+	return c.AllowAllRegions || c.AllowedRegions[r.String()]
+}
+
+// AuthorizesAll returns true if the application may publish keys for every one of regions.
+func (c *APIConfig) AuthorizesAll(regions []string) bool {
+	for _, r := range regions {
+		if !c.AuthorizesRegion(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthorizedSubset returns the regions, in their original order, that the application may
+// publish keys for.
+func (c *APIConfig) AuthorizedSubset(regions []string) []string {
+	var authorized []string
+	for _, r := range regions {
+		if c.AuthorizesRegion(r) {
+			authorized = append(authorized, r)
+		}
+	}
+	return authorized
+}
+
+// ClockSkew returns the clock skew allowed for attestations, which is the config's
+// ClockSkewSeconds bounded by globalMax. A zero ClockSkewSeconds is unbounded, and a zero
+// globalMax applies no bound. capped is true if globalMax replaced the config value.
+func (c *APIConfig) ClockSkew(globalMax time.Duration) (skew time.Duration, capped bool) {
+	skew = c.ClockSkewSeconds * time.Second
+	if globalMax > 0 && (skew <= 0 || skew > globalMax) {
+		return globalMax, true
+	}
+	return skew, false
+}
+
+// VerifyOpts returns the options to verify an attestation received at from, allowing at most
+// maxClockSkew of clock skew regardless of the config; see ClockSkew.
+func (c *APIConfig) VerifyOpts(from time.Time, maxClockSkew time.Duration) android.VerifyOpts {
 	rtn := android.VerifyOpts{
 		AppPkgName:      c.AppPackageName,
 		CTSProfileMatch: c.CTSProfileMatch,
@@ -52,8 +101,8 @@ func (c *APIConfig) VerifyOpts(from time.Time) android.VerifyOpts {
 		minTime := from.UTC().Add(-c.MaxAgeSeconds * time.Second)
 		rtn.MinValidTime = &minTime
 	}
-	if c.ClockSkewSeconds > 0 {
-		maxTime := from.UTC().Add(c.ClockSkewSeconds * time.Second)
+	if skew, _ := c.ClockSkew(maxClockSkew); skew > 0 {
+		maxTime := from.UTC().Add(skew)
 		rtn.MaxValidTime = &maxTime
 	}
 
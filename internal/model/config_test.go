@@ -0,0 +1,99 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuthorizedRegions(t *testing.T) {
+	allRegions := &APIConfig{AllowAllRegions: true}
+	usCaRegions := &APIConfig{AllowedRegions: map[string]bool{"US": true, "CA": true, "MX": false}}
+
+	testCases := []struct {
+		name           string
+		cfg            *APIConfig
+		regions        []string
+		wantAll        bool
+		wantAuthorized []string
+	}{
+		{name: "all regions allowed", cfg: allRegions, regions: []string{"US", "MX"}, wantAll: true, wantAuthorized: []string{"US", "MX"}},
+		{name: "all requested allowed", cfg: usCaRegions, regions: []string{"CA", "US"}, wantAll: true, wantAuthorized: []string{"CA", "US"}},
+		{name: "partial", cfg: usCaRegions, regions: []string{"US", "MX", "CA"}, wantAll: false, wantAuthorized: []string{"US", "CA"}},
+		{name: "none allowed", cfg: usCaRegions, regions: []string{"MX", "GB"}, wantAll: false},
+		{name: "no regions", cfg: usCaRegions, regions: nil, wantAll: true},
+		{name: "no allowed regions configured", cfg: NewAPIConfig(), regions: []string{"US"}, wantAll: false},
+		{name: "normalized", cfg: usCaRegions, regions: []string{"us", " Ca"}, wantAll: true, wantAuthorized: []string{"us", " Ca"}},
+		{name: "invalid region", cfg: allRegions, regions: []string{"US", "not a region"}, wantAll: false, wantAuthorized: []string{"US"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cfg.AuthorizesAll(tc.regions); got != tc.wantAll {
+				t.Errorf("AuthorizesAll(%v) = %v, want %v", tc.regions, got, tc.wantAll)
+			}
+			if diff := cmp.Diff(tc.wantAuthorized, tc.cfg.AuthorizedSubset(tc.regions)); diff != "" {
+				t.Errorf("AuthorizedSubset(%v) mismatch (-want +got):\n%v", tc.regions, diff)
+			}
+		})
+	}
+}
+
+func TestVerifyOptsClockSkew(t *testing.T) {
+	from := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		skewSeconds time.Duration
+		globalMax   time.Duration
+		want        time.Duration
+		wantCapped  bool
+		wantNoBound bool
+	}{
+		{name: "config within global max", skewSeconds: 60, globalMax: time.Hour, want: time.Minute},
+		{name: "config equals global max", skewSeconds: 3600, globalMax: time.Hour, want: time.Hour},
+		{name: "global max smaller", skewSeconds: 7200, globalMax: time.Hour, want: time.Hour, wantCapped: true},
+		{name: "unbounded config capped", globalMax: time.Hour, want: time.Hour, wantCapped: true},
+		{name: "no global max", skewSeconds: 7200, want: 2 * time.Hour},
+		{name: "unbounded", wantNoBound: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &APIConfig{ClockSkewSeconds: tc.skewSeconds}
+			skew, capped := cfg.ClockSkew(tc.globalMax)
+			if skew != tc.want || capped != tc.wantCapped {
+				t.Errorf("ClockSkew(%v) = %v, %v, want %v, %v", tc.globalMax, skew, capped, tc.want, tc.wantCapped)
+			}
+
+			opts := cfg.VerifyOpts(from, tc.globalMax)
+			if tc.wantNoBound {
+				if opts.MaxValidTime != nil {
+					t.Errorf("VerifyOpts MaxValidTime = %v, want nil", *opts.MaxValidTime)
+				}
+				return
+			}
+			if opts.MaxValidTime == nil {
+				t.Fatalf("VerifyOpts MaxValidTime = nil, want %v", from.Add(tc.want))
+			}
+			if want := from.Add(tc.want); !opts.MaxValidTime.Equal(want) {
+				t.Errorf("VerifyOpts MaxValidTime = %v, want %v", *opts.MaxValidTime, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "fmt"
+
+// DuplicatePolicy controls how a federation sync treats fetched keys that are already stored.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesSkip skips keys that are already stored, for partners that send keys again on
+	// every sync. This is the default.
+	DuplicatesSkip DuplicatePolicy = "skip-duplicates"
+	// DuplicatesError fails the sync when a fetched batch contains a key that is already stored,
+	// inserting none of the batch, for partners that must never send a key twice.
+	DuplicatesError DuplicatePolicy = "error-on-duplicate"
+	// DuplicatesCount skips keys that are already stored, like DuplicatesSkip, but logs how many
+	// each batch contained, to watch a partner before moving it to DuplicatesError.
+	DuplicatesCount DuplicatePolicy = "count-only"
+)
+
+// ParseDuplicatePolicy parses a duplicate policy name. An empty name selects DuplicatesSkip.
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(name); p {
+	case "":
+		return DuplicatesSkip, nil
+	case DuplicatesSkip, DuplicatesError, DuplicatesCount:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown duplicate policy %q, must be %q, %q or %q", name, DuplicatesSkip, DuplicatesError, DuplicatesCount)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "testing"
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    DuplicatePolicy
+		wantErr bool
+	}{
+		{name: "", want: DuplicatesSkip},
+		{name: "skip-duplicates", want: DuplicatesSkip},
+		{name: "error-on-duplicate", want: DuplicatesError},
+		{name: "count-only", want: DuplicatesCount},
+		{name: "error", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseDuplicatePolicy(tc.name)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseDuplicatePolicy(%q) returned error %v, want error %v", tc.name, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseDuplicatePolicy(%q) = %q, want %q", tc.name, got, tc.want)
+			}
+		})
+	}
+}
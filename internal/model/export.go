@@ -23,6 +23,11 @@ var (
 	ExportBatchPending  = "PENDING"
 	ExportBatchComplete = "COMPLETE"
 	ExportBatchDeleted  = "DELETED"
+	// ExportBatchFailed marks a batch that exhausted its attempts; it is not leased again until re-queued.
+	ExportBatchFailed = "FAILED"
+	// ExportBatchPartial marks a batch whose files were written for only some of its regions; it is
+	// not leased again until re-queued, when only its FailedRegions are exported.
+	ExportBatchPartial = "PARTIAL"
 )
 
 type ExportConfig struct {
@@ -36,22 +41,31 @@ type ExportConfig struct {
 }
 
 type ExportBatch struct {
-	BatchID        int64     `db:"batch_id", json:"batchID"`
-	ConfigID       int64     `db:"config_id", json:"configID"`
-	FilenameRoot   string    `db:"filename_root", json:"filenameRoot"`
-	StartTimestamp time.Time `db:"start_timestamp", json:"startTimestamp"`
-	EndTimestamp   time.Time `db:"end_timestamp", json:"endTimestamp"`
-	IncludeRegions []string  `db:"include_regions", json:"includeRegions"`
-	ExcludeRegions []string  `db:"exclude_regions", json:"excludeRegions"`
-	Status         string    `db:"status", json:"status"`
-	LeaseExpires   time.Time `db:"lease_expires", json:"leaseExpires"`
+	BatchID        int64     `db:"batch_id" json:"batchID"`
+	ConfigID       int64     `db:"config_id" json:"configID"`
+	FilenameRoot   string    `db:"filename_root" json:"filenameRoot"`
+	StartTimestamp time.Time `db:"start_timestamp" json:"startTimestamp"`
+	EndTimestamp   time.Time `db:"end_timestamp" json:"endTimestamp"`
+	IncludeRegions []string  `db:"include_regions" json:"includeRegions"`
+	ExcludeRegions []string  `db:"exclude_regions" json:"excludeRegions"`
+	Status         string    `db:"status" json:"status"`
+	LeaseExpires   time.Time `db:"lease_expires" json:"leaseExpires"`
+	Attempts       int       `db:"attempts" json:"attempts"`
+	LastError      string    `db:"last_error" json:"lastError"`
+	FailedRegions  []string  `db:"failed_regions" json:"failedRegions"`
 }
 
 type ExportFile struct {
-	Filename  string `db:"filename"`
-	BatchID   int64  `db:"batch_id"`
-	Region    string `db:"region"`
-	BatchNum  int    `db:"batch_num"`
-	BatchSize int    `db:"batch_size"`
-	Status    string `db:"status"`
+	Filename string `db:"filename"`
+	BatchID  int64  `db:"batch_id"`
+	Region   string `db:"region"`
+	// ReportType is the report type of every key in the file, or nil if the file holds keys of
+	// any report type.
+	ReportType *int `db:"report_type"`
+	// Revocation is set if the file is a revocation list: it holds the keys revoked during the
+	// batch, for clients to delete, rather than the keys of the batch.
+	Revocation bool   `db:"revocation"`
+	BatchNum   int    `db:"batch_num"`
+	BatchSize  int    `db:"batch_size"`
+	Status     string `db:"status"`
 }
@@ -15,22 +15,216 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"time"
 )
 
+const (
+	// MaxLastTimestampSkew is how far beyond "now" a FederationQuery's LastTimestamp may be.
+	// Queries only fetch forward from LastTimestamp, so a future value would silently skip all current keys.
+	MaxLastTimestampSkew = 5 * time.Minute
+)
+
 type FederationQuery struct {
 	QueryID        string    `db:"query_id"`
 	ServerAddr     string    `db:"server_addr"`
 	IncludeRegions []string  `db:"include_regions"`
 	ExcludeRegions []string  `db:"exclude_regions"`
 	LastTimestamp  time.Time `db:"last_timestamp"`
+
+	// RegionChunkSize, if positive, splits IncludeRegions into chunks of at most this many regions,
+	// issuing a separate fetch for each chunk. Zero fetches all regions in a single call.
+	RegionChunkSize int `db:"region_chunk_size"`
+
+	// DuplicatePolicy controls how syncs treat fetched keys that are already stored.
+	// DuplicatesSkip is used if empty.
+	DuplicatePolicy DuplicatePolicy `db:"duplicate_policy"`
+
+	// SyncInterval is the least time between the starts of scheduled syncs of the query; scheduled
+	// invocations within SyncInterval of its last sync are skipped. It is stored in whole seconds.
+	// Zero syncs on every invocation.
+	SyncInterval time.Duration `db:"sync_interval_seconds"`
+
+	// LastError is the error of the query's most recent sync, and LastErrorTime when it failed.
+	// Both are cleared when a sync completes. They describe the health of the query rather than
+	// its configuration, so they are not audited.
+	LastError     string    `db:"last_error" json:"-"`
+	LastErrorTime time.Time `db:"last_error_time" json:"-"`
+}
+
+// RegionLayout identifies how the fetches of the query are split by region: its include regions,
+// in order, the region chunk size and its exclude regions. A failed sync can only be resumed from
+// its completed chunks while the layout it was recorded with is that of the query.
+func (q *FederationQuery) RegionLayout() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s", q.RegionChunkSize, strings.Join(q.IncludeRegions, ","), strings.Join(q.ExcludeRegions, ","))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Validate checks the query for values that would prevent it from syncing correctly.
+func (q *FederationQuery) Validate(now time.Time) error {
+	if _, err := NormalizeRegions(q.IncludeRegions); err != nil {
+		return fmt.Errorf("include regions: %v", err)
+	}
+	if _, err := NormalizeRegions(q.ExcludeRegions); err != nil {
+		return fmt.Errorf("exclude regions: %v", err)
+	}
+	if q.RegionChunkSize < 0 {
+		return fmt.Errorf("region chunk size %d must not be negative", q.RegionChunkSize)
+	}
+	if _, err := ParseDuplicatePolicy(string(q.DuplicatePolicy)); err != nil {
+		return err
+	}
+	if q.SyncInterval < 0 {
+		return fmt.Errorf("sync interval %v must not be negative", q.SyncInterval)
+	}
+	if q.SyncInterval%time.Second != 0 {
+		return fmt.Errorf("sync interval %v must be a whole number of seconds", q.SyncInterval)
+	}
+	if limit := now.Add(MaxLastTimestampSkew); q.LastTimestamp.After(limit) {
+		return fmt.Errorf("last timestamp %s is in the future (must not be after %s); the query would skip all current keys",
+			q.LastTimestamp.UTC().Format(time.RFC3339), limit.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// DueForSync reports whether a scheduled sync of the query should run at now, given when its last
+// sync started. A query that has never synced, or has no SyncInterval, is always due.
+func (q *FederationQuery) DueForSync(lastSync, now time.Time) bool {
+	if q.SyncInterval <= 0 || lastSync.IsZero() {
+		return true
+	}
+	return !now.Before(lastSync.Add(q.SyncInterval))
+}
+
+// RequireIncludeRegions returns an error if the query does not list any regions to include, in
+// which case it fetches all regions apart from those it excludes. Use it to guard against
+// fetching all regions by accident.
+func (q *FederationQuery) RequireIncludeRegions() error {
+	if len(q.IncludeRegions) > 0 {
+		return nil
+	}
+	if len(q.ExcludeRegions) == 0 {
+		return fmt.Errorf("query includes and excludes no regions, so it fetches all regions; list the regions to include")
+	}
+	return fmt.Errorf("query includes no regions, so it fetches all regions except %v; list the regions to include", q.ExcludeRegions)
 }
 
+// WantsRegion reports whether the query fetches keys for region: it is included, or the query
+// includes all regions, and it is not excluded.
+func (q *FederationQuery) WantsRegion(region string) bool {
+	for _, r := range q.ExcludeRegions {
+		if r == region {
+			return false
+		}
+	}
+	if len(q.IncludeRegions) == 0 {
+		return true
+	}
+	for _, r := range q.IncludeRegions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlap returns the regions fetched by both q and other. If neither lists the regions it
+// includes, both fetch all but a finite set of regions, so they always overlap and allRegions is
+// true with regions empty.
+func (q *FederationQuery) Overlap(other *FederationQuery) (regions []string, allRegions bool) {
+	if len(q.IncludeRegions) == 0 && len(other.IncludeRegions) == 0 {
+		return nil, true
+	}
+	candidates := q.IncludeRegions
+	if len(candidates) == 0 {
+		candidates = other.IncludeRegions
+	}
+	seen := make(map[string]bool)
+	for _, r := range candidates {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		if q.WantsRegion(r) && other.WantsRegion(r) {
+			regions = append(regions, r)
+		}
+	}
+	return regions, false
+}
+
+// FederationQueryOverlap is a pair of federation queries that fetch some of the same regions,
+// and so may import the same keys twice.
+type FederationQueryOverlap struct {
+	A, B *FederationQuery
+	// Regions are the regions fetched by both queries. It is empty if both fetch all regions.
+	Regions []string
+}
+
+// FindOverlappingQueries returns every pair of queries that fetch a common region, in the order
+// the queries are given.
+func FindOverlappingQueries(queries []*FederationQuery) []*FederationQueryOverlap {
+	var overlaps []*FederationQueryOverlap
+	for i, a := range queries {
+		for _, b := range queries[i+1:] {
+			regions, all := a.Overlap(b)
+			if all || len(regions) > 0 {
+				overlaps = append(overlaps, &FederationQueryOverlap{A: a, B: b, Regions: regions})
+			}
+		}
+	}
+	return overlaps
+}
+
+// Federation query audit actions.
+const (
+	FederationQueryCreated = "CREATE"
+	FederationQueryUpdated = "UPDATE"
+)
+
+// FederationQueryAudit records a change made to a FederationQuery.
+type FederationQueryAudit struct {
+	AuditID int64  `db:"audit_id"`
+	QueryID string `db:"query_id"`
+	Action  string `db:"action"`
+	// Actor identifies who made the change.
+	Actor string `db:"actor"`
+	// OldValue and NewValue are the JSON encoded query before and after the change. OldValue is
+	// empty when the query was created.
+	OldValue string    `db:"old_value"`
+	NewValue string    `db:"new_value"`
+	Changed  time.Time `db:"changed"`
+}
+
+// Statuses of a finished FederationSync. A sync in progress has no status.
+const (
+	FederationSyncComplete = "COMPLETE"
+	// FederationSyncCanceled marks a sync stopped by an operator before it fetched everything.
+	FederationSyncCanceled = "CANCELED"
+	// FederationSyncFailed marks a sync that stopped on an error. A retry may resume it from its
+	// CompletedChunks.
+	FederationSyncFailed = "FAILED"
+)
+
 type FederationSync struct {
-	SyncID       string    `db:"sync_id"`
-	QueryID      string    `db:"query_id"`
-	Started      time.Time `db:"started"`
-	Completed    time.Time `db:"completed"`
-	Insertions   int       `db:"insertions"`
+	SyncID     string    `db:"sync_id"`
+	QueryID    string    `db:"query_id"`
+	Started    time.Time `db:"started"`
+	Completed  time.Time `db:"completed"`
+	Insertions int       `db:"insertions"`
+	// Duplicates is the number of fetched keys that were already stored.
+	Duplicates   int       `db:"duplicates"`
 	MaxTimestamp time.Time `db:"max_timestamp"`
+	Status       string    `db:"status"`
+	// CancelRequested is set to ask a sync in progress to stop at its next checkpoint.
+	CancelRequested bool `db:"cancel_requested"`
+	// CompletedChunks is the number of region chunks of the query the sync fetched completely.
+	// For a failed sync, MaxTimestamp is the newest key timestamp among those chunks only.
+	CompletedChunks int `db:"completed_chunks"`
+	// RegionLayout is the RegionLayout of the query when the sync started, which its
+	// CompletedChunks count chunks of.
+	RegionLayout string `db:"region_layout"`
 }
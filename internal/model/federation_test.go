@@ -0,0 +1,238 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestFederationQueryValidate tests FederationQuery.Validate().
+func TestFederationQueryValidate(t *testing.T) {
+	now := time.Date(2020, 4, 20, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		lastTimestamp time.Time
+		chunkSize     int
+		syncInterval  time.Duration
+		include       []string
+		exclude       []string
+		wantErr       bool
+	}{
+		{
+			name: "zero timestamp",
+		},
+		{
+			name:          "past",
+			lastTimestamp: now.Add(-24 * time.Hour),
+		},
+		{
+			name:          "now",
+			lastTimestamp: now,
+		},
+		{
+			name:          "slightly future within skew",
+			lastTimestamp: now.Add(MaxLastTimestampSkew - time.Second),
+		},
+		{
+			name:          "exactly at skew",
+			lastTimestamp: now.Add(MaxLastTimestampSkew),
+		},
+		{
+			name:          "far future",
+			lastTimestamp: now.Add(30 * 24 * time.Hour),
+			wantErr:       true,
+		},
+		{
+			name:    "invalid include region",
+			include: []string{"US", "bad region"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid exclude region",
+			exclude: []string{"x"},
+			wantErr: true,
+		},
+		{
+			name:      "negative chunk size",
+			chunkSize: -1,
+			wantErr:   true,
+		},
+		{
+			name:         "sync interval",
+			syncInterval: time.Hour,
+		},
+		{
+			name:         "negative sync interval",
+			syncInterval: -time.Hour,
+			wantErr:      true,
+		},
+		{
+			name:         "fractional sync interval",
+			syncInterval: 1500 * time.Millisecond,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &FederationQuery{QueryID: "query", ServerAddr: "localhost:8080", LastTimestamp: tc.lastTimestamp, RegionChunkSize: tc.chunkSize,
+				SyncInterval: tc.syncInterval, IncludeRegions: tc.include, ExcludeRegions: tc.exclude}
+			err := q.Validate(now)
+			if err != nil != tc.wantErr {
+				t.Errorf("Validate() got err %v, want err %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestFederationQueryRequireIncludeRegions tests FederationQuery.RequireIncludeRegions().
+func TestFederationQueryRequireIncludeRegions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		include []string
+		exclude []string
+		wantErr bool
+	}{
+		{name: "include only", include: []string{"US"}},
+		{name: "include and exclude", include: []string{"US", "CA"}, exclude: []string{"CA"}},
+		{name: "exclude only", exclude: []string{"MX"}, wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &FederationQuery{QueryID: "query", IncludeRegions: tc.include, ExcludeRegions: tc.exclude}
+			err := q.RequireIncludeRegions()
+			if err != nil != tc.wantErr {
+				t.Errorf("RequireIncludeRegions() got err %v, want err %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestFederationQueryRegionLayout tests that the region layout changes with anything that changes
+// the region chunks of a query, and with nothing else.
+func TestFederationQueryRegionLayout(t *testing.T) {
+	base := FederationQuery{QueryID: "query", IncludeRegions: []string{"US", "CA", "MX"}, RegionChunkSize: 2}
+	layout := base.RegionLayout()
+
+	same := base
+	same.LastTimestamp = time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	same.DuplicatePolicy = DuplicatesCount
+	if got := same.RegionLayout(); got != layout {
+		t.Errorf("RegionLayout() of a query with the same regions got %s, want %s", got, layout)
+	}
+
+	for name, change := range map[string]func(q *FederationQuery){
+		"region added":       func(q *FederationQuery) { q.IncludeRegions = []string{"US", "CA", "MX", "GB"} },
+		"regions reordered":  func(q *FederationQuery) { q.IncludeRegions = []string{"CA", "US", "MX"} },
+		"chunk size":         func(q *FederationQuery) { q.RegionChunkSize = 1 },
+		"exclude regions":    func(q *FederationQuery) { q.ExcludeRegions = []string{"GB"} },
+		"regions moved over": func(q *FederationQuery) { q.IncludeRegions, q.ExcludeRegions = []string{"US", "CA"}, []string{"MX"} },
+	} {
+		q := base
+		change(&q)
+		if got := q.RegionLayout(); got == layout {
+			t.Errorf("RegionLayout() after %s is unchanged", name)
+		}
+	}
+}
+
+// TestFederationQueryDueForSync tests FederationQuery.DueForSync().
+func TestFederationQueryDueForSync(t *testing.T) {
+	now := time.Date(2020, 4, 20, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		interval time.Duration
+		lastSync time.Time
+		want     bool
+	}{
+		{name: "no interval", lastSync: now.Add(-time.Second), want: true},
+		{name: "never synced", interval: time.Hour, want: true},
+		{name: "within interval", interval: time.Hour, lastSync: now.Add(-59 * time.Minute)},
+		{name: "interval elapsed", interval: time.Hour, lastSync: now.Add(-time.Hour), want: true},
+		{name: "long ago", interval: time.Hour, lastSync: now.Add(-24 * time.Hour), want: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &FederationQuery{QueryID: "query", SyncInterval: tc.interval}
+			if got := q.DueForSync(tc.lastSync, now); got != tc.want {
+				t.Errorf("DueForSync(%v, %v) = %t, want %t", tc.lastSync, now, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFindOverlappingQueries tests FindOverlappingQueries() with overlapping and disjoint queries.
+func TestFindOverlappingQueries(t *testing.T) {
+	usCA := &FederationQuery{QueryID: "us-ca", ServerAddr: "a", IncludeRegions: []string{"US", "CA"}}
+	caMX := &FederationQuery{QueryID: "ca-mx", ServerAddr: "b", IncludeRegions: []string{"CA", "MX"}}
+	gb := &FederationQuery{QueryID: "gb", ServerAddr: "c", IncludeRegions: []string{"GB"}}
+	allButUS := &FederationQuery{QueryID: "all-but-us", ServerAddr: "d", ExcludeRegions: []string{"US"}}
+	allButGB := &FederationQuery{QueryID: "all-but-gb", ServerAddr: "e", ExcludeRegions: []string{"GB"}}
+	usExcluded := &FederationQuery{QueryID: "us-excluded", ServerAddr: "f", IncludeRegions: []string{"US", "FR"}, ExcludeRegions: []string{"US"}}
+
+	testCases := []struct {
+		name    string
+		queries []*FederationQuery
+		want    []*FederationQueryOverlap
+	}{
+		{
+			name:    "disjoint",
+			queries: []*FederationQuery{usCA, gb},
+		},
+		{
+			name:    "intersecting includes",
+			queries: []*FederationQuery{usCA, caMX, gb},
+			want:    []*FederationQueryOverlap{{A: usCA, B: caMX, Regions: []string{"CA"}}},
+		},
+		{
+			name:    "all regions against includes",
+			queries: []*FederationQuery{allButUS, usCA, gb},
+			want: []*FederationQueryOverlap{
+				{A: allButUS, B: usCA, Regions: []string{"CA"}},
+				{A: allButUS, B: gb, Regions: []string{"GB"}},
+			},
+		},
+		{
+			name:    "excluded region does not overlap",
+			queries: []*FederationQuery{allButUS, usExcluded, usCA},
+			want: []*FederationQueryOverlap{
+				{A: allButUS, B: usExcluded, Regions: []string{"FR"}},
+				{A: allButUS, B: usCA, Regions: []string{"CA"}},
+			},
+		},
+		{
+			name:    "all regions",
+			queries: []*FederationQuery{allButUS, allButGB},
+			want:    []*FederationQueryOverlap{{A: allButUS, B: allButGB}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FindOverlappingQueries(tc.queries)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("FindOverlappingQueries() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ package model
 
 import (
 	"encoding/base64"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -23,6 +24,26 @@ import (
 const (
 	// Intervals are defined as 10 minute periods, there are 144 of them in a day.
 	maxIntervalCount = 144
+
+	// MinDaysSinceOnsetOfSymptoms and MaxDaysSinceOnsetOfSymptoms bound the number of days
+	// between the start of a key's interval and the onset of symptoms.
+	MinDaysSinceOnsetOfSymptoms = -14
+	MaxDaysSinceOnsetOfSymptoms = 14
+
+	// MinTransmissionRisk and MaxTransmissionRisk bound the transmission risk level of a key.
+	MinTransmissionRisk = 0
+	MaxTransmissionRisk = 8
+)
+
+// Report types describe how the diagnosis behind a key was established. The values match the
+// report types understood by the exposure notification clients.
+const (
+	ReportTypeUnknown                    = 0
+	ReportTypeConfirmedTest              = 1
+	ReportTypeConfirmedClinicalDiagnosis = 2
+	ReportTypeSelfReport                 = 3
+	ReportTypeRecursive                  = 4
+	ReportTypeRevoked                    = 5
 )
 
 // Publish represents the body of the PublishInfectedIds API call.
@@ -31,17 +52,32 @@ type Publish struct {
 	Regions          []string      `json:"regions"`
 	AppPackageName   string        `json:"appPackageName"`
 	TransmissionRisk int           `json:"transmissionRisk"`
+	ReportType       int           `json:"reportType"`
 	Verification     string        `json:"verificationPayload"`
 	// TODO(helmick): validate this field
 	VerificationAuthorityName string `json:"verificationAuthorityName"`
 }
 
+// PublishResponse is the body of a successful PublishInfectedIds response. It only reports
+// counts, so a client can tell whether a retry was deduplicated without learning which keys
+// were already known.
+type PublishResponse struct {
+	// Inserted is the number of keys newly stored.
+	Inserted int `json:"insertedExposureKeys"`
+	// Duplicates is the number of keys that were already stored, or repeated in the request.
+	Duplicates int `json:"duplicateExposureKeys"`
+}
+
 // ExposureKey is the 16 byte key, the start time of the key and the
 // duration of the key. A duration of 0 means 24 hours.
+// DaysSinceOnsetOfSymptoms is optional; nil means it is unknown.
+// TransmissionRisk is optional; nil means the key takes the transmission risk of the publish.
 type ExposureKey struct {
-	Key            string `json:"key"`
-	IntervalNumber int32  `json:"intervalNumber"`
-	IntervalCount  int32  `json:"intervalCount"`
+	Key                      string `json:"key"`
+	IntervalNumber           int32  `json:"intervalNumber"`
+	IntervalCount            int32  `json:"intervalCount"`
+	DaysSinceOnsetOfSymptoms *int32 `json:"daysSinceOnsetOfSymptoms,omitempty"`
+	TransmissionRisk         *int32 `json:"transmissionRisk,omitempty"`
 }
 
 // Infection represents the record as storedin the database
@@ -53,14 +89,19 @@ type ExposureKey struct {
 type Infection struct {
 	ExposureKey               []byte    `db:"exposure_key"`
 	TransmissionRisk          int       `db:"transmission_risk"`
+	ReportType                int       `db:"report_type"`
 	AppPackageName            string    `db:"app_package_name"`
 	Regions                   []string  `db:"regions"`
 	IntervalNumber            int32     `db:"interval_number"`
 	IntervalCount             int32     `db:"interval_count"`
+	DaysSinceOnsetOfSymptoms  *int32    `db:"days_since_onset_of_symptoms"`
 	CreatedAt                 time.Time `db:"created_at"`
 	LocalProvenance           bool      `db:"local_provenance"`
 	VerificationAuthorityName string    `db:"verification_authority_name"`
 	FederationSyncID          string    `db:"sync_id"`
+	// RegionCopy is the single region of a copy of the key stored by RegionPolicyPerRegion,
+	// empty for a key stored once for all its regions.
+	RegionCopy string `db:"region_copy"`
 }
 
 const (
@@ -80,30 +121,116 @@ func correctIntervalCount(count int32) int32 {
 	return count
 }
 
-// TransformPublish converts incoming key data to a list of infection entities.
-func TransformPublish(inData *Publish, batchTime time.Time) ([]*Infection, error) {
+func validateDaysSinceOnsetOfSymptoms(days *int32) error {
+	if days == nil {
+		return nil
+	}
+	if *days < MinDaysSinceOnsetOfSymptoms || *days > MaxDaysSinceOnsetOfSymptoms {
+		return fmt.Errorf("daysSinceOnsetOfSymptoms %d is out of range [%d, %d]", *days, MinDaysSinceOnsetOfSymptoms, MaxDaysSinceOnsetOfSymptoms)
+	}
+	return nil
+}
+
+// ValidateTransmissionRisk returns an error if risk is not a valid transmission risk level.
+func ValidateTransmissionRisk(risk int) error {
+	if risk < MinTransmissionRisk || risk > MaxTransmissionRisk {
+		return fmt.Errorf("transmissionRisk %d is out of range [%d, %d]", risk, MinTransmissionRisk, MaxTransmissionRisk)
+	}
+	return nil
+}
+
+// ValidateReportType returns an error if reportType is not one of the known report types.
+func ValidateReportType(reportType int) error {
+	if reportType < ReportTypeUnknown || reportType > ReportTypeRevoked {
+		return fmt.Errorf("reportType %d is not a known report type", reportType)
+	}
+	return nil
+}
+
+// transmissionRisk returns the transmission risk of key: its own if set, otherwise that of the
+// publish, otherwise defaultRisk.
+func transmissionRisk(key ExposureKey, publishRisk, defaultRisk int) int {
+	switch {
+	case key.TransmissionRisk != nil:
+		return int(*key.TransmissionRisk)
+	case publishRisk != 0:
+		return publishRisk
+	default:
+		return defaultRisk
+	}
+}
+
+// KeyError is returned by TransformPublish for an invalid key of a publish.
+type KeyError struct {
+	// Index is the position of the key in Publish.Keys.
+	Index int
+	// Field is the JSON name of the invalid field of the key.
+	Field string
+	Err   error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %d: %v", e.Index, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is returned by TransformPublish for an invalid field of the publish itself.
+type FieldError struct {
+	// Field is the JSON name of the invalid field of the publish.
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// TransformPublish converts incoming key data to a list of infection entities. Keys without a
+// transmission risk of their own or of the publish are given defaultRisk. An invalid key is
+// reported as a *KeyError, and any other invalid field as a *FieldError.
+func TransformPublish(inData *Publish, batchTime time.Time, defaultRisk int) ([]*Infection, error) {
 	createdAt := TruncateWindow(batchTime)
 	entities := make([]*Infection, 0, len(inData.Keys))
 
-	// Regions are a multi-value property, uppercase them for storage.
-	upcaseRegions := make([]string, len(inData.Regions))
-	for i, r := range inData.Regions {
-		upcaseRegions[i] = strings.ToUpper(r)
+	if err := ValidateReportType(inData.ReportType); err != nil {
+		return nil, &FieldError{Field: "reportType", Err: err}
 	}
 
-	for _, exposureKey := range inData.Keys {
+	// Regions are a multi-value property, normalize them for storage.
+	upcaseRegions, err := NormalizeRegions(inData.Regions)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, exposureKey := range inData.Keys {
 		binKey, err := base64.StdEncoding.DecodeString(exposureKey.Key)
 		if err != nil {
-			return nil, err
+			return nil, &KeyError{Index: i, Field: "key", Err: err}
+		}
+		if err := validateDaysSinceOnsetOfSymptoms(exposureKey.DaysSinceOnsetOfSymptoms); err != nil {
+			return nil, &KeyError{Index: i, Field: "daysSinceOnsetOfSymptoms", Err: err}
+		}
+		risk := transmissionRisk(exposureKey, inData.TransmissionRisk, defaultRisk)
+		if err := ValidateTransmissionRisk(risk); err != nil {
+			return nil, &KeyError{Index: i, Field: "transmissionRisk", Err: err}
 		}
 		// TODO(helmick) - data validation
 		infection := &Infection{
 			ExposureKey:               binKey,
-			TransmissionRisk:          inData.TransmissionRisk,
+			TransmissionRisk:          risk,
+			ReportType:                inData.ReportType,
 			AppPackageName:            inData.AppPackageName,
 			Regions:                   upcaseRegions,
 			IntervalNumber:            exposureKey.IntervalNumber,
 			IntervalCount:             correctIntervalCount(exposureKey.IntervalCount),
+			DaysSinceOnsetOfSymptoms:  exposureKey.DaysSinceOnsetOfSymptoms,
 			CreatedAt:                 createdAt,
 			LocalProvenance:           true, // This is the origin system for this data.
 			VerificationAuthorityName: strings.ToUpper(strings.TrimSpace(inData.VerificationAuthorityName)),
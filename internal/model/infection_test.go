@@ -16,6 +16,7 @@ package model
 
 import (
 	"encoding/base64"
+	"errors"
 	"testing"
 	"time"
 
@@ -41,11 +42,48 @@ func TestInvalidBase64(t *testing.T) {
 	}
 	batchTime := time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC)
 
-	_, err := TransformPublish(source, batchTime)
-	expErr := `illegal base64 data at input byte 4`
+	_, err := TransformPublish(source, batchTime, 0)
+	expErr := `key 0: illegal base64 data at input byte 4`
 	if err == nil || err.Error() != expErr {
 		t.Errorf("expected error '%v', got: %v", expErr, err)
 	}
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || keyErr.Index != 0 || keyErr.Field != "key" {
+		t.Errorf("expected a KeyError for field key of key 0, got: %#v", err)
+	}
+}
+
+func TestInvalidRegion(t *testing.T) {
+	source := &Publish{
+		Keys: []ExposureKey{
+			{
+				Key: base64.StdEncoding.EncodeToString([]byte("ABC")),
+			},
+		},
+		Regions:        []string{"US", "United States"},
+		AppPackageName: "com.google",
+	}
+	batchTime := time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC)
+
+	if _, err := TransformPublish(source, batchTime, 0); err == nil {
+		t.Errorf("expected error for invalid region, got nil")
+	}
+}
+
+func TestInvalidReportType(t *testing.T) {
+	for _, reportType := range []int{ReportTypeUnknown - 1, ReportTypeRevoked + 1} {
+		source := &Publish{
+			Keys:           []ExposureKey{{Key: base64.StdEncoding.EncodeToString([]byte("ABC"))}},
+			Regions:        []string{"US"},
+			AppPackageName: "com.google",
+			ReportType:     reportType,
+		}
+		_, err := TransformPublish(source, time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC), 0)
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != "reportType" {
+			t.Errorf("TransformPublish with report type %d returned %v, want a FieldError for field reportType", reportType, err)
+		}
+	}
 }
 
 func TestTransform(t *testing.T) {
@@ -115,7 +153,7 @@ func TestTransform(t *testing.T) {
 		}
 	}
 
-	got, err := TransformPublish(source, batchTime)
+	got, err := TransformPublish(source, batchTime, 0)
 	if err != nil {
 		t.Fatalf("TransformPublish returned unexpected error: %v", err)
 	}
@@ -126,3 +164,103 @@ func TestTransform(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformDaysSinceOnsetOfSymptoms(t *testing.T) {
+	batchTime := time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC)
+
+	days := func(d int32) *int32 { return &d }
+
+	testCases := []struct {
+		name    string
+		days    *int32
+		wantErr string
+	}{
+		{name: "unknown", days: nil},
+		{name: "onset day", days: days(0)},
+		{name: "min", days: days(MinDaysSinceOnsetOfSymptoms)},
+		{name: "max", days: days(MaxDaysSinceOnsetOfSymptoms)},
+		{name: "below min", days: days(MinDaysSinceOnsetOfSymptoms - 1), wantErr: "key 1: daysSinceOnsetOfSymptoms -15 is out of range [-14, 14]"},
+		{name: "above max", days: days(MaxDaysSinceOnsetOfSymptoms + 1), wantErr: "key 1: daysSinceOnsetOfSymptoms 15 is out of range [-14, 14]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &Publish{
+				Keys: []ExposureKey{
+					{Key: base64.StdEncoding.EncodeToString([]byte("ABC"))},
+					{Key: base64.StdEncoding.EncodeToString([]byte("DEF")), DaysSinceOnsetOfSymptoms: tc.days},
+				},
+				Regions: []string{"US"},
+			}
+
+			got, err := TransformPublish(source, batchTime, 0)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("expected error '%v', got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TransformPublish returned unexpected error: %v", err)
+			}
+			if got[0].DaysSinceOnsetOfSymptoms != nil {
+				t.Errorf("key without days since onset got %v, want nil", *got[0].DaysSinceOnsetOfSymptoms)
+			}
+			if diff := cmp.Diff(tc.days, got[1].DaysSinceOnsetOfSymptoms); diff != "" {
+				t.Errorf("DaysSinceOnsetOfSymptoms mismatch (-want +got):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTransformTransmissionRisk(t *testing.T) {
+	batchTime := time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC)
+
+	risk := func(r int32) *int32 { return &r }
+
+	testCases := []struct {
+		name        string
+		keyRisk     *int32
+		publishRisk int
+		defaultRisk int
+		want        int
+		wantErr     string
+	}{
+		{name: "absent takes default", defaultRisk: 4, want: 4},
+		{name: "absent without default", want: 0},
+		{name: "absent takes publish", publishRisk: 2, defaultRisk: 4, want: 2},
+		{name: "key overrides publish", keyRisk: risk(6), publishRisk: 2, defaultRisk: 4, want: 6},
+		{name: "key zero overrides default", keyRisk: risk(0), defaultRisk: 4, want: 0},
+		{name: "max", keyRisk: risk(MaxTransmissionRisk), want: MaxTransmissionRisk},
+		{name: "key above max", keyRisk: risk(MaxTransmissionRisk + 1), wantErr: "key 1: transmissionRisk 9 is out of range [0, 8]"},
+		{name: "key below min", keyRisk: risk(MinTransmissionRisk - 1), wantErr: "key 1: transmissionRisk -1 is out of range [0, 8]"},
+		{name: "publish out of range", publishRisk: 12, wantErr: "key 0: transmissionRisk 12 is out of range [0, 8]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &Publish{
+				Keys: []ExposureKey{
+					{Key: base64.StdEncoding.EncodeToString([]byte("ABC"))},
+					{Key: base64.StdEncoding.EncodeToString([]byte("DEF")), TransmissionRisk: tc.keyRisk},
+				},
+				Regions:          []string{"US"},
+				TransmissionRisk: tc.publishRisk,
+			}
+
+			got, err := TransformPublish(source, batchTime, tc.defaultRisk)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("expected error '%v', got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TransformPublish returned unexpected error: %v", err)
+			}
+			if got[1].TransmissionRisk != tc.want {
+				t.Errorf("TransmissionRisk = %d, want %d", got[1].TransmissionRisk, tc.want)
+			}
+		})
+	}
+}
@@ -23,3 +23,16 @@ type Lock struct {
 	LockID  string    `db:"lock_id"`
 	Expires time.Time `db:"expires"`
 }
+
+// Expired returns true if the lock has expired at now and can be acquired by another caller.
+func (l *Lock) Expired(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+// Remaining returns the time left until the lock expires at now, or zero if it has expired.
+func (l *Lock) Remaining(now time.Time) time.Duration {
+	if l.Expired(now) {
+		return 0
+	}
+	return l.Expires.Sub(now)
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockRemaining(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		expires     time.Time
+		wantExpired bool
+		want        time.Duration
+	}{
+		{name: "held", expires: now.Add(90 * time.Second), want: 90 * time.Second},
+		{name: "expiring now", expires: now, want: 0},
+		{name: "expired", expires: now.Add(-time.Minute), wantExpired: true, want: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &Lock{LockID: "foo", Expires: tc.expires}
+			if got := l.Expired(now); got != tc.wantExpired {
+				t.Errorf("Expired() = %v, want %v", got, tc.wantExpired)
+			}
+			if got := l.Remaining(now); got != tc.want {
+				t.Errorf("Remaining() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
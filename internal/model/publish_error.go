@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+// PublishErrorCode identifies why a publish was rejected. The codes are part of the publish API:
+// they are never renamed or reused, so clients may rely on them.
+type PublishErrorCode string
+
+const (
+	// PublishErrorBadRequest: the body is not a single well formed publish JSON object.
+	PublishErrorBadRequest PublishErrorCode = "bad_request"
+	// PublishErrorUnsupportedMediaType: the Content-Type is not application/json.
+	PublishErrorUnsupportedMediaType PublishErrorCode = "unsupported_media_type"
+	// PublishErrorRequestTooLarge: the body is longer than the server accepts.
+	PublishErrorRequestTooLarge PublishErrorCode = "request_too_large"
+	// PublishErrorUnknownApp: the server has no config for the appPackageName.
+	PublishErrorUnknownApp PublishErrorCode = "unknown_app"
+	// PublishErrorUnauthorizedRegion: the app may not publish for the listed regions.
+	PublishErrorUnauthorizedRegion PublishErrorCode = "unauthorized_region"
+	// PublishErrorDeclaredRegion: the regions do not match the region the attestation declares.
+	PublishErrorDeclaredRegion PublishErrorCode = "declared_region_mismatch"
+	// PublishErrorNonceMismatch: the attestation nonce was not computed from this publish.
+	PublishErrorNonceMismatch PublishErrorCode = "attestation_nonce_mismatch"
+	// PublishErrorAttestationExpired: the attestation, or one of its certificates, is too old or
+	// not yet valid.
+	PublishErrorAttestationExpired PublishErrorCode = "attestation_expired"
+	// PublishErrorIntegrity: the attestation reports a device that fails the integrity checks.
+	PublishErrorIntegrity PublishErrorCode = "attestation_integrity_failed"
+	// PublishErrorInvalidAttestation: the attestation is malformed, too large, or not signed by a
+	// trusted certificate.
+	PublishErrorInvalidAttestation PublishErrorCode = "invalid_attestation"
+	// PublishErrorUnauthorized: the publish failed any other verification.
+	PublishErrorUnauthorized PublishErrorCode = "unauthorized"
+	// PublishErrorInvalidRegion: the listed regions are not valid region codes.
+	PublishErrorInvalidRegion PublishErrorCode = "invalid_region"
+	// PublishErrorInvalidKey: a key holds an invalid value. The error names the key and field.
+	PublishErrorInvalidKey PublishErrorCode = "invalid_key"
+	// PublishErrorInvalidPublish: the publish holds any other invalid data.
+	PublishErrorInvalidPublish PublishErrorCode = "invalid_publish"
+	// PublishErrorInternal: the server failed to process a valid publish. It may be retried.
+	PublishErrorInternal PublishErrorCode = "internal"
+)
+
+// PublishErrorResponse is the body of a failed PublishInfectedIds response.
+type PublishErrorResponse struct {
+	Code    PublishErrorCode `json:"code"`
+	Message string           `json:"message"`
+	// Field is the JSON name of the offending field, if the error concerns one.
+	Field string `json:"field,omitempty"`
+	// Regions are the offending regions, as published.
+	Regions []string `json:"regions,omitempty"`
+	// KeyIndices are the positions of the offending keys in exposureKeys.
+	KeyIndices []int `json:"keyIndices,omitempty"`
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+)
+
+// HashKeys returns a SHA-256 hash identifying the set of keys in the publish, independent of
+// the order they were submitted in. It is the shared primitive for detecting replayed publishes
+// and binding attestation nonces to keys.
+//
+// The hash is computed as follows, so that clients can reproduce it:
+//
+//  1. Each key is decoded from standard, padded base64 to its raw bytes. A key that does not
+//     decode is used as the bytes of its text instead; such a publish is rejected on storage.
+//  2. Each key's interval count is normalized as it is stored: a count of 0 or more than 144 is
+//     taken as 144.
+//  3. Each key is encoded as the 4 byte big-endian length of its raw bytes, the raw bytes, then
+//     the 4 byte big-endian interval number and interval count.
+//  4. The encoded keys are sorted by their raw bytes, then interval number, then interval count.
+//     Repeated keys are kept.
+//  5. The hash is the SHA-256 of the concatenated encoded keys.
+//
+// Regions, the app package and the other publish fields are not part of the hash.
+func (p *Publish) HashKeys() []byte {
+	type hashKey struct {
+		key            []byte
+		intervalNumber int32
+		intervalCount  int32
+	}
+	keys := make([]hashKey, len(p.Keys))
+	for i, k := range p.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			raw = []byte(k.Key)
+		}
+		keys[i] = hashKey{key: raw, intervalNumber: k.IntervalNumber, intervalCount: correctIntervalCount(k.IntervalCount)}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := bytes.Compare(keys[i].key, keys[j].key); c != 0 {
+			return c < 0
+		}
+		if keys[i].intervalNumber != keys[j].intervalNumber {
+			return keys[i].intervalNumber < keys[j].intervalNumber
+		}
+		return keys[i].intervalCount < keys[j].intervalCount
+	})
+
+	h := sha256.New()
+	var field [4]byte
+	for _, k := range keys {
+		binary.BigEndian.PutUint32(field[:], uint32(len(k.key)))
+		h.Write(field[:])
+		h.Write(k.key)
+		binary.BigEndian.PutUint32(field[:], uint32(k.intervalNumber))
+		h.Write(field[:])
+		binary.BigEndian.PutUint32(field[:], uint32(k.intervalCount))
+		h.Write(field[:])
+	}
+	return h.Sum(nil)
+}
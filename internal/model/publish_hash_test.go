@@ -0,0 +1,61 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHashKeys(t *testing.T) {
+	keyA := ExposureKey{Key: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")), IntervalNumber: 2650000, IntervalCount: 144}
+	keyB := ExposureKey{Key: base64.StdEncoding.EncodeToString([]byte("fedcba9876543210")), IntervalNumber: 2650144}
+	publish := &Publish{Keys: []ExposureKey{keyA, keyB}, Regions: []string{"US"}, AppPackageName: "com.example.app"}
+
+	// The hash of this key set must never change: clients compute it independently.
+	const want = "4f7b746cf47d959831d7a612661aff4ffe26dcb8960f0d38197f71fb96660302"
+	if got := hex.EncodeToString(publish.HashKeys()); got != want {
+		t.Errorf("HashKeys() = %s, want %s", got, want)
+	}
+
+	testCases := []struct {
+		name string
+		p    *Publish
+		same bool
+	}{
+		{name: "reordered", p: &Publish{Keys: []ExposureKey{keyB, keyA}}, same: true},
+		{name: "other fields", p: &Publish{Keys: []ExposureKey{keyA, keyB}, Regions: []string{"CA"}, TransmissionRisk: 5}, same: true},
+		{
+			name: "normalized interval count",
+			p:    &Publish{Keys: []ExposureKey{{Key: keyA.Key, IntervalNumber: keyA.IntervalNumber}, keyB}},
+			same: true,
+		},
+		{name: "missing key", p: &Publish{Keys: []ExposureKey{keyA}}},
+		{name: "repeated key", p: &Publish{Keys: []ExposureKey{keyA, keyB, keyA}}},
+		{
+			name: "other interval",
+			p:    &Publish{Keys: []ExposureKey{{Key: keyA.Key, IntervalNumber: keyA.IntervalNumber + 1, IntervalCount: 144}, keyB}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := bytes.Equal(tc.p.HashKeys(), publish.HashKeys()); got != tc.same {
+				t.Errorf("HashKeys() equal %t, want %t", got, tc.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regionPattern matches normalized regions. Regions are stored in VARCHAR(5) columns, which
+// leaves room for ISO 3166 codes like "US" and short subdivisions like "US-CA".
+var regionPattern = regexp.MustCompile(`\A[A-Z][A-Z0-9-]{1,4}\z`)
+
+// ErrInvalidRegion is wrapped by the errors of ParseRegion and NormalizeRegions.
+var ErrInvalidRegion = errors.New("invalid region")
+
+// Region is a normalized, validated region code.
+type Region string
+
+// ParseRegion trims and upper-cases s and checks that the result is a valid region: 2 to 5
+// characters, a letter followed by letters, digits or hyphens.
+func ParseRegion(s string) (Region, error) {
+	r := strings.ToUpper(strings.TrimSpace(s))
+	if !regionPattern.MatchString(r) {
+		return "", fmt.Errorf("%w %q: must be 2 to 5 letters, digits or hyphens, starting with a letter", ErrInvalidRegion, s)
+	}
+	return Region(r), nil
+}
+
+// String returns the region as stored and sent on the wire.
+func (r Region) String() string {
+	return string(r)
+}
+
+// NormalizeRegions parses each of regions and returns them in their normalized form.
+func NormalizeRegions(regions []string) ([]string, error) {
+	if regions == nil {
+		return nil, nil
+	}
+	normalized := make([]string, len(regions))
+	for i, s := range regions {
+		r, err := ParseRegion(s)
+		if err != nil {
+			return nil, err
+		}
+		normalized[i] = r.String()
+	}
+	return normalized, nil
+}
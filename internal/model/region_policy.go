@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "fmt"
+
+// RegionPolicy controls how a key published for several regions is stored.
+type RegionPolicy string
+
+const (
+	// RegionPolicyGlobal stores each key once, listing every region it was published for.
+	// An export for any of those regions includes the key. This is the default.
+	RegionPolicyGlobal RegionPolicy = "global"
+	// RegionPolicyPerRegion stores a separate copy of each key for every region it was published
+	// for, so an export spanning several of those regions includes the key once per region.
+	RegionPolicyPerRegion RegionPolicy = "per-region"
+)
+
+// ParseRegionPolicy parses a region policy name. An empty name selects RegionPolicyGlobal.
+func ParseRegionPolicy(name string) (RegionPolicy, error) {
+	switch p := RegionPolicy(name); p {
+	case "":
+		return RegionPolicyGlobal, nil
+	case RegionPolicyGlobal, RegionPolicyPerRegion:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown region policy %q, must be %q or %q", name, RegionPolicyGlobal, RegionPolicyPerRegion)
+	}
+}
+
+// Apply returns the rows to store for infections under the policy. Infections are not
+// modified; under RegionPolicyPerRegion each one is copied once per region, with RegionCopy set
+// to that region, and infections without regions are stored as they are.
+func (p RegionPolicy) Apply(infections []*Infection) []*Infection {
+	if p != RegionPolicyPerRegion {
+		return infections
+	}
+	rows := make([]*Infection, 0, len(infections))
+	for _, inf := range infections {
+		if len(inf.Regions) == 0 {
+			rows = append(rows, inf)
+			continue
+		}
+		for _, region := range inf.Regions {
+			row := *inf
+			row.Regions = []string{region}
+			row.RegionCopy = region
+			rows = append(rows, &row)
+		}
+	}
+	return rows
+}
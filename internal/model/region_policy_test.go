@@ -0,0 +1,99 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRegionPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    RegionPolicy
+		wantErr bool
+	}{
+		{name: "", want: RegionPolicyGlobal},
+		{name: "global", want: RegionPolicyGlobal},
+		{name: "per-region", want: RegionPolicyPerRegion},
+		{name: "PER-REGION", wantErr: true},
+		{name: "regional", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseRegionPolicy(tc.name)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseRegionPolicy(%q) returned error %v, want error %v", tc.name, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseRegionPolicy(%q) = %q, want %q", tc.name, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegionPolicyApply(t *testing.T) {
+	batchTime := time.Date(2020, 3, 1, 10, 43, 1, 0, time.UTC)
+	createdAt := TruncateWindow(batchTime)
+	intervalNumber := IntervalNumber(batchTime.Add(-24 * time.Hour))
+	source := &Publish{
+		Keys: []ExposureKey{
+			{Key: base64.StdEncoding.EncodeToString([]byte("ABC")), IntervalNumber: intervalNumber, IntervalCount: 144},
+		},
+		Regions:          []string{"us", "ca"},
+		AppPackageName:   "com.google",
+		TransmissionRisk: 5,
+	}
+	row := func(copy string, regions ...string) *Infection {
+		return &Infection{
+			ExposureKey:      []byte("ABC"),
+			TransmissionRisk: 5,
+			AppPackageName:   "com.google",
+			Regions:          regions,
+			IntervalNumber:   intervalNumber,
+			IntervalCount:    144,
+			CreatedAt:        createdAt,
+			LocalProvenance:  true,
+			RegionCopy:       copy,
+		}
+	}
+
+	testCases := []struct {
+		policy RegionPolicy
+		want   []*Infection
+	}{
+		{policy: RegionPolicyGlobal, want: []*Infection{row("", "US", "CA")}},
+		{policy: RegionPolicyPerRegion, want: []*Infection{row("US", "US"), row("CA", "CA")}},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			infections, err := TransformPublish(source, batchTime, 0)
+			if err != nil {
+				t.Fatalf("TransformPublish returned unexpected error: %v", err)
+			}
+			got := tc.policy.Apply(infections)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Apply mismatch (-want +got):\n%v", diff)
+			}
+			// The transformed infections must be left untouched.
+			if diff := cmp.Diff([]string{"US", "CA"}, infections[0].Regions); diff != "" {
+				t.Errorf("Apply modified its input (-want +got):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRegion(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    Region
+		wantErr bool
+	}{
+		{input: "US", want: "US"},
+		{input: "us", want: "US"},
+		{input: " cA ", want: "CA"},
+		{input: "us-ca", want: "US-CA"},
+		{input: "GB1", want: "GB1"},
+		{input: "", wantErr: true},
+		{input: "U", wantErr: true},
+		{input: "USA-CA", wantErr: true},
+		{input: "1US", wantErr: true},
+		{input: "U S", wantErr: true},
+		{input: "US,CA", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseRegion(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParseRegion(%q) = %q, want error", tc.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRegion(%q) returned unexpected error: %v", tc.input, err)
+			}
+			if got != tc.want || got.String() != string(tc.want) {
+				t.Errorf("ParseRegion(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeRegions(t *testing.T) {
+	got, err := NormalizeRegions([]string{"us", "Ca", "MX"})
+	if err != nil {
+		t.Fatalf("NormalizeRegions returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"US", "CA", "MX"}, got); diff != "" {
+		t.Errorf("NormalizeRegions mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := NormalizeRegions([]string{"US", "invalid region"}); err == nil {
+		t.Errorf("NormalizeRegions with an invalid region returned no error")
+	}
+	if got, err := NormalizeRegions(nil); got != nil || err != nil {
+		t.Errorf("NormalizeRegions(nil) = %v, %v, want nil, nil", got, err)
+	}
+}
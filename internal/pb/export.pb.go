@@ -129,6 +129,193 @@ func (x *ExposureKeyExport) GetBatchSize() int32 {
 	return 0
 }
 
+// TEKSignatureList is the contents of the export.sig member of an export
+// zip. It holds one signature of the export.bin member per signing key.
+type TEKSignatureList struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Signatures []*TEKSignature `protobuf:"bytes,1,rep,name=signatures,proto3" json:"signatures,omitempty"`
+}
+
+func (x *TEKSignatureList) Reset() {
+	*x = TEKSignatureList{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_pb_export_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TEKSignatureList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TEKSignatureList) ProtoMessage() {}
+
+func (x *TEKSignatureList) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_pb_export_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TEKSignatureList.ProtoReflect.Descriptor instead.
+func (*TEKSignatureList) Descriptor() ([]byte, []int) {
+	return file_internal_pb_export_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TEKSignatureList) GetSignatures() []*TEKSignature {
+	if x != nil {
+		return x.Signatures
+	}
+	return nil
+}
+
+type TEKSignature struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	SignatureInfo *SignatureInfo `protobuf:"bytes,1,opt,name=signatureInfo,proto3" json:"signatureInfo,omitempty"`
+	// E.g., Batch 2 of 10
+	BatchNum  int32 `protobuf:"varint,2,opt,name=batchNum,proto3" json:"batchNum,omitempty"`
+	BatchSize int32 `protobuf:"varint,3,opt,name=batchSize,proto3" json:"batchSize,omitempty"`
+	// ASN.1 DER encoded ECDSA P-256 signature of the SHA-256 digest of export.bin
+	Signature []byte `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+}
+
+func (x *TEKSignature) Reset() {
+	*x = TEKSignature{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_pb_export_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TEKSignature) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TEKSignature) ProtoMessage() {}
+
+func (x *TEKSignature) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_pb_export_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TEKSignature.ProtoReflect.Descriptor instead.
+func (*TEKSignature) Descriptor() ([]byte, []int) {
+	return file_internal_pb_export_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TEKSignature) GetSignatureInfo() *SignatureInfo {
+	if x != nil {
+		return x.SignatureInfo
+	}
+	return nil
+}
+
+func (x *TEKSignature) GetBatchNum() int32 {
+	if x != nil {
+		return x.BatchNum
+	}
+	return 0
+}
+
+func (x *TEKSignature) GetBatchSize() int32 {
+	if x != nil {
+		return x.BatchSize
+	}
+	return 0
+}
+
+func (x *TEKSignature) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+type SignatureInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Identify the key used to verify the signature
+	VerificationKeyVersion string `protobuf:"bytes,3,opt,name=verificationKeyVersion,proto3" json:"verificationKeyVersion,omitempty"`
+	VerificationKeyId      string `protobuf:"bytes,4,opt,name=verificationKeyId,proto3" json:"verificationKeyId,omitempty"`
+	// ASN.1 OID of the signature algorithm, e.g. 1.2.840.10045.4.3.2 for ECDSA with SHA-256
+	SignatureAlgorithm string `protobuf:"bytes,5,opt,name=signatureAlgorithm,proto3" json:"signatureAlgorithm,omitempty"`
+}
+
+func (x *SignatureInfo) Reset() {
+	*x = SignatureInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_pb_export_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SignatureInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignatureInfo) ProtoMessage() {}
+
+func (x *SignatureInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_pb_export_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignatureInfo.ProtoReflect.Descriptor instead.
+func (*SignatureInfo) Descriptor() ([]byte, []int) {
+	return file_internal_pb_export_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SignatureInfo) GetVerificationKeyVersion() string {
+	if x != nil {
+		return x.VerificationKeyVersion
+	}
+	return ""
+}
+
+func (x *SignatureInfo) GetVerificationKeyId() string {
+	if x != nil {
+		return x.VerificationKeyId
+	}
+	return ""
+}
+
+func (x *SignatureInfo) GetSignatureAlgorithm() string {
+	if x != nil {
+		return x.SignatureAlgorithm
+	}
+	return ""
+}
+
 type ExposureKeyExport_ExposureKey struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -144,12 +331,21 @@ type ExposureKeyExport_ExposureKey struct {
 	IntervalCount  int32 `protobuf:"varint,3,opt,name=intervalCount,proto3" json:"intervalCount,omitempty"`
 	// Stems from the uploaded verification source
 	TransmissionRisk int32 `protobuf:"varint,4,opt,name=transmissionRisk,proto3" json:"transmissionRisk,omitempty"`
+	// How the diagnosis behind the key was established. Only set
+	// from export format version 2.
+	ReportType int32 `protobuf:"varint,5,opt,name=reportType,proto3" json:"reportType,omitempty"`
+	// Days between the start of the key's interval and the onset of
+	// symptoms, if known. Only set from export format version 3.
+	//
+	// Types that are assignable to SymptomOnset:
+	//	*ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms
+	SymptomOnset isExposureKeyExport_ExposureKey_SymptomOnset `protobuf_oneof:"symptomOnset"`
 }
 
 func (x *ExposureKeyExport_ExposureKey) Reset() {
 	*x = ExposureKeyExport_ExposureKey{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_pb_export_proto_msgTypes[1]
+		mi := &file_internal_pb_export_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -162,7 +358,7 @@ func (x *ExposureKeyExport_ExposureKey) String() string {
 func (*ExposureKeyExport_ExposureKey) ProtoMessage() {}
 
 func (x *ExposureKeyExport_ExposureKey) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_pb_export_proto_msgTypes[1]
+	mi := &file_internal_pb_export_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -206,11 +402,43 @@ func (x *ExposureKeyExport_ExposureKey) GetTransmissionRisk() int32 {
 	return 0
 }
 
+func (x *ExposureKeyExport_ExposureKey) GetReportType() int32 {
+	if x != nil {
+		return x.ReportType
+	}
+	return 0
+}
+
+func (m *ExposureKeyExport_ExposureKey) GetSymptomOnset() isExposureKeyExport_ExposureKey_SymptomOnset {
+	if m != nil {
+		return m.SymptomOnset
+	}
+	return nil
+}
+
+func (x *ExposureKeyExport_ExposureKey) GetDaysSinceOnsetOfSymptoms() int32 {
+	if x, ok := x.GetSymptomOnset().(*ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms); ok {
+		return x.DaysSinceOnsetOfSymptoms
+	}
+	return 0
+}
+
+type isExposureKeyExport_ExposureKey_SymptomOnset interface {
+	isExposureKeyExport_ExposureKey_SymptomOnset()
+}
+
+type ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms struct {
+	DaysSinceOnsetOfSymptoms int32 `protobuf:"zigzag32,6,opt,name=daysSinceOnsetOfSymptoms,proto3,oneof"`
+}
+
+func (*ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms) isExposureKeyExport_ExposureKey_SymptomOnset() {
+}
+
 var File_internal_pb_export_proto protoreflect.FileDescriptor
 
 var file_internal_pb_export_proto_rawDesc = []byte{
 	0x0a, 0x18, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x62, 0x2f, 0x65, 0x78,
-	0x70, 0x6f, 0x72, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x91, 0x03, 0x0a, 0x11, 0x45,
+	0x70, 0x6f, 0x72, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xff, 0x03, 0x0a, 0x11, 0x45,
 	0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x72, 0x74,
 	0x12, 0x26, 0x0a, 0x0e, 0x73, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
 	0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x73, 0x74, 0x61, 0x72, 0x74, 0x54,
@@ -225,7 +453,7 @@ var file_internal_pb_export_proto_rawDesc = []byte{
 	0x68, 0x4e, 0x75, 0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x62, 0x61, 0x74, 0x63,
 	0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a,
 	0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69,
-	0x7a, 0x65, 0x1a, 0xa9, 0x01, 0x0a, 0x0b, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b,
+	0x7a, 0x65, 0x1a, 0x97, 0x02, 0x0a, 0x0b, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b,
 	0x65, 0x79, 0x12, 0x20, 0x0a, 0x0b, 0x65, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65,
 	0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x65, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72,
 	0x65, 0x4b, 0x65, 0x79, 0x12, 0x26, 0x0a, 0x0e, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c,
@@ -235,9 +463,40 @@ var file_internal_pb_export_proto_rawDesc = []byte{
 	0x01, 0x28, 0x05, 0x52, 0x0d, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x43, 0x6f, 0x75,
 	0x6e, 0x74, 0x12, 0x2a, 0x0a, 0x10, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x6d, 0x69, 0x73, 0x73, 0x69,
 	0x6f, 0x6e, 0x52, 0x69, 0x73, 0x6b, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x10, 0x74, 0x72,
-	0x61, 0x6e, 0x73, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x69, 0x73, 0x6b, 0x42, 0x10,
-	0x5a, 0x0e, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x62, 0x3b, 0x70, 0x62,
-	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x61, 0x6e, 0x73, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x69, 0x73, 0x6b, 0x12, 0x1e,
+	0x0a, 0x0a, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x3c,
+	0x0a, 0x18, 0x64, 0x61, 0x79, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x4f, 0x6e, 0x73, 0x65, 0x74,
+	0x4f, 0x66, 0x53, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x11,
+	0x48, 0x00, 0x52, 0x18, 0x64, 0x61, 0x79, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x4f, 0x6e, 0x73,
+	0x65, 0x74, 0x4f, 0x66, 0x53, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x42, 0x0e, 0x0a, 0x0c,
+	0x73, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x4f, 0x6e, 0x73, 0x65, 0x74, 0x22, 0x41, 0x0a, 0x10,
+	0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x4c, 0x69, 0x73, 0x74,
+	0x12, 0x2d, 0x0a, 0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x52, 0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22,
+	0x9c, 0x01, 0x0a, 0x0c, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65,
+	0x12, 0x34, 0x0a, 0x0d, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66,
+	0x6f, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0d, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1a, 0x0a, 0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e,
+	0x75, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e,
+	0x75, 0x6d, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65,
+	0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x22, 0xa5,
+	0x01, 0x0a, 0x0d, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f,
+	0x12, 0x36, 0x0a, 0x16, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x4b, 0x65, 0x79, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x16, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65,
+	0x79, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2c, 0x0a, 0x11, 0x76, 0x65, 0x72, 0x69,
+	0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x49, 0x64, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x11, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x4b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x2e, 0x0a, 0x12, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x41, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x12, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x41, 0x6c, 0x67,
+	0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x42, 0x10, 0x5a, 0x0e, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e,
+	0x61, 0x6c, 0x2f, 0x70, 0x62, 0x3b, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -252,18 +511,23 @@ func file_internal_pb_export_proto_rawDescGZIP() []byte {
 	return file_internal_pb_export_proto_rawDescData
 }
 
-var file_internal_pb_export_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_internal_pb_export_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_internal_pb_export_proto_goTypes = []interface{}{
 	(*ExposureKeyExport)(nil),             // 0: ExposureKeyExport
-	(*ExposureKeyExport_ExposureKey)(nil), // 1: ExposureKeyExport.ExposureKey
+	(*TEKSignatureList)(nil),              // 1: TEKSignatureList
+	(*TEKSignature)(nil),                  // 2: TEKSignature
+	(*SignatureInfo)(nil),                 // 3: SignatureInfo
+	(*ExposureKeyExport_ExposureKey)(nil), // 4: ExposureKeyExport.ExposureKey
 }
 var file_internal_pb_export_proto_depIdxs = []int32{
-	1, // 0: ExposureKeyExport.keys:type_name -> ExposureKeyExport.ExposureKey
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	4, // 0: ExposureKeyExport.keys:type_name -> ExposureKeyExport.ExposureKey
+	2, // 1: TEKSignatureList.signatures:type_name -> TEKSignature
+	3, // 2: TEKSignature.signatureInfo:type_name -> SignatureInfo
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_internal_pb_export_proto_init() }
@@ -285,6 +549,42 @@ func file_internal_pb_export_proto_init() {
 			}
 		}
 		file_internal_pb_export_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TEKSignatureList); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_pb_export_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TEKSignature); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_pb_export_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SignatureInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_pb_export_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*ExposureKeyExport_ExposureKey); i {
 			case 0:
 				return &v.state
@@ -297,13 +597,16 @@ func file_internal_pb_export_proto_init() {
 			}
 		}
 	}
+	file_internal_pb_export_proto_msgTypes[4].OneofWrappers = []interface{}{
+		(*ExposureKeyExport_ExposureKey_DaysSinceOnsetOfSymptoms)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_internal_pb_export_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -17,7 +17,12 @@ package serverenv
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/logging"
 )
@@ -25,15 +30,58 @@ import (
 const (
 	portEnvVar  = "PORT"
 	defaultPort = "8080"
+
+	shutdownTimeoutEnvVar  = "SHUTDOWN_TIMEOUT"
+	defaultShutdownTimeout = 10 * time.Second
+
+	readTimeoutEnvVar       = "HTTP_READ_TIMEOUT"
+	readHeaderTimeoutEnvVar = "HTTP_READ_HEADER_TIMEOUT"
+	writeTimeoutEnvVar      = "HTTP_WRITE_TIMEOUT"
+	idleTimeoutEnvVar       = "HTTP_IDLE_TIMEOUT"
+
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	// The write timeout bounds the whole handler, so it must outlast the longest request, such
+	// as creating the files of an export batch.
+	defaultWriteTimeout = 20 * time.Minute
+	defaultIdleTimeout  = 2 * time.Minute
 )
 
+// HTTPTimeouts are the timeouts applied to the servers built by HTTPServer.
+type HTTPTimeouts struct {
+	Read       time.Duration
+	ReadHeader time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// CloseFn releases a resource when the server shuts down.
+type CloseFn func(ctx context.Context) error
+
+type closer struct {
+	name string
+	fn   CloseFn
+}
+
 type ServerEnv struct {
-	port string
+	port            string
+	shutdownTimeout time.Duration
+	httpTimeouts    HTTPTimeouts
+
+	mu      sync.Mutex
+	closers []closer
 }
 
 func New(ctx context.Context) *ServerEnv {
 	env := &ServerEnv{
-		port: defaultPort,
+		port:            defaultPort,
+		shutdownTimeout: defaultShutdownTimeout,
+		httpTimeouts: HTTPTimeouts{
+			Read:       defaultReadTimeout,
+			ReadHeader: defaultReadHeaderTimeout,
+			Write:      defaultWriteTimeout,
+			Idle:       defaultIdleTimeout,
+		},
 	}
 
 	logger := logging.FromContext(ctx)
@@ -43,9 +91,101 @@ func New(ctx context.Context) *ServerEnv {
 	}
 	logger.Info("using port %v (override with $%v)", env.port, portEnvVar)
 
+	if override := os.Getenv(shutdownTimeoutEnvVar); override != "" {
+		if d, err := time.ParseDuration(override); err != nil {
+			logger.Warnf("Failed to parse $%s value %q, using default.", shutdownTimeoutEnvVar, override)
+		} else {
+			env.shutdownTimeout = d
+		}
+	}
+
+	for _, t := range []struct {
+		name string
+		env  string
+		val  *time.Duration
+	}{
+		{"read", readTimeoutEnvVar, &env.httpTimeouts.Read},
+		{"read header", readHeaderTimeoutEnvVar, &env.httpTimeouts.ReadHeader},
+		{"write", writeTimeoutEnvVar, &env.httpTimeouts.Write},
+		{"idle", idleTimeoutEnvVar, &env.httpTimeouts.Idle},
+	} {
+		if override := os.Getenv(t.env); override != "" {
+			if d, err := time.ParseDuration(override); err != nil || d <= 0 {
+				logger.Warnf("Failed to parse $%s value %q, using default.", t.env, override)
+			} else {
+				*t.val = d
+			}
+		}
+		logger.Infof("Using HTTP %s timeout %v (override with $%s)", t.name, *t.val, t.env)
+	}
+
 	return env
 }
 
 func (s *ServerEnv) Port() string {
 	return s.port
 }
+
+// HTTPTimeouts returns the timeouts applied by HTTPServer.
+func (s *ServerEnv) HTTPTimeouts() HTTPTimeouts {
+	return s.httpTimeouts
+}
+
+// HTTPServer returns a server for handler listening on Port, with the configured timeouts. A nil
+// handler serves http.DefaultServeMux.
+func (s *ServerEnv) HTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%v", s.port),
+		Handler:           handler,
+		ReadTimeout:       s.httpTimeouts.Read,
+		ReadHeaderTimeout: s.httpTimeouts.ReadHeader,
+		WriteTimeout:      s.httpTimeouts.Write,
+		IdleTimeout:       s.httpTimeouts.Idle,
+	}
+}
+
+// RegisterCloser adds a resource to be released by Shutdown. Resources are released in the reverse
+// order of registration, so register dependencies (e.g. the database) before their users (e.g. the
+// HTTP server).
+func (s *ServerEnv) RegisterCloser(name string, fn CloseFn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, closer{name: name, fn: fn})
+}
+
+// Shutdown releases all registered resources in reverse registration order, bounded by the shutdown
+// timeout. Every closer is invoked even if an earlier one fails; all failures are returned together.
+func (s *ServerEnv) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.shutdownTimeout)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+
+	var errs ShutdownError
+	for i := len(closers) - 1; i >= 0; i-- {
+		c := closers[i]
+		logger.Infof("Closing %s.", c.name)
+		if err := c.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %v", c.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ShutdownError holds the errors returned by the closers invoked during Shutdown.
+type ShutdownError []error
+
+func (e ShutdownError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
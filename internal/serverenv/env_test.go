@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverenv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestShutdown tests that closers run in reverse registration order and their errors aggregate.
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	env := New(ctx)
+
+	var order []string
+	register := func(name string, err error) {
+		env.RegisterCloser(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return err
+		})
+	}
+	register("database", errors.New("db failed"))
+	register("storage", nil)
+	register("http server", errors.New("server failed"))
+
+	err := env.Shutdown(ctx)
+
+	if diff := cmp.Diff([]string{"http server", "storage", "database"}, order); diff != "" {
+		t.Errorf("close order mismatch (-want +got):\n%s", diff)
+	}
+	var shutdownErr ShutdownError
+	if !errors.As(err, &shutdownErr) {
+		t.Fatalf("Shutdown got err %v, want ShutdownError", err)
+	}
+	if len(shutdownErr) != 2 {
+		t.Errorf("Shutdown got %d errors, want 2: %v", len(shutdownErr), err)
+	}
+	if want := "closing http server: server failed; closing database: db failed"; err.Error() != want {
+		t.Errorf("Shutdown got err %q, want %q", err.Error(), want)
+	}
+
+	// Closers only run once.
+	order = nil
+	if err := env.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown got err %v, want nil", err)
+	}
+	if len(order) != 0 {
+		t.Errorf("second Shutdown ran closers %v, want none", order)
+	}
+}
+
+// TestShutdownTimeout tests that closers are given a context bounded by the shutdown timeout.
+func TestShutdownTimeout(t *testing.T) {
+	ctx := context.Background()
+	env := New(ctx)
+	env.shutdownTimeout = 10 * time.Millisecond
+
+	env.RegisterCloser("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if err := env.Shutdown(ctx); err == nil {
+		t.Errorf("Shutdown got err nil, want deadline exceeded")
+	}
+}
+
+// TestHTTPServer tests that the server is built with the timeouts from the environment.
+func TestHTTPServer(t *testing.T) {
+	for k, v := range map[string]string{
+		portEnvVar:              "9090",
+		readTimeoutEnvVar:       "5s",
+		readHeaderTimeoutEnvVar: "2s",
+		writeTimeoutEnvVar:      "1m",
+		idleTimeoutEnvVar:       "invalid",
+	} {
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Setenv(k, v)
+	}
+
+	srv := New(context.Background()).HTTPServer(nil)
+
+	want := HTTPTimeouts{
+		Read:       5 * time.Second,
+		ReadHeader: 2 * time.Second,
+		Write:      time.Minute,
+		Idle:       defaultIdleTimeout,
+	}
+	got := HTTPTimeouts{
+		Read:       srv.ReadTimeout,
+		ReadHeader: srv.ReadHeaderTimeout,
+		Write:      srv.WriteTimeout,
+		Idle:       srv.IdleTimeout,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("server timeouts mismatch (-want +got):\n%s", diff)
+	}
+	if srv.Addr != ":9090" {
+		t.Errorf("server addr got %q, want %q", srv.Addr, ":9090")
+	}
+}
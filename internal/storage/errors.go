@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorClass is the kind of a storage failure, which decides how the operation is retried.
+type ErrorClass string
+
+const (
+	// ErrorUnknown is a failure of none of the other classes.
+	ErrorUnknown ErrorClass = "unknown"
+	// ErrorTransient is a failure expected to clear by itself, such as a timeout, throttling or a
+	// server error, and worth retrying straight away.
+	ErrorTransient ErrorClass = "transient"
+	// ErrorQuota is a failure because a quota of the project or bucket is exhausted. Retrying
+	// fails until the quota resets or is raised.
+	ErrorQuota ErrorClass = "quota_exceeded"
+	// ErrorPermission is a failure because the caller may not write to the bucket or object.
+	// Retrying fails until an operator grants the permission.
+	ErrorPermission ErrorClass = "permission_denied"
+)
+
+// quotaReasons are the reasons of the Cloud Storage API errors reporting an exhausted quota,
+// as opposed to throttling, which is reported as rateLimitExceeded.
+var quotaReasons = map[string]bool{
+	"quotaExceeded":      true,
+	"dailyLimitExceeded": true,
+}
+
+// Classify returns the class of err, an error returned by the functions of this package.
+func Classify(err error) ErrorClass {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, item := range apiErr.Errors {
+			if quotaReasons[item.Reason] {
+				return ErrorQuota
+			}
+		}
+		switch {
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			return ErrorPermission
+		case apiErr.Code == http.StatusRequestTimeout || apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+			return ErrorTransient
+		}
+		return ErrorUnknown
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTransient
+	}
+	return ErrorUnknown
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	apiError := func(code int, reasons ...string) error {
+		e := &googleapi.Error{Code: code, Message: http.StatusText(code)}
+		for _, r := range reasons {
+			e.Errors = append(e.Errors, googleapi.ErrorItem{Reason: r})
+		}
+		// As returned by CreateObject.
+		return fmt.Errorf("storage.Writer.Close: %w", e)
+	}
+
+	testCases := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "quota exceeded", err: apiError(http.StatusForbidden, "quotaExceeded"), want: ErrorQuota},
+		{name: "daily limit exceeded", err: apiError(http.StatusTooManyRequests, "dailyLimitExceeded"), want: ErrorQuota},
+		{name: "forbidden", err: apiError(http.StatusForbidden, "forbidden"), want: ErrorPermission},
+		{name: "unauthorized", err: apiError(http.StatusUnauthorized), want: ErrorPermission},
+		{name: "rate limited", err: apiError(http.StatusTooManyRequests, "rateLimitExceeded"), want: ErrorTransient},
+		{name: "server error", err: apiError(http.StatusServiceUnavailable, "backendError"), want: ErrorTransient},
+		{name: "request timeout", err: apiError(http.StatusRequestTimeout), want: ErrorTransient},
+		{name: "not found", err: apiError(http.StatusNotFound, "notFound"), want: ErrorUnknown},
+		{name: "deadline exceeded", err: fmt.Errorf("io.Copy: %w", context.DeadlineExceeded), want: ErrorTransient},
+		{name: "network timeout", err: fmt.Errorf("io.Copy: %w", timeoutError{}), want: ErrorTransient},
+		{name: "other", err: errors.New("storage.NewClient: no credentials"), want: ErrorUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Classify(tc.err); got != tc.want {
+				t.Errorf("Classify(%v) = %q, want %q", tc.err, got, tc.want)
+			}
+		})
+	}
+}
@@ -37,14 +37,38 @@ func CreateObject(ctx context.Context, bucket, objectName string, contents []byt
 	wc := client.Bucket(bucket).Object(objectName).NewWriter(ctx)
 	r := bytes.NewReader(contents)
 	if _, err = io.Copy(wc, r); err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+		return fmt.Errorf("io.Copy: %w", err)
 	}
 	if err := wc.Close(); err != nil {
-		return fmt.Errorf("storage.Writer.Close: %v", err)
+		return fmt.Errorf("storage.Writer.Close: %w", err)
 	}
 	return nil
 }
 
+// ReadObject returns the contents of a cloud storage object
+func ReadObject(ctx context.Context, bucket, objectName string) ([]byte, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	rc, err := client.Bucket(bucket).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewReader: %w", err)
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		return nil, fmt.Errorf("io.Copy: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 // DeleteObject deletes a cloud storage object
 func DeleteObject(ctx context.Context, bucket, objectName string) error {
 	client, err := storage.NewClient(ctx)
@@ -58,7 +82,7 @@ func DeleteObject(ctx context.Context, bucket, objectName string) error {
 
 	err = client.Bucket(bucket).Object(objectName).Delete(ctx)
 	if err != nil {
-		return fmt.Errorf("storage.DeleteObject: %v", err)
+		return fmt.Errorf("storage.DeleteObject: %w", err)
 	}
 	return nil
 }
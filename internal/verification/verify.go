@@ -16,8 +16,11 @@ package verification
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/android"
@@ -25,10 +28,102 @@ import (
 	"github.com/googlepartners/exposure-notifications/internal/model"
 )
 
+const (
+	// forceSafetyNetEnvVar, if set, disables BypassSafetynet on every APIConfig.
+	forceSafetyNetEnvVar = "FORCE_SAFETYNET"
+
+	// maxClockSkewEnvVar bounds the clock skew allowed by every APIConfig; 0 removes the bound.
+	maxClockSkewEnvVar  = "MAX_CLOCK_SKEW"
+	defaultMaxClockSkew = time.Hour
+
+	// maxAttestationSizeEnvVar sets the longest attestation accepted, in bytes; see
+	// android.DefaultMaxAttestationSize.
+	maxAttestationSizeEnvVar = "MAX_ATTESTATION_SIZE"
+
+	// allowUnknownAppsEnvVar, if set, lets applications without an APIConfig publish.
+	// For development servers only.
+	allowUnknownAppsEnvVar = "DEV_ALLOW_UNKNOWN_APPS"
+
+	// devSkipSafetyNetEnvVar, if true, skips attestation verification for every publish,
+	// regardless of BypassSafetynet. For local development and integration tests only.
+	devSkipSafetyNetEnvVar = "DEV_SKIP_SAFETYNET"
+)
+
+var (
+	// ErrUnknownApplication is returned when no APIConfig matches the publishing application.
+	ErrUnknownApplication = errors.New("unknown application")
+	// ErrUnauthorizedRegion is returned when an application publishes for a region it may not.
+	ErrUnauthorizedRegion = errors.New("unauthorized region")
+	// ErrDeclaredRegion is returned when a publish is for a region other than the one its
+	// attestation declares, or the attestation declares none.
+	ErrDeclaredRegion = errors.New("publish regions do not match the declared region")
+)
+
+// Reasons a publish is rejected, as returned by RejectionReason.
+const (
+	ReasonUnknownApp      = "unknown_app"
+	ReasonRegion          = "region"
+	ReasonNonce           = "nonce"
+	ReasonAttestationTime = "attestation_time"
+	ReasonIntegrity       = "integrity"
+	ReasonAttestation     = "attestation"
+	ReasonOther           = "other"
+)
+
+// RejectionReason classifies an error returned by AppConfig, VerifyRegions or VerifySafetyNet.
+func RejectionReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownApplication):
+		return ReasonUnknownApp
+	case errors.Is(err, ErrUnauthorizedRegion), errors.Is(err, ErrDeclaredRegion):
+		return ReasonRegion
+	case errors.Is(err, android.ErrNonceMismatch):
+		return ReasonNonce
+	case errors.Is(err, android.ErrAttestationTime), errors.Is(err, android.ErrCertificateExpired):
+		return ReasonAttestationTime
+	case errors.Is(err, android.ErrIntegrity):
+		return ReasonIntegrity
+	case errors.Is(err, android.ErrMalformedAttestation), errors.Is(err, android.ErrInvalidCertificateChain), errors.Is(err, android.ErrInvalidSignature),
+		errors.Is(err, android.ErrAttestationTooLarge):
+		return ReasonAttestation
+	default:
+		return ReasonOther
+	}
+}
+
+// RegionError is returned by VerifyRegions when an application publishes for regions it may not.
+// It wraps ErrUnauthorizedRegion.
+type RegionError struct {
+	AppPackageName string
+	// Regions are the unauthorized regions, as published.
+	Regions []string
+}
+
+func (e *RegionError) Error() string {
+	return fmt.Sprintf("application '%v' tried to write unauthorized region: '%v'", e.AppPackageName, strings.Join(e.Regions, "', '"))
+}
+
+func (e *RegionError) Unwrap() error { return ErrUnauthorizedRegion }
+
 var (
 	// Is safetynet being enforced on this server.
 	// TODO(mikehelmick): Remove after client verification.
 	enforce = true
+
+	// Is the per-config safetynet bypass ignored on this server.
+	forbidBypass = false
+
+	// The largest clock skew allowed for attestations, regardless of config.
+	maxClockSkew = defaultMaxClockSkew
+
+	// The longest attestation accepted, or zero for android.DefaultMaxAttestationSize.
+	maxAttestationSize = 0
+
+	// Are applications without an APIConfig allowed to publish.
+	allowUnknownApps = false
+
+	// Is attestation verification skipped for every publish, in development.
+	skipSafetyNet = false
 )
 
 func init() {
@@ -38,6 +133,85 @@ func init() {
 		logger.Errorf("SafetyNet verification disabled, to enable unset the DISABLE_SAFETYNET environment variable")
 		enforce = false
 	}
+	if os.Getenv(forceSafetyNetEnvVar) != "" {
+		logger := logging.FromContext(context.Background())
+		logger.Warnf("SafetyNet bypass disabled for all applications, to allow it unset the %s environment variable", forceSafetyNetEnvVar)
+		forbidBypass = true
+	}
+	if v := os.Getenv(maxClockSkewEnvVar); v != "" {
+		logger := logging.FromContext(context.Background())
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			logger.Warnf("Failed to parse $%s value %q, using default.", maxClockSkewEnvVar, v)
+		} else {
+			maxClockSkew = d
+		}
+	}
+	if v := os.Getenv(maxAttestationSizeEnvVar); v != "" {
+		logger := logging.FromContext(context.Background())
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			logger.Warnf("Failed to parse $%s value %q, using default.", maxAttestationSizeEnvVar, v)
+		} else {
+			maxAttestationSize = n
+		}
+	}
+	if os.Getenv(allowUnknownAppsEnvVar) != "" {
+		logger := logging.FromContext(context.Background())
+		logger.Errorf("Publishing allowed for unconfigured applications, to disable unset the %s environment variable", allowUnknownAppsEnvVar)
+		allowUnknownApps = true
+	}
+	skip, err := devSkipSafetyNet(os.Getenv(devSkipSafetyNetEnvVar), forbidBypass)
+	if err != nil {
+		logger := logging.FromContext(context.Background())
+		logger.Errorf("SafetyNet verification remains enabled: %v", err)
+	}
+	if skip {
+		logger := logging.FromContext(context.Background())
+		logger.Warnf("DEVELOPMENT MODE: SafetyNet attestations are not verified for any application. Never set $%s in production; to verify attestations unset it", devSkipSafetyNetEnvVar)
+		skipSafetyNet = true
+	}
+}
+
+// devSkipSafetyNet parses the value of $DEV_SKIP_SAFETYNET. Verification is only skipped for
+// an explicit true value, and never when the per-config bypass is forbidden by
+// $FORCE_SAFETYNET, which marks a production server.
+func devSkipSafetyNet(value string, forced bool) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	skip, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid $%s value %q, must be true or false", devSkipSafetyNetEnvVar, value)
+	}
+	if skip && forced {
+		return false, fmt.Errorf("$%s cannot be combined with $%s", devSkipSafetyNetEnvVar, forceSafetyNetEnvVar)
+	}
+	return skip, nil
+}
+
+// AppConfig returns the config to verify a publish from appPkg with, given cfg, the APIConfig
+// loaded for it or nil. Without a config the publish is rejected with ErrUnknownApplication,
+// unless the server allows unknown applications, in which case a permissive config is returned
+// that authorizes all regions and bypasses safetynet.
+func AppConfig(ctx context.Context, cfg *model.APIConfig, appPkg string) (*model.APIConfig, error) {
+	if cfg != nil {
+		return cfg, nil
+	}
+	if !allowUnknownApps {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownApplication, appPkg)
+	}
+	logger := logging.FromContext(ctx)
+	logger.Warnf("processing publish for unconfigured app: '%v', allowed by $%s", appPkg, allowUnknownAppsEnvVar)
+	return &model.APIConfig{
+		AppPackageName:  appPkg,
+		AllowAllRegions: true,
+		BypassSafetynet: true,
+	}, nil
+}
+
+// bypassSafetyNet reports whether safetynet failures are ignored for cfg.
+// The server wide override wins over the config.
+func bypassSafetyNet(cfg *model.APIConfig) bool {
+	return cfg.BypassSafetynet && !forbidBypass
 }
 
 func VerifyRegions(cfg *model.APIConfig, data model.Publish) error {
@@ -45,22 +219,29 @@ func VerifyRegions(cfg *model.APIConfig, data model.Publish) error {
 		return fmt.Errorf("no allowed regions configured")
 	}
 
-	if cfg.AllowAllRegions {
+	if cfg.AuthorizesAll(data.Regions) {
+		// no error - application didn't try to write for regions that it isn't allowed
 		return nil
 	}
 
+	var unauthorized []string
 	for _, r := range data.Regions {
-		if v, ok := cfg.AllowedRegions[r]; !ok || !v {
-			return fmt.Errorf("application '%v' tried to write unauthorized region: '%v'", cfg.AppPackageName, r)
+		if !cfg.AuthorizesRegion(r) {
+			unauthorized = append(unauthorized, r)
 		}
 	}
-
-	// no error - application didn't try to write for regions that it isn't allowed
+	if len(unauthorized) > 0 {
+		return &RegionError{AppPackageName: cfg.AppPackageName, Regions: unauthorized}
+	}
 	return nil
 }
 
 func VerifySafetyNet(ctx context.Context, requestTime time.Time, cfg *model.APIConfig, data model.Publish) error {
 	logger := logging.FromContext(ctx)
+	if skipSafetyNet {
+		logger.Warnf("skipping safetynet verification for app: '%v', development mode enabled by $%s", data.AppPackageName, devSkipSafetyNetEnvVar)
+		return nil
+	}
 	if !enforce {
 		logger.Error("skipping safetynet verification, disabled by override")
 		return nil
@@ -72,15 +253,57 @@ func VerifySafetyNet(ctx context.Context, requestTime time.Time, cfg *model.APIC
 		return fmt.Errorf("cannot enforce safetynet, no application config")
 	}
 
-	opts := cfg.VerifyOpts(requestTime.UTC())
-	err := android.ValidateAttestation(ctx, data.Verification, opts)
+	bypass := bypassSafetyNet(cfg)
+	if bypass {
+		logger.Warnf("processing publish with safetynet bypass enabled for app: '%v'", data.AppPackageName)
+	} else if cfg.BypassSafetynet {
+		logger.Warnf("safetynet bypass for app: '%v' ignored, disabled by $%s", data.AppPackageName, forceSafetyNetEnvVar)
+	}
+
+	if skew, capped := cfg.ClockSkew(maxClockSkew); capped {
+		configured := "unbounded"
+		if cfg.ClockSkewSeconds > 0 {
+			configured = (cfg.ClockSkewSeconds * time.Second).String()
+		}
+		logger.Warnf("clock skew for app: '%v' capped at %v by $%s, config allows %v", data.AppPackageName, skew, maxClockSkewEnvVar, configured)
+	}
+
+	opts := cfg.VerifyOpts(requestTime.UTC(), maxClockSkew)
+	opts.MaxAttestationSize = maxAttestationSize
+	att, err := android.VerifyAttestation(ctx, data.Verification, opts)
 	if err != nil {
-		if cfg.BypassSafetynet {
+		err = fmt.Errorf("android.VerifyAttestation: %w", err)
+	} else {
+		err = VerifyDeclaredRegion(cfg, data, att)
+	}
+	if err != nil {
+		if bypass {
 			logger.Errorf("safetynet failed, but bypass enabled for app: '%v', failure: %v", data.AppPackageName, err)
 			return nil
 		}
-		return fmt.Errorf("android.ValidateAttestation: %v", err)
+		return err
 	}
 
 	return nil
 }
+
+// VerifyDeclaredRegion checks, if cfg.VerifyDeclaredRegion is set, that att declares a region
+// and that data is for that region only. The returned error wraps ErrDeclaredRegion.
+func VerifyDeclaredRegion(cfg *model.APIConfig, data model.Publish, att *android.Attestation) error {
+	if !cfg.VerifyDeclaredRegion {
+		return nil
+	}
+	if att == nil || att.Region == "" {
+		return fmt.Errorf("%w: attestation for app '%v' has no region claim", ErrDeclaredRegion, cfg.AppPackageName)
+	}
+	declared, err := model.ParseRegion(att.Region)
+	if err != nil {
+		return fmt.Errorf("%w: attestation region claim: %v", ErrDeclaredRegion, err)
+	}
+	for _, r := range data.Regions {
+		if got, err := model.ParseRegion(r); err != nil || got != declared {
+			return fmt.Errorf("%w: app '%v' published for region '%v', attestation declares '%v'", ErrDeclaredRegion, cfg.AppPackageName, r, declared)
+		}
+	}
+	return nil
+}
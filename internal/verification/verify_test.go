@@ -15,10 +15,18 @@
 package verification
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/googlepartners/exposure-notifications/internal/android"
+	"github.com/googlepartners/exposure-notifications/internal/logging"
 	"github.com/googlepartners/exposure-notifications/internal/model"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const (
@@ -67,6 +75,11 @@ func TestVerifyRegions(t *testing.T) {
 			fmt.Sprintf("application '%v' tried to write unauthorized region: '%v'", appPkgName, "MX"),
 			usCaRegions,
 		},
+		{
+			model.Publish{Regions: []string{"MX", "US", "BR"}},
+			fmt.Sprintf("application '%v' tried to write unauthorized region: 'MX', 'BR'", appPkgName),
+			usCaRegions,
+		},
 	}
 
 	for i, c := range cases {
@@ -83,3 +96,219 @@ func TestVerifyRegions(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifySafetyNetBypass(t *testing.T) {
+	cases := []struct {
+		name         string
+		bypass       bool
+		forbidBypass bool
+		wantErr      bool
+		wantWarning  string
+	}{
+		{name: "enforced", wantErr: true},
+		{name: "bypass", bypass: true, wantWarning: "safetynet bypass enabled"},
+		{name: "bypass forbidden", bypass: true, forbidBypass: true, wantErr: true, wantWarning: "disabled by $" + forceSafetyNetEnvVar},
+		{name: "enforced and bypass forbidden", forbidBypass: true, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(old bool) { forbidBypass = old }(forbidBypass)
+			forbidBypass = c.forbidBypass
+
+			core, logs := observer.New(zapcore.WarnLevel)
+			ctx := logging.WithLogger(context.Background(), zap.New(core).Sugar())
+
+			cfg := &model.APIConfig{AppPackageName: appPkgName, BypassSafetynet: c.bypass, ClockSkewSeconds: 60}
+			// An empty attestation always fails verification.
+			err := VerifySafetyNet(ctx, time.Now(), cfg, model.Publish{AppPackageName: appPkgName})
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Errorf("VerifySafetyNet returned error %v, want error: %v", err, c.wantErr)
+			}
+
+			var warnings []string
+			for _, e := range logs.All() {
+				if e.Level == zapcore.WarnLevel {
+					warnings = append(warnings, e.Message)
+				}
+			}
+			if c.wantWarning == "" {
+				if len(warnings) != 0 {
+					t.Errorf("unexpected warnings logged: %v", warnings)
+				}
+				return
+			}
+			if logs.FilterMessageSnippet(c.wantWarning).Len() == 0 {
+				t.Errorf("no warning containing %q logged, got: %v", c.wantWarning, warnings)
+			}
+		})
+	}
+}
+
+func TestVerifySafetyNetClockSkewCap(t *testing.T) {
+	defer func(old time.Duration) { maxClockSkew = old }(maxClockSkew)
+	maxClockSkew = time.Minute
+
+	cases := []struct {
+		name        string
+		skewSeconds time.Duration
+		wantWarning bool
+	}{
+		{name: "within cap", skewSeconds: 30},
+		{name: "at cap", skewSeconds: 60},
+		{name: "above cap", skewSeconds: 3600, wantWarning: true},
+		{name: "unbounded", skewSeconds: 0, wantWarning: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			ctx := logging.WithLogger(context.Background(), zap.New(core).Sugar())
+
+			cfg := &model.APIConfig{AppPackageName: appPkgName, ClockSkewSeconds: c.skewSeconds}
+			VerifySafetyNet(ctx, time.Now(), cfg, model.Publish{AppPackageName: appPkgName})
+
+			if got := logs.FilterMessageSnippet("clock skew").Len() > 0; got != c.wantWarning {
+				t.Errorf("clock skew warning logged: %v, want %v", got, c.wantWarning)
+			}
+		})
+	}
+}
+
+func TestVerifyDeclaredRegion(t *testing.T) {
+	enabled := &model.APIConfig{AppPackageName: appPkgName, AllowAllRegions: true, VerifyDeclaredRegion: true}
+	disabled := &model.APIConfig{AppPackageName: appPkgName, AllowAllRegions: true}
+
+	cases := []struct {
+		name    string
+		cfg     *model.APIConfig
+		regions []string
+		att     *android.Attestation
+		wantErr bool
+	}{
+		{name: "match", cfg: enabled, regions: []string{"US"}, att: &android.Attestation{Region: "US"}},
+		{name: "match normalized", cfg: enabled, regions: []string{" us"}, att: &android.Attestation{Region: "us"}},
+		{name: "mismatch", cfg: enabled, regions: []string{"CA"}, att: &android.Attestation{Region: "US"}, wantErr: true},
+		{name: "one of several mismatches", cfg: enabled, regions: []string{"US", "CA"}, att: &android.Attestation{Region: "US"}, wantErr: true},
+		{name: "missing claim", cfg: enabled, regions: []string{"US"}, att: &android.Attestation{}, wantErr: true},
+		{name: "invalid claim", cfg: enabled, regions: []string{"US"}, att: &android.Attestation{Region: "not a region"}, wantErr: true},
+		{name: "no attestation", cfg: enabled, regions: []string{"US"}, wantErr: true},
+		{name: "disabled mismatch", cfg: disabled, regions: []string{"CA"}, att: &android.Attestation{Region: "US"}},
+		{name: "disabled missing claim", cfg: disabled, regions: []string{"US"}, att: &android.Attestation{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := VerifyDeclaredRegion(c.cfg, model.Publish{AppPackageName: appPkgName, Regions: c.regions}, c.att)
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Fatalf("VerifyDeclaredRegion returned error %v, want error: %v", err, c.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrDeclaredRegion) {
+					t.Errorf("VerifyDeclaredRegion returned error %v, want %v", err, ErrDeclaredRegion)
+				}
+				if got := RejectionReason(err); got != ReasonRegion {
+					t.Errorf("RejectionReason(%v) = %q, want %q", err, got, ReasonRegion)
+				}
+			}
+		})
+	}
+}
+
+func TestAppConfig(t *testing.T) {
+	configured := &model.APIConfig{AppPackageName: appPkgName}
+
+	cases := []struct {
+		name        string
+		cfg         *model.APIConfig
+		allowAll    bool
+		wantErr     error
+		wantBypass  bool
+		wantRegions bool
+	}{
+		{name: "configured", cfg: configured},
+		{name: "configured in dev mode", cfg: configured, allowAll: true},
+		{name: "missing config denied", wantErr: ErrUnknownApplication},
+		{name: "missing config allowed in dev mode", allowAll: true, wantBypass: true, wantRegions: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(old bool) { allowUnknownApps = old }(allowUnknownApps)
+			allowUnknownApps = c.allowAll
+
+			got, err := AppConfig(context.Background(), c.cfg, appPkgName)
+			if c.wantErr != nil {
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("AppConfig returned error %v, want %v", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AppConfig returned unexpected error: %v", err)
+			}
+			if c.cfg != nil {
+				if got != c.cfg {
+					t.Errorf("AppConfig returned %+v, want the loaded config", got)
+				}
+				return
+			}
+			if got.AppPackageName != appPkgName || got.BypassSafetynet != c.wantBypass || got.AuthorizesRegion("US") != c.wantRegions {
+				t.Errorf("AppConfig returned %+v, want a permissive config for %s", got, appPkgName)
+			}
+			// An unknown app is still distinct from a region rejection.
+			if err := VerifyRegions(got, model.Publish{Regions: []string{"US", "MX"}}); err != nil {
+				t.Errorf("VerifyRegions with dev mode config returned %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifySafetyNetDevSkip(t *testing.T) {
+	if skipSafetyNet {
+		t.Fatalf("safetynet verification skipped by default")
+	}
+
+	defer func(old bool) { skipSafetyNet = old }(skipSafetyNet)
+	skipSafetyNet = true
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core).Sugar())
+
+	// An empty attestation always fails verification, and the config does not allow a bypass.
+	cfg := &model.APIConfig{AppPackageName: appPkgName}
+	if err := VerifySafetyNet(ctx, time.Now(), cfg, model.Publish{AppPackageName: appPkgName}); err != nil {
+		t.Errorf("VerifySafetyNet returned error %v, want nil", err)
+	}
+	if logs.FilterMessageSnippet("development mode enabled by $"+devSkipSafetyNetEnvVar).Len() == 0 {
+		t.Errorf("no development mode warning logged")
+	}
+}
+
+func TestDevSkipSafetyNet(t *testing.T) {
+	cases := []struct {
+		value   string
+		forced  bool
+		want    bool
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "false"},
+		{value: "true", want: true},
+		{value: "TRUE", want: true},
+		{value: "yes", wantErr: true},
+		{value: "true", forced: true, wantErr: true},
+		{value: "false", forced: true},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%q forced %t", c.value, c.forced), func(t *testing.T) {
+			got, err := devSkipSafetyNet(c.value, c.forced)
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Errorf("devSkipSafetyNet returned error %v, want error: %v", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("devSkipSafetyNet = %t, want %t", got, c.want)
+			}
+		})
+	}
+}
@@ -17,7 +17,24 @@ CREATE TABLE FederationQuery (
 	server_addr VARCHAR(100) NOT NULL,
 	include_regions VARCHAR(5) [],
 	exclude_regions VARCHAR(5) [],
-	last_timestamp TIMESTAMP
+	last_timestamp TIMESTAMP,
+	region_chunk_size INT NOT NULL DEFAULT 0,
+	duplicate_policy VARCHAR(20) NOT NULL DEFAULT 'skip-duplicates',
+	last_error TEXT, -- NULL unless the most recent sync failed.
+	last_error_time TIMESTAMP,
+	sync_interval_seconds INT NOT NULL DEFAULT 0 -- 0 syncs on every scheduled invocation.
+);
+
+-- FederationQueryAudit records every change made to a FederationQuery. Rows are written in the same
+-- transaction as the change. There is no foreign key so that the history of a removed query is kept.
+CREATE TABLE FederationQueryAudit (
+	audit_id SERIAL PRIMARY KEY,
+	query_id VARCHAR(50) NOT NULL,
+	action VARCHAR(20) NOT NULL,
+	actor VARCHAR(100) NOT NULL,
+	old_value TEXT,
+	new_value TEXT,
+	changed TIMESTAMP NOT NULL
 );
 
 CREATE TABLE FederationSync (
@@ -26,21 +43,34 @@ CREATE TABLE FederationSync (
 	started TIMESTAMP NOT NULL,
 	completed TIMESTAMP,
 	insertions INT,
+	duplicates INT,
 	max_timestamp TIMESTAMP,
+	status VARCHAR(10), -- NULL while the sync is in progress.
+	cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	completed_chunks INT,
+	region_layout VARCHAR(64), -- The region layout of the query when the sync started; see FederationQuery.RegionLayout.
 	FOREIGN KEY (query_id) REFERENCES FederationQuery (query_id)
 );
 
+-- With the default "global" region policy a key is stored once, in a single row listing all its
+-- regions, and publishing it again for any set of regions is a duplicate. The "per-region" policy
+-- stores a copy of the key for each region, identified by region_copy.
 CREATE TABLE Infection (
-	exposure_key VARCHAR(30) PRIMARY KEY,
+	exposure_key VARCHAR(30) NOT NULL,
 	transmission_risk INT NOT NULL,
+	report_type INT NOT NULL DEFAULT 0,
 	app_package_name VARCHAR(100),
 	regions VARCHAR(5) [],
 	interval_number INT NOT NULL,
 	interval_count INT NOT NULL,
+	days_since_onset_of_symptoms INT, -- NULL if unknown.
 	created_at TIMESTAMP NOT NULL,
 	local_provenance BOOLEAN NOT NULL,
 	verification_authority_name VARCHAR(100),
-	sync_id VARCHAR(100)  -- This could be a foreign key to FederationSync, but it's more difficult to handle nullable strings in Go, and it seems like unnecessary overhead.
+	sync_id VARCHAR(100),  -- This could be a foreign key to FederationSync, but it's more difficult to handle nullable strings in Go, and it seems like unnecessary overhead.
+	revoked_at TIMESTAMP, -- NULL unless the key was revoked; revoked keys are only exported in revocation lists.
+	region_copy VARCHAR(5) NOT NULL DEFAULT '', -- The region of a per-region copy, '' for a key stored once for all its regions.
+	PRIMARY KEY (exposure_key, region_copy)
 );
 
 -- ExportConfig stores a list of batches to create on an ongoing basis. The /create-batches endpoint will iterate over this
@@ -53,9 +83,11 @@ CREATE TABLE ExportConfig (
 	exclude_regions VARCHAR(5) [],
 	from_timestamp TIMESTAMP NOT NULL,
 	thru_timestamp TIMESTAMP,
+	watermark TIMESTAMP,
+	deferred_from TIMESTAMP, -- Start of the first window deferred for too few keys before the config's first batch.
 )
 
-CREATE TYPE ExportBatchStatus AS ENUM ('OPEN', 'PENDING', 'COMPLETE', 'DELETED');
+CREATE TYPE ExportBatchStatus AS ENUM ('OPEN', 'PENDING', 'COMPLETE', 'DELETED', 'FAILED', 'PARTIAL');
 CREATE TABLE ExportBatch (
 	batch_id SERIAL PRIMARY KEY,
 	config_id INT NOT NULL REFERENCES ExportConfig(config_id),
@@ -66,12 +98,19 @@ CREATE TABLE ExportBatch (
 	exclude_regions VARCHAR(5) [],
 	status ExportBatchStatus NOT NULL DEFAULT 'OPEN',
 	lease_expires TIMESTAMP,
+	attempts INT NOT NULL DEFAULT 0, -- Number of times the batch has been leased.
+	last_error TEXT,
+	failed_regions VARCHAR(5) [] -- Regions left to export when status is PARTIAL.
 );
 
 CREATE TABLE ExportFile (
 	filename VARCHAR(200) PRIMARY KEY,
 	batch_id INT REFERENCES ExportBatch(batch_id),
 	region VARCHAR(5),
+	-- The report type of every key in the file when exports are split by report type, NULL otherwise.
+	report_type INT,
+	-- Whether the file lists keys revoked during the batch, rather than the keys of the batch.
+	revocation BOOLEAN NOT NULL DEFAULT false,
 	batch_num INT,
 	batch_size INT,
 	status VARCHAR(10)
@@ -92,5 +131,12 @@ CREATE TABLE APIConfig (
 	clock_skew_seconds INT NOT NULL,
 	allowed_regions VARCHAR(5) [] NOT NULL,
 	all_regions bool NOT NULL,
-	bypass_safetynet bool NOT NULL
+	bypass_safetynet bool NOT NULL,
+	verify_declared_region bool NOT NULL DEFAULT FALSE
+);
+
+-- Settings stores runtime overrides for settings that otherwise come from environment variables.
+CREATE TABLE Settings (
+	name VARCHAR(100) PRIMARY KEY,
+	value VARCHAR(1000) NOT NULL
 );
@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This package is used to inspect the APIConfig table.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+)
+
+var (
+	action = flag.String("action", "lint", "The action to perform, one of: lint. lint exits with status 1 if any issue is found.")
+)
+
+func main() {
+	flag.Parse()
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	switch *action {
+	case "lint":
+		issues, err := db.LintAPIConfigs(ctx)
+		if err != nil {
+			log.Fatalf("Failure: %v", err)
+		}
+		for _, issue := range issues {
+			log.Printf("%s | %s | %s", issue.AppPackageName, issue.Code, issue.Message)
+		}
+		log.Printf("Found %d issue(s)", len(issues))
+		if len(issues) > 0 {
+			db.Close(ctx)
+			os.Exit(1)
+		}
+	default:
+		log.Fatalf("unknown --action %q", *action)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This package is used to list export batches that exhausted their attempts or completed for
+// only some of their regions, and to re-queue them.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+)
+
+var (
+	action  = flag.String("action", "list", "The action to perform, one of: list, requeue.")
+	batchID = flag.Int64("batch-id", 0, "The batch to re-queue; required for -action=requeue.")
+)
+
+func main() {
+	flag.Parse()
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	switch *action {
+	case "list":
+		batches, _, err := db.ListFailedBatches(ctx, database.Page{})
+		if err != nil {
+			log.Fatalf("Failure: %v", err)
+		}
+		log.Printf("%d failed batches.", len(batches))
+		for _, eb := range batches {
+			log.Printf("batch %d | config %d | %s | %v - %v | regions %s | failed regions %s | attempts %d | %s",
+				eb.BatchID, eb.ConfigID, eb.Status, eb.StartTimestamp, eb.EndTimestamp, strings.Join(eb.IncludeRegions, ","),
+				strings.Join(eb.FailedRegions, ","), eb.Attempts, eb.LastError)
+		}
+	case "requeue":
+		if *batchID == 0 {
+			log.Fatal("--batch-id is required.")
+		}
+		if err := db.RequeueBatch(ctx, *batchID); err != nil {
+			log.Fatalf("Failure: %v", err)
+		}
+		log.Printf("Successfully re-queued batch %d.", *batchID)
+	default:
+		log.Fatalf("unknown --action %q", *action)
+	}
+}
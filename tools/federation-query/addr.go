@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// strictServerAddrEnvVar, if set, turns on -strict-server-addr by default.
+const strictServerAddrEnvVar = "FEDERATION_QUERY_STRICT_SERVER_ADDR"
+
+// privateNetworks are the IPv4 and IPv6 private address ranges, RFC 1918 and RFC 4193.
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// lookupIPFn resolves a host name to its addresses, like net.Resolver.LookupIPAddr.
+type lookupIPFn func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// validateServerAddr checks that addr is of the form some-server:some-port. With strict, the
+// host must also resolve, and only to public addresses, so that a query cannot point the
+// federation puller at an internal service.
+func validateServerAddr(ctx context.Context, addr string, strict bool, lookup lookupIPFn) error {
+	if !validServerAddrRegexp.MatchString(addr) {
+		return fmt.Errorf("server-addr %q must match %s", addr, validServerAddrStr)
+	}
+	if !strict {
+		return nil
+	}
+
+	host := addr
+	if strings.Contains(addr, ":") {
+		var err error
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("server-addr %q: %v", addr, err)
+		}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			return fmt.Errorf("server-addr %q does not resolve: %v", addr, err)
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("server-addr %q does not resolve to any address", addr)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if kind := nonPublicKind(ip); kind != "" {
+			return fmt.Errorf("server-addr %q resolves to %s, a %s address; use a public address or leave -strict-server-addr unset for local setups", addr, ip, kind)
+		}
+	}
+	return nil
+}
+
+// nonPublicKind describes why ip is not a public address, or returns "" if it is.
+func nonPublicKind(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local"
+	case ip.IsUnspecified():
+		return "unspecified"
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return "private"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidateServerAddr(t *testing.T) {
+	hosts := map[string][]string{
+		"public.example.com":   {"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"},
+		"internal.example.com": {"10.1.2.3"},
+		"mixed.example.com":    {"93.184.216.34", "192.168.1.1"},
+		"localhost":            {"127.0.0.1"},
+		"metadata.example.com": {"169.254.169.254"},
+		"empty.example.com":    {},
+	}
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+
+	testCases := []struct {
+		name    string
+		addr    string
+		strict  bool
+		wantErr string
+	}{
+		{name: "lenient private", addr: "internal.example.com:443"},
+		{name: "lenient unresolvable", addr: "unknown.example.com:443"},
+		{name: "lenient malformed", addr: "Bad Host", wantErr: "must match"},
+		{name: "public", addr: "public.example.com:443", strict: true},
+		{name: "public without port", addr: "public.example.com", strict: true},
+		{name: "public ip", addr: "93.184.216.34:443", strict: true},
+		{name: "private", addr: "internal.example.com:443", strict: true, wantErr: "a private address"},
+		{name: "any private", addr: "mixed.example.com:443", strict: true, wantErr: "a private address"},
+		{name: "loopback", addr: "localhost:8080", strict: true, wantErr: "a loopback address"},
+		{name: "private ip", addr: "172.16.0.5:443", strict: true, wantErr: "a private address"},
+		{name: "link-local", addr: "metadata.example.com:80", strict: true, wantErr: "a link-local address"},
+		{name: "unresolvable", addr: "unknown.example.com:443", strict: true, wantErr: "does not resolve"},
+		{name: "no addresses", addr: "empty.example.com:443", strict: true, wantErr: "does not resolve"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateServerAddr(context.Background(), tc.addr, tc.strict, lookup)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateServerAddr(%q) returned unexpected error: %v", tc.addr, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateServerAddr(%q) returned error %v, want error containing %q", tc.addr, err, tc.wantErr)
+			}
+		})
+	}
+}
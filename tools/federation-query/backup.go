@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+// queryBackup is the JSON form of a federation query written by -action export and read by
+// -action import.
+type queryBackup struct {
+	QueryID         string   `json:"queryId"`
+	ServerAddr      string   `json:"serverAddr"`
+	IncludeRegions  []string `json:"includeRegions,omitempty"`
+	ExcludeRegions  []string `json:"excludeRegions,omitempty"`
+	RegionChunkSize int      `json:"regionChunkSize,omitempty"`
+	DuplicatePolicy string   `json:"duplicatePolicy,omitempty"`
+	SyncInterval    string   `json:"syncInterval,omitempty"`
+
+	// LastTimestamp advances with every sync, so it is only exported on request.
+	LastTimestamp *time.Time `json:"lastTimestamp,omitempty"`
+}
+
+// writeQueries writes queries to w as a JSON array. The last timestamps are included only if
+// includeVolatile is set.
+func writeQueries(w io.Writer, queries []*model.FederationQuery, includeVolatile bool) error {
+	backups := make([]queryBackup, 0, len(queries))
+	for _, q := range queries {
+		b := queryBackup{
+			QueryID:         q.QueryID,
+			ServerAddr:      q.ServerAddr,
+			IncludeRegions:  q.IncludeRegions,
+			ExcludeRegions:  q.ExcludeRegions,
+			RegionChunkSize: q.RegionChunkSize,
+			DuplicatePolicy: string(q.DuplicatePolicy),
+		}
+		if q.SyncInterval > 0 {
+			b.SyncInterval = q.SyncInterval.String()
+		}
+		if includeVolatile {
+			ts := q.LastTimestamp.UTC()
+			b.LastTimestamp = &ts
+		}
+		backups = append(backups, b)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(backups)
+}
+
+// readQueries reads queries written by writeQueries. Queries exported without their last
+// timestamp start from the beginning.
+func readQueries(r io.Reader) ([]*model.FederationQuery, error) {
+	var backups []queryBackup
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&backups); err != nil {
+		return nil, fmt.Errorf("decoding queries: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	queries := make([]*model.FederationQuery, 0, len(backups))
+	for i, b := range backups {
+		if b.QueryID == "" {
+			return nil, fmt.Errorf("query %d: missing queryId", i)
+		}
+		if seen[b.QueryID] {
+			return nil, fmt.Errorf("query %d: duplicate queryId %q", i, b.QueryID)
+		}
+		seen[b.QueryID] = true
+
+		q := &model.FederationQuery{
+			QueryID:         b.QueryID,
+			ServerAddr:      b.ServerAddr,
+			IncludeRegions:  b.IncludeRegions,
+			ExcludeRegions:  b.ExcludeRegions,
+			RegionChunkSize: b.RegionChunkSize,
+			DuplicatePolicy: model.DuplicatePolicy(b.DuplicatePolicy),
+		}
+		if b.SyncInterval != "" {
+			interval, err := time.ParseDuration(b.SyncInterval)
+			if err != nil {
+				return nil, fmt.Errorf("query %d: invalid syncInterval %q: %v", i, b.SyncInterval, err)
+			}
+			q.SyncInterval = interval
+		}
+		if b.LastTimestamp != nil {
+			q.LastTimestamp = *b.LastTimestamp
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+func TestQueriesRoundTrip(t *testing.T) {
+	last := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	queries := []*model.FederationQuery{
+		{
+			QueryID:        "us-west",
+			ServerAddr:     "federation.example.com:443",
+			IncludeRegions: []string{"US", "CA"},
+			ExcludeRegions: []string{"MX"},
+			LastTimestamp:  last,
+		},
+		{
+			QueryID:         "all",
+			ServerAddr:      "other.example.com",
+			RegionChunkSize: 10,
+			DuplicatePolicy: model.DuplicatesError,
+			SyncInterval:    6 * time.Hour,
+			LastTimestamp:   last.Add(time.Hour),
+		},
+	}
+
+	withoutVolatile := make([]*model.FederationQuery, len(queries))
+	for i, q := range queries {
+		c := *q
+		c.LastTimestamp = time.Time{}
+		withoutVolatile[i] = &c
+	}
+
+	testCases := []struct {
+		name            string
+		includeVolatile bool
+		want            []*model.FederationQuery
+	}{
+		{name: "with last timestamp", includeVolatile: true, want: queries},
+		{name: "without last timestamp", want: withoutVolatile},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeQueries(&buf, queries, tc.includeVolatile); err != nil {
+				t.Fatalf("writeQueries: %v", err)
+			}
+			got, err := readQueries(&buf)
+			if err != nil {
+				t.Fatalf("readQueries: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadQueriesErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{name: "not json", input: "queries"},
+		{name: "not an array", input: `{"queryId": "a"}`},
+		{name: "unknown field", input: `[{"queryId": "a", "serverAddr": "b", "bogus": 1}]`},
+		{name: "missing query id", input: `[{"serverAddr": "b"}]`},
+		{name: "duplicate query id", input: `[{"queryId": "a", "serverAddr": "b"}, {"queryId": "a", "serverAddr": "c"}]`},
+		{name: "invalid sync interval", input: `[{"queryId": "a", "serverAddr": "b", "syncInterval": "hourly"}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := readQueries(strings.NewReader(tc.input)); err == nil {
+				t.Errorf("readQueries(%q) returned no error", tc.input)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// dialOptions returns the transport options for connecting to a federation server. Without
+// useTLS the connection is plaintext, matching how the federation puller dials today.
+func dialOptions(useTLS bool) []grpc.DialOption {
+	if useTLS {
+		return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}
+	}
+	return []grpc.DialOption{grpc.WithInsecure()}
+}
+
+// testConnection dials addr and issues a fetch for keys newer than now, which the remote server
+// answers without returning any keys. It returns how long the dial and fetch took. Nothing is
+// written locally or remotely.
+func testConnection(ctx context.Context, addr string, now time.Time, opts ...grpc.DialOption) (time.Duration, error) {
+	start := time.Now()
+	conn, err := grpc.DialContext(ctx, addr, append(opts, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))...)
+	if err != nil {
+		return 0, fmt.Errorf("dialing %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	request := &pb.FederationFetchRequest{LastFetchResponseKeyTimestamp: now.Unix()}
+	if _, err := pb.NewFederationClient(conn).Fetch(ctx, request); err != nil {
+		return 0, fmt.Errorf("fetching from %s: %v", addr, err)
+	}
+	return time.Since(start), nil
+}
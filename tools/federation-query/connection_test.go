@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/pb"
+
+	"google.golang.org/grpc"
+)
+
+type fakeFederationServer struct {
+	pb.UnimplementedFederationServer
+	err      error
+	requests []*pb.FederationFetchRequest
+}
+
+func (s *fakeFederationServer) Fetch(ctx context.Context, req *pb.FederationFetchRequest) (*pb.FederationFetchResponse, error) {
+	s.requests = append(s.requests, req)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &pb.FederationFetchResponse{}, nil
+}
+
+// startFakeServer serves fake on a local port and returns its address.
+func startFakeServer(t *testing.T, fake *fakeFederationServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterFederationServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestTestConnection(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Reserve a port and release it, so nothing is listening there.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	unreachable := lis.Addr().String()
+	lis.Close()
+
+	testCases := []struct {
+		name    string
+		fake    *fakeFederationServer
+		wantErr bool
+	}{
+		{name: "reachable", fake: &fakeFederationServer{}},
+		{name: "fetch rejected", fake: &fakeFederationServer{err: errors.New("permission denied")}, wantErr: true},
+		{name: "unreachable", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := unreachable
+			if tc.fake != nil {
+				addr = startFakeServer(t, tc.fake)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			latency, err := testConnection(ctx, addr, now, dialOptions(false)...)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("testConnection(%s) succeeded, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("testConnection(%s) returned unexpected error: %v", addr, err)
+			}
+			if latency <= 0 {
+				t.Errorf("testConnection(%s) latency = %v, want positive", addr, latency)
+			}
+			if len(tc.fake.requests) != 1 {
+				t.Fatalf("server received %d requests, want 1", len(tc.fake.requests))
+			}
+			if got := tc.fake.requests[0].LastFetchResponseKeyTimestamp; got != now.Unix() {
+				t.Errorf("fetch requested keys since %d, want %d so that no keys are returned", got, now.Unix())
+			}
+		})
+	}
+}
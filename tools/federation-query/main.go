@@ -12,14 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// This package is a CLI tool for setting federation queries.
+// This package is a CLI tool for setting and listing federation queries, reviewing changes made
+// to them, checking them for overlaps, backing them up, testing connections to partner servers,
+// and canceling or retrying their syncs.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/googlepartners/exposure-notifications/internal/database"
@@ -27,6 +34,14 @@ import (
 	"github.com/googlepartners/exposure-notifications/internal/model"
 )
 
+const (
+	// strictRegionsEnvVar, if set, turns on -require-include-regions by default.
+	strictRegionsEnvVar = "FEDERATION_QUERY_REQUIRE_INCLUDE_REGIONS"
+
+	// maxListedErrorLength is how much of the last error of a query -action=list shows.
+	maxListedErrorLength = 80
+)
+
 var (
 	validQueryIDStr    = `\A[a-z][a-z0-9-_]*[a-z0-9]\z`
 	validQueryIDRegexp = regexp.MustCompile(validQueryIDStr)
@@ -34,9 +49,24 @@ var (
 	validServerAddrStr    = `\A[a-z0-9.-]+(:\d+)?\z`
 	validServerAddrRegexp = regexp.MustCompile(validServerAddrStr)
 
-	queryID       = flag.String("query-id", "", "(Required) The ID of the federation query to set.")
+	action        = flag.String("action", "set", "The action to perform, one of: set, set-regions, list, audit, export, import, lint, test-connection, cancel-sync, retry-sync.")
+	actor         = flag.String("actor", os.Getenv("USER"), "Who is making the change, recorded in the audit log.")
+	auditLimit    = flag.Int("limit", 20, "The maximum number of audit entries to list for -action=audit.")
+	auditAfter    = flag.String("after", "", "For -action=audit, list the entries following the page that printed this cursor.")
+	queryID       = flag.String("query-id", "", "(Required for set, set-regions, cancel-sync and retry-sync) The ID of the federation query to set, or to cancel or retry the sync of. Limits -action=audit to this query.")
 	serverAddr    = flag.String("server-addr", "", "(Required) The address of the remote server, in the form some-server:some-port")
 	lastTimestamp = flag.String("last-timestamp", "", "The last timestamp (RFC3339) to set; queries start from this point and go forward.")
+	file          = flag.String("file", "", "(Required for export and import) The JSON file to write or read the federation queries.")
+	withVolatile  = flag.Bool("include-last-timestamp", false, "Include the last timestamp of each query in -action=export. Without it, imported queries start from the beginning.")
+	chunkSize     = flag.Int("region-chunk-size", 0, "If positive, fetch the included regions in chunks of at most this many regions. Leave 0 to fetch all regions in a single call.")
+	syncInterval  = flag.Duration("sync-interval", 0, "The least time between scheduled syncs of the query, in whole seconds; scheduled invocations in between are skipped. Leave 0 to sync on every invocation.")
+	dupPolicy     = flag.String("duplicate-policy", "", "How syncs treat fetched keys that are already stored, one of: skip-duplicates, error-on-duplicate, count-only. Leave blank to skip them.")
+	useTLS        = flag.Bool("tls", false, "Use TLS for -action=test-connection. Leave false to connect in plaintext, as the federation puller does.")
+	strict        = flag.Bool("require-include-regions", os.Getenv(strictRegionsEnvVar) != "", "Reject queries that do not list any -regions to include, and so fetch all regions, for -action=set, set-regions and import. Defaults to true if $"+strictRegionsEnvVar+" is set.")
+	strictAddr    = flag.Bool("strict-server-addr", os.Getenv(strictServerAddrEnvVar) != "", "Require -server-addr, and the server addresses of imported queries, to resolve to public addresses, rejecting loopback, link-local and private ones. Defaults to true if $"+strictServerAddrEnvVar+" is set.")
+	dialTimeout   = flag.Duration("timeout", 10*time.Second, "How long -action=test-connection waits for the remote server.")
+	pullURL       = flag.String("pull-url", "", "(Required for retry-sync) The base URL of the federation puller. The request is authenticated with $"+retryTokenEnvVar+".")
+	resume        = flag.Bool("resume", false, "For -action=retry-sync, resume the latest sync of the query from its checkpoint if it failed, rather than fetching everything since its last timestamp again.")
 )
 
 func main() {
@@ -45,6 +75,33 @@ func main() {
 	flag.Var(&excludeRegions, "exclude-regions", "A comma-separated list fo regions to exclude from the query.")
 	flag.Parse()
 
+	switch *action {
+	case "set":
+		setQuery(includeRegions, excludeRegions)
+	case "set-regions":
+		setRegions(includeRegions, excludeRegions)
+	case "list":
+		listQueries()
+	case "audit":
+		listAudit()
+	case "export":
+		exportQueries()
+	case "import":
+		importQueries()
+	case "lint":
+		lintQueries()
+	case "test-connection":
+		testServerConnection()
+	case "cancel-sync":
+		cancelSync()
+	case "retry-sync":
+		retrySync()
+	default:
+		log.Fatalf("unknown --action %q", *action)
+	}
+}
+
+func setQuery(includeRegions, excludeRegions []string) {
 	if *queryID == "" {
 		log.Fatalf("query-id is required")
 	}
@@ -54,8 +111,11 @@ func main() {
 	if *serverAddr == "" {
 		log.Fatalf("server-addr is required")
 	}
-	if !validServerAddrRegexp.MatchString(*serverAddr) {
-		log.Fatalf("server-addr %q must match %s", *serverAddr, validServerAddrStr)
+	if err := validateServerAddr(context.Background(), *serverAddr, *strictAddr, net.DefaultResolver.LookupIPAddr); err != nil {
+		log.Fatal(err)
+	}
+	if *actor == "" {
+		log.Fatalf("actor is required")
 	}
 
 	ctx := context.Background()
@@ -75,16 +135,296 @@ func main() {
 	}
 
 	query := &model.FederationQuery{
-		QueryID:        *queryID,
-		ServerAddr:     *serverAddr,
-		IncludeRegions: includeRegions,
-		ExcludeRegions: excludeRegions,
-		LastTimestamp:  lastTime,
+		QueryID:         *queryID,
+		ServerAddr:      *serverAddr,
+		IncludeRegions:  includeRegions,
+		ExcludeRegions:  excludeRegions,
+		LastTimestamp:   lastTime,
+		RegionChunkSize: *chunkSize,
+		DuplicatePolicy: model.DuplicatePolicy(*dupPolicy),
+		SyncInterval:    *syncInterval,
+	}
+	if err := validateQuery(query, time.Now().UTC(), *strict); err != nil {
+		log.Fatalf("invalid query %s: %v", *queryID, err)
 	}
 
-	if err := db.AddFederationQuery(ctx, query); err != nil {
+	if err := db.AddFederationQuery(ctx, query, *actor); err != nil {
 		log.Fatalf("adding new query %s %#v: %v", *queryID, query, err)
 	}
 
 	log.Printf("Successfully added query %s %#v", *queryID, query)
 }
+
+// setRegions replaces the regions of an existing query, keeping its last timestamp so that it
+// continues from where it left off.
+func setRegions(includeRegions, excludeRegions []string) {
+	if *queryID == "" {
+		log.Fatalf("query-id is required")
+	}
+	if *actor == "" {
+		log.Fatalf("actor is required")
+	}
+	if *strict {
+		q := &model.FederationQuery{QueryID: *queryID, IncludeRegions: includeRegions, ExcludeRegions: excludeRegions}
+		if err := q.RequireIncludeRegions(); err != nil {
+			log.Fatalf("invalid regions for query %s: %v", *queryID, err)
+		}
+	}
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	if err := db.UpdateFederationRegions(ctx, *queryID, includeRegions, excludeRegions, *actor); err != nil {
+		if err == database.ErrNotFound {
+			log.Fatalf("query %s does not exist, create it with -action=set", *queryID)
+		}
+		log.Fatalf("updating regions of query %s: %v", *queryID, err)
+	}
+
+	log.Printf("Successfully set regions of query %s to include %v and exclude %v", *queryID, includeRegions, excludeRegions)
+}
+
+// validateQuery checks q before it is written. With requireInclude, a query that does not list
+// any regions to include is rejected rather than fetching all regions.
+func validateQuery(q *model.FederationQuery, now time.Time, requireInclude bool) error {
+	if err := q.Validate(now); err != nil {
+		return err
+	}
+	if requireInclude {
+		return q.RequireIncludeRegions()
+	}
+	return nil
+}
+
+func listQueries() {
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	queries, _, err := db.ListFederationQueries(ctx, database.Page{})
+	if err != nil {
+		log.Fatalf("listing federation queries: %v", err)
+	}
+	for _, q := range queries {
+		log.Print(formatQuery(q))
+	}
+	log.Printf("Found %d queries", len(queries))
+}
+
+// formatQuery describes q on a single line for -action=list, with its last error, if any,
+// truncated to maxListedErrorLength.
+func formatQuery(q *model.FederationQuery) string {
+	regions := "all regions"
+	if len(q.IncludeRegions) > 0 {
+		regions = strings.Join(q.IncludeRegions, ",")
+	}
+	if len(q.ExcludeRegions) > 0 {
+		regions += " except " + strings.Join(q.ExcludeRegions, ",")
+	}
+	line := fmt.Sprintf("%s | %s | %s | last timestamp %s", q.QueryID, q.ServerAddr, regions, q.LastTimestamp.UTC().Format(time.RFC3339))
+	if q.SyncInterval > 0 {
+		line += fmt.Sprintf(" | every %v", q.SyncInterval)
+	}
+	if q.LastError == "" {
+		return line + " | ok"
+	}
+	lastError := q.LastError
+	if r := []rune(lastError); len(r) > maxListedErrorLength {
+		lastError = string(r[:maxListedErrorLength]) + "..."
+	}
+	return fmt.Sprintf("%s | failed %s: %s", line, q.LastErrorTime.UTC().Format(time.RFC3339), lastError)
+}
+
+func listAudit() {
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	entries, next, err := db.ListFederationQueryAudit(ctx, *queryID, database.Page{After: *auditAfter, Limit: *auditLimit})
+	if err != nil {
+		log.Fatalf("listing audit entries: %v", err)
+	}
+	for _, a := range entries {
+		log.Printf("%s | %s | %s by %s\n  old: %s\n  new: %s", a.Changed.Format(time.RFC3339), a.QueryID, a.Action, a.Actor, a.OldValue, a.NewValue)
+	}
+	if next != "" {
+		log.Printf("More entries follow; list them with -after=%s", next)
+	}
+}
+
+func exportQueries() {
+	if *file == "" {
+		log.Fatalf("file is required")
+	}
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	queries, _, err := db.ListFederationQueries(ctx, database.Page{})
+	if err != nil {
+		log.Fatalf("listing federation queries: %v", err)
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		log.Fatalf("creating %s: %v", *file, err)
+	}
+	if err := writeQueries(f, queries, *withVolatile); err != nil {
+		f.Close()
+		log.Fatalf("writing %s: %v", *file, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("closing %s: %v", *file, err)
+	}
+
+	log.Printf("Exported %d queries to %s", len(queries), *file)
+}
+
+func importQueries() {
+	if *file == "" {
+		log.Fatalf("file is required")
+	}
+	if *actor == "" {
+		log.Fatalf("actor is required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("opening %s: %v", *file, err)
+	}
+	queries, err := readQueries(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("reading %s: %v", *file, err)
+	}
+
+	// Check everything before writing anything, so a bad file is not partially imported.
+	now := time.Now().UTC()
+	for _, q := range queries {
+		if !validQueryIDRegexp.MatchString(q.QueryID) {
+			log.Fatalf("query-id %q must match %s", q.QueryID, validQueryIDStr)
+		}
+		if err := validateServerAddr(context.Background(), q.ServerAddr, *strictAddr, net.DefaultResolver.LookupIPAddr); err != nil {
+			log.Fatalf("query %s: %v", q.QueryID, err)
+		}
+		if err := validateQuery(q, now, *strict); err != nil {
+			log.Fatalf("invalid query %s: %v", q.QueryID, err)
+		}
+	}
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	for _, q := range queries {
+		if err := db.AddFederationQuery(ctx, q, *actor); err != nil {
+			log.Fatalf("adding query %s %#v: %v", q.QueryID, q, err)
+		}
+	}
+
+	log.Printf("Imported %d queries from %s", len(queries), *file)
+}
+
+func lintQueries() {
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	overlaps, err := db.FindOverlappingFederationQueries(ctx)
+	if err != nil {
+		log.Fatalf("finding overlapping federation queries: %v", err)
+	}
+	for _, o := range overlaps {
+		regions := "all regions"
+		if len(o.Regions) > 0 {
+			regions = strings.Join(o.Regions, ",")
+		}
+		log.Printf("%s (%s) and %s (%s) both fetch %s", o.A.QueryID, o.A.ServerAddr, o.B.QueryID, o.B.ServerAddr, regions)
+	}
+	log.Printf("Found %d overlapping pair(s) of queries", len(overlaps))
+}
+
+func testServerConnection() {
+	if *serverAddr == "" {
+		log.Fatalf("server-addr is required")
+	}
+	if err := validateServerAddr(context.Background(), *serverAddr, *strictAddr, net.DefaultResolver.LookupIPAddr); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *dialTimeout)
+	defer cancel()
+	latency, err := testConnection(ctx, *serverAddr, time.Now().UTC(), dialOptions(*useTLS)...)
+	if err != nil {
+		log.Fatalf("Connection to %s failed: %v", *serverAddr, err)
+	}
+	log.Printf("Connection to %s succeeded in %v", *serverAddr, latency)
+}
+
+// cancelSync asks the sync of -query-id in progress to stop. The sync stops at its next fetch,
+// keeping the keys it inserted, and is recorded as canceled.
+func cancelSync() {
+	if *queryID == "" {
+		log.Fatalf("query-id is required")
+	}
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	syncID, err := db.CancelFederationSync(ctx, *queryID)
+	if err != nil {
+		if err == database.ErrNotFound {
+			log.Fatalf("query %s has no sync in progress", *queryID)
+		}
+		log.Fatalf("canceling sync of query %s: %v", *queryID, err)
+	}
+	log.Printf("Requested cancellation of sync %s of query %s; it stops at its next fetch", syncID, *queryID)
+}
+
+// retrySync asks the federation puller to re-run the sync of -query-id now, and reports how it
+// went. The sync runs in the puller and holds the query's lock, like a scheduled one.
+func retrySync() {
+	if *queryID == "" {
+		log.Fatalf("query-id is required")
+	}
+	if *pullURL == "" {
+		log.Fatalf("pull-url is required")
+	}
+	token := os.Getenv(retryTokenEnvVar)
+	if token == "" {
+		log.Fatalf("$%s is required", retryTokenEnvVar)
+	}
+
+	outcome, err := requestRetry(context.Background(), http.DefaultClient, *pullURL, token, *queryID, *resume)
+	if outcome != nil && outcome.ResumedFrom != "" {
+		log.Printf("Resumed failed sync %s", outcome.ResumedFrom)
+	}
+	if err != nil {
+		log.Fatalf("retrying sync of query %s: %v", *queryID, err)
+	}
+	log.Printf("Sync %s of query %s finished %s: inserted %d keys, skipped %d duplicates", outcome.SyncID, *queryID, outcome.Status, outcome.Inserted, outcome.Duplicates)
+}
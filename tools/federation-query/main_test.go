@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/model"
+)
+
+func TestValidateQuery(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		include []string
+		exclude []string
+		strict  bool
+		wantErr bool
+	}{
+		{name: "all regions permissive", strict: false},
+		{name: "all regions strict", strict: true, wantErr: true},
+		{name: "exclude only strict", exclude: []string{"MX"}, strict: true, wantErr: true},
+		{name: "include strict", include: []string{"US"}, strict: true},
+		{name: "invalid region permissive", include: []string{"not a region"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &model.FederationQuery{QueryID: "query", ServerAddr: "localhost:8080", IncludeRegions: tc.include, ExcludeRegions: tc.exclude}
+			err := validateQuery(q, now, tc.strict)
+			if err != nil != tc.wantErr {
+				t.Errorf("validateQuery(strict=%t) got err %v, want err %t", tc.strict, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatQuery(t *testing.T) {
+	last := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	failed := time.Date(2020, 5, 2, 8, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name string
+		q    *model.FederationQuery
+		want string
+	}{
+		{
+			name: "healthy",
+			q:    &model.FederationQuery{QueryID: "ca", ServerAddr: "ca.example:443", IncludeRegions: []string{"CA"}, LastTimestamp: last},
+			want: "ca | ca.example:443 | CA | last timestamp 2020-05-01T12:00:00Z | ok",
+		},
+		{
+			name: "failed",
+			q: &model.FederationQuery{QueryID: "mx", ServerAddr: "mx.example:443", ExcludeRegions: []string{"US"}, LastTimestamp: last,
+				LastError: "fetching query mx: unavailable", LastErrorTime: failed},
+			want: "mx | mx.example:443 | all regions except US | last timestamp 2020-05-01T12:00:00Z | failed 2020-05-02T08:30:00Z: fetching query mx: unavailable",
+		},
+		{
+			name: "long error truncated",
+			q: &model.FederationQuery{QueryID: "mx", ServerAddr: "mx.example:443", LastTimestamp: last,
+				LastError: strings.Repeat("x", maxListedErrorLength+1), LastErrorTime: failed},
+			want: "mx | mx.example:443 | all regions | last timestamp 2020-05-01T12:00:00Z | failed 2020-05-02T08:30:00Z: " + strings.Repeat("x", maxListedErrorLength) + "...",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatQuery(tc.q); got != tc.want {
+				t.Errorf("formatQuery got\n%q, want\n%q", got, tc.want)
+			}
+		})
+	}
+}
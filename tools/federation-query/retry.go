@@ -0,0 +1,74 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// retryTokenEnvVar is the bearer token -action=retry-sync authenticates to the federation
+// puller with, the same variable the puller reads it from.
+const retryTokenEnvVar = "PULL_RETRY_TOKEN"
+
+// retryOutcome is the federation puller's report of a retried sync.
+type retryOutcome struct {
+	QueryID     string `json:"queryID"`
+	ResumedFrom string `json:"resumedFrom"`
+	SyncID      string `json:"syncID"`
+	Status      string `json:"status"`
+	Inserted    int    `json:"inserted"`
+	Duplicates  int    `json:"duplicates"`
+	Error       string `json:"error"`
+}
+
+// requestRetry asks the federation puller at pullURL to re-run the sync of queryID, resuming
+// its failed sync if resume is set, and returns the outcome. A sync that ran and failed is
+// returned along with an error.
+func requestRetry(ctx context.Context, client *http.Client, pullURL, token, queryID string, resume bool) (*retryOutcome, error) {
+	params := url.Values{"query-id": {queryID}, "resume": {strconv.FormatBool(resume)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(pullURL, "/")+"/retry-sync?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting retry: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil, fmt.Errorf("retry rejected with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var outcome retryOutcome
+	if err := json.Unmarshal(body, &outcome); err != nil {
+		return nil, fmt.Errorf("decoding response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &outcome, fmt.Errorf("retry failed with status %d: %s", resp.StatusCode, outcome.Error)
+	}
+	return &outcome, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRequestRetry(t *testing.T) {
+	testCases := []struct {
+		name    string
+		code    int
+		body    string
+		json    bool
+		want    *retryOutcome
+		wantErr bool
+	}{
+		{
+			name: "resumed",
+			code: http.StatusOK,
+			json: true,
+			body: `{"queryID":"q","resumedFrom":"failed","syncID":"sync","status":"COMPLETE","inserted":4,"duplicates":1}`,
+			want: &retryOutcome{QueryID: "q", ResumedFrom: "failed", SyncID: "sync", Status: "COMPLETE", Inserted: 4, Duplicates: 1},
+		},
+		{
+			name:    "sync failed",
+			code:    http.StatusInternalServerError,
+			json:    true,
+			body:    `{"queryID":"q","syncID":"sync","status":"FAILED","error":"partner hiccup"}`,
+			want:    &retryOutcome{QueryID: "q", SyncID: "sync", Status: "FAILED", Error: "partner hiccup"},
+			wantErr: true,
+		},
+		{name: "locked", code: http.StatusConflict, body: "Lock query_q already in use.", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotReq *http.Request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotReq = r
+				if tc.json {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.WriteHeader(tc.code)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer srv.Close()
+
+			got, err := requestRetry(context.Background(), srv.Client(), srv.URL+"/", "secret", "q", true)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("requestRetry returned error %v, want error %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("outcome mismatch (-want +got):\n%s", diff)
+			}
+			if gotReq.Method != http.MethodPost || gotReq.URL.Path != "/retry-sync" {
+				t.Errorf("request was %s %s, want POST /retry-sync", gotReq.Method, gotReq.URL.Path)
+			}
+			if got := gotReq.URL.Query().Get("resume"); got != "true" {
+				t.Errorf("resume = %q, want true", got)
+			}
+			if got := gotReq.Header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("Authorization = %q, want the bearer token", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This package is used to inspect and release locks held in the Lock table.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+)
+
+var (
+	action = flag.String("action", "lock-status", "The action to perform, one of: lock-status, force-unlock.")
+	lockID = flag.String("lock-id", "", "The lock to act on.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *lockID == "" {
+		log.Fatal("--lock-id is required.")
+	}
+
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	switch *action {
+	case "lock-status":
+		l, err := db.GetLock(ctx, *lockID)
+		if err == database.ErrNotFound {
+			log.Printf("Lock %q is not held.", *lockID)
+			return
+		}
+		if err != nil {
+			log.Fatalf("Failure: %v", err)
+		}
+		now := time.Now().UTC()
+		if l.Expired(now) {
+			log.Printf("Lock %q expired at %v (%v ago) and can be acquired.", l.LockID, l.Expires, now.Sub(l.Expires).Round(time.Second))
+			return
+		}
+		log.Printf("Lock %q is held until %v (%v remaining).", l.LockID, l.Expires, l.Remaining(now).Round(time.Second))
+	case "force-unlock":
+		if err := db.ForceUnlock(ctx, *lockID); err != nil {
+			if err == database.ErrNotFound {
+				log.Fatalf("Lock %q is not held.", *lockID)
+			}
+			log.Fatalf("Failure: %v", err)
+		}
+		log.Printf("Successfully released lock %q.", *lockID)
+	default:
+		log.Fatalf("unknown --action %q", *action)
+	}
+}
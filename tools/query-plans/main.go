@@ -0,0 +1,56 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This package is used to check that the federation, export and APIConfig queries use indexes,
+// by explaining them against the database. It exits with an error if any is planned with a
+// sequential scan. Run it against a database holding production volumes; with little data the
+// planner prefers sequential scans.
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/googlepartners/exposure-notifications/internal/database"
+)
+
+func main() {
+	ctx := context.Background()
+	db, err := database.NewFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("unable to connect to database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	plans, err := db.ExplainHotQueries(ctx)
+	if err != nil {
+		log.Fatalf("Failure: %v", err)
+	}
+	missing := 0
+	for _, p := range plans {
+		status := "ok"
+		if p.MissingIndex() {
+			status = "SEQUENTIAL SCAN"
+			missing++
+		} else if p.FullTable {
+			status = "ok, reads the whole table"
+		}
+		log.Printf("%s | %s | seq scans %s | indexes %s", p.Name, status, strings.Join(p.SeqScans, ","), strings.Join(p.IndexScans, ","))
+	}
+	if missing > 0 {
+		log.Fatalf("%d of %d queries use a sequential scan.", missing, len(plans))
+	}
+	log.Printf("None of %d queries is missing an index.", len(plans))
+}